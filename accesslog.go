@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var accessLog = flag.String("access_log", "", "file to append a JSON access log record to for every request, one per line, or - for stdout (disabled if empty); a file is reopened on SIGHUP for logrotate")
+
+// AccessRecord is one line of --access_log.
+type AccessRecord struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMS float64   `json:"latency_ms"`
+	ClientIP  string    `json:"client_ip"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	// UpstreamError is the class of the first upstream error serving the
+	// request ran into, like timeout or permission.
+	UpstreamError string `json:"upstream_error,omitempty"`
+}
+
+// accessLogger writes access records to --access_log.
+type accessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File
+}
+
+func openAccessLog(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// newAccessLogger opens --access_log, or returns nil if it's not set.
+func newAccessLogger() *accessLogger {
+	switch *accessLog {
+	case "":
+		return nil
+	case "-":
+		return &accessLogger{w: os.Stdout}
+	}
+	f, err := openAccessLog(*accessLog)
+	if err != nil {
+		log.Exitf("openAccessLog(%s): %v", *accessLog, err)
+	}
+	l := &accessLogger{w: f, f: f}
+	go l.reopenOnHUP()
+	return l
+}
+
+// reopenOnHUP starts a new file when logrotate has moved the old one away.
+func (l *accessLogger) reopenOnHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		f, err := openAccessLog(*accessLog)
+		if err != nil {
+			log.Errorf("Error reopening %s, still writing to the old file: %v", *accessLog, err)
+			continue
+		}
+		l.mu.Lock()
+		old := l.f
+		l.w, l.f = f, f
+		l.mu.Unlock()
+		old.Close()
+		log.Infof("Reopened %s", *accessLog)
+	}
+}
+
+func (l *accessLogger) write(rec *AccessRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("Error encoding access log record: %v", err)
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(b); err != nil {
+		log.Errorf("Error writing access log: %v", err)
+	}
+}
+
+// withAccessLog logs every request h answers to --access_log, whether it was
+// proxied or answered along the way, like a redirect or a health check.
+func withAccessLog(h http.Handler) http.Handler {
+	l := newAccessLogger()
+	if l == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		ctx, note := withUpstreamErrorNote(r.Context())
+		h.ServeHTTP(rec, r.WithContext(ctx))
+		ip := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		l.write(&AccessRecord{
+			Time:          start.UTC(),
+			Method:        r.Method,
+			Host:          r.Host,
+			Path:          r.URL.Path,
+			Proto:         r.Proto,
+			Status:        rec.Status(),
+			Bytes:         rec.bytes,
+			LatencyMS:     float64(time.Since(start)) / float64(time.Millisecond),
+			ClientIP:      ip,
+			Referer:       r.Referer(),
+			UserAgent:     r.UserAgent(),
+			UpstreamError: string(note.get()),
+		})
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	acmeDirectory  = flag.String("acme_directory", acme.LetsEncryptURL, "ACME directory URL to get certificates from, e.g. https://acme-staging-v02.api.letsencrypt.org/directory for Let's Encrypt's staging environment while testing, or another CA's; each CA gets its own account key and certificates in the --cert_cache")
+	acmeEmail      = flag.String("acme_email", "", "contact address for the ACME account, which the CA mails about expiring certificates and policy changes")
+	acmeEABKeyID   = flag.String("acme_eab_key_id", "", "key ID of the external account binding CAs like ZeroSSL and Google Trust Services need to register the ACME account")
+	acmeEABHMACKey = secretVar("acme_eab_hmac_key", "base64url HMAC key of the --acme_eab_key_id external account binding")
+)
+
+// acmeAccountKey is where autocert keeps its ACME account key; wildcard
+// certificates are ordered with the same account.
+const acmeAccountKey = "acme_account+key"
+
+// acmeCache keeps the account key and certificates of any CA but Let's Encrypt
+// production under a prefix of its own in c, so switching to the staging
+// directory and back doesn't leave untrusted certificates behind, or send one
+// CA another's account key. Let's Encrypt keeps the names autocert always used.
+func acmeCache(c autocert.Cache) autocert.Cache {
+	if *acmeDirectory == acme.LetsEncryptURL {
+		return c
+	}
+	u, err := url.Parse(*acmeDirectory)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		log.Exitf("--acme_directory should be an https:// URL, not %q", *acmeDirectory)
+	}
+	if strings.Contains(u.Host, "staging") {
+		log.Warningf("Getting certificates from %s: browsers won't trust them", *acmeDirectory)
+	}
+	return &prefixedCache{Cache: c, prefix: u.Host + "/"}
+}
+
+// prefixedCache puts every name in Cache under prefix.
+type prefixedCache struct {
+	autocert.Cache
+	prefix string
+}
+
+func (c *prefixedCache) Get(ctx context.Context, name string) ([]byte, error) {
+	return c.Cache.Get(ctx, c.prefix+name)
+}
+
+func (c *prefixedCache) Put(ctx context.Context, name string, data []byte) error {
+	return c.Cache.Put(ctx, c.prefix+name, data)
+}
+
+func (c *prefixedCache) Delete(ctx context.Context, name string) error {
+	return c.Cache.Delete(ctx, c.prefix+name)
+}
+
+// newACMEClient returns a client for --acme_directory. Without a key, autocert
+// reads the account key from its cache.
+func newACMEClient(key crypto.Signer) *acme.Client {
+	return &acme.Client{DirectoryURL: *acmeDirectory, Key: key, UserAgent: "hugoproxy"}
+}
+
+// acmeAccount is the account to register with --acme_directory.
+func acmeAccount() (*acme.Account, error) {
+	a := &acme.Account{}
+	if *acmeEmail != "" {
+		a.Contact = []string{"mailto:" + *acmeEmail}
+	}
+	if *acmeEABKeyID != "" {
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(acmeEABHMACKey.Get(), "="))
+		if err != nil || len(key) == 0 {
+			return nil, fmt.Errorf("--acme_eab_hmac_key should be the base64url key the CA gave out with --acme_eab_key_id")
+		}
+		a.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: *acmeEABKeyID, Key: key}
+	}
+	return a, nil
+}
+
+// loadACMEAccountKey reads the account key from c, creating it if it isn't
+// there yet.
+func loadACMEAccountKey(ctx context.Context, c autocert.Cache) (crypto.Signer, error) {
+	data, err := c.Get(ctx, acmeAccountKey)
+	switch {
+	case err == autocert.ErrCacheMiss:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Put(ctx, acmeAccountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})); err != nil {
+			return nil, err
+		}
+		return k, nil
+	case err != nil:
+		return nil, err
+	}
+	b, _ := pem.Decode(data)
+	if b == nil || b.Type != "EC PRIVATE KEY" {
+		return nil, fmt.Errorf("%s in the certificate cache isn't an EC private key", acmeAccountKey)
+	}
+	return x509.ParseECPrivateKey(b.Bytes)
+}
+
+// registerACMEAccount registers c's account with --acme_directory, which is
+// fine to do again for an account that already exists.
+func registerACMEAccount(ctx context.Context, c *acme.Client) error {
+	a, err := acmeAccount()
+	if err != nil {
+		return err
+	}
+	if _, err := c.Register(ctx, a, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return fmt.Errorf("registering the ACME account with %s: %v", *acmeDirectory, err)
+	}
+	return nil
+}
+
+// newAutocertClient returns the ACME client for autocert. autocert can't
+// register with an external account binding, so with --acme_eab_key_id the
+// account is registered here first and autocert finds it already exists.
+func newAutocertClient(cache autocert.Cache) *acme.Client {
+	if *acmeEABKeyID == "" {
+		return newACMEClient(nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	key, err := loadACMEAccountKey(ctx, cache)
+	if err != nil {
+		log.Errorf("Not registering the ACME account: %v", err)
+		return newACMEClient(nil)
+	}
+	c := newACMEClient(key)
+	if err := registerACMEAccount(ctx, c); err != nil {
+		log.Errorf("%v", err)
+	}
+	return c
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	adminAddr  = flag.String("admin_addr", "", "address for the admin API and /debug/vars metrics, e.g. localhost:8081 (disabled if empty)")
+	adminToken = secretVar("admin_token", "bearer token allowed every admin API request; the config's admin_tokens can add scoped ones (unauthenticated without any, so keep --admin_addr private)")
+)
+
+// adminMux holds the admin API. Features register their endpoints on it from init
+// or before serveAdmin is called.
+var adminMux = http.NewServeMux()
+
+func init() {
+	adminMux.HandleFunc("/debug/vars", expvarHandler)
+}
+
+// expvarHandler is expvar.Handler without cmdline: the command line can carry
+// --admin_token and other secrets, which a read token mustn't see.
+func expvarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// serveAdmin serves the admin API on l, the --admin_addr listener, until the
+// process exits.
+func serveAdmin(l net.Listener) {
+	log.Infof("Serving admin API on %s", *adminAddr)
+	startDebugEndpoints()
+	if err := http.Serve(l, requireAdminToken(adminMux)); err != nil {
+		log.Exitf("http.Serve(%s): %v", *adminAddr, err)
+	}
+}
+
+// writeJSON writes v as the indented JSON body of an admin API response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("Error writing admin API response: %v", err)
+	}
+}
@@ -0,0 +1,472 @@
+// Package adminclient is a client for the hugoproxy admin API described at
+// /admin/openapi.json on the --admin_addr listener.
+package adminclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one hugoproxy admin listener.
+type Client struct {
+	// BaseURL is the admin listener, e.g. http://localhost:8081.
+	BaseURL string
+	// Token is sent as a bearer token if set.
+	Token string
+	// HTTPClient is used for requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the admin API at baseURL.
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token}
+}
+
+// Error is a non-2xx response from the admin API.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("hugoproxy admin API: %d %s", e.StatusCode, e.Message)
+}
+
+// do makes an admin API request, decoding the JSON response into out, or copying
+// it verbatim if out is an io.Writer.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, out interface{}) error {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case io.Writer:
+		_, err = io.Copy(out, resp.Body)
+		return err
+	default:
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+}
+
+// NotFoundReport is the response to NotFound.
+type NotFoundReport struct {
+	WindowSeconds int64          `json:"window_seconds"`
+	Paths         []NotFoundPath `json:"paths"`
+}
+
+// NotFoundPath is a path that's been 404ing.
+type NotFoundPath struct {
+	Host      string          `json:"host"`
+	Path      string          `json:"path"`
+	Count     int             `json:"count"`
+	Referrers []ReferrerCount `json:"referrers,omitempty"`
+}
+
+// ReferrerCount is how many 404s for a path came from a referrer.
+type ReferrerCount struct {
+	Referrer string `json:"referrer"`
+	Count    int    `json:"count"`
+}
+
+// NotFound returns the n most frequent 404s in the tracking window.
+func (c *Client) NotFound(ctx context.Context, n int) (*NotFoundReport, error) {
+	r := &NotFoundReport{}
+	return r, c.do(ctx, http.MethodGet, "/admin/404s", url.Values{"n": {strconv.Itoa(n)}}, nil, r)
+}
+
+// LinkReport is the result of a periodic crawl for broken links.
+type LinkReport struct {
+	Start      string        `json:"start"`
+	Started    time.Time     `json:"started"`
+	Duration   time.Duration `json:"duration_ns"`
+	Checked    int           `json:"checked"`
+	Truncated  bool          `json:"truncated,omitempty"`
+	Broken     []Link        `json:"broken"`
+	Redirected []Link        `json:"redirected"`
+}
+
+// Link is a broken or redirected URL and the pages linking to it.
+type Link struct {
+	URL       string   `json:"url"`
+	Status    int      `json:"status,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Redirects []string `json:"redirects,omitempty"`
+	Pages     []string `json:"pages"`
+}
+
+// LinkCheck returns the latest broken link report.
+func (c *Client) LinkCheck(ctx context.Context) (*LinkReport, error) {
+	r := &LinkReport{}
+	return r, c.do(ctx, http.MethodGet, "/admin/linkcheck", nil, nil, r)
+}
+
+// StalenessReport compares the cache with the bucket. Objects are the stale
+// entries, most out of date first, then the oldest of the rest.
+type StalenessReport struct {
+	Checked         time.Time    `json:"checked"`
+	Entries         int          `json:"entries"`
+	Stale           int          `json:"stale"`
+	MaxStaleSeconds int64        `json:"max_stale_seconds"`
+	Objects         []StaleEntry `json:"objects"`
+}
+
+// StaleEntry is a cache entry and what the bucket has for it now.
+type StaleEntry struct {
+	Host              string     `json:"host,omitempty"`
+	URL               string     `json:"url"`
+	Status            int        `json:"status"`
+	Generation        string     `json:"generation,omitempty"`
+	Modified          *time.Time `json:"modified,omitempty"`
+	Cached            time.Time  `json:"cached"`
+	Expires           time.Time  `json:"expires"`
+	AgeSeconds        int64      `json:"age_seconds"`
+	Hits              int64      `json:"hits"`
+	Stale             bool       `json:"stale"`
+	CurrentStatus     int        `json:"current_status,omitempty"`
+	CurrentGeneration string     `json:"current_generation,omitempty"`
+	StaleSeconds      int64      `json:"stale_seconds,omitempty"`
+	Error             string     `json:"error,omitempty"`
+}
+
+// Staleness returns the latest comparison of the cache with the bucket, after
+// making a new one if check is set, with at most limit entries (0 for the
+// server's default).
+func (c *Client) Staleness(ctx context.Context, check bool, limit int) (*StalenessReport, error) {
+	q := url.Values{}
+	if check {
+		q.Set("check", "1")
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	r := &StalenessReport{}
+	return r, c.do(ctx, http.MethodGet, "/admin/staleness", q, nil, r)
+}
+
+// PurgeResult says how many cache entries a purge dropped.
+type PurgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// Purge drops path from the cache, whatever its query, along with the redirect
+// to it if it's a directory and the directory if it's an index document. An
+// empty host purges it for every site.
+func (c *Client) Purge(ctx context.Context, host, path string) (*PurgeResult, error) {
+	return c.purge(ctx, host, url.Values{"path": {path}})
+}
+
+// PurgePrefix drops every page under prefix from the cache.
+func (c *Client) PurgePrefix(ctx context.Context, host, prefix string) (*PurgeResult, error) {
+	return c.purge(ctx, host, url.Values{"prefix": {prefix}})
+}
+
+// PurgeTag drops every page tagged with tag, by its Surrogate-Key or Cache-Tag
+// header, from the cache.
+func (c *Client) PurgeTag(ctx context.Context, host, tag string) (*PurgeResult, error) {
+	return c.purge(ctx, host, url.Values{"tag": {tag}})
+}
+
+// PurgeAll empties the cache, or drops all of host's pages from it.
+func (c *Client) PurgeAll(ctx context.Context, host string) (*PurgeResult, error) {
+	return c.purge(ctx, host, url.Values{"all": {"1"}})
+}
+
+func (c *Client) purge(ctx context.Context, host string, q url.Values) (*PurgeResult, error) {
+	if host != "" {
+		q.Set("host", host)
+	}
+	r := &PurgeResult{}
+	return r, c.do(ctx, http.MethodPost, "/admin/purge", q, nil, r)
+}
+
+// ProbeResult is the latest outcome of a canary probe.
+type ProbeResult struct {
+	URL           string     `json:"url"`
+	OK            bool       `json:"ok"`
+	Error         string     `json:"error,omitempty"`
+	Time          time.Time  `json:"time"`
+	DNSMillis     float64    `json:"dns_ms"`
+	ConnectMillis float64    `json:"connect_ms"`
+	TLSMillis     float64    `json:"tls_ms"`
+	TotalMillis   float64    `json:"total_ms"`
+	CertExpiry    *time.Time `json:"cert_expiry,omitempty"`
+}
+
+// Probes returns the latest canary results keyed by URL.
+func (c *Client) Probes(ctx context.Context) (map[string]*ProbeResult, error) {
+	r := map[string]*ProbeResult{}
+	return r, c.do(ctx, http.MethodGet, "/admin/probes", nil, nil, &r)
+}
+
+// LogLevel is the proxy's glog verbosity.
+type LogLevel struct {
+	V       int    `json:"v"`
+	VModule string `json:"vmodule"`
+	// Until is when a temporary change reverts, if one is in effect.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// LogLevel returns the current log verbosity.
+func (c *Client) LogLevel(ctx context.Context) (*LogLevel, error) {
+	r := &LogLevel{}
+	return r, c.do(ctx, http.MethodGet, "/admin/loglevel", nil, nil, r)
+}
+
+// SetLogLevel sets the log verbosity to v and vmodule. If d is positive the
+// previous level comes back after d.
+func (c *Client) SetLogLevel(ctx context.Context, v int, vmodule string, d time.Duration) (*LogLevel, error) {
+	q := url.Values{"v": {strconv.Itoa(v)}, "vmodule": {vmodule}}
+	if d > 0 {
+		q.Set("for", d.String())
+	}
+	r := &LogLevel{}
+	return r, c.do(ctx, http.MethodPost, "/admin/loglevel", q, nil, r)
+}
+
+// ConnStats is the proxy's connection and request counts.
+type ConnStats struct {
+	RequestsInFlight int64           `json:"requests_in_flight"`
+	Listeners        []ListenerStats `json:"listeners"`
+}
+
+// ListenerStats counts one listener's connections by state. New connections
+// haven't sent a request yet, which on a TLS listener mostly means they're
+// still in the handshake.
+type ListenerStats struct {
+	Name          string  `json:"name"`
+	Addr          string  `json:"addr"`
+	TLS           bool    `json:"tls"`
+	Open          int64   `json:"open"`
+	New           int64   `json:"new"`
+	Active        int64   `json:"active"`
+	Idle          int64   `json:"idle"`
+	Accepted      int64   `json:"accepted"`
+	AcceptRate10s float64 `json:"accept_rate_10s"`
+	AcceptRate1m  float64 `json:"accept_rate_1m"`
+}
+
+// Connections returns open connections, accept rates and requests in flight.
+func (c *Client) Connections(ctx context.Context) (*ConnStats, error) {
+	r := &ConnStats{}
+	return r, c.do(ctx, http.MethodGet, "/admin/connections", nil, nil, r)
+}
+
+// StatusReport is the proxy's status summary.
+type StatusReport struct {
+	Status        string        `json:"status"` // ok, degraded or unavailable
+	Problems      []string      `json:"problems,omitempty"`
+	Started       time.Time     `json:"started"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+	Ready         bool          `json:"ready"`
+	Build         string        `json:"build,omitempty"`
+	Requests      []RequestRate `json:"requests"`
+	Certificates  []CertStatus  `json:"certificates,omitempty"`
+	Sites         []SiteRelease `json:"sites"`
+}
+
+// RequestRate is the requests and server errors over a window, like 5m.
+type RequestRate struct {
+	Window    string  `json:"window"`
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// CertStatus is a certificate the proxy has served.
+type CertStatus struct {
+	Names    string    `json:"names"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int       `json:"days_left"`
+}
+
+// SiteRelease is the gs://bucket/prefix/ some hosts are served from.
+type SiteRelease struct {
+	Hosts   []string `json:"hosts"`
+	Release string   `json:"release"`
+}
+
+// Status returns the proxy's status summary.
+func (c *Client) Status(ctx context.Context) (*StatusReport, error) {
+	r := &StatusReport{}
+	return r, c.do(ctx, http.MethodGet, "/admin/status", url.Values{"format": {"json"}}, nil, r)
+}
+
+// DeployDiff compares a site's objects with a candidate. The lists are cut off
+// at the limit asked for; the counts aren't.
+type DeployDiff struct {
+	Current      string        `json:"current"`
+	Candidate    string        `json:"candidate"`
+	AddedCount   int           `json:"added_count"`
+	RemovedCount int           `json:"removed_count"`
+	ChangedCount int           `json:"changed_count"`
+	Unchanged    int           `json:"unchanged"`
+	Added        []string      `json:"added"`
+	Removed      []string      `json:"removed"`
+	Changed      []string      `json:"changed"`
+	MissingPages []MissingPage `json:"missing_pages"`
+}
+
+// MissingPage is a page the candidate drops with no redirect covering it.
+type MissingPage struct {
+	URL    string `json:"url"`
+	Object string `json:"object"`
+}
+
+// DeployDiff compares the site serving host ("" for --gcs_bucket) with
+// candidate, a gs://bucket/prefix/, listing at most limit names of each kind.
+func (c *Client) DeployDiff(ctx context.Context, host, candidate string, limit int) (*DeployDiff, error) {
+	q := url.Values{"candidate": {candidate}}
+	if host != "" {
+		q.Set("host", host)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	r := &DeployDiff{}
+	return r, c.do(ctx, http.MethodGet, "/admin/deploydiff", q, nil, r)
+}
+
+// TokenInfo describes an admin token, without the token itself.
+type TokenInfo struct {
+	Name     string     `json:"name"`
+	Actions  []string   `json:"actions"`
+	Hosts    []string   `json:"hosts,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Expired  bool       `json:"expired,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Uses     int64      `json:"uses"`
+}
+
+// Tokens lists the admin tokens and when each was last used.
+func (c *Client) Tokens(ctx context.Context) ([]TokenInfo, error) {
+	var r []TokenInfo
+	return r, c.do(ctx, http.MethodGet, "/admin/tokens", nil, nil, &r)
+}
+
+// ClientReport is a kind of report browsers sent to /__report, with how often
+// it's been seen.
+type ClientReport struct {
+	Host      string    `json:"host"`
+	Kind      string    `json:"kind"`
+	Summary   string    `json:"summary"`
+	Source    string    `json:"source,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Stack     string    `json:"stack,omitempty"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// ClientReports is the response to ClientReports.
+type ClientReports struct {
+	Reports []ClientReport `json:"reports"`
+	Dropped int64          `json:"dropped"`
+}
+
+// ClientReports returns up to n of the reports for host and kind, most frequent
+// first. Empty host and kind match everything.
+func (c *Client) ClientReports(ctx context.Context, host, kind string, n int) (*ClientReports, error) {
+	q := url.Values{}
+	if host != "" {
+		q.Set("host", host)
+	}
+	if kind != "" {
+		q.Set("kind", kind)
+	}
+	if n > 0 {
+		q.Set("n", strconv.Itoa(n))
+	}
+	r := &ClientReports{}
+	return r, c.do(ctx, http.MethodGet, "/admin/reports", q, nil, r)
+}
+
+// ClearClientReports forgets the reports for host, or all of them, and returns
+// how many it cleared.
+func (c *Client) ClearClientReports(ctx context.Context, host string) (int, error) {
+	q := url.Values{}
+	if host != "" {
+		q.Set("host", host)
+	}
+	var r struct {
+		Cleared int `json:"cleared"`
+	}
+	err := c.do(ctx, http.MethodDelete, "/admin/reports", q, nil, &r)
+	return r.Cleared, err
+}
+
+// GCStats is the proxy's heap and garbage collector stats.
+type GCStats struct {
+	Goroutines     int             `json:"goroutines"`
+	HeapAlloc      uint64          `json:"heap_alloc"`
+	HeapInuse      uint64          `json:"heap_inuse"`
+	HeapIdle       uint64          `json:"heap_idle"`
+	HeapReleased   uint64          `json:"heap_released"`
+	HeapObjects    uint64          `json:"heap_objects"`
+	Sys            uint64          `json:"sys"`
+	NextGC         uint64          `json:"next_gc"`
+	NumGC          int64           `json:"num_gc"`
+	LastGC         *time.Time      `json:"last_gc,omitempty"`
+	PauseTotal     time.Duration   `json:"pause_total_ns"`
+	RecentPauses   []time.Duration `json:"recent_pauses_ns"`
+	GCCPUFraction  float64         `json:"gc_cpu_fraction"`
+	FreedOSMemory  bool            `json:"freed_os_memory,omitempty"`
+	CollectionTime time.Duration   `json:"collection_ns,omitempty"`
+}
+
+// GCStats returns the proxy's GC stats. It needs --debug_endpoints.
+func (c *Client) GCStats(ctx context.Context) (*GCStats, error) {
+	r := &GCStats{}
+	return r, c.do(ctx, http.MethodGet, "/debug/gc", nil, nil, r)
+}
+
+// FreeOSMemory forces a garbage collection on the proxy that returns as much
+// memory to the OS as it can, and returns the stats after it.
+func (c *Client) FreeOSMemory(ctx context.Context) (*GCStats, error) {
+	r := &GCStats{}
+	return r, c.do(ctx, http.MethodPost, "/debug/gc", nil, nil, r)
+}
+
+// Profile writes one of the proxy's net/http/pprof profiles, such as heap or
+// goroutine, to w. query carries its parameters, like seconds for a CPU
+// profile. It needs --debug_endpoints.
+func (c *Client) Profile(ctx context.Context, name string, query url.Values, w io.Writer) error {
+	return c.do(ctx, http.MethodGet, "/debug/pprof/"+name, query, nil, w)
+}
+
+// Metrics returns the proxy's metrics in the Prometheus text format.
+func (c *Client) Metrics(ctx context.Context) (string, error) {
+	var s strings.Builder
+	err := c.do(ctx, http.MethodGet, "/metrics", nil, nil, &s)
+	return s.String(), err
+}
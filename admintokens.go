@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/tokens", adminTokensHandler)
+}
+
+// AdminToken is an admin API token from the config file, limited to Actions
+// and, if Hosts is set, to requests whose host parameter names one of them.
+// Token is the token itself or an sm:// Secret Manager reference, re-read every
+// --secret_refresh_interval. For a rotation, add the new token and give the
+// old one an Expires so it stops working once everything has moved over.
+//
+// Actions are read, for GET requests, the actions admin endpoints declare for
+// their other methods, like loglevel, and * for everything.
+type AdminToken struct {
+	Name    string    `yaml:"name" toml:"name"`
+	Token   string    `yaml:"token" toml:"token"`
+	Actions []string  `yaml:"actions" toml:"actions"`
+	Hosts   []string  `yaml:"hosts" toml:"hosts"`
+	Expires time.Time `yaml:"expires" toml:"expires"`
+
+	secret *secretFlag
+	use    *tokenUse
+}
+
+// tokenUse tracks when a token was last used.
+type tokenUse struct {
+	mu   sync.Mutex
+	last time.Time
+	uses int64
+}
+
+func (u *tokenUse) record() {
+	u.mu.Lock()
+	u.last = time.Now()
+	u.uses++
+	u.mu.Unlock()
+}
+
+// adminActions maps admin paths to the action their non-GET methods need.
+// Paths that aren't listed need *.
+var adminActions = map[string]string{}
+
+// adminPrefixActions maps path prefixes to the action every request under them
+// needs, GETs included.
+var adminPrefixActions = map[string]string{}
+
+// adminHostPaths are the admin paths that only read or change the host in
+// their host parameter, the only ones a token limited to hosts can use.
+var adminHostPaths = map[string]bool{}
+
+// adminHostScoped declares that path filters what it does by its host
+// parameter.
+func adminHostScoped(path string) {
+	adminHostPaths[path] = true
+}
+
+// adminAction declares the action needed to POST, PUT or DELETE to path.
+func adminAction(path, action string) {
+	adminActions[path] = action
+}
+
+// adminPrefixAction declares the action needed for any request under prefix,
+// for endpoints whose reads are too revealing or costly for a read token.
+func adminPrefixAction(prefix, action string) {
+	adminPrefixActions[prefix] = action
+}
+
+// requiredAction is the action r needs its token to allow.
+func requiredAction(r *http.Request) string {
+	for prefix, a := range adminPrefixActions {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return a
+		}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return "read"
+	}
+	if a, ok := adminActions[r.URL.Path]; ok {
+		return a
+	}
+	return "*"
+}
+
+// allows reports whether the token may take action.
+func (t *AdminToken) allows(action string) bool {
+	for _, a := range t.Actions {
+		if a == "*" || a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHost reports whether the token can make r, given its Hosts: r has to
+// be for one of them, to an endpoint that keeps to that host. The rest would
+// show or change every host's data.
+func (t *AdminToken) allowsHost(r *http.Request) bool {
+	if len(t.Hosts) == 0 {
+		return true
+	}
+	if !adminHostPaths[r.URL.Path] {
+		return false
+	}
+	host := r.URL.Query().Get("host")
+	for _, h := range t.Hosts {
+		if host != "" && strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// flagAdminToken is --admin_token as a token allowed everything.
+var flagAdminToken = &AdminToken{Name: "admin_token", Actions: []string{"*"}, secret: adminToken, use: &tokenUse{}}
+
+// compileAdminTokens checks the config's admin tokens and sets up their secrets.
+func (c *Config) compileAdminTokens() error {
+	names := map[string]bool{flagAdminToken.Name: true}
+	for i := range c.AdminTokens {
+		t := &c.AdminTokens[i]
+		switch {
+		case t.Name == "":
+			return fmt.Errorf("admin token %d needs a name", i+1)
+		case names[t.Name]:
+			return fmt.Errorf("admin token %q is defined twice", t.Name)
+		case t.Token == "":
+			return fmt.Errorf("admin token %q needs a token", t.Name)
+		case len(t.Actions) == 0:
+			return fmt.Errorf("admin token %q needs actions", t.Name)
+		}
+		names[t.Name] = true
+		for _, a := range t.Actions {
+			if !knownAction(a) {
+				return fmt.Errorf("admin token %q has unknown action %q, want one of %s", t.Name, a, strings.Join(knownActions(), ", "))
+			}
+		}
+		t.secret = configSecret(fmt.Sprintf("admin token %q", t.Name), t.Token)
+		t.use = &tokenUse{}
+	}
+	return nil
+}
+
+func knownActions() []string {
+	actions := []string{"*", "read"}
+	seen := map[string]bool{}
+	for _, a := range adminPrefixActions {
+		if !seen[a] {
+			seen[a] = true
+			actions = append(actions, a)
+		}
+	}
+	for _, a := range adminActions {
+		if !seen[a] {
+			seen[a] = true
+			actions = append(actions, a)
+		}
+	}
+	sort.Strings(actions[2:])
+	return actions
+}
+
+func knownAction(a string) bool {
+	for _, k := range knownActions() {
+		if a == k {
+			return true
+		}
+	}
+	return false
+}
+
+// adminTokens returns every admin token, --admin_token first if it's set.
+func adminTokens() []*AdminToken {
+	var tokens []*AdminToken
+	if adminToken.Get() != "" {
+		tokens = append(tokens, flagAdminToken)
+	}
+	for i := range config.AdminTokens {
+		tokens = append(tokens, &config.AdminTokens[i])
+	}
+	return tokens
+}
+
+// matchAdminToken returns the token r carries, or nil. Every token is compared,
+// so the time taken doesn't say which one came close.
+func matchAdminToken(r *http.Request, tokens []*AdminToken) *AdminToken {
+	got := []byte(r.Header.Get("Authorization"))
+	var match *AdminToken
+	for _, t := range tokens {
+		want := t.secret.Get()
+		if want != "" && subtle.ConstantTimeCompare(got, []byte("Bearer "+want)) == 1 {
+			match = t
+		}
+	}
+	return match
+}
+
+// requireAdminToken rejects requests that don't carry an admin token allowing
+// them. Without any tokens the admin API is open.
+func requireAdminToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens := adminTokens()
+		if len(tokens) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		t := matchAdminToken(r, tokens)
+		if t == nil || (!t.Expires.IsZero() && time.Now().After(t.Expires)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hugoproxy admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		t.use.record()
+		if action := requiredAction(r); !t.allows(action) {
+			log.Warningf("Admin token %q tried %s %s, which needs %s", t.Name, r.Method, r.URL.Path, action)
+			http.Error(w, fmt.Sprintf("token %q doesn't allow %s", t.Name, action), http.StatusForbidden)
+			return
+		}
+		if !t.allowsHost(r) {
+			log.Warningf("Admin token %q tried %s %s outside its hosts", t.Name, r.Method, r.URL.RequestURI())
+			http.Error(w, fmt.Sprintf("token %q is limited to host %s, on the endpoints with a host parameter", t.Name, strings.Join(t.Hosts, ", ")), http.StatusForbidden)
+			return
+		}
+		log.V(1).Infof("Admin token %q: %s %s", t.Name, r.Method, r.URL.RequestURI())
+		h.ServeHTTP(w, r)
+	})
+}
+
+// TokenInfo describes an admin token, without the token itself.
+type TokenInfo struct {
+	Name     string     `json:"name"`
+	Actions  []string   `json:"actions"`
+	Hosts    []string   `json:"hosts,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Expired  bool       `json:"expired,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Uses     int64      `json:"uses"`
+}
+
+// adminTokensHandler lists the admin tokens and when each was last used, to
+// tell when an old one can go.
+func adminTokensHandler(w http.ResponseWriter, r *http.Request) {
+	infos := []TokenInfo{}
+	for _, t := range adminTokens() {
+		info := TokenInfo{Name: t.Name, Actions: t.Actions, Hosts: t.Hosts}
+		if !t.Expires.IsZero() {
+			e := t.Expires
+			info.Expires = &e
+			info.Expired = time.Now().After(e)
+		}
+		t.use.mu.Lock()
+		if !t.use.last.IsZero() {
+			last := t.use.last
+			info.LastUsed = &last
+		}
+		info.Uses = t.use.uses
+		t.use.mu.Unlock()
+		infos = append(infos, info)
+	}
+	writeJSON(w, infos)
+}
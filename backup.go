@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	log "github.com/golang/glog"
+	"google.golang.org/api/iterator"
+)
+
+var (
+	backupBucket   = flag.String("backup_bucket", "", "bucket to back the site up to, one <timestamp>/ prefix per backup")
+	backupDir      = flag.String("backup_dir", "", "local directory to back the site up to, one <bucket>-<timestamp>.tar.gz per backup")
+	backupInterval = flag.Duration("backup_interval", 0, "how often to back the site up while serving (disabled if 0)")
+	backupKeep     = flag.Int("backup_keep", 14, "number of backups to keep in each of --backup_bucket and --backup_dir; older ones are deleted")
+)
+
+// backupTimeFormat names backups so they sort oldest first.
+const backupTimeFormat = "20060102T150405Z"
+
+// PAX records carrying the object metadata a tarball restore needs.
+const (
+	paxContentType     = "HUGOPROXY.content_type"
+	paxContentEncoding = "HUGOPROXY.content_encoding"
+	paxCacheControl    = "HUGOPROXY.cache_control"
+)
+
+// siteBucket is the bucket name from --gcs_bucket.
+func siteBucket() string {
+	return strings.TrimPrefix(*hugoBucket, "gs://")
+}
+
+// backup copies every object in the site bucket to --backup_bucket and/or
+// --backup_dir, then prunes backups beyond --backup_keep.
+func backup(ctx context.Context, c *storage.Client) error {
+	if *backupBucket == "" && *backupDir == "" {
+		return errors.New("neither --backup_bucket nor --backup_dir is set")
+	}
+	name := time.Now().UTC().Format(backupTimeFormat)
+	src := c.Bucket(siteBucket())
+
+	if *backupBucket != "" {
+		dst := c.Bucket(*backupBucket)
+		n, err := copyObjects(ctx, src, "", dst, name+"/")
+		if err != nil {
+			return fmt.Errorf("backup to gs://%s/%s/: %v", *backupBucket, name, err)
+		}
+		log.Infof("Backed up %d objects to gs://%s/%s/", n, *backupBucket, name)
+		if err := pruneBucketBackups(ctx, dst); err != nil {
+			return err
+		}
+	}
+	if *backupDir != "" {
+		path := filepath.Join(*backupDir, fmt.Sprintf("%s-%s.tar.gz", siteBucket(), name))
+		n, err := writeTarball(ctx, src, path)
+		if err != nil {
+			return fmt.Errorf("backup to %s: %v", path, err)
+		}
+		log.Infof("Backed up %d objects to %s", n, path)
+		if err := pruneDirBackups(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyObjects server-side copies every object under srcPrefix in src to dst,
+// swapping srcPrefix for dstPrefix. Metadata comes along with the copy.
+func copyObjects(ctx context.Context, src *storage.BucketHandle, srcPrefix string, dst *storage.BucketHandle, dstPrefix string) (int, error) {
+	n := 0
+	it := src.Objects(ctx, &storage.Query{Prefix: srcPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		name := dstPrefix + strings.TrimPrefix(attrs.Name, srcPrefix)
+		if _, err := dst.Object(name).CopierFrom(src.Object(attrs.Name)).Run(ctx); err != nil {
+			return n, fmt.Errorf("copy %s: %v", attrs.Name, err)
+		}
+		n++
+	}
+}
+
+// writeTarball writes every object in src to a gzipped tarball at path. It's
+// written to a temporary file first so a failed backup never looks complete.
+func writeTarball(ctx context.Context, src *storage.BucketHandle, path string) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	n := 0
+	it := src.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		hdr := &tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       attrs.Name,
+			Size:       attrs.Size,
+			Mode:       0644,
+			ModTime:    attrs.Updated,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{},
+		}
+		for k, v := range map[string]string{paxContentType: attrs.ContentType, paxContentEncoding: attrs.ContentEncoding, paxCacheControl: attrs.CacheControl} {
+			if v != "" {
+				hdr.PAXRecords[k] = v
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return n, err
+		}
+		// ReadCompressed so gzip-encoded objects go into the tarball as stored.
+		r, err := src.Object(attrs.Name).ReadCompressed(true).NewReader(ctx)
+		if err != nil {
+			return n, fmt.Errorf("read %s: %v", attrs.Name, err)
+		}
+		_, err = io.Copy(tw, r)
+		r.Close()
+		if err != nil {
+			return n, fmt.Errorf("read %s: %v", attrs.Name, err)
+		}
+		n++
+	}
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+	if err := zw.Close(); err != nil {
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
+
+// bucketBackups lists the backups in --backup_bucket, oldest first.
+func bucketBackups(ctx context.Context, b *storage.BucketHandle) ([]string, error) {
+	var names []string
+	it := b.Objects(ctx, &storage.Query{Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p := strings.TrimSuffix(attrs.Prefix, "/"); p != "" {
+			if _, err := time.Parse(backupTimeFormat, p); err == nil {
+				names = append(names, p)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// dirBackups lists the tarballs in --backup_dir, oldest first.
+func dirBackups() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(*backupDir, siteBucket()+"-*.tar.gz"))
+	sort.Strings(names)
+	return names, err
+}
+
+func pruneBucketBackups(ctx context.Context, b *storage.BucketHandle) error {
+	names, err := bucketBackups(ctx, b)
+	if err != nil {
+		return err
+	}
+	for len(names) > *backupKeep {
+		it := b.Objects(ctx, &storage.Query{Prefix: names[0] + "/"})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := b.Object(attrs.Name).Delete(ctx); err != nil {
+				return fmt.Errorf("delete %s: %v", attrs.Name, err)
+			}
+		}
+		log.Infof("Deleted backup gs://%s/%s/", *backupBucket, names[0])
+		names = names[1:]
+	}
+	return nil
+}
+
+func pruneDirBackups() error {
+	names, err := dirBackups()
+	if err != nil {
+		return err
+	}
+	for len(names) > *backupKeep {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		log.Infof("Deleted backup %s", names[0])
+		names = names[1:]
+	}
+	return nil
+}
+
+// restore makes the site bucket match the named backup: a <timestamp> in
+// --backup_bucket or a tarball path. Objects that aren't in the backup are
+// deleted once everything in it has been restored.
+func restore(ctx context.Context, c *storage.Client, name string) error {
+	dst := c.Bucket(siteBucket())
+	restored := map[string]bool{}
+	if strings.HasSuffix(name, ".tar.gz") {
+		if err := restoreTarball(ctx, name, dst, restored); err != nil {
+			return err
+		}
+	} else {
+		if *backupBucket == "" {
+			return errors.New("--backup_bucket isn't set")
+		}
+		src := c.Bucket(*backupBucket)
+		prefix := strings.TrimSuffix(name, "/") + "/"
+		it := src.Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			obj := strings.TrimPrefix(attrs.Name, prefix)
+			if _, err := dst.Object(obj).CopierFrom(src.Object(attrs.Name)).Run(ctx); err != nil {
+				return fmt.Errorf("copy %s: %v", attrs.Name, err)
+			}
+			restored[obj] = true
+		}
+	}
+	if len(restored) == 0 {
+		return fmt.Errorf("backup %s is empty or doesn't exist", name)
+	}
+	log.Infof("Restored %d objects from %s", len(restored), name)
+
+	it := dst.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !restored[attrs.Name] {
+			if err := dst.Object(attrs.Name).Delete(ctx); err != nil {
+				return fmt.Errorf("delete %s: %v", attrs.Name, err)
+			}
+			log.Infof("Deleted %s, which isn't in the backup", attrs.Name)
+		}
+	}
+}
+
+func restoreTarball(ctx context.Context, path string, dst *storage.BucketHandle, restored map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		w := dst.Object(hdr.Name).NewWriter(ctx)
+		w.ContentType = hdr.PAXRecords[paxContentType]
+		w.ContentEncoding = hdr.PAXRecords[paxContentEncoding]
+		w.CacheControl = hdr.PAXRecords[paxCacheControl]
+		if _, err := io.Copy(w, tr); err != nil {
+			w.Close()
+			return fmt.Errorf("write %s: %v", hdr.Name, err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("write %s: %v", hdr.Name, err)
+		}
+		restored[hdr.Name] = true
+	}
+}
+
+func newStorageClient(ctx context.Context) *storage.Client {
+	opts, err := clientOptions(ctx)
+	if err != nil {
+		log.Exitf("clientOptions: %v", err)
+	}
+	c, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		log.Exitf("storage.NewClient: %v", err)
+	}
+	return c
+}
+
+// backupCommand implements "hugoproxy backup [list]".
+func backupCommand(args []string) {
+	ctx := context.Background()
+	c := newStorageClient(ctx)
+	switch {
+	case len(args) == 0:
+		if err := backup(ctx, c); err != nil {
+			log.Exit(err)
+		}
+	case len(args) == 1 && args[0] == "list":
+		if *backupBucket != "" {
+			names, err := bucketBackups(ctx, c.Bucket(*backupBucket))
+			if err != nil {
+				log.Exitf("list gs://%s: %v", *backupBucket, err)
+			}
+			for _, n := range names {
+				fmt.Println(n)
+			}
+		}
+		if *backupDir != "" {
+			names, err := dirBackups()
+			if err != nil {
+				log.Exitf("list %s: %v", *backupDir, err)
+			}
+			for _, n := range names {
+				fmt.Println(n)
+			}
+		}
+	default:
+		log.Exit("usage: hugoproxy [flags] backup [list]")
+	}
+}
+
+// restoreCommand implements "hugoproxy restore <timestamp|tarball>".
+func restoreCommand(args []string) {
+	if len(args) != 1 {
+		log.Exit("usage: hugoproxy [flags] restore <timestamp in --backup_bucket | tarball>")
+	}
+	ctx := context.Background()
+	if err := restore(ctx, newStorageClient(ctx), args[0]); err != nil {
+		log.Exit(err)
+	}
+}
+
+// periodicBackup backs the site up every --backup_interval.
+func periodicBackup() {
+	ctx := context.Background()
+	c := newStorageClient(ctx)
+	for {
+		time.Sleep(*backupInterval)
+		if err := backup(ctx, c); err != nil {
+			log.Errorf("Backup failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	stagingHostnames = flags.StringSlice("staging_hostnames", []string{}, "CSV of preview hostnames whose HTML pages get --staging_banner injected")
+	stagingBanner    = flag.String("staging_banner", `<div style="position:fixed;top:0;left:0;right:0;z-index:2147483647;background:#c00;color:#fff;font:bold 14px/1.6 sans-serif;text-align:center">STAGING: this is not the live site</div>`, "HTML injected into pages on --staging_hostnames, right after <body>; a <meta> tag goes at the top of <head> instead")
+)
+
+// maxTransformSize is the largest HTML body we'll buffer to rewrite. Anything
+// bigger is passed through untouched.
+const maxTransformSize = 10 << 20
+
+func isStagingHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range *stagingHostnames {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// injectAfterTag inserts snippet just after the first opening tag named tag in
+// doc, reporting whether it found one.
+func injectAfterTag(doc []byte, tag, snippet string) ([]byte, bool) {
+	lower := bytes.ToLower(doc)
+	open := []byte("<" + tag)
+	i := 0
+	for {
+		j := bytes.Index(lower[i:], open)
+		if j < 0 {
+			return doc, false
+		}
+		i += j + len(open)
+		// Make sure we matched <body and not <bodyfoo.
+		if i < len(lower) && strings.IndexByte("> \t\r\n/", lower[i]) >= 0 {
+			break
+		}
+	}
+	end := bytes.IndexByte(doc[i:], '>')
+	if end < 0 {
+		return doc, false
+	}
+	end += i + 1
+	out := make([]byte, 0, len(doc)+len(snippet))
+	out = append(out, doc[:end]...)
+	out = append(out, snippet...)
+	return append(out, doc[end:]...), true
+}
+
+// injectStagingBanner adds --staging_banner to HTML responses for staging hosts.
+func injectStagingBanner(resp *http.Response) error {
+	if len(*stagingHostnames) == 0 || !isStagingHost(resp.Request.Header.Get("X-Original-Host")) {
+		return nil
+	}
+	// Everything on a preview host should stay out of search results.
+	resp.Header.Set("X-Robots-Tag", "noindex")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	if !transformAllowed(resp.Request, resp.Header) {
+		transformsSkipped.Add(1)
+		return nil
+	}
+	doc, ok, err := transformableBody(resp)
+	if !ok {
+		return err
+	}
+
+	tag := "body"
+	if strings.HasPrefix(strings.ToLower(*stagingBanner), "<meta") {
+		tag = "head"
+	}
+	if out, ok := injectAfterTag(doc, tag, *stagingBanner); ok {
+		doc = out
+	}
+
+	setTransformedBody(resp, doc)
+	return nil
+}
+
+// setTransformedBody replaces the body of resp with doc, an uncompressed rewrite
+// of what the bucket sent, fixing up the headers that described the original.
+func setTransformedBody(resp *http.Response, doc []byte) {
+	resp.Body = ioutil.NopCloser(bytes.NewReader(doc))
+	resp.ContentLength = int64(len(doc))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(doc)))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Digest")
+	resp.Header.Del("Repr-Digest")
+	resp.Header.Del("X-Goog-Hash")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
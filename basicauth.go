@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	basicAuthMatch    = flags.StringSlice("basic_auth_match", []string{}, "CSV of cache_control style path patterns, e.g. /private/**, that need --basic_auth_user and --basic_auth_password; the config's protected section can add more")
+	basicAuthUser     = flag.String("basic_auth_user", "", "user name for --basic_auth_match")
+	basicAuthPassword = secretVar("basic_auth_password", "password for --basic_auth_match, or its bcrypt hash as htpasswd -B makes")
+	basicAuthRealm    = flag.String("basic_auth_realm", "Restricted", "realm browsers show when asking for --basic_auth_match credentials")
+)
+
+var basicAuthFailures = expvar.NewInt("basic_auth_failures")
+
+// ProtectedArea puts the paths matching Match, a cache_control style pattern,
+// behind HTTP Basic auth. Users maps user names to passwords, which can be
+// sm:// Secret Manager references or bcrypt hashes ($2a$, $2b$ or $2y$), as
+// htpasswd -B makes. Behind IAP, Identities can let people in by their IAP
+// identity instead, as in --iap_identities. Host is optional.
+type ProtectedArea struct {
+	Host       string            `yaml:"host" toml:"host"`
+	Match      string            `yaml:"match" toml:"match"`
+	Realm      string            `yaml:"realm" toml:"realm"` // defaults to --basic_auth_realm
+	Users      map[string]string `yaml:"users" toml:"users"`
+	Identities []string          `yaml:"identities" toml:"identities"`
+
+	re       *regexp.Regexp
+	secrets  map[string]*secretFlag
+	verified *sync.Map // of bcrypt hash and password digest pairs that matched
+}
+
+// compile checks the area and sets up its secrets; what names it in errors.
+func (a *ProtectedArea) compile(what string) error {
+	if len(a.Users) == 0 && len(a.Identities) == 0 {
+		return fmt.Errorf("%s needs users or identities", what)
+	}
+	re, err := compileGlob(a.Match)
+	if err != nil {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	a.re = re
+	if strings.ContainsAny(a.Realm, `"\`) {
+		return fmt.Errorf("%s: realm can't contain quotes or backslashes", what)
+	}
+	if a.secrets == nil {
+		a.secrets = map[string]*secretFlag{}
+		for user, password := range a.Users {
+			if user == "" || strings.Contains(user, ":") || password == "" {
+				return fmt.Errorf("%s: users need a name without a colon and a password", what)
+			}
+			a.secrets[user] = configSecret(fmt.Sprintf("%s password for %q", what, user), password)
+		}
+	}
+	a.verified = &sync.Map{}
+	return nil
+}
+
+// compileProtected checks the config's protected areas.
+func (c *Config) compileProtected() error {
+	for i := range c.Protected {
+		if err := c.Protected[i].compile(fmt.Sprintf("protected area %q", c.Protected[i].Match)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// authorized reports whether r comes from one of the area's IAP identities, or
+// carries the credentials of one of its users.
+func (a *ProtectedArea) authorized(r *http.Request) (string, bool) {
+	if u := iapIdentity(r); u != nil && u.allowed(a.Identities) {
+		return u.Email, true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	s := a.secrets[user]
+	if s == nil {
+		// Take as long as a wrong password would.
+		subtle.ConstantTimeCompare([]byte(password), []byte(password))
+		return user, false
+	}
+	want := s.Get()
+	if want == "" {
+		return user, false
+	}
+	if !isBcryptHash(want) {
+		return user, subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	}
+	// bcrypt is slow on purpose; once a password has matched, remember it
+	// for as long as the hash stays the same.
+	key := fmt.Sprintf("%s %x", want, sha256.Sum256([]byte(password)))
+	if _, ok := a.verified.Load(key); ok {
+		return user, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(want), []byte(password)) != nil {
+		return user, false
+	}
+	a.verified.Store(key, true)
+	return user, true
+}
+
+// protectedArea returns the first area covering a request for p on host, or
+// nil. A directory is protected along with its index document.
+func protectedArea(areas []*ProtectedArea, host, p string) *ProtectedArea {
+	paths := accessPaths(host, p)
+	for _, a := range areas {
+		if hostMatches(a.Host, host) && anyPathMatches(a.re, paths) {
+			return a
+		}
+	}
+	return nil
+}
+
+// flagProtectedAreas turns --basic_auth_match into protected areas.
+func flagProtectedAreas() []*ProtectedArea {
+	if len(*basicAuthMatch) == 0 {
+		return nil
+	}
+	if *basicAuthUser == "" || basicAuthPassword.String() == "" {
+		log.Exit("--basic_auth_match needs --basic_auth_user and --basic_auth_password")
+	}
+	var areas []*ProtectedArea
+	for _, m := range *basicAuthMatch {
+		a := &ProtectedArea{Match: m, Users: map[string]string{*basicAuthUser: "flag"}, secrets: map[string]*secretFlag{*basicAuthUser: basicAuthPassword}}
+		if err := a.compile("--basic_auth_match " + m); err != nil {
+			log.Exit(err)
+		}
+		areas = append(areas, a)
+	}
+	return areas
+}
+
+// withBasicAuth asks for credentials before serving anything in a protected
+// area. What it then serves is marked private, so shared caches and CDNs don't
+// hand it to anyone else.
+func withBasicAuth(h http.Handler) http.Handler {
+	areas := flagProtectedAreas()
+	for i := range config.Protected {
+		areas = append(areas, &config.Protected[i])
+	}
+	if len(areas) == 0 {
+		return h
+	}
+	if strings.ContainsAny(*basicAuthRealm, `"\`) {
+		log.Exitf("--basic_auth_realm can't contain quotes or backslashes: %q", *basicAuthRealm)
+	}
+	for _, a := range areas {
+		if len(a.Identities) > 0 && *iapAudience == "" {
+			log.Exitf("Protected area %s%s has identities, which need --iap_audience", a.Host, a.Match)
+		}
+		users := make([]string, 0, len(a.Users))
+		for u := range a.Users {
+			users = append(users, u)
+		}
+		sort.Strings(users)
+		log.Infof("Protecting %s%s for %s", a.Host, a.Match, strings.Join(append(users, a.Identities...), ", "))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := protectedArea(areas, r.Host, r.URL.Path)
+		if a == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		user, ok := a.authorized(r)
+		if !ok {
+			if user != "" {
+				basicAuthFailures.Add(1)
+				log.V(1).Infof("Basic auth failed for %q from %s on %s%s", user, r.RemoteAddr, r.Host, r.URL.Path)
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			if len(a.Users) == 0 {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, firstNonEmpty(a.Realm, *basicAuthRealm)))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// The password was for us: it's not the bucket's to see, and a
+		// request carrying one can't be answered from the cache.
+		r.Header.Del("Authorization")
+		h.ServeHTTP(&privateWriter{ResponseWriter: w}, r)
+	})
+}
+
+// privateWriter makes a response cacheable by the browser at most.
+type privateWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *privateWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		h.Set("Cache-Control", "private, no-cache")
+		h.Del("Surrogate-Control")
+		h.Del("Expires")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *privateWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets httputil.ReverseProxy flush through the writer.
+func (w *privateWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *privateWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	bucketRedirectFiles    = flags.StringSlice("bucket_redirects", []string{"_redirects", "redirects.toml"}, "CSV of files at the top of each site's bucket (or prefix) holding redirect rules, in Netlify's _redirects format or, for .toml files, netlify.toml's [[redirects]]; the files themselves aren't served. Empty disables")
+	bucketRedirectInterval = flag.Duration("bucket_redirects_interval", time.Minute, "how often to check --bucket_redirects for changes")
+)
+
+// bucketRedirects holds the redirect rules read from each site's bucket.
+type bucketRedirects struct {
+	backend http.RoundTripper
+	// def is the site for hosts that aren't in --host_buckets.
+	def *url.URL
+
+	mu    sync.RWMutex
+	rules map[string][]Redirect
+	// etags are the ETags of the files as last read, by site and file.
+	etags map[string]string
+	// files holds the rules of each file of each site, to rebuild rules from.
+	files map[string][]Redirect
+}
+
+var siteRedirects *bucketRedirects
+
+// siteKey identifies the site a bucket URL, prefix and all, serves.
+func siteKey(u *url.URL) string {
+	return u.Host + u.Path
+}
+
+// fetch reads one of --bucket_redirects for site u. It reports changed false
+// if the file is as it was, and keeps the old rules on errors.
+func (b *bucketRedirects) fetch(ctx context.Context, u *url.URL, file string) (rules []Redirect, changed bool, err error) {
+	fu := *u
+	fu.Path = singleJoiningSlash(u.Path, file)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fu.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Host = u.Host
+	req.Header.Set("Accept-Encoding", "identity")
+	key := siteKey(u) + " " + file
+	b.mu.RLock()
+	etag := b.etags[key]
+	b.mu.RUnlock()
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := b.backend.RoundTrip(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, false, nil
+	case resp.StatusCode == http.StatusNotFound:
+		b.setETag(key, "")
+		return nil, etag != "", nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("GET %s: %s", fu.String(), resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if rules, err = parseRulesFile("gs://"+u.Host+fu.Path, body); err != nil {
+		return nil, false, err
+	}
+	b.setETag(key, resp.Header.Get("ETag"))
+	return rules, true, nil
+}
+
+// parseRulesFile parses one of --bucket_redirects, a netlify.toml style file if
+// its name ends in .toml and a _redirects file otherwise.
+func parseRulesFile(name string, body []byte) ([]Redirect, error) {
+	im := newRedirectImporter(log.Warningf)
+	var err error
+	if strings.HasSuffix(name, ".toml") {
+		err = im.readNetlifyTOML(name, body)
+	} else {
+		err = im.readNetlify(name, strings.NewReader(string(body)))
+	}
+	return im.redirects, err
+}
+
+func (b *bucketRedirects) setETag(key, etag string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if etag == "" {
+		delete(b.etags, key)
+	} else {
+		b.etags[key] = etag
+	}
+}
+
+// refresh rereads the files of site u that changed.
+func (b *bucketRedirects) refresh(u *url.URL) {
+	changed := false
+	for _, file := range *bucketRedirectFiles {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		rules, ok, err := b.fetch(ctx, u, file)
+		cancel()
+		if err != nil {
+			log.Errorf("Error reading redirects from gs://%s: %v", u.Host+singleJoiningSlash(u.Path, file), err)
+			continue
+		}
+		if ok {
+			b.mu.Lock()
+			b.files[siteKey(u)+" "+file] = rules
+			b.mu.Unlock()
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	var all []Redirect
+	b.mu.Lock()
+	for _, file := range *bucketRedirectFiles {
+		all = append(all, b.files[siteKey(u)+" "+file]...)
+	}
+	b.rules[siteKey(u)] = all
+	b.mu.Unlock()
+	log.Infof("Loaded %d redirects from gs://%s", len(all), siteKey(u))
+}
+
+// lookup returns where the rules of the site serving host redirect p.
+func (b *bucketRedirects) lookup(site *url.URL, host, p string) (string, int, bool) {
+	b.mu.RLock()
+	rules := b.rules[siteKey(site)]
+	b.mu.RUnlock()
+	return matchRedirects(rules, host, p)
+}
+
+// site returns the site serving host.
+func (b *bucketRedirects) site(host string) *url.URL {
+	if u := hostBucketURL(host); u != nil {
+		return u
+	}
+	return b.def
+}
+
+// isRulesFile reports whether p is one of the --bucket_redirects files.
+func isRulesFile(p string) bool {
+	for _, file := range *bucketRedirectFiles {
+		if p == "/"+strings.TrimPrefix(file, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// startBucketRedirects reads --bucket_redirects from the site at def and those
+// in --host_buckets, through backend, and keeps them up to date.
+func startBucketRedirects(backend http.RoundTripper, def *url.URL) {
+	if len(*bucketRedirectFiles) == 0 {
+		return
+	}
+	sites := []*url.URL{def}
+	seen := map[string]bool{siteKey(def): true}
+	for _, h := range hostBucketHosts() {
+		if u := hostBucketURL(h); !seen[siteKey(u)] {
+			seen[siteKey(u)] = true
+			sites = append(sites, u)
+		}
+	}
+	b := &bucketRedirects{backend: backend, def: def, rules: map[string][]Redirect{}, etags: map[string]string{}, files: map[string][]Redirect{}}
+	for _, u := range sites {
+		b.refresh(u)
+	}
+	siteRedirects = b
+	go func() {
+		for range time.Tick(*bucketRedirectInterval) {
+			for _, u := range sites {
+				b.refresh(u)
+			}
+		}
+	}()
+}
+
+// withBucketRedirects applies the redirect rules of the bucket serving each
+// request, and hides the files they come from.
+func withBucketRedirects(h http.Handler) http.Handler {
+	if siteRedirects == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isRulesFile(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		to, status, ok := siteRedirects.lookup(siteRedirects.site(r.Host), r.Host, r.URL.Path)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		redirectKeepingQuery(w, r, to, status)
+	})
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	cacheSize      = flag.Int64("cache_size", 0, "bytes of upstream responses to keep in memory (disabled if 0)")
+	cacheMaxObject = flag.Int64("cache_max_object", 1<<20, "largest response body the cache will hold")
+	cacheTTL       = flag.Duration("cache_ttl", time.Minute, "how long to cache a response that doesn't carry its own max-age")
+	cacheStaleTTL  = flag.Duration("cache_stale_while_revalidate", 0, "how long past its TTL a cached response may still be served while it's fetched again in the background, for responses without their own stale-while-revalidate (disabled if 0)")
+)
+
+var (
+	cacheHits      = expvar.NewInt("cache_hits")
+	cacheMisses    = expvar.NewInt("cache_misses")
+	cacheBypasses  = expvar.NewInt("cache_bypasses")
+	cacheEvictions = expvar.NewInt("cache_evictions")
+	cacheBytes     = expvar.NewInt("cache_bytes")
+
+	cacheStaleHits          = expvar.NewInt("cache_stale_hits")
+	cacheCoalesced          = expvar.NewInt("cache_coalesced")
+	cacheRevalidationErrors = expvar.NewInt("cache_revalidation_errors")
+	cacheNotModified        = expvar.NewInt("cache_not_modified")
+)
+
+// cacheStatuses are the upstream responses worth keeping.
+var cacheStatuses = map[int]bool{
+	http.StatusOK:               true,
+	http.StatusMovedPermanently: true,
+	http.StatusFound:            true,
+	http.StatusNotFound:         true,
+}
+
+type cacheEntry struct {
+	key string
+	// url, host and gzip are what's needed to fetch the entry again.
+	url     string
+	host    string
+	gzip    bool
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	// staleUntil is how long past expires the entry can be served while it's
+	// revalidated.
+	staleUntil time.Time
+	// hits counts the requests answered from the entry, and revalidating is
+	// set while it's being fetched again. c.mu guards both.
+	hits         int64
+	revalidating bool
+	// headOnly entries came from a HEAD, so they hold the headers but no
+	// body, and length is the body's. They answer HEADs but not GETs.
+	headOnly bool
+	length   int64
+	// gzipped holds the *precompressed copy of body, once precompress has
+	// made one.
+	gzipped atomic.Value
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.key) + len(e.body))
+	if p, ok := e.gzipped.Load().(*precompressed); ok {
+		n += int64(len(p.body))
+	}
+	for k, vs := range e.header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+// cache is an LRU of upstream responses in front of the backend, so hot pages
+// and assets don't cost a GCS request each time. It sits under the transport,
+// so redirect rewriting, banners and the rest still apply to every response.
+type cache struct {
+	http.RoundTripper
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	// fetching has the misses being fetched, closed once they're cached.
+	fetching map[string]chan struct{}
+}
+
+// contentCache is the cache newCache made, if any, for the admin endpoints.
+var contentCache *cache
+
+// newCache wraps backend with a cache if --cache_size is set.
+func newCache(backend http.RoundTripper) http.RoundTripper {
+	if *cacheSize <= 0 {
+		return backend
+	}
+	contentCache = &cache{RoundTripper: backend, entries: map[string]*list.Element{}, lru: list.New(), fetching: map[string]chan struct{}{}}
+	return contentCache
+}
+
+// cacheKey identifies what the backend would return for req: the request URL,
+// the host (which picks the index documents) and whether gzip stored objects
+// would come back compressed.
+func cacheKey(req *http.Request) string {
+	gz := "identity"
+	if acceptsEncoding(req, "gzip") {
+		gz = "gzip"
+	}
+	return req.Header.Get("X-Original-Host") + " " + gz + " " + req.URL.RequestURI()
+}
+
+// cacheBypass reports whether req has to go to the backend: it's not a plain
+// GET or HEAD, it's authorized, or the client asked for a fresh copy. Ranges
+// are answered from the cache, but a fresh one is only the range.
+func cacheBypass(req *http.Request) (bypass, store bool) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || req.Header.Get("Authorization") != "" {
+		return true, false
+	}
+	if hasDirective(req.Header, "Cache-Control", "no-cache") || hasDirective(req.Header, "Pragma", "no-cache") {
+		return true, req.Header.Get("Range") == ""
+	}
+	return false, true
+}
+
+// hasDirective reports whether header field of h lists directive.
+func hasDirective(h http.Header, field, directive string) bool {
+	_, ok := directives(h, field)[directive]
+	return ok
+}
+
+// directives parses a Cache-Control style header into its directives.
+func directives(h http.Header, field string) map[string]string {
+	d := map[string]string{}
+	for _, v := range h.Values(field) {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			k, val := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				k, val = part[:i], strings.Trim(part[i+1:], `"`)
+			}
+			d[strings.ToLower(k)] = val
+		}
+	}
+	return d
+}
+
+// cacheLifetime is how long resp may be cached, zero if it mustn't be.
+func cacheLifetime(resp *http.Response) time.Duration {
+	cc := directives(resp.Header, "Cache-Control")
+	for _, k := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[k]; ok {
+			return 0
+		}
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return 0
+	}
+	for _, k := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[k]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return *cacheTTL
+}
+
+// staleWindow is how long past its lifetime resp may be served while it's
+// revalidated: its stale-while-revalidate, or --cache_stale_while_revalidate,
+// unless it must be revalidated first.
+func staleWindow(resp *http.Response) time.Duration {
+	cc := directives(resp.Header, "Cache-Control")
+	for _, k := range []string{"must-revalidate", "proxy-revalidate"} {
+		if _, ok := cc[k]; ok {
+			return 0
+		}
+	}
+	if v, ok := cc["stale-while-revalidate"]; ok {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	return *cacheStaleTTL
+}
+
+func (c *cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	bypass, store := cacheBypass(req)
+	if bypass {
+		cacheBypasses.Add(1)
+		addServerTiming(req.Context(), "cache", 0, "bypass")
+		// A fresh copy for a HEAD is only headers, which can't replace a
+		// cached body.
+		if !store || req.Method == http.MethodHead {
+			return c.RoundTripper.RoundTrip(req)
+		}
+	}
+	key := cacheKey(req)
+	now := time.Now()
+	if bypass {
+		return c.fetch(req, key, now)
+	}
+	if resp := c.cached(req, key, now); resp != nil {
+		cacheHits.Add(1)
+		return resp, nil
+	}
+	cacheMisses.Add(1)
+	addServerTiming(req.Context(), "cache", 0, "miss")
+	if req.Header.Get("Range") != "" {
+		// Only the range is fetched, as a seek in a video that wouldn't fit
+		// in the cache should be; the next whole request fills it.
+		return c.RoundTripper.RoundTrip(req)
+	}
+
+	// A page everyone wants at once, like the front page when a post goes
+	// out, is fetched for the first of them and answered from the cache for
+	// the rest.
+	c.mu.Lock()
+	done, ok := c.fetching[key]
+	if !ok {
+		done = make(chan struct{})
+		c.fetching[key] = done
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.fetching, key)
+			c.mu.Unlock()
+			close(done)
+		}()
+		return c.fetch(req, key, now)
+	}
+	c.mu.Unlock()
+	select {
+	case <-done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	now = time.Now()
+	if resp := c.cached(req, key, now); resp != nil {
+		cacheCoalesced.Add(1)
+		return resp, nil
+	}
+	// It couldn't be cached, or the fetch failed, so there's nothing to share.
+	return c.fetch(req, key, now)
+}
+
+// cached answers req from the cache, if it can, revalidating what it answers
+// with if it's expired.
+func (c *cache) cached(req *http.Request, key string, now time.Time) *http.Response {
+	e, revalidate := c.get(key, req.Method == http.MethodHead, now)
+	if e == nil {
+		return nil
+	}
+	status := "hit"
+	if e.expires.Before(now) {
+		cacheStaleHits.Add(1)
+		status = "stale"
+	}
+	addServerTiming(req.Context(), "cache", 0, status)
+	if revalidate {
+		go c.revalidate(req, e)
+	}
+	return e.response(req, now)
+}
+
+// revalidate fetches e again for req, without holding up req's response.
+func (c *cache) revalidate(req *http.Request, e *cacheEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	r := req.Clone(ctx)
+	if !e.headOnly {
+		// Whatever asked for it, the body is needed to replace it.
+		r.Method = http.MethodGet
+	}
+	resp, err := c.fetch(r, e.key, time.Now())
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			err = errors.New(resp.Status)
+		}
+	}
+	if err != nil {
+		cacheRevalidationErrors.Add(1)
+		log.V(1).Infof("Error revalidating %s: %v", e.url, err)
+	}
+	// The entry's been replaced if it worked; if not, a later hit can try again.
+	c.mu.Lock()
+	e.revalidating = false
+	c.mu.Unlock()
+}
+
+// fetch gets req from the backend and caches the response under key if it
+// can. An expired entry still under key is revalidated rather than fetched
+// again, so an unchanged object costs the backend a 304.
+func (c *cache) fetch(req *http.Request, key string, now time.Time) (*http.Response, error) {
+	// Fetch the whole object whatever the client's conditionals say, so what's
+	// cached can answer everyone; the conditionals are applied to it after.
+	// A HEAD stays a HEAD, which the backends answer from the object's
+	// metadata: monitoring and link checkers send plenty, and needn't cost a
+	// download.
+	freq := req.Clone(req.Context())
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "Range", "If-Range"} {
+		freq.Header.Del(h)
+	}
+	old := c.validatable(key, req.Method == http.MethodHead)
+	if old != nil {
+		if etag := old.header.Get("ETag"); etag != "" {
+			freq.Header.Set("If-None-Match", etag)
+		}
+		if lm := old.header.Get("Last-Modified"); lm != "" {
+			freq.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	resp, err := c.RoundTripper.RoundTrip(freq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && old != nil {
+		resp.Body.Close()
+		cacheNotModified.Add(1)
+		c.mu.Lock()
+		e := old.refreshed(resp.Header, now)
+		c.mu.Unlock()
+		if e.expires.After(now) {
+			c.put(e)
+		}
+		return e.response(req, now), nil
+	}
+	ttl := cacheLifetime(resp)
+	if !cacheStatuses[resp.StatusCode] || ttl <= 0 {
+		return c.passthrough(req, resp), nil
+	}
+	if req.Method == http.MethodHead {
+		resp.Body.Close()
+		e := &cacheEntry{
+			key:      key,
+			url:      req.URL.String(),
+			host:     req.Header.Get("X-Original-Host"),
+			gzip:     acceptsEncoding(req, "gzip"),
+			status:   resp.StatusCode,
+			header:   resp.Header,
+			stored:   now,
+			expires:  now.Add(ttl),
+			headOnly: true,
+			length:   resp.ContentLength,
+		}
+		e.staleUntil = e.expires.Add(staleWindow(resp))
+		c.put(e)
+		return e.response(req, now), nil
+	}
+	if resp.ContentLength > *cacheMaxObject {
+		return c.passthrough(req, resp), nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, *cacheMaxObject+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > *cacheMaxObject {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return c.passthrough(req, resp), nil
+	}
+	resp.Body.Close()
+
+	e := &cacheEntry{
+		key:     key,
+		url:     req.URL.String(),
+		host:    req.Header.Get("X-Original-Host"),
+		gzip:    acceptsEncoding(req, "gzip"),
+		status:  resp.StatusCode,
+		header:  resp.Header,
+		body:    body,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	e.staleUntil = e.expires.Add(staleWindow(resp))
+	c.put(e)
+	go c.precompress(e)
+	return e.response(req, now), nil
+}
+
+// validatable returns the entry under key if it's one an unchanged object
+// could renew: a 200 with an ETag or Last-Modified to send, and a body if head
+// isn't set.
+func (c *cache) validatable(key string, head bool) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if e.status != http.StatusOK || (e.headOnly && !head) || (e.header.Get("ETag") == "" && e.header.Get("Last-Modified") == "") {
+		return nil
+	}
+	return e
+}
+
+// refreshed is a copy of e renewed by a 304 with header, which updates what it
+// carries, as RFC 9111 says, apart from what describes the body. c.mu must be
+// held.
+func (e *cacheEntry) refreshed(header http.Header, now time.Time) *cacheEntry {
+	r := *e
+	r.header = e.header.Clone()
+	for k, vs := range header {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding":
+			continue
+		}
+		r.header[k] = vs
+	}
+	r.stored = now
+	r.revalidating = false
+	resp := &http.Response{Header: r.header}
+	r.expires = now.Add(cacheLifetime(resp))
+	r.staleUntil = r.expires.Add(staleWindow(resp))
+	return &r
+}
+
+// passthrough returns an uncacheable response for req, which might have been
+// made as a GET for a HEAD request.
+func (c *cache) passthrough(req *http.Request, resp *http.Response) *http.Response {
+	resp.Request = req
+	if req.Method == http.MethodHead {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+	}
+	return resp
+}
+
+// response makes a response to req from e, answering its conditionals and
+// Range.
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	resp := &http.Response{
+		StatusCode:    e.status,
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          http.NoBody,
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+	if e.headOnly {
+		resp.ContentLength = e.length
+	}
+	resp.Header.Set("Age", strconv.Itoa(int(now.Sub(e.stored)/time.Second)))
+	body := e.body
+	if e.status == http.StatusOK {
+		etag := e.header.Get("ETag")
+		lm, _ := http.ParseTime(e.header.Get("Last-Modified"))
+		if notModified(req, etag, lm) {
+			resp.StatusCode = http.StatusNotModified
+			resp.Status = "304 Not Modified"
+			resp.ContentLength = 0
+			resp.Header.Del("Content-Length")
+			return resp
+		}
+		if r, size := req.Header.Get("Range"), resp.ContentLength; r != "" && size >= 0 && ifRangeMatches(req, etag, lm) {
+			offset, n, code := parseRange(r, size)
+			switch code {
+			case http.StatusRequestedRangeNotSatisfiable:
+				resp = errorResponse(req, code, "Requested range not satisfiable.")
+				resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				return resp
+			case http.StatusPartialContent:
+				resp.StatusCode = code
+				resp.Status = "206 Partial Content"
+				resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size))
+				resp.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+				resp.ContentLength = n
+				if !e.headOnly {
+					body = body[offset : offset+n]
+				}
+			}
+		}
+	}
+	if req.Method != http.MethodHead {
+		if resp.StatusCode == http.StatusPartialContent {
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		} else {
+			resp.Body = &cachedBody{bytes.NewReader(body), e}
+		}
+	}
+	return resp
+}
+
+// cachedBody is the body of a whole entry's response, by which
+// compressForClient knows it can send the entry's precompressed copy instead.
+type cachedBody struct {
+	*bytes.Reader
+	e *cacheEntry
+}
+
+func (*cachedBody) Close() error { return nil }
+
+// get returns the entry for key, if there's one that can still be served to
+// a GET, or a HEAD if head is set. revalidate is set if it's expired and the
+// caller should fetch it again.
+func (c *cache) get(key string, head bool, now time.Time) (e *cacheEntry, revalidate bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e = el.Value.(*cacheEntry)
+	if now.After(e.staleUntil) {
+		// It stays until it's evicted or replaced, for fetch to revalidate.
+		return nil, false
+	}
+	if e.headOnly && !head {
+		// The GET's response replaces it.
+		return nil, false
+	}
+	if now.After(e.expires) && !e.revalidating {
+		e.revalidating, revalidate = true, true
+	}
+	c.lru.MoveToFront(el)
+	e.hits++
+	return e, revalidate
+}
+
+func (c *cache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	n := e.size()
+	if n > *cacheSize {
+		return
+	}
+	for c.size+n > *cacheSize {
+		c.remove(c.lru.Back())
+		cacheEvictions.Add(1)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += n
+	cacheBytes.Set(c.size)
+}
+
+// remove drops el. c.mu must be held.
+func (c *cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+	cacheBytes.Set(c.size)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControlRule is one entry of the caching policy: it sets the caching
+// headers of successful responses it matches, whatever the object's own
+// metadata says. Match is a path pattern, in which ** matches anything and *
+// anything but /; a pattern without a leading / matches the last path segment,
+// so *.html covers every page. Directory URLs match as their index document,
+// e.g. /blog/ as /blog/index.html. ContentType matches the media type or, ending
+// in /, its top level type, e.g. image/. Hashed restricts the rule to
+// fingerprinted file names, like Hugo's main.min.3f2a1b9c….css. Host is
+// optional, and a rule needs at least one of Match, ContentType and Hashed.
+//
+// Value replaces Cache-Control and Expires follows its max-age, so HTTP/1.0
+// caches agree. SurrogateControl sets Surrogate-Control for a CDN in front.
+type CacheControlRule struct {
+	Host             string `yaml:"host" toml:"host"`
+	Match            string `yaml:"match" toml:"match"`
+	ContentType      string `yaml:"content_type" toml:"content_type"`
+	Hashed           bool   `yaml:"hashed" toml:"hashed"`
+	Value            string `yaml:"value" toml:"value"`
+	SurrogateControl string `yaml:"surrogate_control" toml:"surrogate_control"`
+
+	re *regexp.Regexp
+}
+
+// hashedName matches a file name with a content hash of 8 or more hex digits
+// before its extension, as asset pipelines fingerprint them.
+var hashedName = regexp.MustCompile(`[.\-_][0-9a-fA-F]{8,}\.[^/]+$`)
+
+// compileGlob turns a Match pattern into a regexp.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	if !strings.HasPrefix(pattern, "/") {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// compileCacheControlRules checks and compiles the config's rules.
+func (c *Config) compileCacheControlRules() error {
+	for i := range c.CacheControl {
+		r := &c.CacheControl[i]
+		name := r.Match
+		if name == "" {
+			name = r.ContentType
+		}
+		if r.Value == "" && r.SurrogateControl == "" {
+			return fmt.Errorf("cache_control rule %d (%q) needs a value or surrogate_control", i+1, name)
+		}
+		if r.Match == "" && r.ContentType == "" && !r.Hashed {
+			return fmt.Errorf("cache_control rule %d needs a match, content_type or hashed", i+1)
+		}
+		if r.Match == "" {
+			continue
+		}
+		re, err := compileGlob(r.Match)
+		if err != nil {
+			return fmt.Errorf("cache_control rule %q: %v", r.Match, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// matches reports whether the rule covers a response for p, the path with any
+// directory index filled in, of mediaType.
+func (r *CacheControlRule) matches(host, p, mediaType string) bool {
+	if !hostMatches(r.Host, host) || (r.re != nil && !r.re.MatchString(p)) || (r.Hashed && !hashedName.MatchString(path.Base(p))) {
+		return false
+	}
+	return mediaTypeMatches(r.ContentType, mediaType)
+}
+
+// mediaTypeMatches reports whether mediaType is ct or, if ct ends in /, of that
+// top level type. An empty ct matches anything.
+func mediaTypeMatches(ct, mediaType string) bool {
+	ct = strings.ToLower(ct)
+	switch {
+	case ct == "":
+		return true
+	case strings.HasSuffix(ct, "/"):
+		return strings.HasPrefix(mediaType, ct)
+	}
+	return mediaType == ct
+}
+
+// responseMediaType is the media type of a response for p with headers h. A
+// 304 needn't carry a Content-Type, so it goes by the extension then.
+func responseMediaType(h http.Header, p string) string {
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if mediaType == "" {
+		mediaType, _, _ = mime.ParseMediaType(mime.TypeByExtension(path.Ext(p)))
+	}
+	return mediaType
+}
+
+// applyCachePolicy sets h's caching headers from the first rule matching a
+// response for p on host. It's shared by everything that answers with site
+// content, so the bucket, the cache and the snapshots all agree.
+func applyCachePolicy(h http.Header, host, p string) {
+	if len(config.CacheControl) == 0 {
+		return
+	}
+	if strings.HasSuffix(p, "/") {
+		p = path.Join(p, indexFilesFor(host)[0])
+	}
+	mediaType := responseMediaType(h, p)
+	for i := range config.CacheControl {
+		r := &config.CacheControl[i]
+		if !r.matches(host, p, mediaType) {
+			continue
+		}
+		if r.Value != "" {
+			h.Set("Cache-Control", r.Value)
+			h.Del("Expires")
+			if age, err := strconv.Atoi(directives(h, "Cache-Control")["max-age"]); err == nil {
+				h.Set("Expires", time.Now().Add(time.Duration(age)*time.Second).UTC().Format(http.TimeFormat))
+			}
+		}
+		if r.SurrogateControl != "" {
+			h.Set("Surrogate-Control", r.SurrogateControl)
+		}
+		return
+	}
+}
+
+// responsePath is the path the client asked for, without the host's bucket
+// prefix.
+func responsePath(resp *http.Response) string {
+	p, _ := clientPath(resp.Request.Header.Get("X-Original-Host"), resp.Request.URL.Path)
+	return p
+}
+
+// applyCacheControlRules applies the caching policy to a response. Errors and
+// redirects keep what they have, so a rule for a path that's gone doesn't make
+// its 404 stick.
+func applyCacheControlRules(resp *http.Response) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusPartialContent, http.StatusNotModified:
+	default:
+		return
+	}
+	applyCachePolicy(resp.Header, resp.Request.Header.Get("X-Original-Host"), responsePath(resp))
+}
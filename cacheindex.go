@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	cacheIndexFile     = flag.String("cache_index_file", "", "file to save the --cache_size cache's index in on shutdown and every --cache_index_interval, so a restart can warm the cache up again (disabled if empty)")
+	cacheIndexInterval = flag.Duration("cache_index_interval", 5*time.Minute, "how often to save --cache_index_file, in case we don't get to at shutdown")
+	cacheWarmers       = flag.Int("cache_warmers", 4, "upstream fetches to warm the cache with at once after a restart")
+)
+
+// cacheIndexVersion is bumped whenever the meaning of a saved index changes, so
+// an old one is ignored rather than misread.
+const cacheIndexVersion = 1
+
+// cacheIndex is the saved --cache_index_file. Entries are most recently used
+// first.
+type cacheIndex struct {
+	Version int               `json:"version"`
+	Saved   time.Time         `json:"saved"`
+	Entries []cacheIndexEntry `json:"entries"`
+}
+
+type cacheIndexEntry struct {
+	Key        string `json:"key"`
+	URL        string `json:"url"`
+	Host       string `json:"host"`
+	Gzip       bool   `json:"gzip"`
+	Generation string `json:"generation,omitempty"`
+	Size       int64  `json:"size"`
+}
+
+// index lists what's in the cache, most recently used first.
+func (c *cache) index(now time.Time) *cacheIndex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx := &cacheIndex{Version: cacheIndexVersion, Saved: now}
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		if e.headOnly {
+			// Warming fetches a body, which nobody asked for.
+			continue
+		}
+		idx.Entries = append(idx.Entries, cacheIndexEntry{
+			Key:        e.key,
+			URL:        e.url,
+			Host:       e.host,
+			Gzip:       e.gzip,
+			Generation: e.header.Get("X-Goog-Generation"),
+			Size:       e.size(),
+		})
+	}
+	return idx
+}
+
+func (c *cache) saveIndex(name string) error {
+	b, err := json.Marshal(c.index(time.Now()))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, b)
+}
+
+func loadCacheIndex(name string) (*cacheIndex, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	idx := &cacheIndex{}
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// warmRequest rebuilds the request that filled e, or returns nil if it's not
+// one we'd make any more: the bucket isn't one of buckets, or the key doesn't
+// come out the same.
+func warmRequest(ctx context.Context, e cacheIndexEntry, buckets map[string]bool) *http.Request {
+	u, err := url.Parse(e.URL)
+	if err != nil || !buckets[u.Host] {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.URL, nil)
+	if err != nil {
+		return nil
+	}
+	req.Host = u.Host
+	req.Header.Set("X-Original-Host", e.Host)
+	req.Header.Set("Accept-Encoding", "identity")
+	if e.Gzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if cacheKey(req) != e.Key {
+		return nil
+	}
+	return req
+}
+
+// warm fetches the entries of idx back into c, most recently used first, until
+// they'd fill it. Changed objects are simply fetched as they are now.
+func (c *cache) warm(idx *cacheIndex, buckets map[string]bool) {
+	start := time.Now()
+	entries := make(chan cacheIndexEntry)
+	var mu sync.Mutex
+	var warmed, changed, skipped int
+	var wg sync.WaitGroup
+	for i := 0; i < *cacheWarmers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				req := warmRequest(ctx, e, buckets)
+				ok, gen := false, ""
+				if req != nil {
+					if resp, err := c.RoundTrip(req); err != nil {
+						log.V(1).Infof("Error warming cache with %s: %v", e.URL, err)
+					} else {
+						io.Copy(ioutil.Discard, resp.Body)
+						resp.Body.Close()
+						ok, gen = true, resp.Header.Get("X-Goog-Generation")
+					}
+				}
+				cancel()
+				mu.Lock()
+				switch {
+				case !ok:
+					skipped++
+				case gen != e.Generation:
+					changed++
+					warmed++
+				default:
+					warmed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	var size int64
+	for _, e := range idx.Entries {
+		if size += e.Size; size > *cacheSize {
+			break
+		}
+		entries <- e
+	}
+	close(entries)
+	wg.Wait()
+	log.Infof("Warmed the cache with %d of the %d entries saved %s (%d changed since, %d skipped) in %s", warmed, len(idx.Entries), idx.Saved.Format(time.RFC3339), changed, skipped, time.Since(start))
+}
+
+// startCacheIndex warms rt, if it's a cache, from --cache_index_file and keeps
+// the file up to date until we exit. buckets are the buckets we serve from;
+// saved entries for any other are dropped.
+func startCacheIndex(rt http.RoundTripper, buckets []*url.URL) {
+	c, ok := rt.(*cache)
+	if !ok || *cacheIndexFile == "" {
+		return
+	}
+	known := map[string]bool{}
+	for _, u := range buckets {
+		known[u.Host] = true
+	}
+	if idx, err := loadCacheIndex(*cacheIndexFile); err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Not warming the cache from %s: %v", *cacheIndexFile, err)
+		}
+	} else if idx.Version != cacheIndexVersion {
+		log.Warningf("Not warming the cache from %s: it's version %d, not %d", *cacheIndexFile, idx.Version, cacheIndexVersion)
+	} else {
+		go c.warm(idx, known)
+	}
+
+	save := func() {
+		if err := c.saveIndex(*cacheIndexFile); err != nil {
+			log.Errorf("Error saving the cache index to %s: %v", *cacheIndexFile, err)
+		}
+	}
+	go func() {
+		for range time.Tick(*cacheIndexInterval) {
+			save()
+		}
+	}()
+	onShutdown(func(context.Context) {
+		log.Info("Saving the cache index")
+		save()
+	})
+}
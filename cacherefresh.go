@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	cacheRefreshes     = expvar.NewInt("cache_refreshes")
+	cacheRefreshErrors = expvar.NewInt("cache_refresh_errors")
+)
+
+// RefreshRule keeps the cached pages matching Match, a cache_control style
+// pattern, warm and fresh by revalidating them Every so often (e.g. 1m),
+// whether or not anyone asks for them. A directory matches along with its
+// index document, so the front page is just /. Host is optional.
+//
+//	refresh:
+//	  - match: /
+//	    every: 1m
+//	  - match: /posts/*/
+//	    every: 10m
+type RefreshRule struct {
+	Host  string `yaml:"host" toml:"host"`
+	Match string `yaml:"match" toml:"match"`
+	Every string `yaml:"every" toml:"every"`
+
+	re    *regexp.Regexp
+	every time.Duration
+}
+
+// compileRefresh checks and compiles the config's refresh rules.
+func (c *Config) compileRefresh() error {
+	for i := range c.Refresh {
+		r := &c.Refresh[i]
+		re, err := compileGlob(r.Match)
+		if err != nil {
+			return fmt.Errorf("refresh %q: %v", r.Match, err)
+		}
+		r.re = re
+		if r.every, err = time.ParseDuration(r.Every); err != nil || r.every < time.Second {
+			return fmt.Errorf("refresh %q needs every to be a duration of at least 1s, like 1m", r.Match)
+		}
+	}
+	return nil
+}
+
+// matches reports whether e is one of the pages r keeps fresh.
+func (r *RefreshRule) matches(e *cacheEntry) bool {
+	if e.headOnly || !hostMatches(r.Host, e.host) {
+		return false
+	}
+	p := entryPath(e)
+	if r.re.MatchString(p) {
+		return true
+	}
+	for _, name := range indexFilesFor(e.host) {
+		if strings.HasSuffix(p, "/"+name) && r.re.MatchString(strings.TrimSuffix(p, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshing returns the entries r keeps fresh.
+func (c *cache) refreshing(r *RefreshRule) []*cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []*cacheEntry
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*cacheEntry); r.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// revalidateNow fetches e again, fresh or not. An unchanged object only costs
+// the backend a 304.
+func (c *cache) revalidateNow(e *cacheEntry) error {
+	u, err := url.Parse(e.url)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req := warmRequest(ctx, cacheIndexEntry{Key: e.key, URL: e.url, Host: e.host, Gzip: e.gzip}, map[string]bool{u.Host: true})
+	if req == nil {
+		return nil
+	}
+	resp, err := c.fetch(req, e.key, time.Now())
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// startCacheRefresh revalidates the pages the config's refresh rules cover in
+// rt, which has to be a cache, on their schedules until we exit. Pages only
+// start being kept fresh once a request has put them in the cache.
+func startCacheRefresh(rt http.RoundTripper) {
+	if len(config.Refresh) == 0 {
+		return
+	}
+	c, ok := rt.(*cache)
+	if !ok {
+		log.Exit("The config's refresh rules need the --cache_size cache")
+	}
+	for i := range config.Refresh {
+		r := &config.Refresh[i]
+		log.Infof("Refreshing cached %s%s every %s", r.Host, r.Match, r.every)
+		go func() {
+			for range time.Tick(r.every) {
+				for _, e := range c.refreshing(r) {
+					cacheRefreshes.Add(1)
+					if err := c.revalidateNow(e); err != nil {
+						cacheRefreshErrors.Add(1)
+						log.V(1).Infof("Error refreshing %s in the cache: %v", e.url, err)
+					}
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/storage"
+	log "github.com/golang/glog"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	smpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	certCacheKind         = flag.String("cert_cache", "datastore", "where autocert keeps certificates and keys: datastore (Cloud Datastore in --datastore_project), gcs (--cert_cache_bucket) or secretmanager (Secret Manager in --gcp_project)")
+	certCacheBucket       = flag.String("cert_cache_bucket", "", "bucket, with an optional /prefix, for --cert_cache=gcs, e.g. gs://example-certs/hugoproxy; keep it private, it holds the keys")
+	certCacheSecretPrefix = flag.String("cert_cache_secret_prefix", "hugoproxy-autocert-", "prefix of the secret IDs --cert_cache=secretmanager creates, one secret per cache entry with a version per change")
+	datastoreEmulator     = flag.String("datastore_emulator", "", "host:port of a Cloud Datastore emulator (gcloud beta emulators datastore start) for --cert_cache=datastore to use instead of Cloud Datastore, for local runs; the same as setting DATASTORE_EMULATOR_HOST")
+)
+
+// emulatorProject is the Datastore project used with the emulator when nothing
+// names one. The emulator takes any project.
+const emulatorProject = "hugoproxy-local"
+
+// putAttempts is how many times GCSCache.Put retries when another writer beats
+// it to an object.
+const putAttempts = 5
+
+// GCSCache implements autocert.Cache against a GCS bucket. Every write is
+// conditional on the generation it read, so instances sharing the bucket can't
+// clobber one another's writes unseen.
+type GCSCache struct {
+	B      *storage.BucketHandle
+	Prefix string
+}
+
+func (g *GCSCache) object(name string) *storage.ObjectHandle {
+	return g.B.Object(path.Join(g.Prefix, name))
+}
+
+// Get reads the certificate data with the provided name from the bucket.
+func (g *GCSCache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, _, err := g.read(ctx, name)
+	if err == storage.ErrObjectNotExist {
+		log.Infof("gcs cache miss for certificate: %s", name)
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		log.Errorf("Error fetching cached cert with name %s from gcs: %v", name, err)
+		return nil, err
+	}
+	log.V(2).Infof("Cache hit for certificate with name: %s", name)
+	return data, nil
+}
+
+// read returns the object for name and its generation.
+func (g *GCSCache) read(ctx context.Context, name string) ([]byte, int64, error) {
+	r, err := g.object(name).NewReader(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	return data, r.Attrs.Generation, err
+}
+
+// Put writes the certificate data for the specified name to the bucket.
+func (g *GCSCache) Put(ctx context.Context, name string, data []byte) error {
+	var err error
+	for i := 0; i < putAttempts; i++ {
+		var stored bool
+		if stored, err = g.put(ctx, name, data); err == nil {
+			log.V(2).Infof("Successfully stored certificate with name %s in gcs", name)
+			if stored {
+				publish(CertificateStored{Time: time.Now(), Name: name})
+			}
+			return nil
+		}
+		var gerr *googleapi.Error
+		if !errors.As(err, &gerr) || gerr.Code != http.StatusPreconditionFailed {
+			break
+		}
+		log.V(1).Infof("Certificate %s changed under us, retrying", name)
+	}
+	log.Errorf("Error storing certificate with name %s in gcs: %v", name, err)
+	return err
+}
+
+// put writes data unless the object already holds it, on the condition that
+// nobody has written it since we looked.
+func (g *GCSCache) put(ctx context.Context, name string, data []byte) (bool, error) {
+	current, gen, err := g.read(ctx, name)
+	cond := storage.Conditions{GenerationMatch: gen}
+	switch {
+	case err == storage.ErrObjectNotExist:
+		cond = storage.Conditions{DoesNotExist: true}
+	case err != nil:
+		return false, err
+	case bytes.Equal(current, data):
+		// Don't update if the current value is what we're storing.
+		return false, nil
+	}
+	w := g.object(name).If(cond).NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	w.CacheControl = "no-store"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return false, err
+	}
+	return true, w.Close()
+}
+
+// Delete removes the entry with name from the bucket.
+func (g *GCSCache) Delete(ctx context.Context, name string) error {
+	if err := g.object(name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	return nil
+}
+
+// SMCache implements autocert.Cache against GCP Secret Manager. Each entry is a
+// secret whose latest version is the current value, so earlier certificates
+// and keys stay in its version history.
+type SMCache struct {
+	C       *secretmanager.Client
+	Project string
+	Prefix  string
+}
+
+// secretID turns an autocert cache key into a secret ID, which can only hold
+// letters, digits, - and _. Anything else, and _ itself, becomes _ and its hex
+// code, so "example.com+rsa" is "example_2ecom_2brsa".
+func (s *SMCache) secretID(name string) string {
+	var b strings.Builder
+	b.WriteString(s.Prefix)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *SMCache) secretName(name string) string {
+	return fmt.Sprintf("projects/%s/secrets/%s", s.Project, s.secretID(name))
+}
+
+// Get reads the latest version of the secret for name.
+func (s *SMCache) Get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.C.AccessSecretVersion(ctx, &smpb.AccessSecretVersionRequest{Name: s.secretName(name) + "/versions/latest"})
+	if status.Code(err) == codes.NotFound {
+		log.Infof("secret manager cache miss for certificate: %s", name)
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		log.Errorf("Error fetching cached cert with name %s from secret manager: %v", name, err)
+		return nil, err
+	}
+	log.V(2).Infof("Cache hit for certificate with name: %s", name)
+	return resp.GetPayload().GetData(), nil
+}
+
+// Put adds data as a new version of the secret for name, creating the secret
+// the first time.
+func (s *SMCache) Put(ctx context.Context, name string, data []byte) error {
+	current, err := s.Get(ctx, name)
+	switch {
+	case err == autocert.ErrCacheMiss:
+		_, err = s.C.CreateSecret(ctx, &smpb.CreateSecretRequest{
+			Parent:   "projects/" + s.Project,
+			SecretId: s.secretID(name),
+			Secret: &smpb.Secret{
+				Replication: &smpb.Replication{Replication: &smpb.Replication_Automatic_{Automatic: &smpb.Replication_Automatic{}}},
+				Labels:      map[string]string{"hugoproxy": "autocert"},
+			},
+		})
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			log.Errorf("Error creating secret for certificate with name %s: %v", name, err)
+			return err
+		}
+	case err != nil:
+		return err
+	case bytes.Equal(current, data):
+		// Don't add a version if the current value is what we're storing.
+		return nil
+	}
+	if _, err := s.C.AddSecretVersion(ctx, &smpb.AddSecretVersionRequest{
+		Parent:  s.secretName(name),
+		Payload: &smpb.SecretPayload{Data: data},
+	}); err != nil {
+		log.Errorf("Error storing certificate with name %s in secret manager: %v", name, err)
+		return err
+	}
+	log.V(2).Infof("Successfully stored certificate with name %s in secret manager", name)
+	publish(CertificateStored{Time: time.Now(), Name: name})
+	return nil
+}
+
+// Delete removes the secret for name, with all its versions.
+func (s *SMCache) Delete(ctx context.Context, name string) error {
+	err := s.C.DeleteSecret(ctx, &smpb.DeleteSecretRequest{Name: s.secretName(name)})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	return err
+}
+
+// newDatastoreClient connects to Cloud Datastore in --datastore_project, or to
+// the emulator if --datastore_emulator or DATASTORE_EMULATOR_HOST is set, and
+// returns the client and its project.
+func newDatastoreClient(ctx context.Context, opts []option.ClientOption) (*datastore.Client, string) {
+	if *datastoreEmulator != "" {
+		os.Setenv("DATASTORE_EMULATOR_HOST", *datastoreEmulator)
+	}
+	if emu := os.Getenv("DATASTORE_EMULATOR_HOST"); emu != "" {
+		dsProject := firstNonEmpty(*datastoreProject, *project, os.Getenv("DATASTORE_PROJECT_ID"), emulatorProject)
+		// The emulator takes no credentials, and the client refuses any we pass.
+		dsClient, err := datastore.NewClient(ctx, dsProject)
+		if err != nil {
+			log.Exitf("datastore.NewClient(%q) with the emulator at %s: %v", dsProject, emu, err)
+		}
+		log.Warningf("Using the Datastore emulator at %s, project %q: certificates are only kept as long as it is", emu, dsProject)
+		return dsClient, dsProject
+	}
+
+	if *project == "" && *datastoreProject == "" {
+		p, err := projectID(ctx)
+		if err != nil {
+			log.Exitf("projectID: %v", err)
+		}
+		*project = p
+	}
+	dsProject := *datastoreProject
+	if dsProject == "" {
+		dsProject = *project
+	}
+	dsClient, err := datastore.NewClient(ctx, dsProject, opts...)
+	if err != nil {
+		log.Exitf("datastore.NewClient(%q): %v", dsProject, err)
+	}
+	log.Infof("Connected to datastore %q", dsProject)
+	return dsClient, dsProject
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// newCertCache returns the --cert_cache autocert uses, and a readiness check for it.
+func newCertCache(ctx context.Context, opts []option.ClientOption) (autocert.Cache, readinessCheck) {
+	switch *certCacheKind {
+	case "datastore":
+		dsClient, dsProject := newDatastoreClient(ctx, opts)
+		cache := &DSCache{dsClient}
+		checkCache := checkCertCache(cache)
+		return cache, func(ctx context.Context) error {
+			return explainPermissionDenied(checkCache(ctx), "Cloud Datastore", dsProject)
+		}
+	case "gcs":
+		bucket := strings.TrimPrefix(*certCacheBucket, "gs://")
+		prefix := ""
+		if i := strings.Index(bucket, "/"); i >= 0 {
+			bucket, prefix = bucket[:i], strings.Trim(bucket[i+1:], "/")
+		}
+		if bucket == "" {
+			log.Exitf("--cert_cache=gcs needs --cert_cache_bucket")
+		}
+		c, err := storage.NewClient(ctx, opts...)
+		if err != nil {
+			log.Exitf("storage.NewClient: %v", err)
+		}
+		log.Infof("Caching certificates in gs://%s/%s", bucket, prefix)
+
+		cache := &GCSCache{B: c.Bucket(bucket), Prefix: prefix}
+		checkCache := checkCertCache(cache)
+		return cache, func(ctx context.Context) error {
+			err := checkCache(ctx)
+			var gerr *googleapi.Error
+			if errors.As(err, &gerr) && gerr.Code == http.StatusForbidden {
+				who := "our credentials"
+				if *impersonateServiceAccount != "" {
+					who = *impersonateServiceAccount
+				}
+				return fmt.Errorf("gs://%s: %v: %s need roles/storage.objectAdmin on the bucket", bucket, err, who)
+			}
+			return err
+		}
+	case "secretmanager":
+		if *project == "" {
+			p, err := projectID(ctx)
+			if err != nil {
+				log.Exitf("projectID: %v", err)
+			}
+			*project = p
+		}
+		c, err := secretmanager.NewClient(ctx, opts...)
+		if err != nil {
+			log.Exitf("secretmanager.NewClient: %v", err)
+		}
+		log.Infof("Caching certificates in Secret Manager in %q", *project)
+
+		cache := &SMCache{C: c, Project: *project, Prefix: *certCacheSecretPrefix}
+		checkCache := checkCertCache(cache)
+		smProject := *project
+		return cache, func(ctx context.Context) error {
+			return explainPermissionDenied(checkCache(ctx), "Secret Manager", smProject)
+		}
+	}
+	log.Exitf("Unknown --cert_cache %q, want datastore, gcs or secretmanager", *certCacheKind)
+	return nil, nil
+}
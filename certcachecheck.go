@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCacheCheckWriters is how many concurrent Puts the check races.
+const certCacheCheckWriters = 8
+
+// certCacheCheck is one step of "hugoproxy check-cert-cache".
+type certCacheCheck struct {
+	name string
+	run  func(ctx context.Context, c autocert.Cache, key string) error
+}
+
+// wantCached checks that c holds want under key.
+func wantCached(ctx context.Context, c autocert.Cache, key string, want []byte) error {
+	got, err := c.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("Get: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("Get returned %q, want %q", got, want)
+	}
+	return nil
+}
+
+// wantMiss checks that c has nothing under key.
+func wantMiss(ctx context.Context, c autocert.Cache, key string) error {
+	if got, err := c.Get(ctx, key); err != autocert.ErrCacheMiss {
+		return fmt.Errorf("Get returned %q, %v; want autocert.ErrCacheMiss", got, err)
+	}
+	return nil
+}
+
+var certCacheChecks = []certCacheCheck{
+	{"missing entry is a cache miss", func(ctx context.Context, c autocert.Cache, key string) error {
+		return wantMiss(ctx, c, key)
+	}},
+	{"put then get", func(ctx context.Context, c autocert.Cache, key string) error {
+		if err := c.Put(ctx, key, []byte("first")); err != nil {
+			return fmt.Errorf("Put: %v", err)
+		}
+		return wantCached(ctx, c, key, []byte("first"))
+	}},
+	{"putting the same data again", func(ctx context.Context, c autocert.Cache, key string) error {
+		if err := c.Put(ctx, key, []byte("first")); err != nil {
+			return fmt.Errorf("Put: %v", err)
+		}
+		return wantCached(ctx, c, key, []byte("first"))
+	}},
+	{"overwrite", func(ctx context.Context, c autocert.Cache, key string) error {
+		if err := c.Put(ctx, key, []byte("second")); err != nil {
+			return fmt.Errorf("Put: %v", err)
+		}
+		return wantCached(ctx, c, key, []byte("second"))
+	}},
+	{"entries too big for one Datastore entity", func(ctx context.Context, c autocert.Cache, key string) error {
+		if _, ok := c.(*DSCache); !ok {
+			return nil
+		}
+		big := bytes.Repeat([]byte("0123456789abcdef"), (2*dsChunkSize+100)/16)
+		if err := c.Put(ctx, key, big); err != nil {
+			return fmt.Errorf("Put of %d bytes: %v", len(big), err)
+		}
+		got, err := c.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("Get: %v", err)
+		}
+		if !bytes.Equal(got, big) {
+			return fmt.Errorf("Get returned %d bytes that aren't the %d put", len(got), len(big))
+		}
+		if err := c.Put(ctx, key, []byte("second")); err != nil {
+			return fmt.Errorf("Put: %v", err)
+		}
+		return wantCached(ctx, c, key, []byte("second"))
+	}},
+	{"concurrent puts leave one of them", func(ctx context.Context, c autocert.Cache, key string) error {
+		var wg sync.WaitGroup
+		errs := make([]error, certCacheCheckWriters)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = c.Put(ctx, key, []byte("writer "+strconv.Itoa(i)))
+			}(i)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				return fmt.Errorf("Put by writer %d: %v", i, err)
+			}
+		}
+		got, err := c.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("Get: %v", err)
+		}
+		for i := range errs {
+			if bytes.Equal(got, []byte("writer "+strconv.Itoa(i))) {
+				return nil
+			}
+		}
+		return fmt.Errorf("Get returned %q, not what any writer put", got)
+	}},
+	{"delete", func(ctx context.Context, c autocert.Cache, key string) error {
+		if err := c.Delete(ctx, key); err != nil {
+			return fmt.Errorf("Delete: %v", err)
+		}
+		return wantMiss(ctx, c, key)
+	}},
+	{"deleting a missing entry", func(ctx context.Context, c autocert.Cache, key string) error {
+		if err := c.Delete(ctx, key); err != nil {
+			return fmt.Errorf("Delete: %v", err)
+		}
+		return nil
+	}},
+}
+
+// checkCertCacheCommand implements "hugoproxy check-cert-cache". It puts a
+// scratch entry through the --cert_cache the way autocert would, to try a
+// cache's miss, overwrite and transaction behaviour, say against the Datastore
+// emulator, before trusting certificates to it:
+//
+//	$ gcloud beta emulators datastore start --no-store-on-disk --host-port=localhost:8432 &
+//	$ hugoproxy --datastore_emulator=localhost:8432 check-cert-cache
+func checkCertCacheCommand(args []string) {
+	if len(args) != 0 {
+		log.Exit("usage: hugoproxy [flags] check-cert-cache")
+	}
+	ctx := context.Background()
+	opts, err := clientOptions(ctx)
+	if err != nil {
+		log.Exitf("clientOptions: %v", err)
+	}
+	cache, _ := newCertCache(ctx, opts)
+	key := fmt.Sprintf("hugoproxy-check-%d", time.Now().UnixNano())
+
+	failed := 0
+	for _, check := range certCacheChecks {
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		err := check.run(ctx, cache, key)
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", check.name, err)
+			continue
+		}
+		fmt.Printf("ok   %s\n", check.name)
+	}
+	if failed > 0 {
+		// Don't leave the scratch entry behind.
+		cache.Delete(ctx, key)
+		fmt.Printf("%d of %d checks of --cert_cache=%s failed\n", failed, len(certCacheChecks), *certCacheKind)
+		os.Exit(1)
+	}
+	fmt.Printf("All %d checks of --cert_cache=%s passed\n", len(certCacheChecks), *certCacheKind)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"flag"
+	"fmt"
+
+	log "github.com/golang/glog"
+)
+
+var certKeyType = flag.String("cert_key_type", "auto", "key type of the certificates autocert and --wildcard_domains get: auto gets ECDSA P-256 and RSA ones and picks per client, ecdsa only gets ECDSA, whose handshakes are faster and smaller, and turns away the rare client that can't use it, and rsa only gets RSA")
+
+// certKeyTypes reports which kinds of certificate --cert_key_type wants.
+func certKeyTypes() (withECDSA, withRSA bool) {
+	switch *certKeyType {
+	case "auto":
+		return true, true
+	case "ecdsa":
+		return true, false
+	case "rsa":
+		return false, true
+	}
+	log.Exitf("--cert_key_type must be auto, ecdsa or rsa, not %q", *certKeyType)
+	return false, false
+}
+
+// newCertKey generates a certificate key of the kind asked for.
+func newCertKey(useRSA bool) (crypto.Signer, error) {
+	if useRSA {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// useRSA reports whether to answer hello with an RSA certificate, or errors if
+// --cert_key_type leaves nothing the client can use.
+func useRSA(hello *tls.ClientHelloInfo) (bool, error) {
+	withECDSA, withRSA := certKeyTypes()
+	switch {
+	case !withECDSA:
+		return true, nil
+	case supportsECDSA(hello):
+		return false, nil
+	case withRSA:
+		return true, nil
+	}
+	return false, fmt.Errorf("%s can't use ECDSA certificates, and --cert_key_type=ecdsa", hello.Conn.RemoteAddr())
+}
+
+// withCertKeyType turns away clients that can't use ECDSA before autocert's
+// get would fall back to RSA for them, with --cert_key_type=ecdsa. With rsa
+// autocert's ForceRSA does the job.
+func withCertKeyType(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if *certKeyType != "ecdsa" {
+		return get
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if _, err := useRSA(hello); err != nil {
+			return nil, err
+		}
+		return get(hello)
+	}
+}
+
+// supportsECDSA reports whether hello allows an ECDSA P-256 certificate, the
+// same way autocert decides.
+func supportsECDSA(hello *tls.ClientHelloInfo) bool {
+	if hello.SignatureSchemes != nil && !anyOf(hello.SignatureSchemes, tls.ECDSAWithSHA1, tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512) {
+		return false
+	}
+	if hello.SupportedCurves != nil {
+		ok := false
+		for _, c := range hello.SupportedCurves {
+			ok = ok || c == tls.CurveP256
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, s := range hello.CipherSuites {
+		switch s {
+		case tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+			return true
+		}
+	}
+	return false
+}
+
+func anyOf(schemes []tls.SignatureScheme, want ...tls.SignatureScheme) bool {
+	for _, s := range schemes {
+		for _, w := range want {
+			if s == w {
+				return true
+			}
+		}
+	}
+	return false
+}
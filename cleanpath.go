@@ -0,0 +1,52 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+var pathsRejected = expvar.NewInt("paths_rejected")
+
+// canonicalPath cleans p, which is already unescaped: // collapses, . and ..
+// are resolved without climbing above /, and a trailing slash is kept. It
+// reports false for a path that isn't absolute or holds a NUL or another
+// control character.
+func canonicalPath(p string) (string, bool) {
+	if !strings.HasPrefix(p, "/") {
+		return "", false
+	}
+	for i := 0; i < len(p); i++ {
+		if p[i] < 0x20 || p[i] == 0x7f {
+			return "", false
+		}
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean, true
+}
+
+// withCleanPath canonicalizes request paths before anything routes on them, so
+// no spelling of a path reaches a different object, host prefix or bucket than
+// its clean form. Encoded slashes are decoded for good, as object names can't
+// tell them apart anyway.
+func withCleanPath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := canonicalPath(r.URL.Path)
+		if !ok {
+			pathsRejected.Add(1)
+			log.V(1).Infof("Rejecting request for %q", r.URL.EscapedPath())
+			http.Error(w, "bad request path", http.StatusBadRequest)
+			return
+		}
+		if p != r.URL.Path || r.URL.RawPath != "" {
+			r.URL.Path, r.URL.RawPath = p, ""
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	cleanIndexURLs = flag.Bool("clean_index_urls", true, "redirect requests for /foo/index.html to /foo/ so every page has a single canonical URL")
+	indexFiles     = flags.StringSlice("index_files", []string{indexFile}, "CSV of documents to serve for a directory, in the order they're tried")
+	hostIndexFiles = flags.StringSlice("host_index_files", []string{}, "CSV of host=doc|doc entries overriding --index_files for a host, e.g. old.example.com=index.htm|default.html")
+	prettyURLs     = flag.Bool("pretty_urls", false, "serve /dir from its index document as /dir/ is, rather than having the bucket redirect to /dir/; relative links in such pages resolve against the parent, so only for sites whose links are absolute or root-relative, as Hugo's are by default")
+)
+
+// indexFile is the document GCS serves for a directory.
+const indexFile = "index.html"
+
+var (
+	hostIndexOnce sync.Once
+	hostIndex     map[string][]string
+)
+
+// indexFilesFor returns the directory documents to try for host, in order.
+func indexFilesFor(host string) []string {
+	hostIndexOnce.Do(func() {
+		hostIndex = map[string][]string{}
+		for _, e := range *hostIndexFiles {
+			i := strings.Index(e, "=")
+			if i < 0 {
+				log.Exitf("Bad --host_index_files entry %q, want host=doc|doc", e)
+			}
+			hostIndex[strings.ToLower(e[:i])] = strings.Split(e[i+1:], "|")
+		}
+	})
+	if names, ok := hostIndex[strings.ToLower(host)]; ok {
+		return names
+	}
+	return *indexFiles
+}
+
+// gcsIndexFiles reports whether names is just what GCS's website endpoint
+// serves for a directory by itself.
+func gcsIndexFiles(names []string) bool {
+	return len(names) == 1 && names[0] == indexFile
+}
+
+// cleanIndexPath returns the directory URL for a path naming one of host's index
+// documents, e.g. /foo/ for /foo/index.html.
+func cleanIndexPath(host, p string) (string, bool) {
+	if !*cleanIndexURLs {
+		return p, false
+	}
+	for _, name := range indexFilesFor(host) {
+		if strings.HasSuffix(p, "/"+name) {
+			return strings.TrimSuffix(p, name), true
+		}
+	}
+	return p, false
+}
+
+// withCleanIndexURLs permanently redirects explicit index document requests to
+// the directory URL, keeping the query string.
+func withCleanIndexURLs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		p, ok := cleanIndexPath(r.Host, r.URL.Path)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path = p
+		u.RawPath = ""
+		http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// fetchIndex fetches the first of the host's index documents that exists for a
+// directory request, when they aren't just what GCS serves by itself or
+// --pretty_urls doesn't leave it to GCS. It returns
+// nil if there's nothing to do or none of them exist, leaving the request to GCS.
+// The storage and local backends resolve index documents themselves.
+func (t *transport) fetchIndex(req *http.Request) (*http.Response, error) {
+	names := indexFilesFor(req.Header.Get("X-Original-Host"))
+	if *backend != "http" || (gcsIndexFiles(names) && !*prettyURLs) || !strings.HasSuffix(req.URL.Path, "/") {
+		return nil, nil
+	}
+	for _, name := range names {
+		ireq := req.Clone(req.Context())
+		ireq.URL.Path = req.URL.Path + name
+		ireq.URL.RawPath = ""
+		resp, err := t.RoundTripper.RoundTrip(ireq)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+	return nil, nil
+}
+
+// indexRedirect returns a redirect from /dir to /dir/ when GCS 404s a path that's
+// a directory holding one of the host's index documents, as GCS would do itself
+// for index.html.
+func (t *transport) indexRedirect(req *http.Request) *http.Response {
+	names := indexFilesFor(req.Header.Get("X-Original-Host"))
+	if *backend != "http" || gcsIndexFiles(names) || strings.HasSuffix(req.URL.Path, "/") || (*prettyURLs && prettyPath(req.URL.Path)) {
+		return nil
+	}
+	for _, name := range names {
+		hreq := req.Clone(req.Context())
+		hreq.Method = http.MethodHead
+		hreq.URL.Path = req.URL.Path + "/" + name
+		hreq.URL.RawPath = ""
+		resp, err := t.RoundTripper.RoundTrip(hreq)
+		if err != nil {
+			return nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			r := errorResponse(req, http.StatusMovedPermanently, "Moved permanently.")
+			r.Header.Set("Location", req.URL.Path+"/")
+			return r
+		}
+	}
+	return nil
+}
+
+// prettyPath reports whether p could be a directory without its trailing
+// slash: its last segment has no extension.
+func prettyPath(p string) bool {
+	return !strings.HasSuffix(p, "/") && !strings.Contains(p[strings.LastIndex(p, "/")+1:], ".")
+}
+
+// accessPaths are the paths the access rules check a request for p on host
+// against. A directory is covered along with its index document, and with
+// --pretty_urls so is a path without its trailing slash, which is served as
+// the directory.
+func accessPaths(host, p string) []string {
+	paths := []string{p}
+	if *prettyURLs && prettyPath(p) {
+		p += "/"
+		paths = append(paths, p)
+	}
+	if strings.HasSuffix(p, "/") {
+		paths = append(paths, path.Join(p, indexFilesFor(host)[0]))
+	}
+	return paths
+}
+
+// fetchPrettyURL fetches /dir as /dir/ with --pretty_urls, saving the client
+// the redirect and the bucket's idea of directories. The response links to
+// /dir/ as the canonical URL. It returns nil if there's no such directory.
+func (t *transport) fetchPrettyURL(req *http.Request) (*http.Response, error) {
+	if !*prettyURLs || !prettyPath(req.URL.Path) {
+		return nil, nil
+	}
+	dreq := req.Clone(req.Context())
+	dreq.URL.Path += "/"
+	dreq.URL.RawPath = ""
+	resp, err := t.fetchIndex(dreq)
+	if err != nil || (resp == nil && *backend == "http") {
+		return nil, err
+	}
+	if resp == nil {
+		// The other backends resolve index documents themselves.
+		if resp, err = t.RoundTripper.RoundTrip(dreq); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, nil
+	}
+	resp.Request = req
+	host := req.Header.Get("X-Original-Host")
+	if p, ok := clientPath(host, dreq.URL.Path); ok {
+		resp.Header.Add("Link", "<"+p+`>; rel="canonical"`)
+	}
+	return resp, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	imageVariants      = flag.Bool("image_variants", false, "advertise client hints and serve image variants from the bucket based on them: name@2x.png for Sec-CH-DPR, name-640w.png for Sec-CH-Width, name-dark.png for Sec-CH-Prefers-Color-Scheme")
+	imageVariantWidths = flags.StringSlice("image_variant_widths", []string{}, "CSV of the widths uploaded as name-<width>w variants; the smallest that's at least the hinted width is served")
+)
+
+// clientHints are the hints we ask for with Accept-CH when --image_variants is on.
+var clientHints = []string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Prefers-Color-Scheme"}
+
+var imageExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".avif": true}
+
+// hint returns the value of a client hint, accepting the legacy unprefixed name
+// (DPR, Width) too.
+func hint(h http.Header, name string) string {
+	if v := h.Get(name); v != "" {
+		return strings.Trim(v, `"`)
+	}
+	return h.Get(strings.TrimPrefix(name, "Sec-CH-"))
+}
+
+// variantWidths returns --image_variant_widths sorted ascending.
+func variantWidths() []int {
+	var ws []int
+	for _, s := range *imageVariantWidths {
+		w, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			log.Exitf("Bad --image_variant_widths entry %q: %v", s, err)
+		}
+		ws = append(ws, w)
+	}
+	sort.Ints(ws)
+	return ws
+}
+
+// imageVariantPaths returns the paths of the variants of the requested image that the
+// client hints on req ask for, best match first. Hints are considered one at a
+// time rather than in combination, so the bucket only needs one variant per hint.
+func imageVariantPaths(req *http.Request, widths []int) []string {
+	if !*imageVariants || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return nil
+	}
+	p := req.URL.Path
+	ext := strings.ToLower(path.Ext(p))
+	if !imageExts[ext] {
+		return nil
+	}
+	base := strings.TrimSuffix(p, path.Ext(p))
+	ext = path.Ext(p)
+
+	var paths []string
+	if hint(req.Header, "Sec-CH-Prefers-Color-Scheme") == "dark" {
+		paths = append(paths, base+"-dark"+ext)
+	}
+	if w, err := strconv.Atoi(hint(req.Header, "Sec-CH-Width")); err == nil {
+		for _, vw := range widths {
+			if vw >= w {
+				paths = append(paths, base+"-"+strconv.Itoa(vw)+"w"+ext)
+				break
+			}
+		}
+	}
+	if dpr, err := strconv.ParseFloat(hint(req.Header, "Sec-CH-DPR"), 64); err == nil && dpr >= 1.5 {
+		paths = append(paths, base+"@"+strconv.Itoa(int(math.Min(math.Round(dpr), 3)))+"x"+ext)
+	}
+	return paths
+}
+
+// fetchImageVariant tries each variant of an image req asks for, returning the
+// first one the bucket has. It returns nil if none exist or none were asked for.
+func fetchImageVariant(rt http.RoundTripper, req *http.Request, widths []int) (*http.Response, error) {
+	for _, p := range imageVariantPaths(req, widths) {
+		vreq := req.Clone(req.Context())
+		vreq.URL.Path = p
+		vreq.URL.RawPath = ""
+		resp, err := rt.RoundTrip(vreq)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			log.V(2).Infof("Serving image variant %s for %s", p, req.URL.Path)
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+	}
+	return nil, nil
+}
+
+// setClientHintHeaders asks for client hints on pages and marks images as varying
+// on them.
+func setClientHintHeaders(req *http.Request, resp *http.Response) {
+	if !*imageVariants {
+		return
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		resp.Header.Set("Accept-CH", strings.Join(clientHints, ", "))
+	}
+	if imageExts[strings.ToLower(path.Ext(req.URL.Path))] {
+		addVary(resp.Header, clientHints...)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"flag"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	compressResponses = flag.Bool("compress", false, "gzip responses stored uncompressed for clients that accept it, at a level picked from each response's size and type")
+	compressMinSize   = flag.Int64("compress_min_size", 1024, "smallest response --compress bothers with; gzip's overhead eats what it would save on less")
+	compressTypes     = flags.StringSlice("compress_types", []string{"text/", "application/javascript", "application/json", "application/xml", "application/rss+xml", "application/atom+xml", "application/manifest+json", "image/svg+xml"}, "media types --compress applies to; one ending in / matches every type under it")
+
+	// By the level they were compressed at, so what a level costs can be
+	// weighed against what it saves.
+	compressedResponses = expvar.NewMap("compressed_responses")
+	compressionSeconds  = expvar.NewMap("compression_seconds")
+	compressionSaved    = expvar.NewMap("compression_bytes_saved")
+
+	precompressedBodies    = expvar.NewInt("precompressed_bodies")
+	precompressedResponses = expvar.NewInt("precompressed_responses")
+)
+
+// renderBlocking are the types a browser waits on before it can show a page,
+// worth the most compression when they're small enough for it to be cheap.
+var renderBlocking = map[string]bool{
+	"text/html":              true,
+	"text/css":               true,
+	"application/javascript": true,
+	"text/javascript":        true,
+}
+
+// compressionLevel picks the gzip level for size bytes of mediaType, or an
+// unknown size if it's negative. The time spent grows with the level and the
+// size alike, so small pages, styles and scripts get the most compression and
+// big or unknown bodies the fastest.
+func compressionLevel(mediaType string, size int64) int {
+	switch {
+	case size < 0 || size > 4<<20:
+		return gzip.BestSpeed
+	case size > 512<<10:
+		return 4
+	case size <= 128<<10 && renderBlocking[mediaType]:
+		return gzip.BestCompression
+	}
+	// gzip.DefaultCompression, by the number it stands for.
+	return 6
+}
+
+// compressibleType reports whether --compress_types covers mediaType.
+func compressibleType(mediaType string) bool {
+	for _, t := range *compressTypes {
+		if mediaTypeMatches(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressForClient gzips resp for clients that take it, if the bucket
+// didn't already.
+func compressForClient(resp *http.Response) {
+	req := resp.Request
+	if !*compressResponses || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return
+	}
+	if contentEncoding(resp.Header.Get("Content-Encoding")) != "identity" {
+		return
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < *compressMinSize {
+		return
+	}
+	mediaType := responseMediaType(resp.Header, responsePath(resp))
+	if !compressibleType(mediaType) {
+		return
+	}
+	if !transformAllowed(req, resp.Header) {
+		transformsSkipped.Add(1)
+		return
+	}
+
+	// Caches need to know the client who didn't get it compressed isn't
+	// everyone.
+	addVary(resp.Header, "Accept-Encoding")
+	if !acceptsEncoding(req, "gzip") {
+		return
+	}
+
+	level := compressionLevel(mediaType, resp.ContentLength)
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	resp.Header.Del("Digest")
+	resp.Header.Del("Repr-Digest")
+	resp.Header.Del("X-Goog-Hash")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	resp.ContentLength = -1
+	if req.Method == http.MethodHead {
+		return
+	}
+	if e := bodyEntry(resp.Body); e != nil {
+		if p, ok := e.gzipped.Load().(*precompressed); ok {
+			name := "gzip-" + strconv.Itoa(p.level)
+			addServerTiming(req.Context(), "compress", 0, "gzip level "+strconv.Itoa(p.level)+", precompressed")
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{bytes.NewReader(p.body), resp.Body}
+			resp.ContentLength = int64(len(p.body))
+			resp.Header.Set("Content-Length", strconv.Itoa(len(p.body)))
+			precompressedResponses.Add(1)
+			compressedResponses.Add(name, 1)
+			compressionSaved.Add(name, int64(len(e.body)-len(p.body)))
+			return
+		}
+	}
+
+	// Compress as the body's read, so a big file starts going out at once
+	// and a client that gives up stops the work. Only the compressing is
+	// timed, not waiting on the client; it isn't done by the time the
+	// headers go out, so Server-Timing only gets the level.
+	name := "gzip-" + strconv.Itoa(level)
+	addServerTiming(req.Context(), "compress", 0, "gzip level "+strconv.Itoa(level))
+	body := resp.Body
+	pr, pw := io.Pipe()
+	resp.Body = pr
+	go func() {
+		defer body.Close()
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, level)
+		chunk := make([]byte, 32<<10)
+		var in, out int64
+		var spent time.Duration
+		var err error
+		for {
+			n, rerr := body.Read(chunk)
+			start := time.Now()
+			zw.Write(chunk[:n])
+			if rerr == io.EOF {
+				zw.Close()
+			}
+			spent += time.Since(start)
+			in += int64(n)
+			out += int64(buf.Len())
+			if _, err = buf.WriteTo(pw); err != nil {
+				break
+			}
+			if rerr != nil {
+				if rerr != io.EOF {
+					err = rerr
+				}
+				break
+			}
+		}
+		pw.CloseWithError(err)
+
+		compressedResponses.Add(name, 1)
+		compressionSeconds.AddFloat(name, spent.Seconds())
+		compressionSaved.Add(name, in-out)
+	}()
+}
+
+// precompressed is a cache entry's body gzipped ahead of time, at level.
+type precompressed struct {
+	body  []byte
+	level int
+}
+
+// bodyEntry returns the cache entry b is the whole of, looking through what
+// deadlineTransport wraps it in, or nil if it isn't one.
+func bodyEntry(b io.ReadCloser) *cacheEntry {
+	for {
+		switch t := b.(type) {
+		case *cachedBody:
+			return t.e
+		case *upstreamBody:
+			b = t.ReadCloser
+		case *cancelOnClose:
+			b = t.ReadCloser
+		default:
+			return nil
+		}
+	}
+}
+
+// precompress gzips e's body in the background, once it's in c, if
+// compressForClient would otherwise have to for every client that takes gzip.
+// Its responses then cost nothing to compress. The copy counts towards
+// --cache_size, and isn't kept if e's been replaced or evicted meanwhile.
+func (c *cache) precompress(e *cacheEntry) {
+	if !*compressResponses || e.headOnly || (e.status != http.StatusOK && e.status != http.StatusNotFound) {
+		return
+	}
+	if contentEncoding(e.header.Get("Content-Encoding")) != "identity" || int64(len(e.body)) < *compressMinSize {
+		return
+	}
+	mediaType := responseMediaType(e.header, entryPath(e))
+	if !compressibleType(mediaType) {
+		return
+	}
+	level := compressionLevel(mediaType, int64(len(e.body)))
+	start := time.Now()
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, level)
+	zw.Write(e.body)
+	zw.Close()
+	compressionSeconds.AddFloat("gzip-"+strconv.Itoa(level), time.Since(start).Seconds())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[e.key]
+	if !ok || el.Value.(*cacheEntry) != e {
+		return
+	}
+	n := int64(buf.Len())
+	for c.size+n > *cacheSize {
+		back := c.lru.Back()
+		if back == el {
+			return
+		}
+		c.remove(back)
+		cacheEvictions.Add(1)
+	}
+	e.gzipped.Store(&precompressed{body: buf.Bytes(), level: level})
+	c.size += n
+	cacheBytes.Set(c.size)
+	precompressedBodies.Add(1)
+}
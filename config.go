@@ -0,0 +1,342 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+var configFile = flag.String("config", "", "YAML (.yaml, .yml) or TOML (.toml) file of settings; flags given on the command line override it")
+
+// Config is the --config file. Flags holds any flag by name, e.g.
+//
+//	flags:
+//	  blog_hostnames: [example.com, www.example.com]
+//	  gcs_bucket: example-internal.example.com
+//	  cache_size: 67108864
+//	hosts:
+//	  docs.example.com:
+//	    bucket: gs://docs-example
+//	  old.example.com:
+//	    index_files: [index.htm, default.html]
+//	cache_control:
+//	  - hashed: true
+//	    value: public, max-age=31536000, immutable
+//	  - content_type: text/html
+//	    value: public, max-age=60
+//	    surrogate_control: max-age=3600
+//	headers:
+//	  - path: /feed.xml
+//	    set: {Content-Type: application/rss+xml}
+//	redirects:
+//	  - from: /feed.xml
+//	    to: /index.xml
+//	embargoes:
+//	  - match: /launch/**
+//	    until: 2024-06-01T09:00:00-07:00
+//	admin_tokens:
+//	  - name: ci
+//	    token: sm://hugoproxy-ci-token
+//	    actions: [read]
+//	protected:
+//	  - match: /private/**
+//	    users:
+//	      alice: sm://hugoproxy-alice-password
+//	no_transform:
+//	  - match: /downloads/**
+//	listeners:
+//	  - name: internal
+//	    addr: :8443
+//	    client_ca: /etc/hugoproxy/corp-ca.pem
+//	deprecations:
+//	  - path: /api/v1/*
+//	    deprecated: 2024-01-01T00:00:00Z
+//	    successor: /api/v2/*
+type Config struct {
+	Flags        map[string]interface{} `yaml:"flags" toml:"flags"`
+	Hosts        map[string]HostConfig  `yaml:"hosts" toml:"hosts"`
+	CacheControl []CacheControlRule     `yaml:"cache_control" toml:"cache_control"`
+	Headers      []HeaderRule           `yaml:"headers" toml:"headers"`
+	Redirects    []Redirect             `yaml:"redirects" toml:"redirects"`
+	Embargoes    []Embargo              `yaml:"embargoes" toml:"embargoes"`
+	AdminTokens  []AdminToken           `yaml:"admin_tokens" toml:"admin_tokens"`
+	Protected    []ProtectedArea        `yaml:"protected" toml:"protected"`
+	NoTransform  []NoTransformRule      `yaml:"no_transform" toml:"no_transform"`
+	Listeners    []ListenerConfig       `yaml:"listeners" toml:"listeners"`
+	Deprecations []Deprecation          `yaml:"deprecations" toml:"deprecations"`
+	Refresh      []RefreshRule          `yaml:"refresh" toml:"refresh"`
+}
+
+// HostConfig holds per-host settings, which become entries in the matching
+// per-host flags.
+type HostConfig struct {
+	Bucket     string   `yaml:"bucket" toml:"bucket"`
+	IndexFiles []string `yaml:"index_files" toml:"index_files"`
+	Staging    bool     `yaml:"staging" toml:"staging"`
+	PlainHTTP  bool     `yaml:"plain_http" toml:"plain_http"`
+}
+
+// HeaderRule sets or removes response headers on matching requests. Host is
+// optional, and Path is a prefix.
+type HeaderRule struct {
+	Host   string            `yaml:"host" toml:"host"`
+	Path   string            `yaml:"path" toml:"path"`
+	Set    map[string]string `yaml:"set" toml:"set"`
+	Remove []string          `yaml:"remove" toml:"remove"`
+}
+
+// Redirect sends requests for From to To. A From ending in * matches a prefix,
+// and if To also ends in * the rest of the path is carried over. Status
+// defaults to 301.
+type Redirect struct {
+	Host   string `yaml:"host,omitempty" toml:"host"`
+	From   string `yaml:"from" toml:"from"`
+	To     string `yaml:"to" toml:"to"`
+	Status int    `yaml:"status" toml:"status"`
+}
+
+// config is the loaded --config file, empty without one.
+var config = &Config{}
+
+// commandLineFlags are the flags given on the command line, which win over the
+// config file and metadata.
+var commandLineFlags = map[string]bool{}
+
+func recordCommandLineFlags() {
+	flag.Visit(func(f *flag.Flag) { commandLineFlags[f.Name] = true })
+}
+
+// loadConfig parses a config file, by its extension.
+func loadConfig(name string) (*Config, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, c)
+	case ".toml":
+		var md toml.MetaData
+		if md, err = toml.Decode(string(b), c); err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	default:
+		return nil, fmt.Errorf("%s: want a .yaml, .yml or .toml file", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := c.compileCacheControlRules(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := c.compileEmbargoes(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := c.compileAdminTokens(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := c.compileProtected(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := c.compileNoTransformRules(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := c.compileListeners(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := c.compileDeprecations(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := c.compileRefresh(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for i, r := range c.Redirects {
+		if r.From == "" || r.To == "" {
+			return nil, fmt.Errorf("%s: redirect %d needs from and to", name, i+1)
+		}
+		switch r.Status {
+		case 0:
+			c.Redirects[i].Status = http.StatusMovedPermanently
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("%s: redirect %s has status %d, want a 3xx redirect", name, r.From, r.Status)
+		}
+	}
+	return c, nil
+}
+
+// flagValue turns a config value into what flag.Set takes; lists become CSV.
+func flagValue(v interface{}) string {
+	switch v := v.(type) {
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, e := range v {
+			s[i] = flagValue(e)
+		}
+		return strings.Join(s, ",")
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// configFlags returns the flag values the config sets, the hosts section
+// included.
+func (c *Config) configFlags() map[string]string {
+	vals := map[string]string{}
+	for name, v := range c.Flags {
+		vals[name] = flagValue(v)
+	}
+	hosts := make([]string, 0, len(c.Hosts))
+	for h := range c.Hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	add := func(name, v string) {
+		if vals[name] != "" {
+			vals[name] += ","
+		}
+		vals[name] += v
+	}
+	for _, h := range hosts {
+		hc := c.Hosts[h]
+		if hc.Bucket != "" {
+			add("host_buckets", h+"="+hc.Bucket)
+		}
+		if len(hc.IndexFiles) > 0 {
+			add("host_index_files", h+"="+strings.Join(hc.IndexFiles, "|"))
+		}
+		if hc.Staging {
+			add("staging_hostnames", h)
+		}
+		if hc.PlainHTTP {
+			add("plain_http", h)
+		}
+	}
+	return vals
+}
+
+// applyConfig loads --config and sets every flag it names that wasn't given on
+// the command line.
+func applyConfig() error {
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	for name, v := range c.configFlags() {
+		if commandLineFlags[name] {
+			log.V(1).Infof("Ignoring config value for --%s, it was given on the command line", name)
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: no such flag --%s", *configFile, name)
+		}
+		if err := flag.Set(name, v); err != nil {
+			return fmt.Errorf("%s: setting --%s: %v", *configFile, name, err)
+		}
+	}
+	config = c
+	log.Infof("Loaded %s: %d flags, %d cache control rules, %d header rules, %d redirects, %d embargoes, %d admin tokens, %d protected areas, %d listeners, %d deprecations, %d refresh rules", *configFile, len(c.configFlags()), len(c.CacheControl), len(c.Headers), len(c.Redirects), len(c.Embargoes), len(c.AdminTokens), len(c.Protected), len(c.Listeners), len(c.Deprecations), len(c.Refresh))
+	return nil
+}
+
+func hostMatches(pattern, host string) bool {
+	return pattern == "" || strings.EqualFold(pattern, host)
+}
+
+// applyHeaderRules applies the config's header rules to a response, in order.
+func applyHeaderRules(resp *http.Response) {
+	host := resp.Request.Header.Get("X-Original-Host")
+	p := responsePath(resp)
+	for _, r := range config.Headers {
+		if !hostMatches(r.Host, host) || !strings.HasPrefix(p, r.Path) {
+			continue
+		}
+		for _, k := range r.Remove {
+			resp.Header.Del(k)
+		}
+		for k, v := range r.Set {
+			resp.Header.Set(k, v)
+		}
+	}
+}
+
+// redirectTarget returns where the config redirects a request, if anywhere.
+func redirectTarget(host, p string) (string, int, bool) {
+	return matchRedirects(config.Redirects, host, p)
+}
+
+// matchRedirects returns where the first of rules that matches sends a request.
+func matchRedirects(rules []Redirect, host, p string) (string, int, bool) {
+	for _, r := range rules {
+		if !hostMatches(r.Host, host) {
+			continue
+		}
+		if to, ok := matchPrefix(r.From, r.To, p); ok {
+			return to, r.Status, true
+		}
+	}
+	return "", 0, false
+}
+
+// matchPrefix matches p against from, a path or a prefix ending in *, and
+// returns to, with the rest of p in place of a trailing * if it has one.
+func matchPrefix(from, to, p string) (string, bool) {
+	if strings.HasSuffix(from, "*") {
+		prefix := strings.TrimSuffix(from, "*")
+		if !strings.HasPrefix(p, prefix) {
+			return "", false
+		}
+		if strings.HasSuffix(to, "*") {
+			return strings.TrimSuffix(to, "*") + strings.TrimPrefix(p, prefix), true
+		}
+		return to, true
+	}
+	return to, p == from
+}
+
+// withConfigRedirects serves the config's redirects, keeping the query string
+// when the target doesn't have its own.
+func withConfigRedirects(h http.Handler) http.Handler {
+	if len(config.Redirects) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		to, status, ok := redirectTarget(r.Host, r.URL.Path)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		redirectKeepingQuery(w, r, to, status)
+	})
+}
+
+// redirectKeepingQuery redirects r to to, carrying the query string over unless
+// to has its own. A redirect the rules would send round in a loop, or down too
+// long a chain, gets a 508 instead.
+func redirectKeepingQuery(w http.ResponseWriter, r *http.Request, to string, status int) {
+	base := &url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path}
+	if loc, err := base.Parse(to); err == nil {
+		if err := checkRedirectChain(r.Host, r.URL.RequestURI(), loc, ruleRedirect(r.Host)); err != nil {
+			redirectLoops.Add(1)
+			log.Errorf("Not redirecting %s%s: %v", r.Host, r.URL.RequestURI(), err)
+			w.Header().Set("Cache-Control", "no-store")
+			http.Error(w, "This page redirects in a loop.", http.StatusLoopDetected)
+			return
+		}
+	}
+	if r.URL.RawQuery != "" && !strings.Contains(to, "?") {
+		to += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, to, status)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// acceptSlots is how many seconds of accepts a connTracker remembers for its
+// rates.
+const acceptSlots = 60
+
+var (
+	requestsInFlight int64
+
+	connTrackersMu sync.Mutex
+	connTrackers   []*connTracker
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/connections", connStatsHandler)
+	expvar.Publish("requests_in_flight", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&requestsInFlight)
+	}))
+	expvar.Publish("connections_open", expvar.Func(func() interface{} {
+		var n int64
+		for _, l := range listenerStats(time.Now()) {
+			n += l.Open
+		}
+		return n
+	}))
+}
+
+// ConnStats is the /admin/connections report.
+type ConnStats struct {
+	RequestsInFlight int64           `json:"requests_in_flight"`
+	Listeners        []ListenerStats `json:"listeners"`
+}
+
+// ListenerStats counts one listener's connections by state. New connections
+// haven't sent a request yet, which on a TLS listener mostly means they're
+// still in the handshake.
+type ListenerStats struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	TLS      bool   `json:"tls"`
+	Open     int64  `json:"open"`
+	New      int64  `json:"new"`
+	Active   int64  `json:"active"`
+	Idle     int64  `json:"idle"`
+	Accepted int64  `json:"accepted"`
+	// AcceptRate10s and AcceptRate1m are accepts per second, averaged over the
+	// last 10 seconds and minute.
+	AcceptRate10s float64 `json:"accept_rate_10s"`
+	AcceptRate1m  float64 `json:"accept_rate_1m"`
+}
+
+// connTracker follows the connections of one http.Server through its ConnState
+// hook.
+type connTracker struct {
+	name, addr string
+	tls        bool
+
+	mu       sync.Mutex
+	states   map[net.Conn]http.ConnState
+	counts   map[http.ConnState]int64
+	accepted int64
+	// accepts counts accepts per second, indexed by Unix time modulo acceptSlots.
+	accepts [acceptSlots]int64
+	last    int64
+}
+
+// trackConns returns a ConnState hook for a server, listed on /admin/connections
+// under name.
+func trackConns(name, addr string, tls bool) func(net.Conn, http.ConnState) {
+	t := &connTracker{name: name, addr: addr, tls: tls, states: map[net.Conn]http.ConnState{}, counts: map[http.ConnState]int64{}}
+	connTrackersMu.Lock()
+	connTrackers = append(connTrackers, t)
+	connTrackersMu.Unlock()
+	return t.connState
+}
+
+func (t *connTracker) connState(c net.Conn, s http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev, ok := t.states[c]; ok {
+		t.counts[prev]--
+	}
+	switch s {
+	case http.StateClosed, http.StateHijacked:
+		delete(t.states, c)
+		return
+	case http.StateNew:
+		t.accepted++
+		now := time.Now().Unix()
+		t.advance(now)
+		t.accepts[now%acceptSlots]++
+	}
+	t.states[c] = s
+	t.counts[s]++
+}
+
+// advance clears the accept slots for the seconds since the last one counted.
+// t.mu must be held.
+func (t *connTracker) advance(now int64) {
+	if now-t.last >= acceptSlots {
+		t.accepts = [acceptSlots]int64{}
+	} else {
+		for s := t.last + 1; s <= now; s++ {
+			t.accepts[s%acceptSlots] = 0
+		}
+	}
+	if now > t.last {
+		t.last = now
+	}
+}
+
+// rate is the average accepts per second over the last secs seconds, not
+// counting the current one, which isn't over yet.
+func (t *connTracker) rate(now int64, secs int64) float64 {
+	var n int64
+	for s := now - secs; s < now; s++ {
+		n += t.accepts[s%acceptSlots]
+	}
+	return float64(n) / float64(secs)
+}
+
+func (t *connTracker) stats(now time.Time) ListenerStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sec := now.Unix()
+	t.advance(sec)
+	return ListenerStats{
+		Name:          t.name,
+		Addr:          t.addr,
+		TLS:           t.tls,
+		Open:          int64(len(t.states)),
+		New:           t.counts[http.StateNew],
+		Active:        t.counts[http.StateActive],
+		Idle:          t.counts[http.StateIdle],
+		Accepted:      t.accepted,
+		AcceptRate10s: t.rate(sec, 10),
+		AcceptRate1m:  t.rate(sec, acceptSlots-1),
+	}
+}
+
+func listenerStats(now time.Time) []ListenerStats {
+	connTrackersMu.Lock()
+	defer connTrackersMu.Unlock()
+	stats := make([]ListenerStats, 0, len(connTrackers))
+	for _, t := range connTrackers {
+		stats = append(stats, t.stats(now))
+	}
+	return stats
+}
+
+// withInFlight counts the requests being served.
+func withInFlight(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requestsInFlight, 1)
+		defer atomic.AddInt64(&requestsInFlight, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// connStatsHandler reports open connections and requests in flight on
+// /admin/connections, for telling quickly whether we're saturated.
+func connStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, ConnStats{
+		RequestsInFlight: atomic.LoadInt64(&requestsInFlight),
+		Listeners:        listenerStats(time.Now()),
+	})
+}
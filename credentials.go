@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	credentialsFile           = flag.String("credentials_file", "", "service account key or workload identity federation (external_account) JSON to use for GCP APIs instead of Application Default Credentials, for running off GCE")
+	impersonateServiceAccount = flag.String("impersonate_service_account", "", "email of a service account to impersonate for all GCP API calls; the base credentials need roles/iam.serviceAccountTokenCreator on it")
+)
+
+// cloudPlatformScope is the OAuth scope requested for every GCP API we call.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// clientOptions returns the options every GCP API client should be created with so
+// they all authenticate the same way.
+func clientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if *credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(*credentialsFile))
+	}
+	if *impersonateServiceAccount != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: *impersonateServiceAccount,
+			Scopes:          []string{cloudPlatformScope},
+		}, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("impersonate.CredentialsTokenSource(%s): %v", *impersonateServiceAccount, err)
+		}
+		opts = []option.ClientOption{option.WithTokenSource(ts)}
+	}
+	return opts, nil
+}
+
+// credentialsFileProject returns the project named in --credentials_file, if any.
+// Workload identity federation configs don't name one.
+func credentialsFileProject(ctx context.Context) (string, error) {
+	data, err := ioutil.ReadFile(*credentialsFile)
+	if err != nil {
+		return "", err
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, cloudPlatformScope)
+	if err != nil {
+		return "", fmt.Errorf("google.CredentialsFromJSON(%s): %v", *credentialsFile, err)
+	}
+	return creds.ProjectID, nil
+}
+
+// explainPermissionDenied says which project a permission error came from. With
+// Datastore, Secret Manager and the bucket able to live in different projects it's
+// otherwise not obvious which grant is missing.
+func explainPermissionDenied(err error, service, project string) error {
+	if status.Code(err) != codes.PermissionDenied {
+		return err
+	}
+	who := "our credentials"
+	if *impersonateServiceAccount != "" {
+		who = *impersonateServiceAccount
+	}
+	return fmt.Errorf("%v: %s need access to %s in project %q", err, who, service, project)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	upstreamTimeout     = flag.Duration("upstream_timeout", 30*time.Second, "how long the bucket gets to start answering a request before we give up with a 504 (no limit if 0)")
+	upstreamBodyTimeout = flag.Duration("upstream_body_timeout", 0, "deadline for a whole upstream fetch, body included (no limit if 0)")
+	upstreamRetries     = flag.Int("upstream_retries", 1, "how many more times to try a fetch GCS failed or couldn't be reached for, within --upstream_timeout")
+)
+
+var (
+	upstreamTimeouts = expvar.NewInt("upstream_timeouts")
+	upstreamRetried  = expvar.NewInt("upstream_retries")
+)
+
+// upstreamRetryBackoff is how long the first retry of a failed fetch waits;
+// each after it waits twice as long.
+const upstreamRetryBackoff = 100 * time.Millisecond
+
+// deadlineTransport gives every upstream fetch, and any cache fill it drives,
+// the --upstream_timeout and --upstream_body_timeout deadlines on top of the
+// client's own context. The server cancels that when the client goes away, so
+// an abandoned request stops reading from GCS too. It's also where upstream
+// failures become upstreamErrors: fetches that fail in a retryable way are
+// tried again, up to --upstream_retries times within the deadline, and the rest
+// are counted and handed on.
+type deadlineTransport struct {
+	http.RoundTripper
+}
+
+func (t *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if *upstreamBodyTimeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), *upstreamBodyTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+	var timedOut int32
+	if *upstreamTimeout > 0 {
+		timer := time.AfterFunc(*upstreamTimeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	var uerr *upstreamError
+	for attempt := 0; ; attempt++ {
+		resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+		if err == nil {
+			resp.Body = &upstreamBody{ReadCloser: &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}, ctx: req.Context(), object: req.URL.String()}
+			return resp, nil
+		}
+		uerr = newUpstreamError(req.URL.String(), err)
+		if atomic.LoadInt32(&timedOut) == 1 {
+			uerr.Class, uerr.Err = classTimeout, fmt.Errorf("no answer within %s: %v", *upstreamTimeout, err)
+		}
+		if attempt >= *upstreamRetries || !uerr.Class.retryable() || ctx.Err() != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+			break
+		}
+		upstreamRetried.Add(1)
+		log.V(1).Infof("Retrying %s %s: %v", req.Method, req.URL, uerr)
+		select {
+		case <-time.After(upstreamRetryBackoff << attempt):
+		case <-ctx.Done():
+		}
+	}
+	cancel()
+	if uerr.Class == classTimeout {
+		upstreamTimeouts.Add(1)
+	}
+	countUpstreamError(req.Context(), uerr)
+	return nil, uerr
+}
+
+// cancelOnClose releases a request's context once its body is done with.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	debugEndpoints       = flag.Bool("debug_endpoints", false, "serve net/http/pprof profiles, goroutine dumps and GC stats under /debug/ on --admin_addr; needs an admin token, or --admin_addr on loopback")
+	blockProfileRate     = flag.Int("block_profile_rate", 0, "with --debug_endpoints, record goroutine blocking events lasting this many nanoseconds or more for /debug/pprof/block (disabled if 0)")
+	mutexProfileFraction = flag.Int("mutex_profile_fraction", 0, "with --debug_endpoints, sample 1 in this many mutex contention events for /debug/pprof/mutex (disabled if 0)")
+)
+
+func init() {
+	adminMux.Handle("/debug/pprof/", debugOnly(http.HandlerFunc(pprof.Index)))
+	adminMux.Handle("/debug/pprof/cmdline", debugOnly(http.HandlerFunc(pprof.Cmdline)))
+	adminMux.Handle("/debug/pprof/profile", debugOnly(http.HandlerFunc(pprof.Profile)))
+	adminMux.Handle("/debug/pprof/symbol", debugOnly(http.HandlerFunc(pprof.Symbol)))
+	adminMux.Handle("/debug/pprof/trace", debugOnly(http.HandlerFunc(pprof.Trace)))
+	adminMux.Handle("/debug/gc", debugOnly(http.HandlerFunc(gcHandler)))
+	// Profiles show memory contents and a CPU profile slows serving, so a read
+	// token isn't enough.
+	adminPrefixAction("/debug/pprof/", "debug")
+	adminPrefixAction("/debug/gc", "debug")
+}
+
+// debugOnly hides h unless --debug_endpoints is set.
+func debugOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !*debugEndpoints {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startDebugEndpoints turns on the profiling --debug_endpoints asks for, and
+// refuses to expose them unauthenticated beyond loopback.
+func startDebugEndpoints() {
+	if !*debugEndpoints {
+		return
+	}
+	if len(adminTokens()) == 0 && !isLoopbackAddr(*adminAddr) {
+		log.Exitf("--debug_endpoints needs an admin token, or --admin_addr on loopback, not %q", *adminAddr)
+	}
+	runtime.SetBlockProfileRate(*blockProfileRate)
+	runtime.SetMutexProfileFraction(*mutexProfileFraction)
+	log.Infof("Serving pprof and GC stats at http://%s/debug/", *adminAddr)
+}
+
+// isLoopbackAddr reports whether a listen address only accepts local
+// connections.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// GCStats is what /debug/gc reports about the heap and garbage collector.
+type GCStats struct {
+	Goroutines     int             `json:"goroutines"`
+	HeapAlloc      uint64          `json:"heap_alloc"`
+	HeapInuse      uint64          `json:"heap_inuse"`
+	HeapIdle       uint64          `json:"heap_idle"`
+	HeapReleased   uint64          `json:"heap_released"`
+	HeapObjects    uint64          `json:"heap_objects"`
+	Sys            uint64          `json:"sys"`
+	NextGC         uint64          `json:"next_gc"`
+	NumGC          int64           `json:"num_gc"`
+	LastGC         *time.Time      `json:"last_gc,omitempty"`
+	PauseTotal     time.Duration   `json:"pause_total_ns"`
+	RecentPauses   []time.Duration `json:"recent_pauses_ns"`
+	GCCPUFraction  float64         `json:"gc_cpu_fraction"`
+	FreedOSMemory  bool            `json:"freed_os_memory,omitempty"`
+	CollectionTime time.Duration   `json:"collection_ns,omitempty"`
+}
+
+// gcHandler reports GC stats and, on POST, forces a collection that returns as
+// much memory to the OS as it can first:
+//
+//	GET  /debug/gc
+//	POST /debug/gc
+func gcHandler(w http.ResponseWriter, r *http.Request) {
+	var st GCStats
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		start := time.Now()
+		debug.FreeOSMemory()
+		st.FreedOSMemory, st.CollectionTime = true, time.Since(start)
+		log.Infof("Forced a GC from the admin API, took %v", st.CollectionTime)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	st.Goroutines = runtime.NumGoroutine()
+	st.HeapAlloc, st.HeapInuse, st.HeapIdle, st.HeapReleased, st.HeapObjects = ms.HeapAlloc, ms.HeapInuse, ms.HeapIdle, ms.HeapReleased, ms.HeapObjects
+	st.Sys, st.NextGC, st.GCCPUFraction = ms.Sys, ms.NextGC, ms.GCCPUFraction
+	st.NumGC, st.PauseTotal = gc.NumGC, gc.PauseTotal
+	if !gc.LastGC.IsZero() {
+		st.LastGC = &gc.LastGC
+	}
+	st.RecentPauses = gc.Pause
+	if len(st.RecentPauses) > 16 {
+		st.RecentPauses = st.RecentPauses[:16]
+	}
+	writeJSON(w, st)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	log "github.com/golang/glog"
+	"google.golang.org/api/iterator"
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/deploydiff", deployDiffHandler)
+	adminHostScoped("/admin/deploydiff")
+}
+
+// deployDiffTimeout bounds listing both sides of a deploy diff.
+const deployDiffTimeout = 5 * time.Minute
+
+var (
+	diffStorageOnce   sync.Once
+	diffStorageClient *storage.Client
+)
+
+// DeployDiff compares the objects a site is served from with a candidate
+// bucket or prefix it's about to be switched to. The lists are cut off at the
+// limit asked for; the counts aren't.
+type DeployDiff struct {
+	Current   string `json:"current"`
+	Candidate string `json:"candidate"`
+
+	AddedCount   int      `json:"added_count"`
+	RemovedCount int      `json:"removed_count"`
+	ChangedCount int      `json:"changed_count"`
+	Unchanged    int      `json:"unchanged"`
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+	Changed      []string `json:"changed"`
+
+	// MissingPages are the pages whose URLs would stop working: HTML objects
+	// that are gone with no redirect in the config or the candidate's
+	// --bucket_redirects files covering them.
+	MissingPages []MissingPage `json:"missing_pages"`
+}
+
+// MissingPage is a page the candidate drops.
+type MissingPage struct {
+	URL    string `json:"url"`
+	Object string `json:"object"`
+}
+
+// gsURL is the gs:// URL of a site, e.g. gs://sites/docs/.
+func gsURL(site *url.URL) string {
+	return "gs://" + site.Host + site.Path
+}
+
+// listObjects returns the checksums of the objects under site, keyed by name
+// relative to it.
+func listObjects(ctx context.Context, c *storage.Client, site *url.URL) (map[string]string, error) {
+	prefix := strings.TrimPrefix(site.Path, "/")
+	objs := map[string]string{}
+	it := c.Bucket(site.Host).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing gs://%s/%s: %v", site.Host, prefix, err)
+		}
+		sum := fmt.Sprintf("%x", attrs.MD5)
+		if len(attrs.MD5) == 0 {
+			// Composite objects only have a CRC32C.
+			sum = "crc32c:" + strconv.FormatUint(uint64(attrs.CRC32C), 16)
+		}
+		objs[strings.TrimPrefix(attrs.Name, prefix)] = sum
+	}
+}
+
+// candidateRedirects reads the candidate's --bucket_redirects files.
+func candidateRedirects(ctx context.Context, c *storage.Client, site *url.URL) ([]Redirect, error) {
+	var rules []Redirect
+	for _, file := range *bucketRedirectFiles {
+		name := strings.TrimPrefix(site.Path, "/") + strings.TrimPrefix(file, "/")
+		r, err := c.Bucket(site.Host).Object(name).NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		file, err := parseRulesFile("gs://"+site.Host+"/"+name, body)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, file...)
+	}
+	return rules, nil
+}
+
+// pageURL returns the URL an HTML object is served at on host, or false if
+// the object isn't a page.
+func pageURL(host, name string) (string, bool) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".html", ".htm":
+	default:
+		return "", false
+	}
+	p, _ := cleanIndexPath(host, "/"+name)
+	return p, true
+}
+
+// diffDeploy compares the site at current with candidate.
+func diffDeploy(ctx context.Context, c *storage.Client, host string, current, candidate *url.URL, limit int) (*DeployDiff, error) {
+	cur, err := listObjects(ctx, c, current)
+	if err != nil {
+		return nil, err
+	}
+	next, err := listObjects(ctx, c, candidate)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := candidateRedirects(ctx, c, candidate)
+	if err != nil {
+		return nil, fmt.Errorf("reading the candidate's redirects: %v", err)
+	}
+
+	// A candidate uploaded under the current site isn't part of it.
+	if current.Host == candidate.Host && len(candidate.Path) > len(current.Path) && strings.HasPrefix(candidate.Path, current.Path) {
+		nested := strings.TrimPrefix(strings.TrimPrefix(candidate.Path, current.Path), "/")
+		for name := range cur {
+			if strings.HasPrefix(name, nested) {
+				delete(cur, name)
+			}
+		}
+	}
+
+	d := &DeployDiff{Current: gsURL(current), Candidate: gsURL(candidate), Added: []string{}, Removed: []string{}, Changed: []string{}, MissingPages: []MissingPage{}}
+	for name, sum := range next {
+		switch old, ok := cur[name]; {
+		case !ok:
+			d.Added = append(d.Added, name)
+		case old != sum:
+			d.Changed = append(d.Changed, name)
+		default:
+			d.Unchanged++
+		}
+	}
+	for name := range cur {
+		if _, ok := next[name]; ok {
+			continue
+		}
+		d.Removed = append(d.Removed, name)
+		u, ok := pageURL(host, name)
+		if !ok {
+			continue
+		}
+		if _, _, ok := redirectTarget(host, u); ok {
+			continue
+		}
+		if _, _, ok := matchRedirects(rules, host, u); ok {
+			continue
+		}
+		d.MissingPages = append(d.MissingPages, MissingPage{URL: u, Object: name})
+	}
+	d.AddedCount, d.RemovedCount, d.ChangedCount = len(d.Added), len(d.Removed), len(d.Changed)
+	for _, list := range []*[]string{&d.Added, &d.Removed, &d.Changed} {
+		sort.Strings(*list)
+		if len(*list) > limit {
+			*list = (*list)[:limit]
+		}
+	}
+	sort.Slice(d.MissingPages, func(i, j int) bool { return d.MissingPages[i].URL < d.MissingPages[j].URL })
+	if len(d.MissingPages) > limit {
+		d.MissingPages = d.MissingPages[:limit]
+	}
+	return d, nil
+}
+
+// deployDiffHandler diffs a host's site against a candidate before cutting over
+// to it:
+//
+//	GET /admin/deploydiff?candidate=gs://sites/releases/v42/&host=docs.example.com&limit=100
+//
+// host picks the site from --host_buckets, --gcs_bucket without it.
+func deployDiffHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	candidate, err := bucketURL(q.Get("candidate"))
+	if err != nil || candidate.Host == "" {
+		http.Error(w, "candidate must be a bucket, with an optional prefix, e.g. gs://bucket/prefix/", http.StatusBadRequest)
+		return
+	}
+	limit := 1000
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	host := q.Get("host")
+	current := hostBucketURL(host)
+	if current == nil {
+		if current, err = bucketURL(*hugoBucket); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	diffStorageOnce.Do(func() { diffStorageClient = newStorageClient(context.Background()) })
+	ctx, cancel := context.WithTimeout(r.Context(), deployDiffTimeout)
+	defer cancel()
+	d, err := diffDeploy(ctx, diffStorageClient, host, current, candidate, limit)
+	if err != nil {
+		log.Errorf("Error diffing %s against %s: %v", gsURL(current), gsURL(candidate), err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, d)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deprecation announces that the paths Path matches, a path or a prefix
+// ending in * as in redirects, are on their way out, for clients of feeds and
+// other API-like content that can act on it before they go:
+//
+//	deprecations:
+//	  - path: /api/v1/*
+//	    deprecated: 2024-01-01T00:00:00Z
+//	    sunset: 2024-07-01T00:00:00Z
+//	    successor: /api/v2/*
+//	    info: https://example.com/blog/api-v2/
+//
+// Responses get a Deprecation header (RFC 9745) from Deprecated, which can be
+// in the future, a Sunset header (RFC 8594) if there's a Sunset, and Link
+// headers to the Successor, which takes the rest of the path in place of a
+// trailing * like a redirect's to, and to Info, a page about the change.
+// Host is optional.
+type Deprecation struct {
+	Host       string    `yaml:"host" toml:"host"`
+	Path       string    `yaml:"path" toml:"path"`
+	Deprecated time.Time `yaml:"deprecated" toml:"deprecated"`
+	Sunset     time.Time `yaml:"sunset" toml:"sunset"`
+	Successor  string    `yaml:"successor" toml:"successor"`
+	Info       string    `yaml:"info" toml:"info"`
+}
+
+// compileDeprecations checks the config's deprecations.
+func (c *Config) compileDeprecations() error {
+	for i, d := range c.Deprecations {
+		switch {
+		case !strings.HasPrefix(d.Path, "/"):
+			return fmt.Errorf("deprecation %d needs a path starting with /", i+1)
+		case d.Deprecated.IsZero():
+			return fmt.Errorf("deprecation %q needs a deprecated date", d.Path)
+		case !d.Sunset.IsZero() && d.Sunset.Before(d.Deprecated):
+			return fmt.Errorf("deprecation %q has its sunset before it's deprecated", d.Path)
+		case strings.HasSuffix(d.Successor, "*") && !strings.HasSuffix(d.Path, "*"):
+			return fmt.Errorf("deprecation %q has a successor ending in * but isn't a prefix", d.Path)
+		case strings.ContainsAny(d.Successor+d.Info, "<>"):
+			return fmt.Errorf("deprecation %q has a successor or info that isn't a URL", d.Path)
+		}
+	}
+	return nil
+}
+
+// applyDeprecations sets the headers of the first deprecation matching a
+// response's path.
+func applyDeprecations(resp *http.Response) {
+	host := resp.Request.Header.Get("X-Original-Host")
+	p := responsePath(resp)
+	for _, d := range config.Deprecations {
+		if !hostMatches(d.Host, host) {
+			continue
+		}
+		successor, ok := matchPrefix(d.Path, d.Successor, p)
+		if !ok {
+			continue
+		}
+		resp.Header.Set("Deprecation", "@"+strconv.FormatInt(d.Deprecated.Unix(), 10))
+		if !d.Sunset.IsZero() {
+			resp.Header.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+		}
+		if successor != "" {
+			resp.Header.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+		}
+		if d.Info != "" {
+			resp.Header.Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"`, d.Info))
+		}
+		return
+	}
+}
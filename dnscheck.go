@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	dnsCheck  = flag.Bool("dns_check", true, "before asking for a certificate, check the hostname resolves to --public_ips, so misconfigured DNS doesn't burn ACME rate limits")
+	publicIPs = flags.StringSlice("public_ips", []string{}, "CSV of the addresses our hostnames should resolve to, e.g. a load balancer's; defaults to the instance's external IP on GCE, and without either DNS isn't checked")
+)
+
+// dnsRecheck is how long a DNS check result is trusted before it's redone.
+const dnsRecheck = 5 * time.Minute
+
+type dnsResult struct {
+	err     error
+	checked time.Time
+}
+
+// dnsChecker checks hostnames resolve to us.
+type dnsChecker struct {
+	expected []net.IP
+
+	mu      sync.Mutex
+	results map[string]dnsResult
+}
+
+// newDNSChecker returns a checker for --public_ips or our GCE external IP, or
+// nil if we don't know what our addresses should be.
+func newDNSChecker() (*dnsChecker, error) {
+	var expected []net.IP
+	for _, s := range *publicIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("bad --public_ips address %q", s)
+		}
+		expected = append(expected, ip)
+	}
+	if len(expected) == 0 && metadata.OnGCE() {
+		s, err := metadata.ExternalIP()
+		if err != nil {
+			log.Warningf("Not checking DNS: no --public_ips and no external IP from metadata: %v", err)
+			return nil, nil
+		}
+		expected = append(expected, net.ParseIP(s))
+	}
+	if len(expected) == 0 {
+		log.Warningf("Not checking DNS: set --public_ips to the addresses our hostnames should resolve to")
+		return nil, nil
+	}
+	return &dnsChecker{expected: expected, results: map[string]dnsResult{}}, nil
+}
+
+// lookup resolves host and reports an error unless one of its addresses is ours.
+func (d *dnsChecker) lookup(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("DNS lookup of %s: %v", host, err)
+	}
+	var got []string
+	for _, a := range addrs {
+		for _, ip := range d.expected {
+			if a.IP.Equal(ip) {
+				return nil
+			}
+		}
+		got = append(got, a.IP.String())
+	}
+	want := make([]string, len(d.expected))
+	for i, ip := range d.expected {
+		want[i] = ip.String()
+	}
+	return fmt.Errorf("%s resolves to %s, not us (%s): point its A/AAAA records here, or set --public_ips if something in front of us owns the address", host, strings.Join(got, ", "), strings.Join(want, ", "))
+}
+
+// check returns the recent result for host, looking it up again if it's stale.
+func (d *dnsChecker) check(ctx context.Context, host string) error {
+	d.mu.Lock()
+	r, ok := d.results[host]
+	d.mu.Unlock()
+	if ok && time.Since(r.checked) < dnsRecheck {
+		return r.err
+	}
+	err := d.lookup(ctx, host)
+	if ctx.Err() != nil {
+		// We gave up, which says nothing about the host.
+		return err
+	}
+	d.mu.Lock()
+	d.results[host] = dnsResult{err: err, checked: time.Now()}
+	d.mu.Unlock()
+	return err
+}
+
+// hostPolicy wraps policy so certificates are only requested for hosts whose
+// DNS points at us. A nil checker leaves policy alone.
+func (d *dnsChecker) hostPolicy(policy autocert.HostPolicy) autocert.HostPolicy {
+	if d == nil {
+		return policy
+	}
+	return func(ctx context.Context, host string) error {
+		if err := policy(ctx, host); err != nil {
+			return err
+		}
+		if err := d.check(ctx, host); err != nil {
+			log.Errorf("Not requesting a certificate: %v", err)
+			return err
+		}
+		return nil
+	}
+}
+
+// checkAll checks every host at startup, so DNS mistakes are in the log before
+// the first handshake needs them.
+func (d *dnsChecker) checkAll(hosts []string) {
+	if d == nil {
+		return
+	}
+	for _, h := range hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := d.check(ctx, h); err != nil {
+			log.Errorf("DNS check failed: %v", err)
+		} else {
+			log.Infof("DNS check passed: %s resolves to us", h)
+		}
+		cancel()
+	}
+}
+
+// certHostPolicy is the autocert host policy for our hostnames, checking their
+// DNS first if --dns_check is set.
+func certHostPolicy(hosts []string) autocert.HostPolicy {
+	policy := autocert.HostWhitelist(hosts...)
+	if !*dnsCheck {
+		return policy
+	}
+	d, err := newDNSChecker()
+	if err != nil {
+		log.Exitf("newDNSChecker: %v", err)
+	}
+	go d.checkAll(hosts)
+	return d.hostPolicy(policy)
+}
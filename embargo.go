@@ -0,0 +1,95 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var embargoedRequests = expvar.NewInt("embargoed_requests")
+
+// Embargo restricts the paths matching Match, a cache_control style pattern,
+// from From until Until. Either end can be left out, so an Until alone keeps a
+// launch page dark until its time and a From alone takes pages down at one.
+// Status is what's served meanwhile, 403 by default or 404 to not admit the
+// page exists. Host is optional.
+type Embargo struct {
+	Host   string    `yaml:"host" toml:"host"`
+	Match  string    `yaml:"match" toml:"match"`
+	From   time.Time `yaml:"from" toml:"from"`
+	Until  time.Time `yaml:"until" toml:"until"`
+	Status int       `yaml:"status" toml:"status"`
+
+	re *regexp.Regexp
+}
+
+// active reports whether t falls in the embargo's window.
+func (e *Embargo) active(t time.Time) bool {
+	return (e.From.IsZero() || !t.Before(e.From)) && (e.Until.IsZero() || t.Before(e.Until))
+}
+
+// compileEmbargoes checks and compiles the config's embargoes.
+func (c *Config) compileEmbargoes() error {
+	for i := range c.Embargoes {
+		e := &c.Embargoes[i]
+		if e.From.IsZero() && e.Until.IsZero() {
+			return fmt.Errorf("embargo %q needs from or until", e.Match)
+		}
+		if !e.From.IsZero() && !e.Until.IsZero() && !e.Until.After(e.From) {
+			return fmt.Errorf("embargo %q ends before it starts", e.Match)
+		}
+		switch e.Status {
+		case 0:
+			e.Status = http.StatusForbidden
+		case http.StatusForbidden, http.StatusNotFound, http.StatusGone, http.StatusUnavailableForLegalReasons:
+		default:
+			return fmt.Errorf("embargo %q has status %d, want 403, 404, 410 or 451", e.Match, e.Status)
+		}
+		re, err := compileGlob(e.Match)
+		if err != nil {
+			return fmt.Errorf("embargo %q: %v", e.Match, err)
+		}
+		e.re = re
+	}
+	return nil
+}
+
+// activeEmbargo returns the first embargo covering a request for p on host
+// right now, or nil.
+func activeEmbargo(host, p string, now time.Time) *Embargo {
+	// A directory is embargoed along with its index document.
+	paths := accessPaths(host, p)
+	for i := range config.Embargoes {
+		e := &config.Embargoes[i]
+		if hostMatches(e.Host, host) && e.active(now) && anyPathMatches(e.re, paths) {
+			return e
+		}
+	}
+	return nil
+}
+
+// withEmbargoes refuses requests the config's embargoes cover. The refusals
+// aren't cacheable, so the page appears as soon as its embargo ends.
+func withEmbargoes(h http.Handler) http.Handler {
+	if len(config.Embargoes) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := activeEmbargo(r.Host, r.URL.Path, time.Now())
+		if e == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		embargoedRequests.Add(1)
+		log.V(1).Infof("Embargoed %s%s by %q", r.Host, r.URL.Path, e.Match)
+		w.Header().Set("Cache-Control", "no-store")
+		if !e.Until.IsZero() && e.Status == http.StatusForbidden {
+			w.Header().Set("Retry-After", e.Until.UTC().Format(http.TimeFormat))
+		}
+		http.Error(w, http.StatusText(e.Status), e.Status)
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	maxDecompressedSize  = flag.Int64("max_decompressed_size", 256<<20, "largest body we'll decompress, for a client that can't take the stored encoding or to rewrite it; longer ones are cut off with an error")
+	maxDecompressedRatio = flag.Int64("max_decompression_ratio", 100, "most a body may expand when we decompress it, once it's past a megabyte, so a compression bomb in the bucket fails rather than eating memory and bandwidth")
+)
+
+var decompressionLimitsHit = expvar.NewInt("decompression_limits_hit")
+
+// errDecompressionLimit is returned by a body that grew past
+// --max_decompressed_size or --max_decompression_ratio.
+var errDecompressionLimit = errors.New("decompressed body over the size or expansion limit")
+
+// ratioSlack is how much a body can expand to before --max_decompression_ratio
+// applies, since small, repetitive files legitimately compress very well.
+const ratioSlack = 1 << 20
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitedDecoder enforces the decompression limits on a decoder's output.
+type limitedDecoder struct {
+	io.ReadCloser
+	in  *countingReader
+	out int64
+}
+
+func (l *limitedDecoder) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.out += int64(n)
+	if l.out > *maxDecompressedSize || (l.out > ratioSlack && l.out > l.in.n*(*maxDecompressedRatio)) {
+		decompressionLimitsHit.Add(1)
+		return n, fmt.Errorf("%w: %d bytes from %d", errDecompressionLimit, l.out, l.in.n)
+	}
+	return n, err
+}
+
+// acceptsEncoding reports whether req's Accept-Encoding allows enc, going by
+// its q-values and a * entry. identity is acceptable unless it's ruled out.
+func acceptsEncoding(req *http.Request, enc string) bool {
+	enc = strings.ToLower(enc)
+	star := -1.0
+	for _, v := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range parts[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch name {
+		case enc:
+			return q > 0
+		case "*":
+			star = q
+		}
+	}
+	if star >= 0 {
+		return star > 0
+	}
+	return enc == "identity"
+}
+
+// normalizeAcceptEncoding reduces the Accept-Encoding of an upstream request to
+// the one thing GCS acts on, whether gzip is acceptable. Sending identity
+// rather than nothing also stops http.Transport quietly asking for gzip and
+// decompressing it behind our back.
+func normalizeAcceptEncoding(req *http.Request) {
+	if acceptsEncoding(req, "gzip") {
+		req.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// decoder returns a reader decompressing r from Content-Encoding enc, or nil if
+// it's not an encoding we can undo. Its output is held to the decompression
+// limits.
+func decoder(enc string, r io.Reader) (io.ReadCloser, error) {
+	in := &countingReader{r: r}
+	var d io.ReadCloser
+	switch contentEncoding(enc) {
+	case "identity":
+		return ioutil.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, fmt.Errorf("gzip.NewReader: %v", err)
+		}
+		d = zr
+	case "deflate":
+		d = flate.NewReader(in)
+	default:
+		return nil, nil
+	}
+	return &limitedDecoder{ReadCloser: d, in: in}, nil
+}
+
+// decodeForClient decompresses resp if it's encoded in a way req didn't accept.
+// GCS does that for objects stored with Cache-Control: no-transform.
+func decodeForClient(req *http.Request, resp *http.Response) error {
+	enc := resp.Header.Get("Content-Encoding")
+	// A range of the encoded bytes can't be decoded on its own.
+	if contentEncoding(enc) == "identity" || acceptsEncoding(req, enc) || req.Method == http.MethodHead || resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+	if !transformAllowed(req, resp.Header) {
+		transformsSkipped.Add(1)
+		return nil
+	}
+	d, err := decoder(enc, resp.Body)
+	if err != nil || d == nil {
+		return err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{d, resp.Body}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Range")
+	resp.Header.Del("Accept-Ranges")
+	// The decoded body is a different representation, so it can't share the
+	// stored object's strong ETag.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// transformableBody reads resp's body, decompressed, for a middleware to rewrite.
+// It reports false, leaving resp to be sent as is, if the encoding is one we
+// can't undo or the body is bigger than maxTransformSize; in the latter case the
+// body is also decompressed so nothing downstream sees a half-read stream.
+func transformableBody(resp *http.Response) ([]byte, bool, error) {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		// There's no body to rewrite.
+		return nil, false, nil
+	}
+	if resp.ContentLength > maxTransformSize {
+		return nil, false, nil
+	}
+	body, err := decoder(resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil || body == nil {
+		return nil, false, err
+	}
+	doc, err := ioutil.ReadAll(io.LimitReader(body, maxTransformSize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, false, err
+	}
+	if len(doc) > maxTransformSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(doc), body), resp.Body}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Content-Encoding")
+		return nil, false, nil
+	}
+	resp.Body.Close()
+	return doc, true, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var notModifiedServed = expvar.NewInt("not_modified_served")
+
+// ensureETag gives a response GCS sent without an ETag one, from the object's
+// MD5 if GCS has one, as its own ETags are, or else its generation.
+func ensureETag(h http.Header) {
+	if h.Get("ETag") != "" {
+		return
+	}
+	for _, v := range h.Values("X-Goog-Hash") {
+		for _, kv := range strings.Split(v, ",") {
+			kv = strings.TrimSpace(kv)
+			if !strings.HasPrefix(kv, "md5=") {
+				continue
+			}
+			if sum, err := base64.StdEncoding.DecodeString(kv[len("md5="):]); err == nil {
+				h.Set("ETag", strconv.Quote(hex.EncodeToString(sum)))
+				return
+			}
+		}
+	}
+	if gen := h.Get("X-Goog-Generation"); gen != "" {
+		h.Set("ETag", strconv.Quote(gen))
+	}
+}
+
+// answerConditional turns a 200 into a 304 when the client already has what it
+// would get. The bucket answers conditionals itself, but not for bodies we
+// rewrote on the way out, whose ETags are our own.
+func answerConditional(resp *http.Response) {
+	req := resp.Request
+	if resp.StatusCode != http.StatusOK || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return
+	}
+	ensureETag(resp.Header)
+	etag := resp.Header.Get("ETag")
+	lm, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if lm.IsZero() && req.Header.Get("If-None-Match") == "" {
+		// If-Modified-Since means nothing without a Last-Modified.
+		return
+	}
+	if !notModified(req, etag, lm) {
+		return
+	}
+	resp.Body.Close()
+	resp.Body = http.NoBody
+	resp.StatusCode = http.StatusNotModified
+	resp.Status = "304 Not Modified"
+	resp.ContentLength = 0
+	for _, h := range []string{"Content-Length", "Content-Encoding", "Content-Range", "Digest", "Repr-Digest"} {
+		resp.Header.Del(h)
+	}
+	notModifiedServed.Add(1)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventBufferSize is how many events a subscriber can fall behind by before
+// events are dropped for it.
+const eventBufferSize = 1024
+
+var eventsDropped = expvar.NewInt("events_dropped")
+
+// Event is something that happened while serving that other parts of hugoproxy
+// may want to react to. Subscribers type switch on the concrete event types.
+type Event interface {
+	isEvent()
+}
+
+// RequestCompleted is published after every proxied request has been answered.
+type RequestCompleted struct {
+	Time     time.Time
+	Host     string
+	Method   string
+	Path     string
+	Referer  string
+	Status   int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// CertificateStored is published when autocert stores a new or renewed
+// certificate (or account key) in the certificate cache.
+type CertificateStored struct {
+	Time time.Time
+	Name string
+}
+
+// CachePurged is published when entries are purged from the cache through
+// /admin/purge. Host is empty when every host's entries were purged.
+type CachePurged struct {
+	Time   time.Time
+	Host   string
+	Path   string
+	Prefix string
+	Tag    string
+	All    bool
+	Purged int
+}
+
+// DeploySwitched is published when a deploy changes some of a site's
+// --ping_sitemaps or --ping_feeds. Site is the bucket and prefix, as
+// gs://bucket/prefix, and Hosts are those known to serve it.
+type DeploySwitched struct {
+	Time     time.Time
+	Site     string
+	Hosts    []string
+	Sitemaps []string
+	Feeds    []string
+}
+
+func (RequestCompleted) isEvent()  {}
+func (CertificateStored) isEvent() {}
+func (CachePurged) isEvent()       {}
+func (DeploySwitched) isEvent()    {}
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   []chan Event
+)
+
+// subscribe calls fn, from a goroutine of its own, with every event published from
+// now on. Slow subscribers lose events rather than holding up the publisher.
+func subscribe(fn func(Event)) {
+	ch := make(chan Event, eventBufferSize)
+	subscribersMu.Lock()
+	subscribers = append(subscribers, ch)
+	subscribersMu.Unlock()
+	go func() {
+		for e := range ch {
+			fn(e)
+		}
+	}()
+}
+
+// publish hands e to every subscriber without blocking.
+func publish(e Event) {
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	for _, ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+			eventsDropped.Add(1)
+		}
+	}
+}
+
+// recorderPool saves publishRequests allocating a recorder per request.
+var recorderPool = sync.Pool{New: func() interface{} { return &statusRecorder{} }}
+
+// publishRequests publishes a RequestCompleted event for every request h serves.
+func publishRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := recorderPool.Get().(*statusRecorder)
+		*rec = statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		publish(RequestCompleted{
+			Time:     start,
+			Host:     r.Host,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Referer:  r.Referer(),
+			Status:   rec.Status(),
+			Bytes:    rec.bytes,
+			Duration: time.Since(start),
+		})
+		*rec = statusRecorder{}
+		recorderPool.Put(rec)
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+var (
+	gcsNotifySubscription = flag.String("gcs_notify_subscription", "", "Pub/Sub subscription, as projects/P/subscriptions/S or just S in --gcp_project, to a topic the buckets send their object change notifications to (gsutil notification create -f json -t TOPIC gs://BUCKET); each changed object's pages are dropped from the --cache_size cache as soon as it's written or deleted")
+	gcsNotifyRefresh      = flag.Bool("gcs_notify_refresh", false, "fetch the pages --gcs_notify_subscription drops from the cache straight back into it, so the first reader after a deploy doesn't wait on the bucket")
+)
+
+// gcsNotifyMaxBackoff is the longest we wait before pulling again after
+// failed pulls.
+const gcsNotifyMaxBackoff = time.Minute
+
+var (
+	gcsNotifications   = expvar.NewInt("gcs_notifications")
+	gcsNotifyErrors    = expvar.NewInt("gcs_notify_errors")
+	cacheInvalidations = expvar.NewInt("cache_invalidations")
+)
+
+// changedObject is where an object a notification is about is served from.
+type changedObject struct {
+	bucket string
+	// path is the object name as it appears in an upstream URL, with a
+	// leading slash.
+	path string
+}
+
+// changedObjects lists the places bucket's object name is served from: the
+// bucket itself, and the base of any --overlay_buckets it's the overlay of,
+// since pages from an overlay are cached under the base's URL.
+func changedObjects(bucket, name string) []changedObject {
+	objs := []changedObject{{bucket, "/" + name}}
+	overlaysOnce.Do(parseOverlays)
+	for _, o := range overlays {
+		overPath := o.over.Path
+		if overPath == "" {
+			overPath = "/"
+		}
+		if o.over.Host == bucket && strings.HasPrefix("/"+name, overPath) {
+			objs = append(objs, changedObject{o.base.Host, singleJoiningSlash(o.base.Path, strings.TrimPrefix("/"+name, overPath))})
+		}
+	}
+	return objs
+}
+
+// affects reports whether e might have been answered from obj: it's the
+// object itself, the directory obj is the index document of, or a 404
+// answered with obj as the not found page.
+func (obj changedObject) affects(e *cacheEntry) bool {
+	u, err := url.Parse(e.url)
+	if err != nil || u.Host != obj.bucket {
+		return false
+	}
+	p := u.Path
+	if p == "" {
+		p = "/"
+	}
+	if p == obj.path {
+		return true
+	}
+	for _, idx := range indexFilesFor(e.host) {
+		if strings.HasSuffix(obj.path, "/"+idx) {
+			dir := strings.TrimSuffix(obj.path, idx)
+			if p == dir || p+"/" == dir {
+				return true
+			}
+		}
+	}
+	if e.status == 404 && *storageNotFoundPage != "" && strings.HasSuffix(obj.path, "/"+*storageNotFoundPage) {
+		return strings.HasPrefix(p, strings.TrimSuffix(obj.path, *storageNotFoundPage))
+	}
+	return false
+}
+
+// invalidate drops the entries any of objs affects and returns them.
+func (c *cache) invalidate(objs []changedObject) []*cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var dropped []*cacheEntry
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*cacheEntry)
+		for _, obj := range objs {
+			if obj.affects(e) {
+				c.remove(el)
+				dropped = append(dropped, e)
+				break
+			}
+		}
+		el = next
+	}
+	return dropped
+}
+
+// refresh fetches entries back into c the way warm does, except the ones
+// only HEADs have asked for.
+func (c *cache) refresh(entries []*cacheEntry) {
+	for _, e := range entries {
+		u, err := url.Parse(e.url)
+		if err != nil || e.headOnly {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		req := warmRequest(ctx, cacheIndexEntry{Key: e.key, URL: e.url, Host: e.host, Gzip: e.gzip}, map[string]bool{u.Host: true})
+		if req != nil {
+			if resp, err := c.RoundTrip(req); err != nil {
+				log.V(1).Infof("Error refreshing %s in the cache: %v", e.url, err)
+			} else {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}
+		cancel()
+	}
+}
+
+// handleNotification invalidates what a GCS notification's object change
+// affects. Its attributes say what happened; the JSON object in the payload,
+// if any, isn't needed.
+func (c *cache) handleNotification(attrs map[string]string) {
+	bucket, name := attrs["bucketId"], attrs["objectId"]
+	if bucket == "" || name == "" {
+		log.V(1).Infof("Ignoring Pub/Sub message that isn't a GCS notification: %v", attrs)
+		return
+	}
+	dropped := c.invalidate(changedObjects(bucket, name))
+	cacheInvalidations.Add(int64(len(dropped)))
+	log.V(1).Infof("%s of gs://%s/%s dropped %d cache entries", attrs["eventType"], bucket, name, len(dropped))
+	if *gcsNotifyRefresh && attrs["eventType"] != "OBJECT_DELETE" && attrs["eventType"] != "OBJECT_ARCHIVE" {
+		c.refresh(dropped)
+	}
+}
+
+// startGCSNotify pulls --gcs_notify_subscription until we exit, invalidating
+// rt's entries as objects change. rt has to be a cache.
+func startGCSNotify(ctx context.Context, rt http.RoundTripper, opts []option.ClientOption) {
+	if *gcsNotifySubscription == "" {
+		return
+	}
+	c, ok := rt.(*cache)
+	if !ok {
+		log.Exitf("--gcs_notify_subscription needs the --cache_size cache")
+	}
+	sub := *gcsNotifySubscription
+	if !strings.HasPrefix(sub, "projects/") {
+		p := *project
+		if p == "" {
+			var err error
+			if p, err = projectID(ctx); err != nil {
+				log.Exitf("projectID: %v", err)
+			}
+		}
+		sub = "projects/" + p + "/subscriptions/" + sub
+	}
+	if h := os.Getenv("PUBSUB_EMULATOR_HOST"); h != "" {
+		// The emulator serves the REST API too, without authentication.
+		opts = []option.ClientOption{option.WithEndpoint("http://" + h + "/"), option.WithoutAuthentication()}
+	}
+	s, err := pubsub.NewService(ctx, opts...)
+	if err != nil {
+		log.Exitf("pubsub.NewService: %v", err)
+	}
+	log.Infof("Invalidating the cache from GCS notifications on %s", sub)
+	go c.pullNotifications(ctx, s.Projects.Subscriptions, sub)
+}
+
+func (c *cache) pullNotifications(ctx context.Context, subs *pubsub.ProjectsSubscriptionsService, sub string) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		resp, err := subs.Pull(sub, &pubsub.PullRequest{MaxMessages: 100}).Context(ctx).Do()
+		if err != nil {
+			gcsNotifyErrors.Add(1)
+			log.Errorf("Error pulling %s: %v", sub, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > gcsNotifyMaxBackoff {
+				backoff = gcsNotifyMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		if len(resp.ReceivedMessages) == 0 {
+			continue
+		}
+		var ackIDs []string
+		for _, m := range resp.ReceivedMessages {
+			gcsNotifications.Add(1)
+			if m.Message != nil {
+				c.handleNotification(m.Message.Attributes)
+			}
+			ackIDs = append(ackIDs, m.AckId)
+		}
+		if _, err := subs.Acknowledge(sub, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).Context(ctx).Do(); err != nil {
+			// They'll be redelivered, which only costs another invalidation.
+			gcsNotifyErrors.Add(1)
+			log.Warningf("Error acknowledging %d messages on %s: %v", len(ackIDs), sub, err)
+		}
+	}
+}
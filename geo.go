@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	geoDB            = flag.String("geo_db", "", "IP to ASN and country database to count requests by where they come from, in the TSV format of iptoasn.com's ip2asn-combined.tsv (gzipped or not); read at startup")
+	geoCountryHeader = flag.String("geo_country_header", "", "request header a load balancer puts the client's country code in, e.g. X-Client-Geo-Location set to {client_region} on a Google Cloud load balancer, or CF-IPCountry behind Cloudflare; it takes precedence over --geo_db's country")
+	geoMaxASNs       = flag.Int("geo_max_asns", 500, "most ASNs to count requests for separately; requests from any further ones count as other")
+)
+
+var (
+	requestsByCountry     = expvar.NewMap("requests_by_country")
+	serverErrorsByCountry = expvar.NewMap("server_errors_by_country")
+	requestsByASN         = expvar.NewMap("requests_by_asn")
+	serverErrorsByASN     = expvar.NewMap("server_errors_by_asn")
+)
+
+// ipRange is one row of the --geo_db: the addresses from start to end, both
+// in 16 byte form, announced by asn and located in country.
+type ipRange struct {
+	start, end [16]byte
+	asn        uint32
+	country    string
+}
+
+// geoTable is the --geo_db, its ranges sorted by start.
+type geoTable struct {
+	ranges []ipRange
+}
+
+// loadGeoDB reads an ip2asn TSV: range start, range end, AS number, country
+// code and AS description, separated by tabs.
+func loadGeoDB(name string) (*geoTable, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	t := &geoTable{}
+	// Countries are interned, there are only a few hundred of them.
+	countries := map[string]string{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.SplitN(s.Text(), "\t", 5)
+		if len(fields) < 4 {
+			continue
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if start == nil || end == nil || err != nil {
+			return nil, fmt.Errorf("%s:%d: want start IP, end IP, AS number and country, got %q", name, n, s.Text())
+		}
+		c, ok := countries[fields[3]]
+		if !ok {
+			c = fields[3]
+			countries[c] = c
+		}
+		ir := ipRange{asn: uint32(asn), country: c}
+		copy(ir.start[:], start.To16())
+		copy(ir.end[:], end.To16())
+		t.ranges = append(t.ranges, ir)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	sort.Slice(t.ranges, func(i, j int) bool { return bytes.Compare(t.ranges[i].start[:], t.ranges[j].start[:]) < 0 })
+	return t, nil
+}
+
+// lookup finds the range ip is in, or returns nil.
+func (t *geoTable) lookup(ip net.IP) *ipRange {
+	ip = ip.To16()
+	if t == nil || ip == nil {
+		return nil
+	}
+	// The first range starting after ip, so the one before is the candidate.
+	i := sort.Search(len(t.ranges), func(i int) bool { return bytes.Compare(t.ranges[i].start[:], ip) > 0 })
+	if i == 0 {
+		return nil
+	}
+	if r := &t.ranges[i-1]; bytes.Compare(ip, r.end[:]) <= 0 {
+		return r
+	}
+	return nil
+}
+
+// clientOrigin works out the country and ASN of r's client, as they're
+// counted: "unknown" when there's no telling, and "other" for ASNs past
+// --geo_max_asns.
+type clientOrigin struct {
+	db *geoTable
+
+	mu   sync.Mutex
+	asns map[string]bool
+}
+
+func (o *clientOrigin) of(r *http.Request) (country, asn string) {
+	country, asn = "unknown", "unknown"
+	if rng := o.db.lookup(clientIP(r)); rng != nil {
+		// ip2asn says None for unrouted space and 0 for no AS.
+		if len(rng.country) == 2 {
+			country = rng.country
+		}
+		if rng.asn != 0 {
+			asn = o.limit("AS" + strconv.FormatUint(uint64(rng.asn), 10))
+		}
+	}
+	if *geoCountryHeader != "" {
+		// A Google Cloud load balancer's header can hold more than the region,
+		// like {client_region},{client_city}.
+		v := strings.TrimSpace(strings.SplitN(r.Header.Get(*geoCountryHeader), ",", 2)[0])
+		if len(v) == 2 && isASCIILetters(v) {
+			country = strings.ToUpper(v)
+		}
+	}
+	return country, asn
+}
+
+// limit keeps the number of ASNs counted separately to --geo_max_asns.
+func (o *clientOrigin) limit(asn string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.asns[asn] {
+		return asn
+	}
+	if len(o.asns) >= *geoMaxASNs {
+		return "other"
+	}
+	o.asns[asn] = true
+	return asn
+}
+
+func isASCIILetters(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// withClientOrigins counts requests and server errors by the client's country
+// and ASN, for telling a scraping farm or a regional outage from the metrics.
+func withClientOrigins(h http.Handler) http.Handler {
+	if *geoDB == "" && *geoCountryHeader == "" {
+		return h
+	}
+	o := &clientOrigin{asns: map[string]bool{}}
+	if *geoDB != "" {
+		db, err := loadGeoDB(*geoDB)
+		if err != nil {
+			log.Exitf("loadGeoDB: %v", err)
+		}
+		log.Infof("Loaded %d address ranges from %s", len(db.ranges), *geoDB)
+		o.db = db
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		country, asn := o.of(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		// Deferred to count requests the reverse proxy abandons too.
+		defer func() {
+			requestsByCountry.Add(country, 1)
+			if *geoDB != "" {
+				requestsByASN.Add(asn, 1)
+			}
+			if rec.Status() >= 500 {
+				serverErrorsByCountry.Add(country, 1)
+				if *geoDB != "" {
+					serverErrorsByASN.Add(asn, 1)
+				}
+			}
+		}()
+		h.ServeHTTP(rec, r)
+	})
+}
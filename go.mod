@@ -5,8 +5,26 @@ go 1.15
 require (
 	cloud.google.com/go v0.88.0
 	cloud.google.com/go/datastore v1.5.0
+	cloud.google.com/go/storage v1.16.0
+	github.com/BurntSushi/toml v0.4.1
+	github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace v1.0.0
 	github.com/golang/glog v0.0.0-20210429001901-424d2337a529
+	github.com/golang/snappy v0.0.3
 	github.com/gorilla/handlers v1.5.1
 	github.com/mikewiacek/flags v0.0.0-20190603023329-1be21e8282ef
+	go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace v0.24.0
+	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.24.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	golang.org/x/net v0.0.0-20210716203947-853a461950ff
+	golang.org/x/oauth2 v0.0.0-20210628180205-a41e5a781914
+	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c
+	google.golang.org/api v0.51.0
+	google.golang.org/genproto v0.0.0-20210722135532-667f2b7c528f
+	google.golang.org/grpc v1.41.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	runAs      = flag.String("run_as", "", "user, or user:group, to switch to once the listeners are open, so a proxy started as root to bind ports 80 and 443 doesn't keep serving as root (Linux only); certificate files, --cache_index_file and the access log need to be usable by it")
+	useSeccomp = flag.Bool("seccomp", false, "once the listeners are open, have the kernel refuse syscalls serving has no use for, like running programs, ptrace, mounting, loading modules and changing users (Linux on amd64 and arm64 only)")
+)
+
+// dropPrivileges applies --run_as and --seccomp. It's called once every
+// listener is open, and exits if either can't be applied rather than serve
+// without them.
+func dropPrivileges() {
+	if *runAs != "" {
+		if err := switchUser(*runAs); err != nil {
+			log.Exitf("--run_as=%s: %v", *runAs, err)
+		}
+	}
+	if *useSeccomp {
+		if err := applySeccomp(); err != nil {
+			log.Exitf("--seccomp: %v", err)
+		}
+		log.Info("Applied the seccomp filter")
+	}
+}
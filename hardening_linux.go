@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	log "github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// switchUser becomes spec, a user or user:group by name or number, along
+// with the user's supplementary groups. Since Go 1.16 syscall.Setuid and
+// friends change every thread, not just the calling one.
+func switchUser(spec string) error {
+	name, group := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, group = spec[:i], spec[i+1:]
+	}
+	u, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	groups := []int{gid}
+	if group != "" {
+		g, err := lookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+		groups = []int{gid}
+	} else if ids, err := u.GroupIds(); err == nil {
+		groups = groups[:0]
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, n)
+			}
+		}
+	}
+	if os.Getuid() == uid && os.Geteuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid(%d): %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid(%d): %v", uid, err)
+	}
+	// Make sure there's no way back.
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("could still become root after dropping privileges")
+	}
+	log.Infof("Running as %s (uid %d, gid %d)", u.Username, uid, gid)
+	return nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// A uid with no passwd entry, as in a distroless container.
+		return &user.User{Uid: name, Gid: name, Username: name}, nil
+	}
+	return user.Lookup(name)
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return &user.Group{Gid: name, Name: name}, nil
+	}
+	return user.LookupGroup(name)
+}
+
+// seccompArches are the AUDIT_ARCH values of the architectures the seccomp
+// filter knows the syscall numbers of.
+var seccompArches = map[string]uint32{
+	"amd64": 0xc000003e,
+	"arm64": 0xc00000b7,
+}
+
+// seccompDenied are the syscalls the filter refuses. It's a deny list, rather
+// than a list of what's allowed, so a new Go runtime or library needing some
+// syscall we didn't think of doesn't break serving; these are the ones an
+// attacker who got code running in the proxy would want.
+var seccompDenied = []uintptr{
+	unix.SYS_EXECVE, unix.SYS_EXECVEAT,
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD, unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF, unix.SYS_ACCT,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+	unix.SYS_SETUID, unix.SYS_SETGID, unix.SYS_SETREUID, unix.SYS_SETREGID,
+	unix.SYS_SETRESUID, unix.SYS_SETRESGID, unix.SYS_SETGROUPS,
+	unix.SYS_SETFSUID, unix.SYS_SETFSGID, unix.SYS_CAPSET,
+	unix.SYS_OPEN_BY_HANDLE_AT, unix.SYS_PERSONALITY,
+}
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+	// x32 syscalls on amd64 have this bit set and numbers of their own.
+	x32SyscallBit = 0x40000000
+)
+
+// applySeccomp installs a filter on every thread that fails the
+// seccompDenied syscalls, and syscalls of other ABIs, with EPERM.
+func applySeccomp() error {
+	arch, ok := seccompArches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("not supported on %s", runtime.GOARCH)
+	}
+	deny := uint32(seccompRetErrno | uint32(unix.EPERM))
+	n := uint8(len(seccompDenied))
+	prog := []unix.SockFilter{
+		// seccomp_data.arch
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+		// seccomp_data.nr
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: n + 1, K: x32SyscallBit},
+	}
+	for i, nr := range seccompDenied {
+		// Jump past the rest and the allow to the deny at the end.
+		prog = append(prog, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: n - uint8(i), K: uint32(nr)})
+	}
+	prog = append(prog,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+	)
+
+	// no_new_privs is per thread until the filter syncs it to the rest, so
+	// both have to happen on the same one.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %v", err)
+	}
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp(SECCOMP_SET_MODE_FILTER): %v", errno)
+	}
+	if tid != 0 {
+		return fmt.Errorf("seccomp(SECCOMP_SET_MODE_FILTER): thread %d couldn't take the filter", tid)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func switchUser(spec string) error {
+	return errors.New("only supported on Linux")
+}
+
+func applySeccomp() error {
+	return errors.New("only supported on Linux")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/textproto"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var headerCase = flags.StringSlice("header_case", []string{}, "CSV of response header names to send with exactly this casing over HTTP/1.x, e.g. ETag,X-UA-Compatible, for clients that compare header names case-sensitively")
+
+// headerCaseExempt are headers net/http looks up by their canonical name while
+// writing the response; renaming them would make it add a second copy.
+var headerCaseExempt = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Date":              true,
+	"Transfer-Encoding": true,
+}
+
+// headerCaseNames maps canonical header names to --header_case spellings.
+func headerCaseNames() map[string]string {
+	names := map[string]string{}
+	for _, name := range *headerCase {
+		canon := textproto.CanonicalMIMEHeaderKey(name)
+		if headerCaseExempt[canon] {
+			log.Exitf("--header_case can't change the casing of %s, net/http writes it itself", canon)
+		}
+		if canon != name {
+			names[canon] = name
+		}
+	}
+	return names
+}
+
+// headerCaseWriter renames headers to their --header_case spellings just
+// before they're written. net/http writes header map keys as they are, so
+// moving a value to a non-canonical key is all it takes.
+type headerCaseWriter struct {
+	http.ResponseWriter
+	names   map[string]string
+	written bool
+}
+
+func (w *headerCaseWriter) recase() {
+	if w.written {
+		return
+	}
+	w.written = true
+	h := w.ResponseWriter.Header()
+	for canon, name := range w.names {
+		if v, ok := h[canon]; ok {
+			delete(h, canon)
+			h[name] = v
+		}
+	}
+}
+
+func (w *headerCaseWriter) WriteHeader(code int) {
+	w.recase()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerCaseWriter) Write(b []byte) (int, error) {
+	w.recase()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets httputil.ReverseProxy flush through the writer.
+func (w *headerCaseWriter) Flush() {
+	w.recase()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *headerCaseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withHeaderCase sends --header_case headers with their exact casing. HTTP/2
+// and later require lower case names on the wire, so it only applies to
+// HTTP/1.x requests.
+func withHeaderCase(h http.Handler) http.Handler {
+	names := headerCaseNames()
+	if len(names) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 1 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&headerCaseWriter{ResponseWriter: w, names: names}, r)
+	})
+}
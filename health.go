@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	healthChecks      = flag.Bool("health_checks", false, "answer /healthz (liveness) and /readyz (readiness) probes ahead of the site content")
+	readinessInterval = flag.Duration("readiness_interval", 30*time.Second, "how often to re-run the readiness checks, that the buckets and the certificate cache answer, once ready; 0 only checks at startup")
+	readinessFailures = flag.Int("readiness_failures", 3, "consecutive failed readiness checks before /readyz reports not ready, and passing ones before it recovers")
+)
+
+// ready is non-zero while this instance should be receiving traffic. It's
+// flipped on once the listeners have everything they need to serve, and off
+// while the readiness checks keep failing or once we're shutting down.
+var ready, stopping int32
+
+func setReady(r bool) {
+	var v int32
+	if r {
+		if atomic.LoadInt32(&stopping) != 0 {
+			return
+		}
+		v = 1
+	}
+	atomic.StoreInt32(&ready, v)
+}
+
+// setStopping reports not ready for good, whatever the checks say.
+func setStopping() {
+	atomic.StoreInt32(&stopping, 1)
+	setReady(false)
+}
+
+// readinessCheck is something that has to succeed before we report ready.
+type readinessCheck func(ctx context.Context) error
+
+// checkUpstream verifies the bucket's HTTP endpoint answers. Any response short
+// of a server error will do; the root of a bucket is often a 404.
+func checkUpstream(u *url.URL) readinessCheck {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("HEAD %s: %s: the bucket has to be publicly readable (allUsers needs roles/storage.objectViewer)", u, resp.Status)
+		}
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("HEAD %s: %s", u, resp.Status)
+		}
+		return nil
+	}
+}
+
+// checkCertCache verifies the certificate cache can be read. A miss is fine, it
+// only has to answer.
+func checkCertCache(c autocert.Cache) readinessCheck {
+	return func(ctx context.Context) error {
+		if _, err := c.Get(ctx, "hugoproxy-readiness-check"); err != nil && err != autocert.ErrCacheMiss {
+			return fmt.Errorf("certificate cache: %v", err)
+		}
+		return nil
+	}
+}
+
+// runChecks runs checks in order, stopping at the first to fail.
+func runChecks(checks []readinessCheck) error {
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := check(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// becomeReady runs checks until they all pass, then marks us ready and tells
+// systemd, if it's watching, that startup is complete. After that it keeps
+// running them every --readiness_interval.
+func becomeReady(checks ...readinessCheck) {
+	for {
+		err := runChecks(checks)
+		if err == nil {
+			break
+		}
+		log.Warningf("Not ready yet: %v", err)
+		sdStatus("Not ready yet: " + err.Error())
+		time.Sleep(5 * time.Second)
+	}
+
+	setReady(true)
+	log.Info("Startup checks passed, ready to serve")
+	if err := sdNotify("READY=1\nSTATUS=Ready"); err != nil {
+		log.Errorf("sdNotify(READY=1): %v", err)
+	}
+	if *readinessInterval > 0 {
+		watchReadiness(checks)
+	}
+}
+
+// watchReadiness takes us out of rotation when checks fail --readiness_failures
+// times in a row, say because Datastore or the bucket went away, and back in
+// once they've passed as many times. A single blip doesn't drain traffic.
+func watchReadiness(checks []readinessCheck) {
+	failed, passed := 0, 0
+	isReady := true
+	for range time.Tick(*readinessInterval) {
+		if err := runChecks(checks); err != nil {
+			failed, passed = failed+1, 0
+			log.Warningf("Readiness check failed (%d in a row): %v", failed, err)
+			if isReady && failed >= *readinessFailures {
+				log.Errorf("Readiness checks failed %d times in a row, reporting not ready", failed)
+				isReady = false
+				setReady(false)
+				sdStatus("Not ready: " + err.Error())
+			}
+			continue
+		}
+		failed, passed = 0, passed+1
+		if !isReady && passed >= *readinessFailures {
+			log.Info("Readiness checks pass again, ready to serve")
+			isReady = true
+			setReady(true)
+			sdStatus("Ready")
+		}
+	}
+}
+
+// withHealthChecks answers /healthz and /readyz ahead of h. Liveness only says
+// the process is up and serving HTTP; it deliberately doesn't look at GCS or
+// Datastore so a backend outage doesn't get every replica restarted. Readiness
+// reports whether we're able to serve, so a load balancer or kubelet can hold
+// traffic back until we are.
+func withHealthChecks(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("ok\n"))
+		case "/readyz":
+			w.Header().Set("Cache-Control", "no-store")
+			if atomic.LoadInt32(&ready) == 0 {
+				http.Error(w, "not ready", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok\n"))
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var hostBuckets = flags.StringSlice("host_buckets", []string{}, "CSV of host=bucket entries serving a host from its own bucket, or a prefix of one, e.g. blog.example.com=gs://blog,docs.example.com=gs://sites/docs/; other hosts use --gcs_bucket. The hosts get certificates like --blog_hostnames. A wildcard host serves each host one label under it from the prefix with that label in place of $subdomain, e.g. *.docs.example.com=gs://sites/docs/$subdomain/, and gets a certificate like --wildcard_domains")
+
+var (
+	hostBucketsOnce sync.Once
+	hostBucketURLs  map[string]*url.URL
+	// hostBucketWildcards holds the wildcard hosts, like *.docs.example.com,
+	// whose bucket URLs have $subdomain in their paths.
+	hostBucketWildcards map[string]*url.URL
+)
+
+// subdomainVar is replaced by the subdomain in the prefix of a wildcard host.
+const subdomainVar = "$subdomain"
+
+// bucketURL is the upstream URL for a bucket, given with or without gs://. A
+// path after the bucket name is a prefix, which always ends up ending in /.
+func bucketURL(bucket string) (*url.URL, error) {
+	u, err := url.Parse("http://" + strings.TrimPrefix(strings.TrimPrefix(bucket, "gs://"), "s3://"))
+	if err != nil {
+		return nil, err
+	}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		u.Path = "/" + p + "/"
+	} else {
+		u.Path = ""
+	}
+	u.RawPath = ""
+	return u, nil
+}
+
+// normalizeHost lower cases host and drops any port.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func parseHostBuckets() {
+	hostBucketURLs = map[string]*url.URL{}
+	hostBucketWildcards = map[string]*url.URL{}
+	for _, e := range *hostBuckets {
+		i := strings.Index(e, "=")
+		if i < 0 {
+			log.Exitf("Bad --host_buckets entry %q, want host=bucket", e)
+		}
+		u, err := bucketURL(e[i+1:])
+		if err != nil || u.Host == "" {
+			log.Exitf("Bad --host_buckets entry %q: %v", e, err)
+		}
+		host := normalizeHost(e[:i])
+		if !strings.HasPrefix(host, "*.") {
+			hostBucketURLs[host] = u
+			continue
+		}
+		if strings.Count(host, ".") < 2 || strings.Contains(host[2:], "*") || !strings.Contains(u.Path, subdomainVar) {
+			log.Exitf("Bad --host_buckets entry %q: a wildcard host like *.docs.example.com needs %s in its prefix, like gs://sites/docs/%s/", e, subdomainVar, subdomainVar)
+		}
+		hostBucketWildcards[host] = u
+	}
+}
+
+// isDNSLabel reports whether s can be one label of a hostname.
+func isDNSLabel(s string) bool {
+	if s == "" || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// hostBucketURL returns the upstream URL of the bucket --host_buckets maps host
+// to, or nil if it's served from --gcs_bucket.
+func hostBucketURL(host string) *url.URL {
+	hostBucketsOnce.Do(parseHostBuckets)
+	host = normalizeHost(host)
+	if u := hostBucketURLs[host]; u != nil || len(hostBucketWildcards) == 0 {
+		return u
+	}
+	i := strings.Index(host, ".")
+	if i <= 0 {
+		return nil
+	}
+	w := hostBucketWildcards["*"+host[i:]]
+	if w == nil || !isDNSLabel(host[:i]) {
+		return nil
+	}
+	u := *w
+	u.Path = strings.Replace(w.Path, subdomainVar, host[:i], -1)
+	return &u
+}
+
+// route is where the director sends a host's requests.
+type route struct {
+	target *url.URL
+	// join is set if target has a path to put in front of the request's.
+	join bool
+}
+
+func newRoute(target *url.URL) *route {
+	return &route{target: target, join: target.Path != "" && target.Path != "/"}
+}
+
+// routeTable has a route worked out ahead of time for each host in
+// --host_buckets, by the host as clients send it, so the director finds it
+// without normalizing the host or building a URL.
+type routeTable struct {
+	def   *route
+	hosts map[string]*route
+}
+
+func newRouteTable(def *url.URL) *routeTable {
+	hostBucketsOnce.Do(parseHostBuckets)
+	t := &routeTable{def: newRoute(def), hosts: map[string]*route{}}
+	for host, u := range hostBucketURLs {
+		t.hosts[host] = newRoute(u)
+	}
+	return t
+}
+
+// lookup returns host's route. Hosts under a wildcard, or sent with a port or
+// capitals, are looked up in --host_buckets each time.
+func (t *routeTable) lookup(host string) *route {
+	if r := t.hosts[host]; r != nil {
+		return r
+	}
+	if len(hostBucketWildcards) == 0 && strings.IndexByte(host, ':') < 0 && strings.ToLower(host) == host {
+		return t.def
+	}
+	if u := hostBucketURL(host); u != nil {
+		return newRoute(u)
+	}
+	return t.def
+}
+
+// hostPrefix returns the bucket prefix --host_buckets gives host, like
+// "docs/", or "" if it's served from the top of a bucket.
+func hostPrefix(host string) string {
+	if u := hostBucketURL(host); u != nil {
+		return strings.TrimPrefix(u.Path, "/")
+	}
+	return ""
+}
+
+// clientPath turns the upstream path p of an object under host's prefix back
+// into the path the client uses for it, reporting false if it's outside it.
+func clientPath(host, p string) (string, bool) {
+	prefix := hostPrefix(host)
+	if prefix == "" {
+		return p, true
+	}
+	if !strings.HasPrefix(p, "/"+prefix) {
+		return p, false
+	}
+	return "/" + strings.TrimPrefix(p, "/"+prefix), true
+}
+
+// hostBucketHosts returns the hosts in --host_buckets, but not the wildcards.
+func hostBucketHosts() []string {
+	hostBucketsOnce.Do(parseHostBuckets)
+	var hosts []string
+	for h := range hostBucketURLs {
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// hostBucketWildcardHosts returns the wildcard hosts in --host_buckets.
+func hostBucketWildcardHosts() []string {
+	hostBucketsOnce.Do(parseHostBuckets)
+	var hosts []string
+	for h := range hostBucketWildcards {
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// allBucketURLs returns def and every --host_buckets bucket, each once.
+func allBucketURLs(def *url.URL) []*url.URL {
+	hostBucketsOnce.Do(parseHostBuckets)
+	urls := []*url.URL{def}
+	seen := map[string]bool{def.Host: true}
+	for _, u := range hostBucketURLs {
+		if !seen[u.Host] {
+			seen[u.Host] = true
+			urls = append(urls, u)
+		}
+	}
+	for _, u := range hostBucketWildcards {
+		if !seen[u.Host] {
+			seen[u.Host] = true
+			urls = append(urls, &url.URL{Scheme: u.Scheme, Host: u.Host})
+		}
+	}
+	return urls
+}
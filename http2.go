@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"net"
+	"net/http"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/http2"
+)
+
+var (
+	http2MaxConcurrentStreams = flag.Uint("http2_max_concurrent_streams", 0, "streams each HTTP/2 client may have open at once (0 for the default, 250)")
+	http2MaxReadFrameSize     = flag.Uint("http2_max_read_frame_size", 0, "largest HTTP/2 frame to accept from clients, from 16384 to 16777215 bytes (0 for the default, 1MiB)")
+	http2StreamWindow         = flag.Int("http2_initial_stream_window", 0, "initial HTTP/2 flow control window of each stream, in bytes: how much a client may send on one before waiting for us to read it (0 for the default, 1MiB)")
+	http2ConnWindow           = flag.Int("http2_initial_conn_window", 0, "initial HTTP/2 flow control window of each connection, in bytes, at least 65535 (0 for the default, 1MiB); raise it with the stream window for fast uploads over long round trips")
+	http2IdleTimeout          = flag.Duration("http2_idle_timeout", 0, "how long an HTTP/2 connection can go without a request before it's closed with a GOAWAY; PINGs don't count (0 for no limit)")
+	tcpKeepAlive              = flag.Duration("tcp_keepalive", 0, "how often to probe idle client connections, so ones whose client went away without closing them get closed; the HTTP/2 server doesn't send PINGs of its own, so this is how idle HTTP/2 connections are checked too (0 for Go's default, 15s, negative to turn probes off)")
+)
+
+// http2StreamResets counts HTTP/2 requests whose stream went away, reset by
+// the client or with its connection, before we were done answering.
+var http2StreamResets = expvar.NewInt("http2_stream_resets")
+
+// http2Tuned reports whether any of the --http2_* flags are set.
+func http2Tuned() bool {
+	return *http2MaxConcurrentStreams != 0 || *http2MaxReadFrameSize != 0 || *http2StreamWindow != 0 || *http2ConnWindow != 0 || *http2IdleTimeout != 0
+}
+
+// configureHTTP2 sets s up to serve HTTP/2 with the --http2_* settings. Left
+// alone, s serves HTTP/2 with net/http's own defaults.
+func configureHTTP2(s *http.Server) {
+	if !http2Tuned() {
+		return
+	}
+	const maxInt32 = 1<<31 - 1
+	switch {
+	case *http2MaxConcurrentStreams > maxInt32:
+		log.Exitf("--http2_max_concurrent_streams should be at most %d, not %d", maxInt32, *http2MaxConcurrentStreams)
+	case *http2MaxReadFrameSize != 0 && (*http2MaxReadFrameSize < 1<<14 || *http2MaxReadFrameSize >= 1<<24):
+		log.Exitf("--http2_max_read_frame_size should be from 16384 to 16777215, not %d", *http2MaxReadFrameSize)
+	case *http2StreamWindow < 0 || *http2StreamWindow > maxInt32:
+		log.Exitf("--http2_initial_stream_window should be from 0 to %d, not %d", maxInt32, *http2StreamWindow)
+	case *http2ConnWindow != 0 && (*http2ConnWindow < 65535 || *http2ConnWindow > maxInt32):
+		log.Exitf("--http2_initial_conn_window should be from 65535 to %d, not %d", maxInt32, *http2ConnWindow)
+	}
+	err := http2.ConfigureServer(s, &http2.Server{
+		MaxConcurrentStreams:         uint32(*http2MaxConcurrentStreams),
+		MaxReadFrameSize:             uint32(*http2MaxReadFrameSize),
+		MaxUploadBufferPerStream:     int32(*http2StreamWindow),
+		MaxUploadBufferPerConnection: int32(*http2ConnWindow),
+		IdleTimeout:                  *http2IdleTimeout,
+	})
+	if err != nil {
+		log.Exitf("http2.ConfigureServer: %v", err)
+	}
+}
+
+// listen opens a listener on addr with --tcp_keepalive probes on each
+// connection. Everything listens before serving, so privileges can be dropped
+// in between.
+func listen(addr string) net.Listener {
+	lc := net.ListenConfig{KeepAlive: *tcpKeepAlive}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		log.Exitf("listen %s: %v", addr, err)
+	}
+	return l
+}
+
+// serveListener serves s on l, over TLS if s.TLSConfig has the certificates.
+func serveListener(s *http.Server, l net.Listener, withTLS bool) error {
+	if withTLS {
+		return s.ServeTLS(l, "", "")
+	}
+	return s.Serve(l)
+}
+
+// withStreamResets counts the HTTP/2 requests whose stream was reset while we
+// were answering them. It defers the check since the reverse proxy gives up on
+// such a request by panicking with http.ErrAbortHandler.
+func withStreamResets(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer func() {
+			if r.Context().Err() == context.Canceled {
+				http2StreamResets.Add(1)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
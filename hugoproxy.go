@@ -1,23 +1,28 @@
 // Command hugoproxy serves a website from a GCS bucket using an HTTPS
-// front end with automatic certificates provided by LetsEncrypt. It pulls
-// the content of the bucket via a GCS bucket's built in HTTP serving. As
-// it pulls the data over an unencrypted connection, it should only be run
-// from a network that's considered secure. In this case, it should ideally
-// run from GCE so the end to end path to GCS is already somewhat trusted.
+// front end with automatic certificates provided by LetsEncrypt. It reads
+// objects with the Cloud Storage API, so the bucket can stay private and
+// nothing travels unencrypted.
 //
-// TODO: Pull files from GCS and serve them directly and not rely on GCS's
-// insecure HTTP server.
+// With --backend=http it instead pulls the content of the bucket via a GCS
+// bucket's built in HTTP serving. As that pulls the data over an unencrypted
+// connection, it should only be run from a network that's considered secure,
+// ideally GCE, so the end to end path to GCS is already somewhat trusted.
 package main
 
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/datastore"
@@ -25,12 +30,25 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/mikewiacek/flags"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/oauth2/google"
 )
 
 var (
-	project    = flag.String("gcp_project", "", "GCP Cloud Datastore used for certificate caching (if on GCE this is determined automatically and can be left blank)")
+	project    = flag.String("gcp_project", "", "GCP project used by default for Cloud Datastore certificate caching and Secret Manager (if on GCE this is determined automatically and can be left blank)")
 	hostnames  = flags.StringSlice("blog_hostnames", []string{}, "CSV of hostnames for which to get certificates")
 	hugoBucket = flag.String("gcs_bucket", "", "name of the GCS bucket storing our site")
+
+	datastoreProject = flag.String("datastore_project", "", "GCP project whose Cloud Datastore caches certificates, if not --gcp_project (e.g. to share certificates between deployments)")
+
+	httpAddr            = flag.String("http_addr", ":http", "address for the plain HTTP listener (the HTTPS redirect and ACME challenges, or all traffic with --tls_terminated)")
+	httpsAddr           = flag.String("https_addr", ":https", "address for the TLS listener")
+	tlsTerminated       = flag.Bool("tls_terminated", false, "TLS is terminated in front of us: serve everything as plain HTTP on --http_addr (or $PORT when set) with no autocert")
+	httpACMEOnly        = flag.Bool("http_acme_only", false, "only answer ACME challenges on --http_addr and drop every other plaintext request instead of redirecting it to HTTPS")
+	httpsRedirectStatus = flag.Int("https_redirect_status", http.StatusMovedPermanently, "status for redirects to HTTPS: 301 or 302, or 308 or 307 to have clients keep the request method")
+	trustProxyHeaders   = flag.Bool("trust_proxy_headers", false, "take the client address and scheme from X-Forwarded-For and X-Forwarded-Proto; only enable behind a proxy that sets them")
+
+	cloudRun      = flag.Bool("cloud_run", os.Getenv("K_SERVICE") != "", "serve plain HTTP on $PORT behind Cloud Run's TLS termination with no autocert or port 80 redirect (defaults to true when K_SERVICE is set)")
+	digestHeaders = flag.Bool("digest_headers", true, "emit Digest and Repr-Digest headers derived from the GCS object hashes")
 )
 
 type logger struct{}
@@ -45,16 +63,70 @@ type DSCache struct {
 	D *datastore.Client
 }
 
+// dsChunkSize is the most of an entry DSCache keeps in one entity, well under
+// Datastore's 1 MiB entity limit. Larger entries, like long chains or
+// post-quantum certificates some day, are split across CachedCertificateChunk
+// entities.
+const dsChunkSize = 900 << 10
+
 // CachedCertificate is how we cache certificates and letsencrypt keys in GCP Cloud Datastore.
+// An entry of more than dsChunkSize bytes is kept in Chunks child entities
+// instead of Certificate. SHA256 is the digest of the whole entry; entities
+// written before chunking don't have one.
 type CachedCertificate struct {
 	Certificate []byte `datastore:",noindex"`
+	Chunks      int    `datastore:",noindex"`
+	SHA256      []byte `datastore:",noindex"`
+}
+
+// CachedCertificateChunk is one dsChunkSize piece of a large entry, a child of
+// its CachedCertificate.
+type CachedCertificateChunk struct {
+	Data []byte `datastore:",noindex"`
+}
+
+func dsCertKey(name string) *datastore.Key {
+	return datastore.NameKey("CachedCertificate", name, nil)
+}
+
+// dsChunkKeys returns the keys of the first n chunks of the entry under parent.
+func dsChunkKeys(parent *datastore.Key, n int) []*datastore.Key {
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = datastore.IDKey("CachedCertificateChunk", int64(i+1), parent)
+	}
+	return keys
 }
 
 // Get reads a certificate data with the provided name from GCP Cloud Datastore cache.
 func (d *DSCache) Get(ctx context.Context, name string) ([]byte, error) {
-	cached := &CachedCertificate{}
-	key := datastore.NameKey("CachedCertificate", name, nil)
-	if err := d.D.Get(ctx, key, cached); err != nil {
+	var data []byte
+	// A transaction, so the entry and its chunks are read as of the same write.
+	_, err := d.D.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		cached := &CachedCertificate{}
+		key := dsCertKey(name)
+		if err := tx.Get(key, cached); err != nil {
+			return err
+		}
+		data = cached.Certificate
+		if cached.Chunks > 0 {
+			chunks := make([]CachedCertificateChunk, cached.Chunks)
+			if err := tx.GetMulti(dsChunkKeys(key, cached.Chunks), chunks); err != nil {
+				return fmt.Errorf("reading its %d chunks: %v", cached.Chunks, err)
+			}
+			data = nil
+			for _, c := range chunks {
+				data = append(data, c.Data...)
+			}
+		}
+		if cached.SHA256 != nil {
+			if sum := sha256.Sum256(data); !bytes.Equal(sum[:], cached.SHA256) {
+				return fmt.Errorf("its %d bytes don't match their SHA-256", len(data))
+			}
+		}
+		return nil
+	}, datastore.ReadOnly)
+	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			log.Infof("datastore cache miss for certificate: %s", name)
 			return nil, autocert.ErrCacheMiss
@@ -64,26 +136,54 @@ func (d *DSCache) Get(ctx context.Context, name string) ([]byte, error) {
 	}
 
 	log.V(2).Infof("Cache hit for certificate with name: %s", name)
-	return cached.Certificate, nil
+	return data, nil
 }
 
 // Put writes the certificate data for the specified name to GCP Cloud Datastore cache.
 func (d *DSCache) Put(ctx context.Context, name string, data []byte) error {
-	key := datastore.NameKey("CachedCertificate", name, nil)
+	key := dsCertKey(name)
+	sum := sha256.Sum256(data)
+	stored := false
 	_, err := d.D.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		stored = false
 		cached := &CachedCertificate{}
 		if err := tx.Get(key, cached); err != nil && err != datastore.ErrNoSuchEntity {
 			return err
 		}
 
 		// Don't update if the current value is what we're storing is the same.
-		if bytes.Equal(data, cached.Certificate) {
+		if bytes.Equal(sum[:], cached.SHA256) || (cached.SHA256 == nil && cached.Chunks == 0 && bytes.Equal(data, cached.Certificate)) {
 			return nil
 		}
 
-		cached.Certificate = data
+		old := cached.Chunks
+		cached.Certificate, cached.Chunks, cached.SHA256 = nil, 0, sum[:]
+		if len(data) <= dsChunkSize {
+			cached.Certificate = data
+		} else {
+			var chunks []CachedCertificateChunk
+			for i := 0; i < len(data); i += dsChunkSize {
+				end := i + dsChunkSize
+				if end > len(data) {
+					end = len(data)
+				}
+				chunks = append(chunks, CachedCertificateChunk{Data: data[i:end]})
+			}
+			cached.Chunks = len(chunks)
+			if _, err := tx.PutMulti(dsChunkKeys(key, len(chunks)), chunks); err != nil {
+				return err
+			}
+		}
+		if old > cached.Chunks {
+			if err := tx.DeleteMulti(dsChunkKeys(key, old)[cached.Chunks:]); err != nil {
+				return err
+			}
+		}
 
 		_, err := tx.Put(key, cached)
+		if err == nil {
+			stored = true
+		}
 		return err
 	})
 	if err != nil {
@@ -91,19 +191,57 @@ func (d *DSCache) Put(ctx context.Context, name string, data []byte) error {
 		return err
 	}
 	log.V(2).Infof("Successfully stored certificate with name %s in datastore", name)
+	if stored {
+		publish(CertificateStored{Time: time.Now(), Name: name})
+	}
 	return nil
 }
 
 // Delete removes then entry with name from the GCP Cloud Datastore backed cache.
 func (d *DSCache) Delete(ctx context.Context, name string) error {
-	return d.D.Delete(ctx, datastore.NameKey("CachedCertificate", name, nil))
+	key := dsCertKey(name)
+	_, err := d.D.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		cached := &CachedCertificate{}
+		if err := tx.Get(key, cached); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return tx.DeleteMulti(append(dsChunkKeys(key, cached.Chunks), key))
+	})
+	return err
 }
 
 // goSecure just sends folks to the HTTPS version of whatever they requested.
 func goSecure(w http.ResponseWriter, r *http.Request) {
 	r.URL.Scheme = "https"
 	r.URL.Host = r.Host
-	http.Redirect(w, r, r.URL.String(), http.StatusMovedPermanently)
+	http.Redirect(w, r, r.URL.String(), *httpsRedirectStatus)
+}
+
+// dropPlaintext is the port 80 handler with --http_acme_only. Anything that isn't
+// an ACME challenge gets its connection closed without a response.
+func dropPlaintext(w http.ResponseWriter, r *http.Request) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// redirectForwardedHTTP sends requests that reached the TLS terminating proxy in
+// front of us over plain HTTP to their HTTPS equivalent, as goSecure does when we
+// own port 80 ourselves.
+func redirectForwardedHTTP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Scheme == "http" && !plainHTTPAllowed(r) {
+			goSecure(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
 // Taken from: golang.org/src/net/http/httputil/reverseproxy.go
@@ -121,6 +259,9 @@ func singleJoiningSlash(a, b string) string {
 
 type transport struct {
 	http.RoundTripper
+
+	// widths are the --image_variant_widths.
+	widths []int
 }
 
 // RoundTrip implements http.RoundTripper on transport. It's necessary because sometimes
@@ -129,9 +270,35 @@ type transport struct {
 // will look for 301/302 redirects and rewrite the redirected URL to maintain the appropriate
 // user visible hostname.
 func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	if resp, err = t.RoundTripper.RoundTrip(req); err != nil {
+	start := time.Now()
+	if resp, err = fetchImageVariant(t.RoundTripper, req, t.widths); err != nil {
 		return nil, err
 	}
+	if resp == nil {
+		if resp, err = t.fetchPrettyURL(req); err != nil {
+			return nil, err
+		}
+	}
+	if resp == nil {
+		if resp, err = t.fetchIndex(req); err != nil {
+			return nil, err
+		}
+	}
+	if resp == nil {
+		if resp, err = t.RoundTripper.RoundTrip(req); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			if r := t.indexRedirect(req); r != nil {
+				resp.Body.Close()
+				resp = r
+			} else if r := t.notFoundPage(req, resp); r != nil {
+				resp.Body.Close()
+				resp = r
+			}
+		}
+	}
+	log.V(3).Infof("Upstream %s %s: %s in %s", req.Method, req.URL, resp.Status, time.Since(start))
 
 	if resp.StatusCode == http.StatusFound || resp.StatusCode == http.StatusMovedPermanently {
 		loc := resp.Header.Get("Location")
@@ -141,22 +308,154 @@ func (t *transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		}
 		locURL.Host = req.Header.Get("X-Original-Host")
 		locURL.Scheme = "https"
+		// Send the client straight to the clean URL rather than via /foo/index.html.
+		if p, ok := cleanIndexPath(locURL.Host, locURL.Path); ok {
+			locURL.Path = p
+			locURL.RawPath = ""
+		}
+		if err := checkRedirectChain(req.Header.Get("X-Original-Host"), req.URL.RequestURI(), locURL, t.upstreamRedirect(req)); err != nil {
+			resp.Body.Close()
+			redirectLoops.Add(1)
+			log.Errorf("Not redirecting %s: %v", req.URL.RequestURI(), err)
+			return errorResponse(req, http.StatusLoopDetected, "This page redirects in a loop."), nil
+		}
+
+		// The chain is checked in terms of the bucket, but the client sees the
+		// host's paths without its --host_buckets prefix.
+		if p, ok := clientPath(locURL.Host, locURL.Path); ok {
+			locURL.Path = p
+			locURL.RawPath = ""
+		}
 		resp.Header.Set("Location", locURL.String())
 		log.V(2).Infof("Rewrote redirected URL from %s to %s", loc, locURL)
 	}
 
+	// GCS transcodes gzip stored objects for clients that don't accept gzip, so
+	// the representation depends on Accept-Encoding whether or not this particular
+	// response came back compressed.
+	if contentEncoding(resp.Header.Get("X-Goog-Stored-Content-Encoding")) != "identity" ||
+		contentEncoding(resp.Header.Get("Content-Encoding")) != "identity" {
+		addVary(resp.Header, "Accept-Encoding")
+	}
+
+	if err := decodeForClient(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	setClientHintHeaders(req, resp)
+
+	if *digestHeaders {
+		setDigestHeaders(resp.Header)
+	}
+
 	return resp, nil
 }
 
+// setDigestHeaders translates the x-goog-hash header GCS attaches to object responses
+// into the standard Digest (RFC 3230) and Repr-Digest (RFC 9530) headers. GCS hashes
+// the stored bytes, so if GCS transcoded the object on the way out (stored gzip,
+// served identity) the hashes don't describe the payload and nothing is emitted.
+func setDigestHeaders(h http.Header) {
+	if contentEncoding(h.Get("X-Goog-Stored-Content-Encoding")) != contentEncoding(h.Get("Content-Encoding")) {
+		return
+	}
+
+	var digest, repr []string
+	for _, v := range h.Values("X-Goog-Hash") {
+		for _, kv := range strings.Split(v, ",") {
+			kv = strings.TrimSpace(kv)
+			i := strings.Index(kv, "=")
+			if i < 0 {
+				continue
+			}
+			alg, sum := kv[:i], kv[i+1:]
+			switch alg {
+			case "md5":
+				digest = append(digest, "MD5="+sum)
+			case "crc32c":
+				digest = append(digest, "CRC32c="+sum)
+			default:
+				continue
+			}
+			repr = append(repr, alg+"=:"+sum+":")
+		}
+	}
+	if len(repr) == 0 {
+		return
+	}
+	h.Set("Digest", strings.Join(digest, ","))
+	h.Set("Repr-Digest", strings.Join(repr, ", "))
+}
+
+// addVary adds each of fields to the Vary header of h unless it's already listed.
+func addVary(h http.Header, fields ...string) {
+	var have []string
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				have = append(have, f)
+			}
+		}
+	}
+	changed := false
+next:
+	for _, f := range fields {
+		for _, v := range have {
+			if v == "*" || strings.EqualFold(v, f) {
+				continue next
+			}
+		}
+		have = append(have, f)
+		changed = true
+	}
+	if changed {
+		h.Set("Vary", strings.Join(have, ", "))
+	}
+}
+
+// contentEncoding normalizes a Content-Encoding value so an absent header and
+// "identity" compare equal.
+func contentEncoding(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return "identity"
+	}
+	return v
+}
+
+// modifyResponse applies our rewriting of page content to what the bucket returned.
+func modifyResponse(resp *http.Response) error {
+	if err := checkSnapshotFallback(resp); err != nil {
+		return err
+	}
+	if err := injectStagingBanner(resp); err != nil {
+		return err
+	}
+	applyCacheControlRules(resp)
+	applyDeprecations(resp)
+	applyHeaderRules(resp)
+	answerConditional(resp)
+	compressForClient(resp)
+	return nil
+}
+
 // NewSingleHostReverseProxy is a copy of httputil.NewSingleHostReverseProxy but it
 // is modified to set the request.Host header of the modified request to match the
-// hostname of target.
-func NewSingleHostReverseProxy(target *url.URL) *httputil.ReverseProxy {
-	targetQuery := target.RawQuery
+// hostname of target, and to send hosts in --host_buckets to their own bucket
+// instead.
+func NewSingleHostReverseProxy(target *url.URL, backend http.RoundTripper) *httputil.ReverseProxy {
+	routes := newRouteTable(target)
 	director := func(req *http.Request) {
+		r := routes.lookup(req.Host)
+		target := r.target
+		targetQuery := target.RawQuery
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
-		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		// Bucket URLs have no path, so there's usually nothing to join.
+		if r.join || !strings.HasPrefix(req.URL.Path, "/") {
+			req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		}
 		if targetQuery == "" || req.URL.RawQuery == "" {
 			req.URL.RawQuery = targetQuery + req.URL.RawQuery
 		} else {
@@ -168,59 +467,291 @@ func NewSingleHostReverseProxy(target *url.URL) *httputil.ReverseProxy {
 		}
 		req.Header.Set("X-Original-Host", req.Host)
 		req.Host = target.Host
+		normalizeAcceptEncoding(req)
+	}
+
+	return &httputil.ReverseProxy{
+		Director:       director,
+		Transport:      &deadlineTransport{&transport{RoundTripper: backend, widths: variantWidths()}},
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   snapshotErrorHandler,
+	}
+}
+
+// projectID works out which GCP project to use when --gcp_project isn't given. The
+// project in --credentials_file wins, then the metadata server if we're actually on
+// GCE, then the environment and Application Default Credentials.
+func projectID(ctx context.Context) (string, error) {
+	if *credentialsFile != "" {
+		p, err := credentialsFileProject(ctx)
+		if err != nil || p != "" {
+			return p, err
+		}
+	}
+	if metadata.OnGCE() {
+		return metadata.ProjectID()
 	}
+	for _, env := range []string{"GOOGLE_CLOUD_PROJECT", "GCLOUD_PROJECT"} {
+		if p := os.Getenv(env); p != "" {
+			return p, nil
+		}
+	}
+	creds, err := google.FindDefaultCredentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	if creds.ProjectID == "" {
+		return "", errors.New("not on GCE and no project in the environment or default credentials; set --gcp_project")
+	}
+	return creds.ProjectID, nil
+}
 
-	return &httputil.ReverseProxy{Director: director, Transport: &transport{http.DefaultTransport}}
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func main() {
 	flag.Parse()
+	recordCommandLineFlags()
 
-	ctx := context.Background()
+	if *configFile != "" {
+		if err := applyConfig(); err != nil {
+			log.Exitf("applyConfig: %v", err)
+		}
+	}
 
-	if *project == "" {
-		p, err := metadata.ProjectID()
+	if *metadataConfig {
+		if !metadata.OnGCE() {
+			log.Exit("--metadata_config needs the GCE metadata server and we're not on GCE")
+		}
+		vals, err := applyMetadataConfig()
 		if err != nil {
-			log.Exitf("metadata.ProjectID: %v", err)
+			log.Exitf("applyMetadataConfig: %v", err)
 		}
-		*project = p
+		go watchMetadataConfig(vals)
 	}
 
-	dsClient, err := datastore.NewClient(ctx, *project)
+	switch *httpsRedirectStatus {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		log.Exitf("--https_redirect_status must be 301, 302, 307 or 308, not %d", *httpsRedirectStatus)
+	}
+
+	switch flag.Arg(0) {
+	case "service":
+		serviceCommand(flag.Args()[1:])
+		return
+	case "linkcheck":
+		linkcheckCommand(flag.Args()[1:])
+		return
+	case "backup":
+		backupCommand(flag.Args()[1:])
+		return
+	case "restore":
+		restoreCommand(flag.Args()[1:])
+		return
+	case "import-redirects":
+		importRedirectsCommand(flag.Args()[1:])
+		return
+	case "check-cert-cache":
+		checkCertCacheCommand(flag.Args()[1:])
+		return
+	}
+	if isWindowsService() {
+		runService(serve)
+		return
+	}
+	serve()
+}
+
+// serve runs the proxy until it's shut down.
+func serve() {
+	ctx := context.Background()
+
+	opts, err := clientOptions(ctx)
 	if err != nil {
-		log.Exitf("datastore.NewClient(%q): %v", *project, err)
+		log.Exitf("clientOptions: %v", err)
 	}
-	log.Infof("Connected to datastore %q", *project)
 
-	hugoURL, err := url.Parse(fmt.Sprintf("http://%s", strings.TrimPrefix(*hugoBucket, "gs://")))
+	if err := resolveSecrets(ctx, opts...); err != nil {
+		log.Exitf("resolveSecrets: %v", err)
+	}
+	startTracing(ctx, opts)
+
+	hugoURL, err := bucketURL(*hugoBucket)
 	if err != nil {
 		log.Exitf("url.Parse(http://%s): %v", *hugoBucket, err)
 	}
 	log.Infof("Actual site serving from: %s", hugoURL)
+	upstream, checkUpstream := upstreamBackend(ctx, append(allBucketURLs(hugoURL), overlayBucketURLs()...))
+	upstream = withOverlays(upstream)
+	startBucketRedirects(upstream, hugoURL)
+	startDeployWatch(upstream, hugoURL)
+	checks := []readinessCheck{checkUpstream}
+	startSnapshots(hugoURL, upstream)
+	handleShutdownSignals()
 
 	requestLogger := &logger{}
-	m := &autocert.Manager{
-		Cache:      &DSCache{dsClient},
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(*hostnames...),
+	pageCache := newCache(timedBackend(tracedTransport(upstream)))
+	startCacheIndex(pageCache, append(allBucketURLs(hugoURL), overlayBucketURLs()...))
+	startStaleness(pageCache)
+	startCacheRefresh(pageCache)
+	startGCSNotify(ctx, pageCache, opts)
+	var handler http.Handler = handlers.CombinedLoggingHandler(requestLogger, publishRequests(withPrefetch(NewSingleHostReverseProxy(hugoURL, pageCache))))
+	handler = withCleanIndexURLs(handler)
+	handler = withBucketRedirects(handler)
+	handler = withConfigRedirects(handler)
+	handler = skippable("embargoes", withEmbargoes)(handler)
+	handler = skippable("basic_auth", withBasicAuth)(handler)
+	handler = skippable("iap", withIAP)(handler)
+	handler = withNormalizedQuery(handler)
+	handler = withCleanPath(handler)
+	handler = withServerTiming(handler)
+	if *warcBucket != "" && len(*warcHostnames) > 0 {
+		a := newWARCArchiver(newStorageClient(ctx))
+		go a.run()
+		onShutdown(a.flush)
+		handler = a.withWARCArchive(handler)
+	}
+	if *healthChecks {
+		handler = skippable("health_checks", withHealthChecks)(handler)
+	}
+	handler = skippable("status_page", withStatusPage)(handler)
+	handler = skippable("client_reports", withClientReports)(handler)
+	handler = skippable("rate_limit", withRateLimit)(handler)
+	handler = withClientOrigins(handler)
+	handler = skippable("security_headers", withSecurityHeaders)(handler)
+	handler = withHeaderCase(handler)
+	handler = withStreamResets(handler)
+	handler = withInFlight(handler)
+	handler = skippable("access_log", withAccessLog)(handler)
+
+	if *adminAddr != "" {
+		go serveAdmin(listen(*adminAddr))
 	}
-	s := &http.Server{
-		Addr:      ":https",
-		TLSConfig: m.TLSConfig(),
-		Handler:   handlers.CombinedLoggingHandler(requestLogger, NewSingleHostReverseProxy(hugoURL)),
+	if *linkcheckURL != "" {
+		go periodicLinkcheck()
+	}
+	if len(*probeURLs) > 0 {
+		go runProbes()
+	}
+	if *metricsPushURL != "" {
+		go runMetricsPush()
+	}
+	if *backupInterval > 0 {
+		go periodicBackup()
+	}
+
+	// On Cloud Run the platform terminates TLS and owns the certificates, so there's
+	// no autocert, no Datastore cache and no port 80 redirect. Just plain HTTP on $PORT.
+	if *cloudRun {
+		*tlsTerminated = true
+		*trustProxyHeaders = true
+	}
+	// ProxyHeaders has to run first so the redirect sees the forwarded scheme.
+	if *tlsTerminated && *trustProxyHeaders {
+		handler = redirectForwardedHTTP(handler)
+	}
+	if *trustProxyHeaders {
+		handler = handlers.ProxyHeaders(handler)
+	}
+	handler = withTracing(handler)
+
+	if *tlsTerminated {
+		addr := *httpAddr
+		if port := os.Getenv("PORT"); port != "" && !isFlagSet("http_addr") {
+			addr = ":" + port
+		}
+		log.Infof("TLS is terminated upstream: serving HTTP on %s", addr)
+		s := drained(&http.Server{Addr: addr, Handler: handler, ConnState: trackConns("http", addr, false)})
+		l := listen(addr)
+		go sdWatchdog(l.Addr().String())
+		serves := openListeners(handler, nil)
+		dropPrivileges()
+		for _, serve := range serves {
+			go serve()
+		}
+		go becomeReady(checks...)
+		listenerStopped("http.Serve", serveListener(s, l, false))
+		return
+	}
+
+	var tlsConfig *tls.Config
+	var redirect http.Handler = http.HandlerFunc(goSecure)
+	if *httpACMEOnly {
+		redirect = http.HandlerFunc(dropPlaintext)
+	}
+	redirect = withPlainHTTP(redirect, handler)
+	if *tlsCertFile != "" || *tlsKeyFile != "" {
+		// Certificates are managed externally (e.g. cert-manager mounting a secret),
+		// so there's no ACME and no need for a certificate cache.
+		if len(*wildcardDomains) > 0 {
+			log.Exit("--wildcard_domains needs autocert, not --tls_cert_file and --tls_key_file")
+		}
+		reloader, err := newCertReloader(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			log.Exitf("newCertReloader: %v", err)
+		}
+		go reloader.watch(*tlsReloadInterval)
+		log.Infof("Serving TLS certificate from %s", *tlsCertFile)
+		tlsConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+	} else {
+		cache, checkCache := newCertCache(ctx, opts)
+		checks = append(checks, checkCache)
+		cache = acmeCache(cache)
+		m := &autocert.Manager{
+			Cache:      cache,
+			Client:     newAutocertClient(cache),
+			Email:      *acmeEmail,
+			ForceRSA:   *certKeyType == "rsa",
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: certHostPolicy(append(append(*hostnames, hostBucketHosts()...), listenerTLSHosts()...)),
+		}
+		certKeyTypes() // exits on a bad --cert_key_type before a handshake would
+		tlsConfig = m.TLSConfig()
+		tlsConfig.GetCertificate = withCertKeyType(tlsConfig.GetCertificate)
+		if w := newWildcardCerts(ctx, cache, opts); w != nil {
+			tlsConfig.GetCertificate = w.getCertificate(tlsConfig.GetCertificate)
+			go w.run()
+		}
+		redirect = m.HTTPHandler(redirect)
+	}
+
+	tlsConfig.GetCertificate = observeCertificates(tlsConfig.GetCertificate)
+
+	s := drained(&http.Server{
+		Addr:      *httpsAddr,
+		TLSConfig: traceTLSConfig(tlsConfig),
+		Handler:   handler,
+		ConnState: traceConnState(trackConns("https", *httpsAddr, true)),
+	})
+	configureHTTP2(s)
+
+	hl, tl := listen(*httpAddr), listen(*httpsAddr)
+	// The plain HTTP server answers the watchdog, which needn't speak TLS.
+	go sdWatchdog(hl.Addr().String())
+	serves := openListeners(handler, tlsConfig)
+	dropPrivileges()
+	for _, serve := range serves {
+		go serve()
 	}
 
 	// Redirect http requests to https...
 	go func() {
-		log.Info("Serving goSecure handler on port 80")
-		if err := http.ListenAndServe(":http", m.HTTPHandler(http.HandlerFunc(goSecure))); err != nil {
-			log.Exitf("http.ListenAndServe: %v", err)
-		}
+		log.Infof("Serving goSecure handler on %s", *httpAddr)
+		rs := drained(&http.Server{Addr: *httpAddr, Handler: redirect, ConnState: trackConns("http", *httpAddr, false)})
+		listenerStopped("http.Serve", serveListener(rs, hl, false))
 	}()
 
 	// Now serve the TLS version of our content.
-	log.Info("Serving TLS on port 443")
-	if err := s.ListenAndServeTLS("", ""); err != nil {
-		log.Exitf("s.ListenAndServeTLS: %v", err)
-	}
+	log.Infof("Serving TLS on %s", *httpsAddr)
+	go becomeReady(checks...)
+	listenerStopped("s.ServeTLS", serveListener(s, tl, true))
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+	"google.golang.org/api/idtoken"
+)
+
+var (
+	iapAudience   = flag.String("iap_audience", "", "audience of the Identity-Aware Proxy in front of us, /projects/<number>/global/backendServices/<id> or /projects/<number>/apps/<project>; requests for --iap_match paths without a valid x-goog-iap-jwt-assertion are refused (disabled if empty)")
+	iapMatch      = flags.StringSlice("iap_match", []string{"/**"}, "CSV of cache_control style path patterns that need an IAP assertion with --iap_audience")
+	iapIdentities = flags.StringSlice("iap_identities", []string{}, "CSV of who, of those IAP lets through, may see --iap_match paths: email addresses, or domain:example.com for a Workspace domain (everyone if empty)")
+)
+
+var iapDenied = expvar.NewInt("iap_denied_requests")
+
+const (
+	// iapIssuer is the iss of every IAP assertion.
+	iapIssuer = "https://cloud.google.com/iap"
+	// iapClockSkew is how far in the future an assertion's iat may be.
+	iapClockSkew = 30 * time.Second
+)
+
+// iapIdentityKey is the context key for the IAP user a request came from.
+type iapIdentityKey struct{}
+
+// iapUser is who an IAP assertion vouches for.
+type iapUser struct {
+	Email  string
+	Domain string // the hd claim, for Workspace accounts
+}
+
+// iapIdentity returns the IAP user withIAP verified for r, or nil.
+func iapIdentity(r *http.Request) *iapUser {
+	u, _ := r.Context().Value(iapIdentityKey{}).(*iapUser)
+	return u
+}
+
+// allowed reports whether one of identities, as in --iap_identities, names u.
+func (u *iapUser) allowed(identities []string) bool {
+	for _, id := range identities {
+		if d := strings.TrimPrefix(id, "domain:"); d != id {
+			if u.Domain != "" && strings.EqualFold(d, u.Domain) {
+				return true
+			}
+		} else if strings.EqualFold(id, u.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyIAPAssertion checks an x-goog-iap-jwt-assertion: it's signed with one of
+// IAP's keys, for audience, and current.
+func verifyIAPAssertion(ctx context.Context, assertion, audience string) (*iapUser, error) {
+	if assertion == "" {
+		return nil, fmt.Errorf("no x-goog-iap-jwt-assertion")
+	}
+	p, err := idtoken.Validate(ctx, assertion, audience)
+	if err != nil {
+		return nil, err
+	}
+	if p.Issuer != iapIssuer {
+		return nil, fmt.Errorf("issuer is %q, not %q", p.Issuer, iapIssuer)
+	}
+	if time.Unix(p.IssuedAt, 0).After(time.Now().Add(iapClockSkew)) {
+		return nil, fmt.Errorf("issued in the future, at %s", time.Unix(p.IssuedAt, 0).Format(time.RFC3339))
+	}
+	u := &iapUser{}
+	u.Email, _ = p.Claims["email"].(string)
+	u.Domain, _ = p.Claims["hd"].(string)
+	if u.Email == "" {
+		return nil, fmt.Errorf("no email claim")
+	}
+	return u, nil
+}
+
+// withIAP refuses requests for --iap_match paths that didn't come through the
+// Identity-Aware Proxy, or came from someone not in --iap_identities, so going
+// around IAP to our address gets nowhere. The verified user goes in the
+// request's context for protected areas to check.
+func withIAP(h http.Handler) http.Handler {
+	if *iapAudience == "" {
+		return h
+	}
+	if !strings.HasPrefix(*iapAudience, "/projects/") {
+		log.Exitf("--iap_audience should look like /projects/<number>/global/backendServices/<id> or /projects/<number>/apps/<project>, not %q", *iapAudience)
+	}
+	var match []*regexp.Regexp
+	for _, m := range *iapMatch {
+		re, err := compileGlob(m)
+		if err != nil {
+			log.Exitf("Bad --iap_match pattern %q: %v", m, err)
+		}
+		match = append(match, re)
+	}
+	log.Infof("Requiring IAP assertions for %s on %s", *iapAudience, strings.Join(*iapMatch, ", "))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matched := false
+		for _, p := range accessPaths(r.Host, r.URL.Path) {
+			matched = matched || anyMatch(match, p)
+		}
+		u, err := verifyIAPAssertion(r.Context(), r.Header.Get("X-Goog-IAP-JWT-Assertion"), *iapAudience)
+		switch {
+		case err == nil && (!matched || len(*iapIdentities) == 0 || u.allowed(*iapIdentities)):
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), iapIdentityKey{}, u)))
+			return
+		case !matched:
+			h.ServeHTTP(w, r)
+			return
+		case err == nil:
+			err = fmt.Errorf("%s isn't in --iap_identities", u.Email)
+		}
+		iapDenied.Add(1)
+		log.V(1).Infof("Refused %s%s from %s: %v", r.Host, r.URL.Path, r.RemoteAddr, err)
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+}
+
+// anyPathMatches reports whether re matches any of paths.
+func anyPathMatches(re *regexp.Regexp, paths []string) bool {
+	for _, p := range paths {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyMatch(res []*regexp.Regexp, p string) bool {
+	for _, re := range res {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// importRedirectsCommand implements "hugoproxy import-redirects <file|dir>...".
+// It reads redirects exported from another platform and prints them as the
+// redirects section of a --config file. Formats go by file name:
+//
+//	_redirects          Netlify: from to [status]
+//	netlify.toml, *.toml  Netlify: [[redirects]] tables
+//	*.csv               WordPress Redirection plugin export
+//	.htaccess           Apache Redirect lines, as WordPress sites often have
+//	*.json              Jekyll redirects.json from jekyll-redirect-from
+//	*.md, *.html, dirs  Jekyll front matter: redirect_from to the permalink
+//
+// Rules hugoproxy can't express (rewrites, regexes, placeholders other than a
+// trailing splat) are skipped with a warning.
+func importRedirectsCommand(args []string) {
+	if len(args) == 0 {
+		log.Exit("usage: hugoproxy [flags] import-redirects <file or directory>...")
+	}
+	im := newRedirectImporter(func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	})
+	for _, name := range args {
+		if err := im.importPath(name); err != nil {
+			log.Exit(err)
+		}
+	}
+	out, err := yaml.Marshal(struct {
+		Redirects []Redirect `yaml:"redirects"`
+	}{im.redirects})
+	if err != nil {
+		log.Exit(err)
+	}
+	os.Stdout.Write(out)
+	fmt.Fprintf(os.Stderr, "Imported %d redirects, skipped %d\n", len(im.redirects), im.skipped)
+}
+
+type redirectImporter struct {
+	redirects []Redirect
+	seen      map[string]bool
+	skipped   int
+	// warnf reports skipped rules.
+	warnf func(format string, args ...interface{})
+}
+
+func newRedirectImporter(warnf func(format string, args ...interface{})) *redirectImporter {
+	return &redirectImporter{seen: map[string]bool{}, warnf: warnf}
+}
+
+func (im *redirectImporter) skip(where, format string, args ...interface{}) {
+	im.skipped++
+	im.warnf("%s: skipping %s", where, fmt.Sprintf(format, args...))
+}
+
+// add records a redirect from from to to. from may be a full URL, whose host
+// the redirect is then limited to.
+func (im *redirectImporter) add(where, from, to string, status int) {
+	host := ""
+	if u, err := url.Parse(from); err == nil && u.Host != "" {
+		host, from = u.Host, u.Path
+		if u.RawQuery != "" {
+			im.skip(where, "%s: query string conditions aren't supported", from)
+			return
+		}
+	}
+	switch {
+	case from == "" || to == "":
+		im.skip(where, "a rule without both a source and a target")
+		return
+	case !strings.HasPrefix(from, "/"):
+		from = "/" + from
+	}
+	if status == 0 {
+		status = http.StatusMovedPermanently
+	}
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		im.skip(where, "%s: status %d isn't a redirect", from, status)
+		return
+	}
+	if strings.Contains(strings.TrimSuffix(from, "*"), "*") || strings.Contains(from, "/:") {
+		im.skip(where, "%s: only a trailing * is supported in sources", from)
+		return
+	}
+	if strings.HasSuffix(to, ":splat") {
+		to = strings.TrimSuffix(to, ":splat") + "*"
+	}
+	if strings.Contains(to, ":") && !strings.Contains(to, "://") {
+		im.skip(where, "%s: placeholders other than :splat aren't supported", from)
+		return
+	}
+	key := host + " " + from
+	if im.seen[key] {
+		im.skip(where, "%s: already redirected by an earlier rule", from)
+		return
+	}
+	im.seen[key] = true
+	im.redirects = append(im.redirects, Redirect{Host: host, From: from, To: to, Status: status})
+}
+
+func (im *redirectImporter) importPath(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return filepath.Walk(name, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			switch strings.ToLower(filepath.Ext(p)) {
+			case ".md", ".markdown", ".html":
+				return im.importFrontMatter(p)
+			}
+			return nil
+		})
+	}
+	base := strings.ToLower(filepath.Base(name))
+	switch {
+	case base == "_redirects":
+		return im.importNetlify(name)
+	case base == ".htaccess":
+		return im.importHtaccess(name)
+	}
+	switch filepath.Ext(base) {
+	case ".toml":
+		return im.importNetlifyTOML(name)
+	case ".csv":
+		return im.importRedirectionCSV(name)
+	case ".json":
+		return im.importJekyllJSON(name)
+	case ".md", ".markdown", ".html":
+		return im.importFrontMatter(name)
+	}
+	return fmt.Errorf("%s: don't know what format this is (see hugoproxy import-redirects)", name)
+}
+
+// importNetlify reads a Netlify _redirects file.
+func (im *redirectImporter) importNetlify(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return im.readNetlify(name, f)
+}
+
+// readNetlify reads Netlify _redirects rules from r; name is for messages.
+func (im *redirectImporter) readNetlify(name string, r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		where := fmt.Sprintf("%s:%d", name, n)
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			im.skip(where, "%q: want from to [status]", line)
+			continue
+		}
+		// Query parameter, country, language and role conditions are key=value
+		// fields around the target.
+		conditional := false
+		for _, f := range fields[1:] {
+			if strings.Contains(f, "=") && !strings.HasPrefix(f, "/") && !strings.Contains(f, "://") {
+				conditional = true
+			}
+		}
+		if conditional || len(fields) > 3 {
+			im.skip(where, "%s: conditions aren't supported", fields[0])
+			continue
+		}
+		status := 0
+		if len(fields) > 2 {
+			var err error
+			if status, err = strconv.Atoi(strings.TrimSuffix(fields[2], "!")); err != nil {
+				im.skip(where, "%s: bad status %q", fields[0], fields[2])
+				continue
+			}
+		}
+		im.add(where, fields[0], fields[1], status)
+	}
+	return s.Err()
+}
+
+// importNetlifyTOML reads the [[redirects]] of a netlify.toml.
+func (im *redirectImporter) importNetlifyTOML(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return im.readNetlifyTOML(name, b)
+}
+
+// readNetlifyTOML reads netlify.toml style [[redirects]] from b; name is for
+// messages.
+func (im *redirectImporter) readNetlifyTOML(name string, b []byte) error {
+	var cfg struct {
+		Redirects []struct {
+			From       string                 `toml:"from"`
+			To         string                 `toml:"to"`
+			Status     int                    `toml:"status"`
+			Force      bool                   `toml:"force"`
+			Query      map[string]interface{} `toml:"query"`
+			Conditions map[string]interface{} `toml:"conditions"`
+		} `toml:"redirects"`
+	}
+	if _, err := toml.Decode(string(b), &cfg); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for i, r := range cfg.Redirects {
+		where := fmt.Sprintf("%s: redirect %d", name, i+1)
+		if len(r.Query) > 0 || len(r.Conditions) > 0 {
+			im.skip(where, "%s: conditions aren't supported", r.From)
+			continue
+		}
+		im.add(where, r.From, r.To, r.Status)
+	}
+	return nil
+}
+
+// importRedirectionCSV reads a CSV export from the WordPress Redirection
+// plugin, finding its columns by the header row.
+func (im *redirectImporter) importRedirectionCSV(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	src, ok1 := col["source"]
+	dst, ok2 := col["target"]
+	if !ok1 || !ok2 {
+		return fmt.Errorf("%s: want source and target columns, like the Redirection plugin exports", name)
+	}
+	get := func(rec []string, c string) string {
+		if i, ok := col[c]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+	for n := 2; ; n++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		where := fmt.Sprintf("%s:%d", name, n)
+		if src >= len(rec) || dst >= len(rec) {
+			im.skip(where, "a short row")
+			continue
+		}
+		if get(rec, "regex") == "1" {
+			im.skip(where, "%s: regular expressions aren't supported", rec[src])
+			continue
+		}
+		status, _ := strconv.Atoi(get(rec, "code"))
+		im.add(where, rec[src], rec[dst], status)
+	}
+}
+
+// importHtaccess reads Apache Redirect directives. RedirectMatch and
+// mod_rewrite rules are regular expressions, so they're skipped.
+func (im *redirectImporter) importHtaccess(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		where := fmt.Sprintf("%s:%d", name, n)
+		switch strings.ToLower(fields[0]) {
+		case "redirect", "redirectpermanent", "redirecttemp":
+		case "redirectmatch", "rewriterule":
+			im.skip(where, "%s: regular expressions aren't supported", fields[0])
+			continue
+		default:
+			continue
+		}
+		status := http.StatusFound
+		switch strings.ToLower(fields[0]) {
+		case "redirectpermanent":
+			status = http.StatusMovedPermanently
+		case "redirect":
+			if len(fields) == 4 {
+				switch strings.ToLower(fields[1]) {
+				case "permanent":
+					status = http.StatusMovedPermanently
+				case "temp":
+					status = http.StatusFound
+				case "seeother":
+					status = http.StatusSeeOther
+				default:
+					if status, err = strconv.Atoi(fields[1]); err != nil {
+						im.skip(where, "bad status %q", fields[1])
+						continue
+					}
+				}
+				fields = append(fields[:1], fields[2:]...)
+			}
+		}
+		if len(fields) != 3 {
+			im.skip(where, "%q: want Redirect [status] from to", s.Text())
+			continue
+		}
+		// Apache's Redirect matches a prefix and carries the rest over.
+		from, to := fields[1], fields[2]
+		im.add(where, from, to, status)
+		if !strings.HasSuffix(from, "/") {
+			from += "/"
+			to = strings.TrimSuffix(to, "/") + "/"
+		}
+		im.add(where, from+"*", to+"*", status)
+	}
+	return s.Err()
+}
+
+// importJekyllJSON reads the redirects.json jekyll-redirect-from generates,
+// which maps each old path to its new URL.
+func (im *redirectImporter) importJekyllJSON(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	m := map[string]string{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%s: want a jekyll-redirect-from redirects.json: %v", name, err)
+	}
+	froms := make([]string, 0, len(m))
+	for from := range m {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		im.add(name, from, m[from], http.StatusMovedPermanently)
+	}
+	return nil
+}
+
+// importFrontMatter reads the redirect_from and redirect_to of a Jekyll page or
+// post. redirect_from needs the page's permalink to know where to go.
+func (im *redirectImporter) importFrontMatter(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(b, []byte("---")) {
+		return nil
+	}
+	parts := bytes.SplitN(b, []byte("\n---"), 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	var fm struct {
+		Permalink    string      `yaml:"permalink"`
+		RedirectFrom interface{} `yaml:"redirect_from"`
+		RedirectTo   interface{} `yaml:"redirect_to"`
+	}
+	if err := yaml.Unmarshal(bytes.TrimPrefix(parts[0], []byte("---")), &fm); err != nil {
+		im.skip(name, "front matter: %v", err)
+		return nil
+	}
+	froms := stringOrList(fm.RedirectFrom)
+	if len(froms) == 0 {
+		return nil
+	}
+	to := fm.Permalink
+	if tos := stringOrList(fm.RedirectTo); len(tos) > 0 {
+		to = tos[0]
+	}
+	if to == "" {
+		im.skip(name, "redirect_from without a permalink to send it to")
+		return nil
+	}
+	for _, from := range froms {
+		im.add(name, from, to, http.StatusMovedPermanently)
+	}
+	return nil
+}
+
+// stringOrList reads a YAML value that's a string or a list of them.
+func stringOrList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var s []string
+		for _, e := range v {
+			if str, ok := e.(string); ok {
+				s = append(s, str)
+			}
+		}
+		return s
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/html"
+)
+
+var (
+	linkcheckExternal    = flag.Bool("linkcheck_external", false, "have linkcheck also check links to other sites (they're never crawled)")
+	linkcheckConcurrency = flag.Int("linkcheck_concurrency", 8, "requests linkcheck makes in parallel")
+	linkcheckMaxPages    = flag.Int("linkcheck_max_pages", 10000, "most URLs a single linkcheck run will check")
+	linkcheckURL         = flag.String("linkcheck_url", "", "site URL to crawl for broken links every --linkcheck_interval while serving; the latest report is at /admin/linkcheck")
+	linkcheckInterval    = flag.Duration("linkcheck_interval", 24*time.Hour, "how often to crawl --linkcheck_url")
+)
+
+// maxRedirects is how long a redirect chain linkcheck will follow before calling
+// the link broken.
+const maxRedirects = 10
+
+var (
+	lastLinkReportMu sync.Mutex
+	lastLinkReport   *LinkReport
+
+	linkcheckBroken = expvar.NewInt("linkcheck_broken")
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/linkcheck", func(w http.ResponseWriter, r *http.Request) {
+		lastLinkReportMu.Lock()
+		report := lastLinkReport
+		lastLinkReportMu.Unlock()
+		if report == nil {
+			http.Error(w, "no linkcheck has completed (is --linkcheck_url set?)", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, report)
+	})
+}
+
+// LinkReport is the result of crawling a site.
+type LinkReport struct {
+	Start    string        `json:"start"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration_ns"`
+	Checked  int           `json:"checked"`
+	// Truncated is set if the crawl stopped at --linkcheck_max_pages.
+	Truncated  bool   `json:"truncated,omitempty"`
+	Broken     []Link `json:"broken"`
+	Redirected []Link `json:"redirected"`
+}
+
+// Link is a URL that was found to be broken or redirected.
+type Link struct {
+	URL string `json:"url"`
+	// Status is the final HTTP status, or zero if the request failed outright.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Redirects lists every hop after URL, ending with where the chain stopped.
+	Redirects []string `json:"redirects,omitempty"`
+	// Pages are the pages that link to URL.
+	Pages []string `json:"pages"`
+}
+
+// linkChecker crawls every page reachable from root on root's host.
+type linkChecker struct {
+	root     *url.URL
+	external bool
+	maxPages int
+	client   *http.Client
+
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	sem     chan struct{}
+	seen    map[string]*Link
+	checked int
+	report  *LinkReport
+}
+
+func newLinkChecker(root *url.URL) *linkChecker {
+	return &linkChecker{
+		root:     root,
+		external: *linkcheckExternal,
+		maxPages: *linkcheckMaxPages,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			// We follow redirects ourselves to record the chain.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		sem:  make(chan struct{}, *linkcheckConcurrency),
+		seen: map[string]*Link{},
+	}
+}
+
+// run crawls the site and returns what it found.
+func (c *linkChecker) run(ctx context.Context) *LinkReport {
+	c.report = &LinkReport{Start: c.root.String(), Started: time.Now()}
+	c.enqueue(ctx, c.root, "")
+	c.wg.Wait()
+
+	c.report.Duration = time.Since(c.report.Started)
+	c.report.Checked = c.checked
+	for _, l := range c.seen {
+		switch {
+		case l.Error != "" || l.Status >= 400:
+			c.report.Broken = append(c.report.Broken, *l)
+		case len(l.Redirects) > 0:
+			c.report.Redirected = append(c.report.Redirected, *l)
+		}
+	}
+	for _, l := range []*[]Link{&c.report.Broken, &c.report.Redirected} {
+		sort.Slice(*l, func(i, j int) bool { return (*l)[i].URL < (*l)[j].URL })
+		for i := range *l {
+			sort.Strings((*l)[i].Pages)
+		}
+	}
+	return c.report
+}
+
+func (c *linkChecker) internal(u *url.URL) bool {
+	return strings.EqualFold(u.Host, c.root.Host)
+}
+
+// enqueue checks u, found on page, unless it's already been seen.
+func (c *linkChecker) enqueue(ctx context.Context, u *url.URL, page string) {
+	u.Fragment = ""
+	key := u.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l, ok := c.seen[key]; ok {
+		if page != "" {
+			l.Pages = append(l.Pages, page)
+		}
+		return
+	}
+	if !c.internal(u) && !c.external {
+		return
+	}
+	if c.checked >= c.maxPages {
+		c.report.Truncated = true
+		return
+	}
+	c.checked++
+	l := &Link{URL: key}
+	if page != "" {
+		l.Pages = []string{page}
+	}
+	c.seen[key] = l
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.sem <- struct{}{}
+		defer func() { <-c.sem }()
+		c.check(ctx, u, l)
+	}()
+}
+
+// check fetches u, following redirects, and crawls it if it's an internal HTML page.
+func (c *linkChecker) check(ctx context.Context, u *url.URL, l *Link) {
+	method := http.MethodGet
+	if !c.internal(u) {
+		method = http.MethodHead
+	}
+
+	var resp *http.Response
+	var err error
+	cur := u
+	for hop := 0; ; hop++ {
+		resp, err = c.fetch(ctx, method, cur)
+		if err == nil && method == http.MethodHead && resp.StatusCode == http.StatusMethodNotAllowed {
+			resp.Body.Close()
+			method = http.MethodGet
+			resp, err = c.fetch(ctx, method, cur)
+		}
+		if err != nil {
+			break
+		}
+		loc := resp.Header.Get("Location")
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 || loc == "" {
+			break
+		}
+		resp.Body.Close()
+		next, perr := cur.Parse(loc)
+		if perr != nil {
+			err = fmt.Errorf("bad Location %q: %v", loc, perr)
+			break
+		}
+		l.Redirects = append(l.Redirects, next.String())
+		if hop == maxRedirects {
+			err = fmt.Errorf("more than %d redirects", maxRedirects)
+			break
+		}
+		cur = next
+	}
+
+	c.mu.Lock()
+	if err != nil {
+		l.Error = err.Error()
+	} else {
+		l.Status = resp.StatusCode
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// Crawl the page a redirect lands on once, under its own URL.
+	if len(l.Redirects) > 0 {
+		c.enqueue(ctx, cur, "")
+		return
+	}
+	if resp.StatusCode != http.StatusOK || !c.internal(cur) || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return
+	}
+	for _, link := range extractLinks(resp.Body) {
+		ref, err := cur.Parse(link)
+		if err != nil || (ref.Scheme != "http" && ref.Scheme != "https") {
+			continue
+		}
+		c.enqueue(ctx, ref, u.String())
+	}
+}
+
+func (c *linkChecker) fetch(ctx context.Context, method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "hugoproxy-linkcheck")
+	return c.client.Do(req)
+}
+
+// extractLinks returns the href and src attributes in an HTML document.
+func extractLinks(r io.Reader) []string {
+	var links []string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			for {
+				key, val, more := z.TagAttr()
+				if k := string(key); k == "href" || k == "src" {
+					links = append(links, strings.TrimSpace(string(val)))
+				}
+				if !more {
+					break
+				}
+			}
+		}
+	}
+}
+
+// linkcheckCommand implements `hugoproxy [flags] linkcheck <url>`, printing broken
+// links and redirects and exiting non-zero if anything is broken.
+func linkcheckCommand(args []string) {
+	if len(args) != 1 {
+		log.Exit("usage: hugoproxy [flags] linkcheck <site url>")
+	}
+	root, err := url.Parse(args[0])
+	if err != nil {
+		log.Exitf("url.Parse(%q): %v", args[0], err)
+	}
+
+	report := newLinkChecker(root).run(context.Background())
+	for _, l := range report.Redirected {
+		fmt.Printf("REDIRECT %s -> %s (linked from %s)\n", l.URL, strings.Join(l.Redirects, " -> "), strings.Join(l.Pages, ", "))
+	}
+	for _, l := range report.Broken {
+		why := l.Error
+		if why == "" {
+			why = fmt.Sprintf("HTTP %d", l.Status)
+		}
+		fmt.Printf("BROKEN   %s: %s (linked from %s)\n", l.URL, why, strings.Join(l.Pages, ", "))
+	}
+	fmt.Printf("Checked %d URLs in %s: %d broken, %d redirected\n", report.Checked, report.Duration.Round(time.Millisecond), len(report.Broken), len(report.Redirected))
+	if len(report.Broken) > 0 {
+		os.Exit(1)
+	}
+}
+
+// periodicLinkcheck crawls --linkcheck_url every --linkcheck_interval, keeping the
+// latest report for the admin API.
+func periodicLinkcheck() {
+	root, err := url.Parse(*linkcheckURL)
+	if err != nil {
+		log.Exitf("url.Parse(%q): %v", *linkcheckURL, err)
+	}
+	for {
+		report := newLinkChecker(root).run(context.Background())
+		log.Infof("linkcheck of %s: checked %d URLs, %d broken, %d redirected", root, report.Checked, len(report.Broken), len(report.Redirected))
+		linkcheckBroken.Set(int64(len(report.Broken)))
+
+		lastLinkReportMu.Lock()
+		lastLinkReport = report
+		lastLinkReportMu.Unlock()
+
+		time.Sleep(*linkcheckInterval)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// ListenerConfig is one of the config's listeners, served alongside the
+// --http_addr and --https_addr ones from the same sites, with a TLS policy,
+// hosts and middleware of its own:
+//
+//	listeners:
+//	  - name: internal
+//	    addr: :8443
+//	    client_ca: /etc/hugoproxy/corp-ca.pem
+//	    min_tls_version: "1.3"
+//	    hosts: [docs.internal.example.com]
+//	    skip: [iap]
+//	    headers: {X-Robots-Tag: noindex}
+//	  - name: onion
+//	    addr: 127.0.0.1:8080
+//	    plaintext: true
+//	    hosts: [exampleonionaddress.onion]
+//	    skip: [rate_limit]
+//
+// Listeners serve TLS with the proxy's certificates unless they're
+// plaintext. ClientCA makes clients present a certificate it signed. Hosts,
+// when given, are the only ones answered; other requests get a 421. Skip
+// names middleware from listenerMiddleware to leave out, and Headers are set
+// on every response, or removed where they're empty.
+type ListenerConfig struct {
+	Name          string            `yaml:"name" toml:"name"`
+	Addr          string            `yaml:"addr" toml:"addr"`
+	Plaintext     bool              `yaml:"plaintext" toml:"plaintext"`
+	ClientCA      string            `yaml:"client_ca" toml:"client_ca"`
+	MinTLSVersion string            `yaml:"min_tls_version" toml:"min_tls_version"`
+	Hosts         []string          `yaml:"hosts" toml:"hosts"`
+	Skip          []string          `yaml:"skip" toml:"skip"`
+	Headers       map[string]string `yaml:"headers" toml:"headers"`
+
+	clientCAs  *x509.CertPool
+	minVersion uint16
+	hosts      map[string]bool
+	skip       map[string]bool
+}
+
+// listenerMiddleware are the middleware a listener can skip.
+var listenerMiddleware = map[string]bool{
+	"access_log":       true,
+	"basic_auth":       true,
+	"client_reports":   true,
+	"embargoes":        true,
+	"health_checks":    true,
+	"iap":              true,
+	"rate_limit":       true,
+	"security_headers": true,
+	"status_page":      true,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// compileListeners checks the config's listeners and loads their client CAs.
+func (c *Config) compileListeners() error {
+	// The names show up in the connection stats next to the built in ones.
+	names := map[string]bool{"http": true, "https": true}
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		switch {
+		case l.Name == "":
+			return fmt.Errorf("listener %d needs a name", i+1)
+		case names[l.Name]:
+			return fmt.Errorf("listener %q is defined twice, or is one of http and https", l.Name)
+		case l.Addr == "":
+			return fmt.Errorf("listener %q needs an addr", l.Name)
+		case l.Plaintext && (l.ClientCA != "" || l.MinTLSVersion != ""):
+			return fmt.Errorf("listener %q is plaintext, so it can't have a client_ca or min_tls_version", l.Name)
+		}
+		names[l.Name] = true
+		if l.ClientCA != "" {
+			pem, err := ioutil.ReadFile(l.ClientCA)
+			if err != nil {
+				return fmt.Errorf("listener %q: %v", l.Name, err)
+			}
+			l.clientCAs = x509.NewCertPool()
+			if !l.clientCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("listener %q: no certificates in %s", l.Name, l.ClientCA)
+			}
+		}
+		if l.MinTLSVersion != "" {
+			v, ok := tlsVersions[l.MinTLSVersion]
+			if !ok {
+				return fmt.Errorf("listener %q has min_tls_version %q, want 1.0, 1.1, 1.2 or 1.3", l.Name, l.MinTLSVersion)
+			}
+			l.minVersion = v
+		}
+		l.hosts = map[string]bool{}
+		for _, h := range l.Hosts {
+			l.hosts[normalizeHost(h)] = true
+		}
+		l.skip = map[string]bool{}
+		for _, m := range l.Skip {
+			if !listenerMiddleware[m] {
+				return fmt.Errorf("listener %q skips unknown middleware %q, want one of %s", l.Name, m, strings.Join(listenerMiddlewareNames(), ", "))
+			}
+			l.skip[m] = true
+		}
+	}
+	return nil
+}
+
+func listenerMiddlewareNames() []string {
+	var names []string
+	for m := range listenerMiddleware {
+		names = append(names, m)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// listenerTLSHosts returns the hosts of the TLS listeners, which need
+// certificates like --blog_hostnames do.
+func listenerTLSHosts() []string {
+	var hosts []string
+	for _, l := range config.Listeners {
+		if !l.Plaintext {
+			hosts = append(hosts, l.Hosts...)
+		}
+	}
+	return hosts
+}
+
+type listenerKey struct{}
+
+// requestListener returns the config listener r came in on, or nil for the
+// flag ones.
+func requestListener(r *http.Request) *ListenerConfig {
+	l, _ := r.Context().Value(listenerKey{}).(*ListenerConfig)
+	return l
+}
+
+// skippable returns mw made skippable by listeners that list name in their
+// skip.
+func skippable(name string, mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	if !listenerMiddleware[name] {
+		log.Exitf("skippable(%q): not in listenerMiddleware", name)
+	}
+	if len(config.Listeners) == 0 {
+		return mw
+	}
+	return func(h http.Handler) http.Handler {
+		wrapped := mw(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l := requestListener(r); l != nil && l.skip[name] {
+				h.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withListener marks requests as l's, turns away hosts it doesn't serve and
+// sets its headers.
+func withListener(l *ListenerConfig, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(l.hosts) > 0 && !l.hosts[normalizeHost(r.Host)] {
+			http.Error(w, "misdirected request", http.StatusMisdirectedRequest)
+			return
+		}
+		if len(l.Headers) > 0 {
+			w = &listenerHeaderWriter{ResponseWriter: w, headers: l.Headers}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey{}, l)))
+	})
+}
+
+// listenerHeaderWriter applies a listener's headers as the response is
+// written, so they win over what the handlers set.
+type listenerHeaderWriter struct {
+	http.ResponseWriter
+	headers     map[string]string
+	wroteHeader bool
+}
+
+func (w *listenerHeaderWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for k, v := range w.headers {
+			if v == "" {
+				w.Header().Del(k)
+			} else {
+				w.Header().Set(k, v)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *listenerHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *listenerHeaderWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *listenerHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// openListeners opens the config's listeners, serving handler with tlsConfig
+// (nil when TLS is terminated upstream), and returns the functions that serve
+// them, to run once privileges are dropped.
+func openListeners(handler http.Handler, tlsConfig *tls.Config) []func() {
+	var serves []func()
+	for i := range config.Listeners {
+		l := &config.Listeners[i]
+		s := &http.Server{Addr: l.Addr, Handler: withListener(l, handler)}
+		if l.Plaintext {
+			s.ConnState = trackConns(l.Name, l.Addr, false)
+		} else {
+			if tlsConfig == nil {
+				log.Exitf("Listener %q serves TLS, which --tls_terminated leaves to the load balancer; make it plaintext", l.Name)
+			}
+			c := tlsConfig.Clone()
+			if l.minVersion != 0 {
+				c.MinVersion = l.minVersion
+			}
+			if l.clientCAs != nil {
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+				c.ClientCAs = l.clientCAs
+			}
+			s.TLSConfig = traceTLSConfig(c)
+			s.ConnState = traceConnState(trackConns(l.Name, l.Addr, true))
+			configureHTTP2(s)
+		}
+		drained(s)
+		ln := listen(l.Addr)
+		serves = append(serves, func() {
+			log.Infof("Serving listener %q on %s", l.Name, l.Addr)
+			listenerStopped(fmt.Sprintf("listener %q", l.Name), serveListener(s, ln, !l.Plaintext))
+		})
+	}
+	return serves
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var localDir = flag.String("local_dir", "", "directory, e.g. a Hugo site's public/, to serve instead of the buckets, for trying hugoproxy out locally; every bucket is read from it, so --host_buckets prefixes are its subdirectories")
+
+// localTransport answers the reverse proxy's upstream requests from files in
+// dir the way storageTransport answers them from the Cloud Storage API, so the
+// rest of the transport sees what it would with a bucket. The generation is the
+// file's modification time in microseconds, as a GCS generation is the time the
+// object was written.
+type localTransport struct {
+	dir string
+}
+
+func (t *localTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := errorResponse(req, http.StatusMethodNotAllowed, "Method not allowed.")
+		resp.Header.Set("Allow", "GET, HEAD")
+		return resp, nil
+	}
+
+	indexes := indexFilesFor(req.Header.Get("X-Original-Host"))
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	var fi os.FileInfo
+	var err error
+	if name == "" || strings.HasSuffix(name, "/") {
+		for _, idx := range indexes {
+			if fi, err = t.stat(name + idx); !os.IsNotExist(err) {
+				name += idx
+				break
+			}
+		}
+	} else {
+		fi, err = t.stat(name)
+		if os.IsNotExist(err) {
+			for _, idx := range indexes {
+				if _, err := t.stat(name + "/" + idx); err == nil {
+					resp := errorResponse(req, http.StatusMovedPermanently, "Moved permanently.")
+					resp.Header.Set("Location", req.URL.Path+"/")
+					return resp, nil
+				}
+			}
+		}
+	}
+	status := http.StatusOK
+	if os.IsNotExist(err) && *storageNotFoundPage != "" {
+		status = http.StatusNotFound
+		name = hostPrefix(req.Header.Get("X-Original-Host")) + *storageNotFoundPage
+		fi, err = t.stat(name)
+	}
+	if os.IsNotExist(err) {
+		return errorResponse(req, http.StatusNotFound, "Not found."), nil
+	}
+	if err != nil {
+		return nil, newUpstreamError(t.path(name), err)
+	}
+	return t.serveFile(req, name, fi, status)
+}
+
+// path is where the object name is in dir. Cleaning it as an absolute path
+// first keeps it inside.
+func (t *localTransport) path(name string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// stat is os.Stat for object names, where directories don't exist as objects
+// and files can't have anything under them.
+func (t *localTransport) stat(name string) (os.FileInfo, error) {
+	fi, err := os.Stat(t.path(name))
+	if (err == nil && fi.IsDir()) || errors.Is(err, syscall.ENOTDIR) {
+		return nil, os.ErrNotExist
+	}
+	return fi, err
+}
+
+func (t *localTransport) serveFile(req *http.Request, name string, fi os.FileInfo, status int) (*http.Response, error) {
+	h := http.Header{}
+	gen := strconv.FormatInt(fi.ModTime().UnixNano()/1000, 10)
+	etag := strconv.Quote(gen)
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	h.Set("X-Goog-Generation", gen)
+	h.Set("X-Goog-Stored-Content-Encoding", "identity")
+	ct := mime.TypeByExtension(path.Ext(name))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	h.Set("Content-Type", ct)
+	h.Set("Accept-Ranges", "bytes")
+
+	resp := &http.Response{
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+	if status == http.StatusOK && notModified(req, etag, fi.ModTime()) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = "304 Not Modified"
+		return resp, nil
+	}
+
+	length := fi.Size()
+	offset, n := int64(0), length
+	if r := req.Header.Get("Range"); r != "" && status == http.StatusOK && ifRangeMatches(req, etag, fi.ModTime()) {
+		var code int
+		offset, n, code = parseRange(r, length)
+		switch code {
+		case http.StatusRequestedRangeNotSatisfiable:
+			resp = errorResponse(req, code, "Requested range not satisfiable.")
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+			return resp, nil
+		case http.StatusPartialContent:
+			resp.StatusCode = code
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, length))
+		}
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.ContentLength = n
+	h.Set("Content-Length", strconv.FormatInt(n, 10))
+	if req.Method == http.MethodHead {
+		return resp, nil
+	}
+
+	f, err := os.Open(t.path(name))
+	if err != nil {
+		return nil, newUpstreamError(t.path(name), err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, newUpstreamError(t.path(name), err)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, n), f}
+	return resp, nil
+}
+
+// checkLocalDir verifies --local_dir is a directory we can read.
+func checkLocalDir(dir string) readinessCheck {
+	return func(ctx context.Context) error {
+		f, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("--local_dir %s isn't a directory", dir)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/loglevel", logLevelHandler)
+	adminAction("/admin/loglevel", "loglevel")
+}
+
+// LogLevel is glog's verbosity as reported by /admin/loglevel.
+type LogLevel struct {
+	V       int    `json:"v"`
+	VModule string `json:"vmodule"`
+	// Until is when a temporary change reverts, if one is in effect.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+var (
+	logLevelMu sync.Mutex
+	// logLevelRevert puts back the level from before a temporary change.
+	logLevelRevert *time.Timer
+	logLevelBase   LogLevel
+	logLevelUntil  *time.Time
+)
+
+func currentLogLevel() LogLevel {
+	v, _ := strconv.Atoi(flag.Lookup("v").Value.String())
+	return LogLevel{V: v, VModule: flag.Lookup("vmodule").Value.String(), Until: logLevelUntil}
+}
+
+func setLogLevel(l LogLevel) error {
+	if err := flag.Set("v", strconv.Itoa(l.V)); err != nil {
+		return err
+	}
+	return flag.Set("vmodule", l.VModule)
+}
+
+// logLevelHandler reports glog's verbosity and changes it without a restart:
+//
+//	GET  /admin/loglevel
+//	POST /admin/loglevel?v=2&vmodule=probe=3,banner=2&for=15m
+//
+// vmodule patterns match source file names, so hugoproxy=2 logs certificate
+// cache hits and stores and hugoproxy=3 traces every upstream request. With for,
+// the previous level comes back after that long.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	logLevelMu.Lock()
+	defer logLevelMu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		prev := currentLogLevel()
+		next := prev
+		if s := r.FormValue("v"); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 0 {
+				http.Error(w, "bad v: "+s, http.StatusBadRequest)
+				return
+			}
+			next.V = v
+		}
+		if _, ok := r.Form["vmodule"]; ok {
+			next.VModule = r.FormValue("vmodule")
+		}
+		var d time.Duration
+		if s := r.FormValue("for"); s != "" {
+			var err error
+			if d, err = time.ParseDuration(s); err != nil || d <= 0 {
+				http.Error(w, "bad for: "+s, http.StatusBadRequest)
+				return
+			}
+		}
+		if err := setLogLevel(next); err != nil {
+			setLogLevel(prev)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Infof("Log level changed from v=%d vmodule=%q to v=%d vmodule=%q", prev.V, prev.VModule, next.V, next.VModule)
+
+		// A change on top of a temporary one still reverts to where things
+		// were before either of them.
+		if logLevelRevert != nil {
+			logLevelRevert.Stop()
+			logLevelRevert, logLevelUntil = nil, nil
+		} else {
+			logLevelBase = prev
+		}
+		if d > 0 {
+			until := time.Now().Add(d)
+			logLevelUntil = &until
+			logLevelRevert = time.AfterFunc(d, revertLogLevel)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, currentLogLevel())
+}
+
+func revertLogLevel() {
+	logLevelMu.Lock()
+	defer logLevelMu.Unlock()
+	logLevelRevert, logLevelUntil = nil, nil
+	base := logLevelBase
+	base.Until = nil
+	if err := setLogLevel(base); err != nil {
+		log.Errorf("Error reverting log level: %v", err)
+		return
+	}
+	log.Infof("Log level reverted to v=%d vmodule=%q", base.V, base.VModule)
+}
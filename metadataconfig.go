@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	log "github.com/golang/glog"
+)
+
+var (
+	metadataConfig         = flag.Bool("metadata_config", false, "on GCE, take flags not given on the command line from hugoproxy-<flag-name> instance or project metadata attributes (instance wins, and both win over --config)")
+	metadataConfigInterval = flag.Duration("metadata_config_interval", time.Minute, "how often to poll the metadata server for changed hugoproxy-* attributes")
+	metadataConfigRestart  = flag.Bool("metadata_config_restart", false, "exit when the hugoproxy-* metadata attributes change so the supervisor restarts us with the new configuration")
+)
+
+// metadataAttrPrefix marks the metadata attributes that configure hugoproxy. The
+// rest of the attribute name is the flag name with underscores as dashes, so
+// hugoproxy-gcs-bucket sets --gcs_bucket.
+const metadataAttrPrefix = "hugoproxy-"
+
+// metadataFlags returns the hugoproxy-* attributes from the project and instance
+// metadata keyed by flag name. Instance attributes override project ones.
+func metadataFlags() (map[string]string, error) {
+	vals := map[string]string{}
+	for _, dir := range []string{"project/attributes/", "instance/attributes/"} {
+		v, err := metadata.Get(dir + "?recursive=true")
+		if err != nil {
+			if _, ok := err.(metadata.NotDefinedError); ok {
+				continue
+			}
+			return nil, fmt.Errorf("metadata.Get(%s): %v", dir, err)
+		}
+		attrs := map[string]string{}
+		if err := json.Unmarshal([]byte(v), &attrs); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", dir, err)
+		}
+		for k, v := range attrs {
+			if strings.HasPrefix(k, metadataAttrPrefix) {
+				vals[strings.Replace(strings.TrimPrefix(k, metadataAttrPrefix), "-", "_", -1)] = v
+			}
+		}
+	}
+	return vals, nil
+}
+
+// applyMetadataConfig sets every flag that wasn't given on the command line from
+// the metadata attributes, returning the attributes it found.
+func applyMetadataConfig() (map[string]string, error) {
+	vals, err := metadataFlags()
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range vals {
+		if commandLineFlags[name] {
+			log.V(1).Infof("Ignoring metadata value for --%s, it was given on the command line", name)
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			log.Warningf("Ignoring metadata attribute %s%s: no such flag --%s", metadataAttrPrefix, strings.Replace(name, "_", "-", -1), name)
+			continue
+		}
+		if err := flag.Set(name, v); err != nil {
+			return nil, fmt.Errorf("setting --%s from metadata: %v", name, err)
+		}
+		log.Infof("Set --%s=%q from instance metadata", name, v)
+	}
+	return vals, nil
+}
+
+// watchMetadataConfig polls the metadata server and reports when the hugoproxy-*
+// attributes no longer match current. Flags are only read at startup, so a change
+// takes a restart to apply; with --metadata_config_restart we exit and leave that
+// to systemd, the Windows service manager or the instance group.
+func watchMetadataConfig(current map[string]string) {
+	for range time.Tick(*metadataConfigInterval) {
+		vals, err := metadataFlags()
+		if err != nil {
+			log.Errorf("Error polling metadata config: %v", err)
+			continue
+		}
+		if reflect.DeepEqual(vals, current) {
+			continue
+		}
+		if *metadataConfigRestart {
+			shutdown("hugoproxy-* metadata attributes changed, exiting to pick up the new configuration")
+			return
+		}
+		log.Warning("hugoproxy-* metadata attributes changed, restart hugoproxy to apply them")
+		current = vals
+	}
+}
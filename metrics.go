@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	metricsPushURL      = flag.String("metrics_push_url", "", "Prometheus Pushgateway base URL or remote-write endpoint to push metrics to every --metrics_push_interval, for when nothing can scrape us")
+	metricsPushFormat   = flag.String("metrics_push_format", "pushgateway", "how to push to --metrics_push_url: pushgateway or remote_write")
+	metricsPushInterval = flag.Duration("metrics_push_interval", time.Minute, "how often to push metrics")
+	metricsPushJob      = flag.String("metrics_push_job", "hugoproxy", "job label for pushed metrics")
+)
+
+// metricPrefix namespaces our metrics in Prometheus.
+const metricPrefix = "hugoproxy_"
+
+func init() {
+	adminMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(prometheusText(collectSamples()))
+	})
+}
+
+// sample is one Prometheus sample derived from an expvar.
+type sample struct {
+	name   string
+	labels [][2]string
+	value  float64
+}
+
+// promName makes s a valid Prometheus metric or label name.
+func promName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// collectSamples turns the expvars into Prometheus samples. Numbers become gauges.
+// Maps and JSON objects become one gauge labelled by key, for each numeric value in
+// them. Everything else, like the 404 report, only makes sense as JSON and is
+// skipped.
+func collectSamples() []sample {
+	var samples []sample
+	expvar.Do(func(kv expvar.KeyValue) {
+		var v interface{}
+		if err := json.Unmarshal([]byte(kv.Value.String()), &v); err != nil {
+			return
+		}
+		name := metricPrefix + promName(kv.Key)
+		switch v := v.(type) {
+		case float64:
+			samples = append(samples, sample{name: name, value: v})
+		case map[string]interface{}:
+			for k, f := range v {
+				if f, ok := f.(float64); ok {
+					samples = append(samples, sample{name: name, labels: [][2]string{{"key", k}}, value: f})
+				}
+			}
+		}
+	})
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].name != samples[j].name {
+			return samples[i].name < samples[j].name
+		}
+		return fmt.Sprint(samples[i].labels) < fmt.Sprint(samples[j].labels)
+	})
+	return samples
+}
+
+// prometheusText renders samples in the Prometheus text exposition format.
+func prometheusText(samples []sample) []byte {
+	var buf bytes.Buffer
+	last := ""
+	for _, s := range samples {
+		if s.name != last {
+			fmt.Fprintf(&buf, "# TYPE %s gauge\n", s.name)
+			last = s.name
+		}
+		buf.WriteString(s.name)
+		if len(s.labels) > 0 {
+			var ls []string
+			for _, l := range s.labels {
+				ls = append(ls, fmt.Sprintf("%s=%q", l[0], l[1]))
+			}
+			buf.WriteString("{" + strings.Join(ls, ",") + "}")
+		}
+		fmt.Fprintf(&buf, " %v\n", s.value)
+	}
+	return buf.Bytes()
+}
+
+// remoteWriteRequest encodes samples as a snappy compressed prometheus.WriteRequest
+// protobuf, as the remote-write protocol wants.
+func remoteWriteRequest(samples []sample, labels [][2]string, ts time.Time) []byte {
+	var req []byte
+	for _, s := range samples {
+		all := append([][2]string{{"__name__", s.name}}, labels...)
+		all = append(all, s.labels...)
+		sort.Slice(all, func(i, j int) bool { return all[i][0] < all[j][0] })
+
+		var series []byte
+		for _, l := range all {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l[0])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l[1])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var smp []byte
+		smp = protowire.AppendTag(smp, 1, protowire.Fixed64Type)
+		smp = protowire.AppendFixed64(smp, math.Float64bits(s.value))
+		smp = protowire.AppendTag(smp, 2, protowire.VarintType)
+		smp = protowire.AppendVarint(smp, uint64(ts.UnixNano()/int64(time.Millisecond)))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, smp)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+	return snappy.Encode(nil, req)
+}
+
+// pushMetrics sends the current metrics to --metrics_push_url once.
+func pushMetrics(ctx context.Context, instance string) error {
+	samples := collectSamples()
+
+	var req *http.Request
+	var err error
+	switch *metricsPushFormat {
+	case "pushgateway":
+		u := fmt.Sprintf("%s/metrics/job/%s/instance/%s", strings.TrimSuffix(*metricsPushURL, "/"), *metricsPushJob, instance)
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(prometheusText(samples))); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	case "remote_write":
+		body := remoteWriteRequest(samples, [][2]string{{"job", *metricsPushJob}, {"instance", instance}}, time.Now())
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, *metricsPushURL, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	default:
+		return fmt.Errorf("unknown --metrics_push_format %q", *metricsPushFormat)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return nil
+}
+
+// runMetricsPush pushes metrics every --metrics_push_interval until the process exits.
+func runMetricsPush() {
+	instance, err := os.Hostname()
+	if err != nil {
+		log.Exitf("os.Hostname: %v", err)
+	}
+	log.Infof("Pushing metrics to %s every %s", *metricsPushURL, *metricsPushInterval)
+	for range time.Tick(*metricsPushInterval) {
+		ctx, cancel := context.WithTimeout(context.Background(), *metricsPushInterval)
+		if err := pushMetrics(ctx, instance); err != nil {
+			log.Errorf("Error pushing metrics: %v", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	notFoundWindow   = flag.Duration("not_found_window", time.Hour, "how far back 404 tracking looks when reporting the most frequent missing paths")
+	notFoundMaxPaths = flag.Int("not_found_max_paths", 10000, "most distinct 404 paths remembered per slice of --not_found_window, so a scanner can't exhaust memory")
+)
+
+// notFoundSlots is how many slices --not_found_window is divided into. The window
+// rolls forward a slice at a time.
+const notFoundSlots = 12
+
+// maxNotFoundReferrers caps the distinct referrers remembered for each path.
+const maxNotFoundReferrers = 100
+
+var (
+	notFound      = &notFoundTracker{}
+	notFoundTotal = expvar.NewInt("not_found_total")
+)
+
+func init() {
+	expvar.Publish("not_found_top", expvar.Func(func() interface{} {
+		return notFound.top(20, time.Now())
+	}))
+	adminMux.HandleFunc("/admin/404s", notFoundHandler)
+	subscribe(func(e Event) {
+		if r, ok := e.(RequestCompleted); ok && r.Status == http.StatusNotFound {
+			notFound.record(r.Host, r.Path, r.Referer, r.Time)
+		}
+	})
+}
+
+// notFoundTracker counts 404s by host and path, with the referrers that led
+// there, over a rolling window. It's how broken links show up after a site
+// restructure.
+type notFoundTracker struct {
+	mu        sync.Mutex
+	slots     [notFoundSlots]map[string]*notFoundEntry
+	cur       int
+	slotStart time.Time
+}
+
+type notFoundEntry struct {
+	host, path string
+	count      int
+	referrers  map[string]int
+}
+
+// NotFoundPath is one row of the 404 report.
+type NotFoundPath struct {
+	Host      string          `json:"host"`
+	Path      string          `json:"path"`
+	Count     int             `json:"count"`
+	Referrers []ReferrerCount `json:"referrers,omitempty"`
+}
+
+// ReferrerCount is how many 404s for a path came from a referrer.
+type ReferrerCount struct {
+	Referrer string `json:"referrer"`
+	Count    int    `json:"count"`
+}
+
+// advance rolls the window forward to now, discarding slots that fell out of it.
+// t.mu must be held.
+func (t *notFoundTracker) advance(now time.Time) {
+	slot := *notFoundWindow / notFoundSlots
+	if t.slotStart.IsZero() {
+		t.slotStart = now
+	}
+	for i := 0; now.Sub(t.slotStart) >= slot && i < notFoundSlots; i++ {
+		t.cur = (t.cur + 1) % notFoundSlots
+		t.slots[t.cur] = nil
+		t.slotStart = t.slotStart.Add(slot)
+	}
+	if now.Sub(t.slotStart) >= slot {
+		// We were idle for longer than the whole window.
+		t.slotStart = now
+	}
+}
+
+func (t *notFoundTracker) record(host, path, referrer string, now time.Time) {
+	notFoundTotal.Add(1)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(now)
+
+	m := t.slots[t.cur]
+	if m == nil {
+		m = map[string]*notFoundEntry{}
+		t.slots[t.cur] = m
+	}
+	key := host + path
+	e := m[key]
+	if e == nil {
+		if len(m) >= *notFoundMaxPaths {
+			return
+		}
+		e = &notFoundEntry{host: host, path: path, referrers: map[string]int{}}
+		m[key] = e
+	}
+	e.count++
+	if referrer != "" {
+		if _, ok := e.referrers[referrer]; ok || len(e.referrers) < maxNotFoundReferrers {
+			e.referrers[referrer]++
+		}
+	}
+}
+
+// top returns the n most frequent 404s in the window, most frequent first.
+func (t *notFoundTracker) top(n int, now time.Time) []NotFoundPath {
+	t.mu.Lock()
+	t.advance(now)
+	agg := map[string]*notFoundEntry{}
+	for _, m := range t.slots {
+		for k, e := range m {
+			a := agg[k]
+			if a == nil {
+				a = &notFoundEntry{host: e.host, path: e.path, referrers: map[string]int{}}
+				agg[k] = a
+			}
+			a.count += e.count
+			for r, c := range e.referrers {
+				a.referrers[r] += c
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	paths := make([]NotFoundPath, 0, len(agg))
+	for _, e := range agg {
+		p := NotFoundPath{Host: e.host, Path: e.path, Count: e.count}
+		for r, c := range e.referrers {
+			p.Referrers = append(p.Referrers, ReferrerCount{r, c})
+		}
+		sort.Slice(p.Referrers, func(i, j int) bool { return p.Referrers[i].Count > p.Referrers[j].Count })
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Count != paths[j].Count {
+			return paths[i].Count > paths[j].Count
+		}
+		return paths[i].Host+paths[i].Path < paths[j].Host+paths[j].Path
+	})
+	if n > 0 && len(paths) > n {
+		paths = paths[:n]
+	}
+	return paths
+}
+
+// notFoundHandler serves the 404 report: GET /admin/404s?n=50
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	n := 50
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "bad n: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, struct {
+		Window int64          `json:"window_seconds"`
+		Paths  []NotFoundPath `json:"paths"`
+	}{int64(*notFoundWindow / time.Second), notFound.top(n, time.Now())})
+}
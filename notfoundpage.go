@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// notFoundPage replaces a 404 from the http backend with the site's
+// --storage_not_found_page, like the storage backend serves. GCS's own answer
+// is an XML error naming the bucket unless the bucket has a website 404 page,
+// and even then it's the bucket's page rather than that of a host's prefix.
+// It returns nil to keep resp.
+func (t *transport) notFoundPage(req *http.Request, resp *http.Response) *http.Response {
+	if *backend != "http" {
+		// The storage and local backends serve the page themselves.
+		return nil
+	}
+	prefix := hostPrefix(req.Header.Get("X-Original-Host"))
+	html := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html")
+	if html && prefix == "" {
+		return nil
+	}
+	if page := "/" + prefix + *storageNotFoundPage; *storageNotFoundPage != "" && req.URL.Path != page {
+		nreq := req.Clone(req.Context())
+		nreq.URL.Path = page
+		nreq.URL.RawPath = ""
+		nreq.URL.RawQuery = ""
+		for _, h := range []string{"If-None-Match", "If-Modified-Since", "Range", "If-Range"} {
+			nreq.Header.Del(h)
+		}
+		if r, err := t.RoundTripper.RoundTrip(nreq); err == nil {
+			if r.StatusCode == http.StatusOK {
+				r.StatusCode = http.StatusNotFound
+				r.Status = "404 Not Found"
+				r.Request = req
+				return r
+			}
+			r.Body.Close()
+		}
+	}
+	if html {
+		return nil
+	}
+	return errorResponse(req, http.StatusNotFound, "Not found.")
+}
@@ -0,0 +1,465 @@
+package main
+
+import "net/http"
+
+func init() {
+	adminMux.HandleFunc("/admin/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(adminOpenAPI))
+	})
+}
+
+// adminOpenAPI describes the admin API. Keep it, and the adminclient package, in
+// step with the handlers registered on adminMux.
+const adminOpenAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "hugoproxy admin API",
+    "version": "1"
+  },
+  "components": {
+    "securitySchemes": {
+      "adminToken": {"type": "http", "scheme": "bearer", "description": "--admin_token or one of the config's admin_tokens, when any are set. A scoped token gets 403 for requests outside its actions (the operation's x-hugoproxy-action if it has one, else read for GET and * for the rest) or hosts. A token limited to hosts can only use the operations with a host parameter, for one of its hosts"}
+    },
+    "schemas": {
+      "NotFoundReport": {
+        "type": "object",
+        "properties": {
+          "window_seconds": {"type": "integer"},
+          "paths": {"type": "array", "items": {"$ref": "#/components/schemas/NotFoundPath"}}
+        }
+      },
+      "NotFoundPath": {
+        "type": "object",
+        "properties": {
+          "host": {"type": "string"},
+          "path": {"type": "string"},
+          "count": {"type": "integer"},
+          "referrers": {"type": "array", "items": {"$ref": "#/components/schemas/ReferrerCount"}}
+        }
+      },
+      "ReferrerCount": {
+        "type": "object",
+        "properties": {
+          "referrer": {"type": "string"},
+          "count": {"type": "integer"}
+        }
+      },
+      "LinkReport": {
+        "type": "object",
+        "properties": {
+          "start": {"type": "string"},
+          "started": {"type": "string", "format": "date-time"},
+          "duration_ns": {"type": "integer"},
+          "checked": {"type": "integer"},
+          "truncated": {"type": "boolean"},
+          "broken": {"type": "array", "items": {"$ref": "#/components/schemas/Link"}},
+          "redirected": {"type": "array", "items": {"$ref": "#/components/schemas/Link"}}
+        }
+      },
+      "Link": {
+        "type": "object",
+        "properties": {
+          "url": {"type": "string"},
+          "status": {"type": "integer"},
+          "error": {"type": "string"},
+          "redirects": {"type": "array", "items": {"type": "string"}},
+          "pages": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "StalenessReport": {
+        "type": "object",
+        "properties": {
+          "checked": {"type": "string", "format": "date-time"},
+          "entries": {"type": "integer"},
+          "stale": {"type": "integer"},
+          "max_stale_seconds": {"type": "integer"},
+          "objects": {"type": "array", "items": {"$ref": "#/components/schemas/StaleEntry"}}
+        }
+      },
+      "StaleEntry": {
+        "type": "object",
+        "properties": {
+          "host": {"type": "string"},
+          "url": {"type": "string"},
+          "status": {"type": "integer"},
+          "generation": {"type": "string"},
+          "modified": {"type": "string", "format": "date-time"},
+          "cached": {"type": "string", "format": "date-time"},
+          "expires": {"type": "string", "format": "date-time"},
+          "age_seconds": {"type": "integer"},
+          "hits": {"type": "integer"},
+          "stale": {"type": "boolean"},
+          "current_status": {"type": "integer", "description": "absent if the check failed"},
+          "current_generation": {"type": "string"},
+          "stale_seconds": {"type": "integer", "description": "how long the entry has been out of date"},
+          "error": {"type": "string"}
+        }
+      },
+      "ProbeResult": {
+        "type": "object",
+        "properties": {
+          "url": {"type": "string"},
+          "ok": {"type": "boolean"},
+          "error": {"type": "string"},
+          "time": {"type": "string", "format": "date-time"},
+          "dns_ms": {"type": "number"},
+          "connect_ms": {"type": "number"},
+          "tls_ms": {"type": "number"},
+          "total_ms": {"type": "number"},
+          "cert_expiry": {"type": "string", "format": "date-time"}
+        }
+      },
+      "LogLevel": {
+        "type": "object",
+        "properties": {
+          "v": {"type": "integer"},
+          "vmodule": {"type": "string"},
+          "until": {"type": "string", "format": "date-time"}
+        }
+      },
+      "DeployDiff": {
+        "type": "object",
+        "description": "Lists are cut off at limit; the counts aren't.",
+        "properties": {
+          "current": {"type": "string"},
+          "candidate": {"type": "string"},
+          "added_count": {"type": "integer"},
+          "removed_count": {"type": "integer"},
+          "changed_count": {"type": "integer"},
+          "unchanged": {"type": "integer"},
+          "added": {"type": "array", "items": {"type": "string"}},
+          "removed": {"type": "array", "items": {"type": "string"}},
+          "changed": {"type": "array", "items": {"type": "string"}},
+          "missing_pages": {"type": "array", "items": {"$ref": "#/components/schemas/MissingPage"}}
+        }
+      },
+      "MissingPage": {
+        "type": "object",
+        "description": "A page the candidate drops with no redirect covering its URL",
+        "properties": {
+          "url": {"type": "string"},
+          "object": {"type": "string"}
+        }
+      },
+      "TokenInfo": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "actions": {"type": "array", "items": {"type": "string"}},
+          "hosts": {"type": "array", "items": {"type": "string"}},
+          "expires": {"type": "string", "format": "date-time"},
+          "expired": {"type": "boolean"},
+          "last_used": {"type": "string", "format": "date-time"},
+          "uses": {"type": "integer"}
+        }
+      },
+      "ClientReport": {
+        "type": "object",
+        "properties": {
+          "host": {"type": "string"},
+          "kind": {"type": "string", "description": "csp, js-error, network-error or another Reporting API type"},
+          "summary": {"type": "string"},
+          "source": {"type": "string"},
+          "url": {"type": "string"},
+          "user_agent": {"type": "string"},
+          "stack": {"type": "string"},
+          "count": {"type": "integer"},
+          "first_seen": {"type": "string", "format": "date-time"},
+          "last_seen": {"type": "string", "format": "date-time"}
+        }
+      },
+      "GCStats": {
+        "type": "object",
+        "properties": {
+          "goroutines": {"type": "integer"},
+          "heap_alloc": {"type": "integer"},
+          "heap_inuse": {"type": "integer"},
+          "heap_idle": {"type": "integer"},
+          "heap_released": {"type": "integer"},
+          "heap_objects": {"type": "integer"},
+          "sys": {"type": "integer"},
+          "next_gc": {"type": "integer"},
+          "num_gc": {"type": "integer"},
+          "last_gc": {"type": "string", "format": "date-time"},
+          "pause_total_ns": {"type": "integer"},
+          "recent_pauses_ns": {"type": "array", "items": {"type": "integer"}, "description": "most recent first"},
+          "gc_cpu_fraction": {"type": "number"},
+          "freed_os_memory": {"type": "boolean"},
+          "collection_ns": {"type": "integer"}
+        }
+      },
+      "ConnStats": {
+        "type": "object",
+        "properties": {
+          "requests_in_flight": {"type": "integer"},
+          "listeners": {"type": "array", "items": {"$ref": "#/components/schemas/ListenerStats"}}
+        }
+      },
+      "StatusReport": {
+        "type": "object",
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "degraded", "unavailable"]},
+          "problems": {"type": "array", "items": {"type": "string"}},
+          "started": {"type": "string", "format": "date-time"},
+          "uptime_seconds": {"type": "integer"},
+          "ready": {"type": "boolean"},
+          "build": {"type": "string"},
+          "requests": {"type": "array", "items": {"type": "object", "properties": {
+            "window": {"type": "string"},
+            "requests": {"type": "integer"},
+            "errors": {"type": "integer", "description": "server errors"},
+            "error_rate": {"type": "number"}
+          }}},
+          "certificates": {"type": "array", "items": {"type": "object", "properties": {
+            "names": {"type": "string"},
+            "not_after": {"type": "string", "format": "date-time"},
+            "days_left": {"type": "integer"}
+          }}},
+          "sites": {"type": "array", "items": {"type": "object", "properties": {
+            "hosts": {"type": "array", "items": {"type": "string"}},
+            "release": {"type": "string", "description": "gs://bucket/prefix/ the hosts are served from"}
+          }}}
+        }
+      },
+      "ListenerStats": {
+        "type": "object",
+        "description": "New connections haven't sent a request yet; on a TLS listener they're mostly still in the handshake.",
+        "properties": {
+          "name": {"type": "string"},
+          "addr": {"type": "string"},
+          "tls": {"type": "boolean"},
+          "open": {"type": "integer"},
+          "new": {"type": "integer"},
+          "active": {"type": "integer"},
+          "idle": {"type": "integer"},
+          "accepted": {"type": "integer"},
+          "accept_rate_10s": {"type": "number", "description": "accepts per second over the last 10 seconds"},
+          "accept_rate_1m": {"type": "number", "description": "accepts per second over the last minute"}
+        }
+      }
+    }
+  },
+  "security": [{"adminToken": []}],
+  "paths": {
+    "/admin/404s": {
+      "get": {
+        "operationId": "notFound",
+        "summary": "Most frequent 404s over the rolling window, with referrers",
+        "parameters": [
+          {"name": "n", "in": "query", "schema": {"type": "integer", "default": 50}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NotFoundReport"}}}}
+        }
+      }
+    },
+    "/admin/linkcheck": {
+      "get": {
+        "operationId": "linkCheck",
+        "summary": "Latest periodic broken link report",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LinkReport"}}}},
+          "404": {"description": "No crawl has completed"}
+        }
+      }
+    },
+    "/admin/staleness": {
+      "get": {
+        "operationId": "staleness",
+        "summary": "Cache entries compared with their objects in the bucket, stale ones first",
+        "parameters": [
+          {"name": "check", "in": "query", "schema": {"type": "boolean"}, "description": "check the cache now rather than report the last check"},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "default": 100}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StalenessReport"}}}},
+          "400": {"description": "Bad limit"},
+          "404": {"description": "The cache is off"}
+        }
+      }
+    },
+    "/admin/purge": {
+      "post": {
+        "operationId": "purge",
+        "x-hugoproxy-action": "purge",
+        "summary": "Drop a page, everything under a prefix or with a tag, or everything from the cache",
+        "parameters": [
+          {"name": "path", "in": "query", "schema": {"type": "string"}, "description": "page to drop with any query, the redirect to it if it's a directory and the directory if it's an index document"},
+          {"name": "prefix", "in": "query", "schema": {"type": "string"}, "description": "drop every page under it"},
+          {"name": "tag", "in": "query", "schema": {"type": "string"}, "description": "drop every page with this tag in its Surrogate-Key or Cache-Tag header"},
+          {"name": "all", "in": "query", "schema": {"type": "boolean"}, "description": "drop every page"},
+          {"name": "host", "in": "query", "schema": {"type": "string"}, "description": "only drop this site's pages"}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"purged": {"type": "integer"}}}}}},
+          "400": {"description": "Not exactly one of path, prefix, tag and all, or a path not starting with /"},
+          "404": {"description": "The cache is off"}
+        }
+      }
+    },
+    "/admin/probes": {
+      "get": {
+        "operationId": "probes",
+        "summary": "Latest canary probe results keyed by URL",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"$ref": "#/components/schemas/ProbeResult"}}}}}
+        }
+      }
+    },
+    "/admin/loglevel": {
+      "get": {
+        "operationId": "logLevel",
+        "summary": "Current glog verbosity",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LogLevel"}}}}
+        }
+      },
+      "post": {
+        "operationId": "setLogLevel",
+        "x-hugoproxy-action": "loglevel",
+        "summary": "Change glog verbosity, optionally only for a while",
+        "parameters": [
+          {"name": "v", "in": "query", "schema": {"type": "integer"}},
+          {"name": "vmodule", "in": "query", "schema": {"type": "string"}, "description": "pattern=N pairs matched against source file names"},
+          {"name": "for", "in": "query", "schema": {"type": "string"}, "description": "Go duration after which the previous level is restored"}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LogLevel"}}}},
+          "400": {"description": "Bad parameter"}
+        }
+      }
+    },
+    "/admin/connections": {
+      "get": {
+        "operationId": "connections",
+        "summary": "Open connections by listener and state, accept rates and requests in flight",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ConnStats"}}}}
+        }
+      }
+    },
+    "/admin/status": {
+      "get": {
+        "operationId": "status",
+        "summary": "Uptime, recent error rates, certificate expiry and the release each site serves; HTML unless JSON is asked for",
+        "parameters": [
+          {"name": "format", "in": "query", "schema": {"type": "string", "enum": ["json"]}, "description": "JSON without an Accept: application/json header"}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StatusReport"}}, "text/html": {}}}
+        }
+      }
+    },
+    "/admin/deploydiff": {
+      "get": {
+        "operationId": "deployDiff",
+        "summary": "Compare a site's objects with a candidate bucket or prefix before switching to it",
+        "parameters": [
+          {"name": "candidate", "in": "query", "required": true, "schema": {"type": "string"}, "description": "gs://bucket/prefix/ of the candidate"},
+          {"name": "host", "in": "query", "schema": {"type": "string"}, "description": "site to compare, from --host_buckets; --gcs_bucket if omitted"},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "default": 1000}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DeployDiff"}}}},
+          "400": {"description": "Bad parameter"},
+          "502": {"description": "Listing a bucket failed"}
+        }
+      }
+    },
+    "/admin/tokens": {
+      "get": {
+        "operationId": "tokens",
+        "summary": "Admin tokens, their scopes and when each was last used",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/TokenInfo"}}}}}
+        }
+      }
+    },
+    "/admin/reports": {
+      "get": {
+        "operationId": "clientReports",
+        "summary": "CSP, Reporting API, NEL and JavaScript error reports browsers sent to /__report, most frequent first",
+        "parameters": [
+          {"name": "host", "in": "query", "schema": {"type": "string"}},
+          {"name": "kind", "in": "query", "schema": {"type": "string"}},
+          {"name": "n", "in": "query", "schema": {"type": "integer", "default": 100}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {
+            "reports": {"type": "array", "items": {"$ref": "#/components/schemas/ClientReport"}},
+            "dropped": {"type": "integer", "description": "reports dropped since --max_client_reports was reached"}
+          }}}}},
+          "400": {"description": "Bad parameter"}
+        }
+      },
+      "delete": {
+        "operationId": "clearClientReports",
+        "summary": "Forget the reports for a host, or all of them",
+        "x-hugoproxy-action": "reports",
+        "parameters": [
+          {"name": "host", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"type": "object", "properties": {"cleared": {"type": "integer"}}}}}}
+        }
+      }
+    },
+    "/admin/openapi.json": {
+      "get": {
+        "operationId": "openAPI",
+        "summary": "This document",
+        "responses": {"200": {"description": "OK"}}
+      }
+    },
+    "/metrics": {
+      "get": {
+        "operationId": "metrics",
+        "summary": "Metrics in the Prometheus text format",
+        "responses": {"200": {"description": "OK", "content": {"text/plain": {}}}}
+      }
+    },
+    "/debug/gc": {
+      "get": {
+        "operationId": "gcStats",
+        "summary": "Heap and garbage collector stats, with --debug_endpoints",
+        "x-hugoproxy-action": "debug",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GCStats"}}}},
+          "404": {"description": "--debug_endpoints is off"}
+        }
+      },
+      "post": {
+        "operationId": "freeOSMemory",
+        "summary": "Force a garbage collection that returns as much memory to the OS as it can, then report the stats",
+        "x-hugoproxy-action": "debug",
+        "responses": {
+          "200": {"description": "OK", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/GCStats"}}}},
+          "404": {"description": "--debug_endpoints is off"}
+        }
+      }
+    },
+    "/debug/pprof/{profile}": {
+      "get": {
+        "operationId": "pprof",
+        "summary": "net/http/pprof, with --debug_endpoints: the index at /debug/pprof/, profiles such as heap, profile?seconds=30 and goroutine?debug=2 for a full goroutine dump, and trace",
+        "x-hugoproxy-action": "debug",
+        "parameters": [
+          {"name": "profile", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "OK", "content": {"application/octet-stream": {}, "text/plain": {}}},
+          "404": {"description": "--debug_endpoints is off"}
+        }
+      }
+    },
+    "/debug/vars": {
+      "get": {
+        "operationId": "vars",
+        "summary": "Metrics as expvar JSON, leaving out cmdline since the flags can carry secrets",
+        "responses": {"200": {"description": "OK", "content": {"application/json": {}}}}
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var overlayBuckets = flags.StringSlice("overlay_buckets", []string{}, "CSV of base=overlay entries, each a bucket with an optional prefix, e.g. gs://example-site=gs://example-hotfix or gs://sites/docs/=gs://hotfix/docs/: requests under base are tried in the overlay first and only fall back to base if it doesn't have them. Several overlays for one base are tried in order")
+
+var (
+	overlayHits      = expvar.NewInt("overlay_hits")
+	overlayFallbacks = expvar.NewInt("overlay_fallbacks")
+)
+
+// overlay is one --overlay_buckets entry.
+type overlay struct {
+	base, over *url.URL
+}
+
+var (
+	overlaysOnce sync.Once
+	overlays     []overlay
+)
+
+func parseOverlays() {
+	for _, e := range *overlayBuckets {
+		i := strings.Index(e, "=")
+		if i < 0 {
+			log.Exitf("Bad --overlay_buckets entry %q, want base=overlay", e)
+		}
+		base, err := bucketURL(e[:i])
+		if err != nil || base.Host == "" {
+			log.Exitf("Bad --overlay_buckets entry %q: %v", e, err)
+		}
+		over, err := bucketURL(e[i+1:])
+		if err != nil || over.Host == "" {
+			log.Exitf("Bad --overlay_buckets entry %q: %v", e, err)
+		}
+		overlays = append(overlays, overlay{base: base, over: over})
+	}
+}
+
+// overlayBucketURLs returns the overlay buckets, for readiness checks.
+func overlayBucketURLs() []*url.URL {
+	overlaysOnce.Do(parseOverlays)
+	var urls []*url.URL
+	for _, o := range overlays {
+		urls = append(urls, o.over)
+	}
+	return urls
+}
+
+// overlayTransport serves requests from the --overlay_buckets laid over their
+// base, so single pages can be hotfixed without redeploying the site.
+type overlayTransport struct {
+	http.RoundTripper
+}
+
+// withOverlays wraps backend with the --overlay_buckets, if there are any.
+func withOverlays(backend http.RoundTripper) http.RoundTripper {
+	overlaysOnce.Do(parseOverlays)
+	if len(overlays) == 0 {
+		return backend
+	}
+	return &overlayTransport{backend}
+}
+
+// overlayServed reports whether the overlay's answer stands. Anything else,
+// a 404 or a redirect to somewhere in the overlay included, means the base
+// decides.
+func overlayServed(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+		return true
+	}
+	return false
+}
+
+func (t *overlayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	for _, o := range overlays {
+		basePath := o.base.Path
+		if basePath == "" {
+			basePath = "/"
+		}
+		if req.URL.Host != o.base.Host || !strings.HasPrefix(req.URL.Path, basePath) {
+			continue
+		}
+		oreq := req.Clone(req.Context())
+		oreq.URL.Host = o.over.Host
+		oreq.Host = o.over.Host
+		oreq.URL.Path = singleJoiningSlash(o.over.Path, strings.TrimPrefix(req.URL.Path, basePath))
+		oreq.URL.RawPath = ""
+		resp, err := t.RoundTripper.RoundTrip(oreq)
+		if err != nil {
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			log.Warningf("Error reading overlay gs://%s%s, falling back: %v", oreq.URL.Host, oreq.URL.Path, err)
+			overlayFallbacks.Add(1)
+			continue
+		}
+		if overlayServed(resp.StatusCode) {
+			overlayHits.Add(1)
+			log.V(2).Infof("Served %s from overlay gs://%s%s", req.URL.Path, oreq.URL.Host, oreq.URL.Path)
+			resp.Request = req
+			return resp, nil
+		}
+		if resp.StatusCode >= 500 {
+			log.Warningf("Overlay gs://%s%s: %s, falling back", oreq.URL.Host, oreq.URL.Path, resp.Status)
+			overlayFallbacks.Add(1)
+		}
+		resp.Body.Close()
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	pingSitemaps    = flags.StringSlice("ping_sitemaps", []string{"sitemap.xml"}, "CSV of sitemaps at the top of each site whose change marks a deploy, after which they're sent to --sitemap_ping_urls")
+	pingFeeds       = flags.StringSlice("ping_feeds", []string{"index.xml"}, "CSV of feeds at the top of each site whose change marks a deploy, after which they're published to --websub_hubs")
+	sitemapPingURLs = flags.StringSlice("sitemap_ping_urls", []string{}, "CSV of search engine ping URLs to fetch when a sitemap changes, with %s standing for the escaped sitemap URL, e.g. https://www.bing.com/ping?sitemap=%s (disabled if empty)")
+	websubHubs      = flags.StringSlice("websub_hubs", []string{}, "CSV of WebSub hubs to notify when a feed changes, e.g. https://pubsubhubbub.appspot.com/ (disabled if empty)")
+	pingInterval    = flag.Duration("ping_interval", time.Minute, "how often to check --ping_sitemaps and --ping_feeds for a new deploy")
+)
+
+var (
+	pingsSent  = expvar.NewInt("pings_sent")
+	pingErrors = expvar.NewInt("ping_errors")
+)
+
+// pingTimeout bounds each search engine or hub request.
+const pingTimeout = 30 * time.Second
+
+// deployWatcher watches each site's sitemaps and feeds through the backend and
+// publishes a DeploySwitched event once a deploy changes them.
+type deployWatcher struct {
+	backend http.RoundTripper
+
+	mu       sync.Mutex
+	versions map[string]string // site and file to its ETag or Last-Modified
+}
+
+// deployPinger tells search engines and WebSub hubs where to find the sitemaps
+// and feeds a deploy changed, on every host the site serves.
+type deployPinger struct {
+	client *http.Client
+}
+
+// startDeployWatch watches the sites at def and in --host_buckets for deploys,
+// pinging after each if there's anywhere to ping.
+func startDeployWatch(backend http.RoundTripper, def *url.URL) {
+	hosts := map[string][]string{}
+	sites := map[string]*url.URL{siteKey(def): def}
+	for _, h := range *hostnames {
+		if hostBucketURL(h) == nil {
+			hosts[siteKey(def)] = append(hosts[siteKey(def)], h)
+		}
+	}
+	for _, h := range hostBucketHosts() {
+		u := hostBucketURL(h)
+		hosts[siteKey(u)] = append(hosts[siteKey(u)], h)
+		sites[siteKey(u)] = u
+	}
+	if len(*sitemapPingURLs) > 0 || len(*websubHubs) > 0 {
+		if len(hosts) == 0 {
+			log.Warning("--sitemap_ping_urls and --websub_hubs need --blog_hostnames or --host_buckets to know the sites' public URLs")
+		} else {
+			p := &deployPinger{client: &http.Client{Timeout: pingTimeout}}
+			subscribe(func(e Event) {
+				if d, ok := e.(DeploySwitched); ok {
+					p.ping(d)
+				}
+			})
+		}
+	}
+
+	w := &deployWatcher{backend: backend, versions: map[string]string{}}
+	go func() {
+		// The first look only learns the current versions.
+		for {
+			for k, u := range sites {
+				w.check(u, hosts[k])
+			}
+			time.Sleep(*pingInterval)
+		}
+	}()
+}
+
+// version returns the ETag, or failing that the Last-Modified time, of file
+// in site u, or "" if it doesn't exist.
+func (w *deployWatcher) version(ctx context.Context, u *url.URL, file string) (string, error) {
+	fu := *u
+	fu.Path = singleJoiningSlash(u.Path, file)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, fu.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Host = u.Host
+	resp, err := w.backend.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("HEAD %s: %s", fu.String(), resp.Status)
+	}
+	if v := resp.Header.Get("ETag"); v != "" {
+		return v, nil
+	}
+	return resp.Header.Get("Last-Modified"), nil
+}
+
+// changed reports whether file in site u is new or different since the last
+// check. It's never changed on the first check.
+func (w *deployWatcher) changed(u *url.URL, file string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	v, err := w.version(ctx, u, file)
+	if err != nil {
+		log.Errorf("Error checking gs://%s for a deploy: %v", u.Host+singleJoiningSlash(u.Path, file), err)
+		return false
+	}
+	key := siteKey(u) + " " + file
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old, seen := w.versions[key]
+	w.versions[key] = v
+	return seen && v != "" && v != old
+}
+
+// check publishes a DeploySwitched event for site u, served on hosts, if any of
+// its sitemaps and feeds changed.
+func (w *deployWatcher) check(u *url.URL, hosts []string) {
+	var sitemaps, feeds []string
+	for _, file := range *pingSitemaps {
+		if w.changed(u, file) {
+			sitemaps = append(sitemaps, file)
+		}
+	}
+	for _, file := range *pingFeeds {
+		if w.changed(u, file) {
+			feeds = append(feeds, file)
+		}
+	}
+	if len(sitemaps) == 0 && len(feeds) == 0 {
+		return
+	}
+	site := "gs://" + u.Host + u.Path
+	log.Infof("Deploy changed %s in %s", strings.Join(append(append([]string{}, sitemaps...), feeds...), ", "), site)
+	publish(DeploySwitched{Time: time.Now(), Site: site, Hosts: hosts, Sitemaps: sitemaps, Feeds: feeds})
+}
+
+// ping pings for whichever of the sitemaps and feeds d changed, on each of its
+// hosts.
+func (p *deployPinger) ping(d DeploySwitched) {
+	for _, h := range d.Hosts {
+		for _, file := range d.Sitemaps {
+			sitemap := publicURL(h, file)
+			log.Infof("Deploy changed %s, pinging search engines", sitemap)
+			for _, ping := range *sitemapPingURLs {
+				p.send(http.MethodGet, strings.Replace(ping, "%s", url.QueryEscape(sitemap), -1), nil)
+			}
+		}
+		for _, file := range d.Feeds {
+			feed := publicURL(h, file)
+			log.Infof("Deploy changed %s, notifying WebSub hubs", feed)
+			for _, hub := range *websubHubs {
+				p.send(http.MethodPost, hub, url.Values{"hub.mode": {"publish"}, "hub.url": {feed}})
+			}
+		}
+	}
+}
+
+// publicURL is where file at the top of the site is served on host.
+func publicURL(host, file string) string {
+	return "https://" + host + "/" + strings.TrimPrefix(file, "/")
+}
+
+// send makes one ping, posting form if it's set.
+func (p *deployPinger) send(method, target string, form url.Values) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		pingErrors.Add(1)
+		log.Errorf("Bad ping URL %q: %v", target, err)
+		return
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("User-Agent", "hugoproxy")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		pingErrors.Add(1)
+		log.Errorf("Error pinging %s: %v", req.URL.Host, err)
+		return
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		pingErrors.Add(1)
+		log.Errorf("Pinging %s: %s", req.URL.Host, resp.Status)
+		return
+	}
+	pingsSent.Add(1)
+	log.V(1).Infof("Pinged %s %s: %s", method, target, resp.Status)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mikewiacek/flags"
+)
+
+var plainHTTP = flags.StringSlice("plain_http", []string{}, "CSV of host, host/path-prefix or /path-prefix entries served over plain HTTP instead of being redirected to HTTPS, e.g. status.example.com,example.com/legacy/")
+
+// plainHTTPAllowed reports whether r matches a --plain_http exemption.
+func plainHTTPAllowed(r *http.Request) bool {
+	if len(*plainHTTP) == 0 {
+		return false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	// withCleanPath hasn't run yet, so /legacy/../admin/ mustn't get in on
+	// /legacy/.
+	cp, ok := canonicalPath(r.URL.Path)
+	if !ok {
+		return false
+	}
+	for _, e := range *plainHTTP {
+		h, p := e, "/"
+		if i := strings.Index(e, "/"); i >= 0 {
+			h, p = e[:i], e[i:]
+		}
+		if (h == "" || strings.EqualFold(h, host)) && strings.HasPrefix(cp, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// withPlainHTTP serves --plain_http exemptions with h and sends everything else
+// to redirect.
+func withPlainHTTP(redirect, h http.Handler) http.Handler {
+	if len(*plainHTTP) == 0 {
+		return redirect
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if plainHTTPAllowed(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		redirect.ServeHTTP(w, r)
+	})
+}
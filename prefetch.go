@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"flag"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/html"
+)
+
+var (
+	prefetch         = flag.Bool("prefetch", false, "with --cache_size, warm the cache with the pages readers are likeliest to go to next from each HTML page served: the links readers have followed from it most, rel=next and rel=prev, then links in its main content")
+	prefetchLinks    = flag.Int("prefetch_links", 3, "most links --prefetch fetches from each page")
+	prefetchRate     = flag.Float64("prefetch_rate", 5, "most --prefetch fetches per second, so prefetching can't swamp the backend")
+	prefetchInterval = flag.Duration("prefetch_interval", 5*time.Minute, "how long after prefetching a page's links to do it again, the next time it's served")
+	prefetchMaxPages = flag.Int("prefetch_max_pages", 10000, "most pages --prefetch remembers; past that it forgets them all and starts learning again")
+)
+
+var (
+	prefetches        = expvar.NewInt("prefetches")
+	prefetchesDropped = expvar.NewInt("prefetches_dropped")
+)
+
+const (
+	// prefetchQueueSize is how many prefetches can wait for --prefetch_rate
+	// before more are dropped.
+	prefetchQueueSize = 256
+	// maxFollowedLinks caps the links remembered as followed from each page.
+	maxFollowedLinks = 100
+)
+
+// prefetchKey marks the context of a prefetch, which mustn't prefetch in turn.
+type prefetchKey struct{}
+
+type prefetchJob struct {
+	host, path string
+}
+
+// prefetcher fetches the pages a served page most likely leads to through the
+// proxy, so they're in the cache by the time the reader clicks.
+type prefetcher struct {
+	h     http.Handler
+	queue chan prefetchJob
+
+	mu       sync.Mutex
+	analyzed map[string]time.Time      // host and path to when its links were last queued
+	followed map[string]map[string]int // host and path to how often readers went to each other path from it
+}
+
+// withPrefetch prefetches through h the likely next pages of the HTML pages h
+// serves.
+func withPrefetch(h http.Handler) http.Handler {
+	if !*prefetch {
+		return h
+	}
+	if *cacheSize <= 0 {
+		log.Exit("--prefetch needs --cache_size to have somewhere to put what it fetches")
+	}
+	if *prefetchLinks < 1 || *prefetchRate <= 0 {
+		log.Exitf("--prefetch needs a positive --prefetch_links and --prefetch_rate, not %d and %g", *prefetchLinks, *prefetchRate)
+	}
+	p := &prefetcher{
+		h:        h,
+		queue:    make(chan prefetchJob, prefetchQueueSize),
+		analyzed: map[string]time.Time{},
+		followed: map[string]map[string]int{},
+	}
+	subscribe(p.learn)
+	go p.run()
+	log.Infof("Prefetching up to %d links from each page, %g a second at most", *prefetchLinks, *prefetchRate)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.Context().Value(prefetchKey{}) != nil || !looksLikePage(r.URL.Path) || !p.due(r.Host, r.URL.Path, time.Now()) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rec := &prefetchRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.capture {
+			go p.analyze(r.Host, r.URL.Path, rec.encoding, rec.buf.Bytes())
+		}
+	})
+}
+
+// looksLikePage reports whether p could be an HTML page rather than an asset.
+func looksLikePage(p string) bool {
+	switch path.Ext(p) {
+	case "", ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+// due reports whether the page's links haven't been prefetched for
+// --prefetch_interval.
+func (p *prefetcher) due(host, page string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return now.Sub(p.analyzed[host+" "+page]) >= *prefetchInterval
+}
+
+// learn counts the links readers follow between pages, from their Referers.
+func (p *prefetcher) learn(e Event) {
+	r, ok := e.(RequestCompleted)
+	if !ok || r.Status != http.StatusOK || r.Method != http.MethodGet || r.Referer == "" || !looksLikePage(r.Path) {
+		return
+	}
+	ref, err := url.Parse(r.Referer)
+	if err != nil || !strings.EqualFold(ref.Host, r.Host) || ref.Path == r.Path {
+		return
+	}
+	key := r.Host + " " + ref.Path
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.followed[key]
+	if m == nil {
+		if len(p.followed) >= *prefetchMaxPages {
+			p.followed = map[string]map[string]int{}
+		}
+		m = map[string]int{}
+		p.followed[key] = m
+	}
+	if _, ok := m[r.Path]; ok || len(m) < maxFollowedLinks {
+		m[r.Path]++
+	}
+}
+
+// analyze queues prefetches of the likeliest next pages from page, whose body
+// was served with Content-Encoding enc.
+func (p *prefetcher) analyze(host, page, enc string, body []byte) {
+	p.mu.Lock()
+	if len(p.analyzed) >= *prefetchMaxPages {
+		p.analyzed = map[string]time.Time{}
+	}
+	p.analyzed[host+" "+page] = time.Now()
+	p.mu.Unlock()
+
+	d, err := decoder(enc, bytes.NewReader(body))
+	if d == nil || err != nil {
+		return
+	}
+	defer d.Close()
+	links := rankLinks(pageLinks(d, host, page), p.followedFrom(host, page))
+
+	for i, l := range links {
+		if i == *prefetchLinks {
+			break
+		}
+		select {
+		case p.queue <- prefetchJob{host, l}:
+		default:
+			prefetchesDropped.Add(1)
+		}
+	}
+}
+
+// followedFrom returns a copy of the counts of links followed from page.
+func (p *prefetcher) followedFrom(host, page string) map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := map[string]int{}
+	for k, v := range p.followed[host+" "+page] {
+		m[k] = v
+	}
+	return m
+}
+
+// pageLink is an internal link found on a page.
+type pageLink struct {
+	path string
+	// tier is 0 for rel=next and rel=prev, 1 inside <main> or <article> and 2
+	// anywhere else.
+	tier int
+	pos  int
+}
+
+// pageLinks returns the links from page on host to other pages on host, each
+// once, in its canonical form.
+func pageLinks(r io.Reader, host, page string) []pageLink {
+	base := &url.URL{Scheme: "http", Host: host, Path: page}
+	seen := map[string]bool{page: true}
+	var links []pageLink
+	content := 0
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return links
+		case html.EndTagToken:
+			if name, _ := z.TagName(); (string(name) == "main" || string(name) == "article") && content > 0 {
+				content--
+			}
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken:
+		default:
+			continue
+		}
+		name, hasAttr := z.TagName()
+		tag := string(name)
+		if tag == "main" || tag == "article" {
+			if tt == html.StartTagToken {
+				content++
+			}
+			continue
+		}
+		if (tag != "a" && tag != "link") || !hasAttr {
+			continue
+		}
+		var href, rel string
+		for {
+			k, v, more := z.TagAttr()
+			switch string(k) {
+			case "href":
+				href = strings.TrimSpace(string(v))
+			case "rel":
+				rel = strings.ToLower(string(v))
+			}
+			if !more {
+				break
+			}
+		}
+		tier := 2
+		switch {
+		case hasWord(rel, "next") || hasWord(rel, "prev"):
+			tier = 0
+		case tag == "link":
+			continue
+		case content > 0:
+			tier = 1
+		}
+		u, err := base.Parse(href)
+		if err != nil || href == "" || (u.Scheme != "http" && u.Scheme != "https") || !strings.EqualFold(u.Host, host) || u.RawQuery != "" || !looksLikePage(u.Path) {
+			continue
+		}
+		p, _ := cleanIndexPath(host, u.Path)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		links = append(links, pageLink{path: p, tier: tier, pos: len(links)})
+	}
+}
+
+// hasWord reports whether the space separated list s contains w.
+func hasWord(s, w string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == w {
+			return true
+		}
+	}
+	return false
+}
+
+// rankLinks orders links likeliest first: the most followed, then by tier, then
+// in page order.
+func rankLinks(links []pageLink, followed map[string]int) []string {
+	sort.SliceStable(links, func(i, j int) bool {
+		a, b := links[i], links[j]
+		if followed[a.path] != followed[b.path] {
+			return followed[a.path] > followed[b.path]
+		}
+		if a.tier != b.tier {
+			return a.tier < b.tier
+		}
+		return a.pos < b.pos
+	})
+	paths := make([]string, len(links))
+	for i, l := range links {
+		paths[i] = l.path
+	}
+	return paths
+}
+
+// run makes the queued prefetches, no faster than --prefetch_rate.
+func (p *prefetcher) run() {
+	tick := time.NewTicker(time.Duration(float64(time.Second) / *prefetchRate))
+	defer tick.Stop()
+	for j := range p.queue {
+		<-tick.C
+		p.fetch(j)
+	}
+}
+
+// fetch requests one page through the proxy, as a browser would, and throws the
+// response away; the point is the cache entry it leaves.
+func (p *prefetcher) fetch(j prefetchJob) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), prefetchKey{}, true), 30*time.Second)
+	defer cancel()
+	u := &url.URL{Scheme: "http", Host: j.host, Path: j.path}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("User-Agent", "hugoproxy-prefetch")
+	w := &discardWriter{header: http.Header{}}
+	p.h.ServeHTTP(w, req)
+	prefetches.Add(1)
+	log.V(2).Infof("Prefetched %s%s: %d", j.host, j.path, w.status)
+}
+
+// prefetchRecorder keeps a copy of a successful HTML response's body, up to
+// --cache_max_object.
+type prefetchRecorder struct {
+	http.ResponseWriter
+	wroteHeader bool
+	capture     bool
+	encoding    string
+	buf         bytes.Buffer
+}
+
+func (w *prefetchRecorder) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		w.capture = code == http.StatusOK && strings.HasPrefix(h.Get("Content-Type"), "text/html")
+		w.encoding = h.Get("Content-Encoding")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *prefetchRecorder) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.capture {
+		if int64(w.buf.Len()+len(b)) > *cacheMaxObject {
+			w.capture = false
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets httputil.ReverseProxy flush through the recorder.
+func (w *prefetchRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *prefetchRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// discardWriter is an http.ResponseWriter that throws the response away.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header { return w.header }
+
+func (w *discardWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
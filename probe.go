@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	probeURLs       = flags.StringSlice("probe_urls", []string{}, "CSV of public URLs to fetch every --probe_interval as a canary; append #sha256=<hex> to also check the body's hash")
+	probeInterval   = flag.Duration("probe_interval", time.Minute, "how often to run the --probe_urls canaries")
+	probeTimeout    = flag.Duration("probe_timeout", 10*time.Second, "how long a canary fetch may take before it counts as failed")
+	probeWebhookURL = secretVar("probe_webhook_url", "URL to POST a JSON alert to whenever a canary starts failing or recovers")
+)
+
+var probeVars = expvar.NewMap("probe")
+
+func init() {
+	adminMux.HandleFunc("/admin/probes", func(w http.ResponseWriter, r *http.Request) {
+		probeStatesMu.Lock()
+		defer probeStatesMu.Unlock()
+		writeJSON(w, probeStates)
+	})
+}
+
+var (
+	probeStatesMu sync.Mutex
+	probeStates   = map[string]*ProbeResult{}
+)
+
+// ProbeResult is the outcome of one canary fetch.
+type ProbeResult struct {
+	URL   string    `json:"url"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+	// The latency breakdown, in milliseconds. DNS, connect and TLS are zero when
+	// the connection was reused.
+	DNSMillis     float64 `json:"dns_ms"`
+	ConnectMillis float64 `json:"connect_ms"`
+	TLSMillis     float64 `json:"tls_ms"`
+	TotalMillis   float64 `json:"total_ms"`
+	// CertExpiry is when the certificate presented expires.
+	CertExpiry *time.Time `json:"cert_expiry,omitempty"`
+}
+
+// probe is a canary URL with an optional expected SHA-256 of the body.
+type probe struct {
+	url    string
+	sha256 string
+}
+
+// parseProbe splits the expected hash off a --probe_urls entry. The fragment is
+// never sent to the server, so it's a safe place to carry it.
+func parseProbe(s string) (probe, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return probe{}, err
+	}
+	p := probe{}
+	if strings.HasPrefix(u.Fragment, "sha256=") {
+		p.sha256 = strings.ToLower(strings.TrimPrefix(u.Fragment, "sha256="))
+		u.Fragment = ""
+	}
+	p.url = u.String()
+	return p, nil
+}
+
+// run fetches the canary through the full public path: DNS, TLS verification and
+// all.
+func (p probe) run(client *http.Client) *ProbeResult {
+	res := &ProbeResult{URL: p.url, Time: time.Now()}
+	var dnsStart, connStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { res.DNSMillis = millisSince(dnsStart) },
+		ConnectStart:      func(string, string) { connStart = time.Now() },
+		ConnectDone:       func(string, string, error) { res.ConnectMillis = millisSince(connStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(cs tls.ConnectionState, _ error) {
+			res.TLSMillis = millisSince(tlsStart)
+			if len(cs.PeerCertificates) > 0 {
+				res.CertExpiry = &cs.PeerCertificates[0].NotAfter
+			}
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *probeTimeout)
+	defer cancel()
+	err := func() error {
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, p.url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "hugoproxy-probe")
+		req.Header.Set("Cache-Control", "no-cache")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, resp.Body); err != nil {
+			return fmt.Errorf("reading body: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("got %s", resp.Status)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); p.sha256 != "" && sum != p.sha256 {
+			return fmt.Errorf("body sha256 %s, want %s", sum, p.sha256)
+		}
+		return nil
+	}()
+	res.TotalMillis = millisSince(res.Time)
+	res.OK = err == nil
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func millisSince(t time.Time) float64 {
+	return float64(time.Since(t)) / float64(time.Millisecond)
+}
+
+// runProbes runs every canary each --probe_interval, publishing results as
+// metrics and alerting on changes.
+func runProbes() {
+	var probes []probe
+	for _, s := range *probeURLs {
+		p, err := parseProbe(s)
+		if err != nil {
+			log.Exitf("Bad --probe_urls entry %q: %v", s, err)
+		}
+		probes = append(probes, p)
+	}
+	client := &http.Client{}
+
+	for {
+		for _, p := range probes {
+			res := p.run(client)
+			recordProbe(res)
+		}
+		time.Sleep(*probeInterval)
+	}
+}
+
+func recordProbe(res *ProbeResult) {
+	ok := new(expvar.Int)
+	if res.OK {
+		ok.Set(1)
+	}
+	latency := new(expvar.Float)
+	latency.Set(res.TotalMillis)
+	probeVars.Set(res.URL+" ok", ok)
+	probeVars.Set(res.URL+" latency_ms", latency)
+
+	probeStatesMu.Lock()
+	prev := probeStates[res.URL]
+	probeStates[res.URL] = res
+	probeStatesMu.Unlock()
+
+	if res.OK {
+		log.V(1).Infof("Probe %s OK in %.1fms", res.URL, res.TotalMillis)
+	} else {
+		log.Warningf("Probe %s failed: %s", res.URL, res.Error)
+	}
+	// Alert on the first result too if it's a failure, but not on a healthy start.
+	if (prev == nil && !res.OK) || (prev != nil && prev.OK != res.OK) {
+		go sendProbeAlert(res)
+	}
+}
+
+// sendProbeAlert POSTs res to --probe_webhook_url.
+func sendProbeAlert(res *ProbeResult) {
+	hook := probeWebhookURL.Get()
+	if hook == "" {
+		return
+	}
+	state := "recovered"
+	if !res.OK {
+		state = "failing"
+	}
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+		*ProbeResult
+	}{fmt.Sprintf("hugoproxy probe %s is %s %s", res.URL, state, res.Error), res})
+	if err != nil {
+		log.Errorf("json.Marshal: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("Error building probe alert: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Errorf("Error sending probe alert: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Errorf("Probe alert webhook returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/purge", purgeHandler)
+	adminAction("/admin/purge", "purge")
+	adminHostScoped("/admin/purge")
+}
+
+// PurgeResult says how many cache entries a purge dropped.
+type PurgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// entryPath is the path a client asked for to get e, without the query.
+func entryPath(e *cacheEntry) string {
+	u, err := url.Parse(e.url)
+	if err != nil {
+		return ""
+	}
+	target := hostBucketURL(e.host)
+	if target == nil {
+		target, _ = bucketURL(*hugoBucket)
+	}
+	p := u.Path
+	if target != nil && target.Path != "" && target.Path != "/" {
+		p = "/" + strings.TrimPrefix(p, target.Path)
+	}
+	if p == "" {
+		p = "/"
+	}
+	return p
+}
+
+// entryTags returns the tags e can be purged by: those in the Surrogate-Key
+// (space separated) and Cache-Tag (comma separated) headers it's served with,
+// whether they come from the bucket or the config's header rules.
+func entryTags(e *cacheEntry) []string {
+	u, err := url.Parse(e.url)
+	if err != nil {
+		return nil
+	}
+	resp := &http.Response{
+		StatusCode: e.status,
+		Header:     e.header.Clone(),
+		Request:    &http.Request{URL: u, Header: http.Header{"X-Original-Host": {e.host}}},
+	}
+	applyHeaderRules(resp)
+	tags := strings.Fields(resp.Header.Get("Surrogate-Key"))
+	for _, t := range strings.Split(resp.Header.Get("Cache-Tag"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// purge drops the entries match picks and returns how many there were.
+func (c *cache) purge(match func(e *cacheEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*cacheEntry)) {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// purgeHandler drops pages from the cache, so a deploy script can have them
+// served fresh without waiting out their TTL or restarting us:
+//
+//	POST /admin/purge?path=/posts/hello/&host=blog.example.com
+//	POST /admin/purge?prefix=/posts/
+//	POST /admin/purge?tag=posts
+//	POST /admin/purge?all=1
+//
+// path drops the page whatever its query, along with the redirect to it if
+// it's a directory, and the directory if it's an index document. tag drops the
+// pages entryTags tags with it. host limits the purge to one site; without it,
+// every site's matching pages go.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "purge with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if contentCache == nil {
+		http.Error(w, "the cache is off (is --cache_size set?)", http.StatusNotFound)
+		return
+	}
+	// host comes from the query alone, the one a token's hosts are checked
+	// against.
+	host := r.URL.Query().Get("host")
+	p, prefix, tag := r.FormValue("path"), r.FormValue("prefix"), r.FormValue("tag")
+	all, _ := strconv.ParseBool(r.FormValue("all"))
+	given := 0
+	for _, b := range []bool{p != "", prefix != "", tag != "", all} {
+		if b {
+			given++
+		}
+	}
+	if given != 1 {
+		http.Error(w, "give one of path, prefix, tag or all=1", http.StatusBadRequest)
+		return
+	}
+	if (p != "" && !strings.HasPrefix(p, "/")) || (prefix != "" && !strings.HasPrefix(prefix, "/")) {
+		http.Error(w, "path and prefix start with /", http.StatusBadRequest)
+		return
+	}
+
+	n := contentCache.purge(func(e *cacheEntry) bool {
+		if host != "" && normalizeHost(e.host) != normalizeHost(host) {
+			return false
+		}
+		ep := entryPath(e)
+		switch {
+		case all:
+			return true
+		case prefix != "":
+			return strings.HasPrefix(ep, prefix)
+		case tag != "":
+			for _, t := range entryTags(e) {
+				if t == tag {
+					return true
+				}
+			}
+			return false
+		}
+		if ep == p || ep+"/" == p {
+			return true
+		}
+		for _, idx := range indexFilesFor(e.host) {
+			if dir := strings.TrimSuffix(p, idx); dir != p && strings.HasSuffix(dir, "/") && (ep == dir || ep+"/" == dir) {
+				return true
+			}
+		}
+		return false
+	})
+	cacheInvalidations.Add(int64(n))
+	log.Infof("Purged %d cache entries: %s", n, r.URL.RequestURI())
+	publish(CachePurged{Time: time.Now(), Host: host, Path: p, Prefix: prefix, Tag: tag, All: all, Purged: n})
+	writeJSON(w, &PurgeResult{Purged: n})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	stripQueryParams = flags.StringSlice("strip_query_params", []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid", "_ga"}, "CSV of query parameters to drop before the request goes any further; a trailing * matches a prefix")
+	sortQueryParams  = flag.Bool("sort_query_params", true, "sort the query parameters left after --strip_query_params so equivalent URLs look the same upstream")
+)
+
+// stripQueryParam reports whether the query parameter named key should be dropped.
+func stripQueryParam(key string) bool {
+	for _, p := range *stripQueryParams {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if key == p {
+			return true
+		}
+	}
+	return false
+}
+
+// queryKey returns the still-encoded name from a name=value query pair.
+func queryKey(pair string) string {
+	if i := strings.IndexByte(pair, '='); i >= 0 {
+		return pair[:i]
+	}
+	return pair
+}
+
+// decodedQueryKey returns the name from a name=value query pair, unescaped.
+func decodedQueryKey(pair string) string {
+	key := queryKey(pair)
+	if strings.IndexByte(key, '%') >= 0 || strings.IndexByte(key, '+') >= 0 {
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+	}
+	return key
+}
+
+// queryIsNormal reports whether normalizeQuery would leave raw alone. It walks
+// the query in place, so the common case of an untouched query costs nothing.
+func queryIsNormal(raw string) bool {
+	if strings.HasSuffix(raw, "&") {
+		return false
+	}
+	prev := ""
+	for rest := raw; rest != ""; {
+		pair := rest
+		if i := strings.IndexByte(rest, '&'); i >= 0 {
+			pair, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = ""
+		}
+		if pair == "" || stripQueryParam(decodedQueryKey(pair)) {
+			return false
+		}
+		key := queryKey(pair)
+		if *sortQueryParams && key < prev {
+			return false
+		}
+		prev = key
+	}
+	return true
+}
+
+// normalizeQuery drops tracking parameters from a raw query string and sorts
+// what's left by name. Pairs are kept in their original encoding.
+func normalizeQuery(raw string) string {
+	if raw == "" || queryIsNormal(raw) {
+		return raw
+	}
+	var kept []string
+	for _, pair := range strings.Split(raw, "&") {
+		if pair != "" && !stripQueryParam(decodedQueryKey(pair)) {
+			kept = append(kept, pair)
+		}
+	}
+	if *sortQueryParams {
+		sort.SliceStable(kept, func(i, j int) bool {
+			return queryKey(kept[i]) < queryKey(kept[j])
+		})
+	}
+	return strings.Join(kept, "&")
+}
+
+// withNormalizedQuery rewrites the query string of every request with
+// normalizeQuery, so campaign links don't defeat caching of static pages.
+func withNormalizedQuery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" {
+			r.URL.RawQuery = normalizeQuery(r.URL.RawQuery)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	rateLimit           = flag.Float64("rate_limit", 0, "requests per second each client IP may average before getting 429s, e.g. 10; with --trust_proxy_headers the IP is the forwarded one (disabled if 0)")
+	rateLimitBurst      = flag.Int("rate_limit_burst", 50, "requests a client IP may make at once on top of --rate_limit, enough for a page and its assets")
+	rateLimitExempt     = flags.StringSlice("rate_limit_exempt_cidrs", []string{}, "CSV of CIDRs never rate limited, e.g. monitoring or a CDN's egress ranges")
+	rateLimitIPv6Prefix = flag.Int("rate_limit_ipv6_prefix", 64, "IPv6 prefix length client addresses are grouped by, since one host often has a whole /64")
+	rateLimitMaxClients = flag.Int("rate_limit_max_clients", 100000, "most client IPs tracked at once; past that, new clients aren't limited until idle ones are forgotten")
+)
+
+var (
+	rateLimited        = expvar.NewInt("rate_limited_requests")
+	rateLimitUntracked = expvar.NewInt("rate_limit_untracked_requests")
+)
+
+// rateLimitSweepInterval is how often clients whose buckets have refilled are
+// forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds up to burst tokens, refilled at rate per second. A request
+// takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), clients: map[string]*tokenBucket{}}
+}
+
+// refill brings b up to date at now. l.mu must be held.
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+}
+
+// allow takes a token for client, or reports how long until there's one.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.clients[client]
+	if b == nil {
+		if len(l.clients) >= *rateLimitMaxClients {
+			rateLimitUntracked.Add(1)
+			return true, 0
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets clients whose buckets have filled back up; they're no
+// different from a client never seen.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for c, b := range l.clients {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.clients, c)
+		}
+	}
+}
+
+// rateLimitKey is the client a request counts against: its IP, or for IPv6
+// the --rate_limit_ipv6_prefix network it's in.
+func rateLimitKey(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(*rateLimitIPv6Prefix, 128)).String()
+}
+
+// withRateLimit answers clients going over --rate_limit with a 429 instead of
+// passing them to h. Health checks are never limited, so a busy load balancer
+// can't take us out of rotation.
+func withRateLimit(h http.Handler) http.Handler {
+	if *rateLimit <= 0 {
+		return h
+	}
+	if *rateLimitBurst < 1 {
+		log.Exitf("--rate_limit_burst must be at least 1, not %d", *rateLimitBurst)
+	}
+	if *rateLimitIPv6Prefix < 0 || *rateLimitIPv6Prefix > 128 {
+		log.Exitf("--rate_limit_ipv6_prefix must be between 0 and 128, not %d", *rateLimitIPv6Prefix)
+	}
+	var exempt []*net.IPNet
+	for _, c := range *rateLimitExempt {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			log.Exitf("Bad --rate_limit_exempt_cidrs entry %q: %v", c, err)
+		}
+		exempt = append(exempt, n)
+	}
+
+	l := newRateLimiter(*rateLimit, *rateLimitBurst)
+	go func() {
+		for now := range time.Tick(rateLimitSweepInterval) {
+			l.sweep(now)
+		}
+	}()
+	log.Infof("Rate limiting each client IP to %g requests per second, bursts of %d", *rateLimit, *rateLimitBurst)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ip == nil || ipInNets(ip, exempt) || (*healthChecks && (r.URL.Path == "/healthz" || r.URL.Path == "/readyz")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := l.allow(rateLimitKey(ip), time.Now())
+		if ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rateLimited.Add(1)
+		log.V(1).Infof("Rate limited %s: %s %s%s", ip, r.Method, r.Host, r.URL.Path)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+	})
+}
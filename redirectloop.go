@@ -0,0 +1,136 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+var maxRedirectChain = flag.Int("max_redirect_chain", 5, "longest chain of redirects within the site we'll send a client down; longer chains and loops get a 508 instead (0 only catches a redirect straight back to itself)")
+
+var redirectLoops = expvar.NewInt("redirect_loops")
+
+// redirectLoopError describes a redirect chain that loops or runs too long.
+type redirectLoopError struct {
+	chain []string
+	loop  bool
+}
+
+func (e *redirectLoopError) Error() string {
+	what := "redirect chain too long"
+	if e.loop {
+		what = "redirect loop"
+	}
+	return what + ": " + strings.Join(e.chain, " -> ")
+}
+
+// checkRedirectChain follows a redirect from from, a request URI on host, to loc
+// through the site, asking next where each hop leads (ok is false once a URL
+// doesn't redirect). It fails if the chain comes back around or is longer than
+// --max_redirect_chain.
+func checkRedirectChain(host, from string, loc *url.URL, next func(*url.URL) (*url.URL, bool, error)) error {
+	chain := []string{from}
+	seen := map[string]bool{chain[0]: true}
+	cur := loc
+	for hop := 0; ; hop++ {
+		if !strings.EqualFold(cur.Host, host) {
+			// Off site now, not our problem.
+			return nil
+		}
+		key := cur.RequestURI()
+		chain = append(chain, key)
+		if seen[key] {
+			return &redirectLoopError{chain: chain, loop: true}
+		}
+		seen[key] = true
+		if hop >= *maxRedirectChain {
+			return &redirectLoopError{chain: chain}
+		}
+
+		n, ok, err := next(cur)
+		if err != nil {
+			// We couldn't tell; let the client find out.
+			log.Warningf("Error following redirect chain from %s: %v", from, err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		cur = n
+	}
+}
+
+// ruleRedirect asks the config's redirects, then the site's --bucket_redirects,
+// where u redirects to on host, as withConfigRedirects and withBucketRedirects
+// would answer it.
+func ruleRedirect(host string) func(*url.URL) (*url.URL, bool, error) {
+	return func(u *url.URL) (*url.URL, bool, error) {
+		to, _, ok := redirectTarget(host, u.Path)
+		if !ok && siteRedirects != nil {
+			to, _, ok = siteRedirects.lookup(siteRedirects.site(host), host, u.Path)
+		}
+		if !ok {
+			return nil, false, nil
+		}
+		n, err := u.Parse(to)
+		if err != nil {
+			return nil, false, err
+		}
+		return n, true, nil
+	}
+}
+
+// upstreamRedirect asks the bucket, with a HEAD, where u redirects to.
+func (t *transport) upstreamRedirect(req *http.Request) func(*url.URL) (*url.URL, bool, error) {
+	return func(u *url.URL) (*url.URL, bool, error) {
+		hreq := req.Clone(req.Context())
+		hreq.Method = http.MethodHead
+		hreq.Body = nil
+		hreq.ContentLength = 0
+		hreq.URL.Path = u.Path
+		hreq.URL.RawPath = u.RawPath
+		hreq.URL.RawQuery = u.RawQuery
+		resp, err := t.RoundTripper.RoundTrip(hreq)
+		if err != nil {
+			return nil, false, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound && resp.StatusCode != http.StatusMovedPermanently {
+			return nil, false, nil
+		}
+		n, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return nil, false, err
+		}
+		n.Host = req.Header.Get("X-Original-Host")
+		return n, true, nil
+	}
+}
+
+// errorResponse makes a plain text response for the proxy to send in place of
+// what the bucket returned.
+func errorResponse(req *http.Request, code int, msg string) *http.Response {
+	body := msg + "\n"
+	return &http.Response{
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":  {"text/plain; charset=utf-8"},
+			"Cache-Control": {"no-store"},
+		},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
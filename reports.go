@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	clientReports      = flag.Bool("client_reports", false, "collect browser reports at /__report on every host: CSP violations, Reporting API and NEL reports, and JavaScript errors sent by /__report.js; see /admin/reports")
+	maxClientReports   = flag.Int("max_client_reports", 1000, "most distinct client reports kept; once full, reports that don't match one already seen are dropped until /admin/reports is cleared")
+	nelFailureFraction = flag.Float64("nel_failure_fraction", 0, "with --client_reports, send NEL and Report-To headers over HTTPS asking browsers to report this fraction of failed requests, e.g. 0.1 (disabled if 0)")
+)
+
+const (
+	reportPath   = "/__report"
+	reportScript = "/__report.js"
+
+	// maxReportBody caps a report request. Browsers batch Reporting API
+	// reports, but even a batch is a few KB.
+	maxReportBody = 64 << 10
+	// maxReportField caps each string kept from a report.
+	maxReportField = 500
+	// reportGroup is the Reporting API endpoint group NEL and CSP report-to use.
+	reportGroup = "hugoproxy"
+)
+
+var (
+	clientReportsTotal   = expvar.NewInt("client_reports")
+	clientReportsDropped = expvar.NewInt("client_reports_dropped")
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/reports", clientReportsHandler)
+	adminAction("/admin/reports", "reports")
+	adminHostScoped("/admin/reports")
+}
+
+// reportJS hooks window errors and unhandled rejections and beacons them to
+// /__report, at most ten per page. Pages include it with
+// <script src="/__report.js" async></script>.
+const reportJS = `(function(){var n=0;function send(d){if(n++>=10||!navigator.sendBeacon)return;d.type="js-error";d.url=location.href;navigator.sendBeacon("/__report",JSON.stringify(d))}
+addEventListener("error",function(e){if(e.message)send({message:e.message,source:e.filename,line:e.lineno,column:e.colno,stack:e.error&&e.error.stack})});
+addEventListener("unhandledrejection",function(e){var r=e.reason;send({message:"Unhandled rejection: "+(r&&r.message||String(r)),stack:r&&r.stack})})})();
+`
+
+// ClientReport is a kind of report a browser sent, with how often it's been
+// seen. Reports are grouped by host, kind, summary and source, so a thousand
+// visitors hitting the same broken script make one entry.
+type ClientReport struct {
+	Host string `json:"host"`
+	// Kind is csp, js-error, network-error or another Reporting API type,
+	// like deprecation or intervention.
+	Kind string `json:"kind"`
+	// Summary is what went wrong: the CSP directive and what it blocked, the
+	// NEL error type and phase, or the error message.
+	Summary string `json:"summary"`
+	// Source is the script and line it happened at, where the report says.
+	Source    string    `json:"source,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Stack     string    `json:"stack,omitempty"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func (c *ClientReport) key() string {
+	return c.Host + "\x00" + c.Kind + "\x00" + c.Summary + "\x00" + c.Source
+}
+
+// reportCollector aggregates the client reports.
+type reportCollector struct {
+	mu      sync.Mutex
+	reports map[string]*ClientReport
+	dropped int64
+}
+
+var reports = &reportCollector{reports: map[string]*ClientReport{}}
+
+func (c *reportCollector) add(rep *ClientReport, now time.Time) {
+	clientReportsTotal.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := rep.key()
+	e := c.reports[k]
+	if e == nil {
+		if len(c.reports) >= *maxClientReports {
+			c.dropped++
+			clientReportsDropped.Add(1)
+			return
+		}
+		e = rep
+		e.FirstSeen = now
+		c.reports[k] = e
+	} else if rep.URL != "" {
+		// Keep the latest example.
+		e.URL, e.UserAgent = rep.URL, rep.UserAgent
+	}
+	e.Count++
+	e.LastSeen = now
+}
+
+// list returns the reports for host and kind, if given, most frequent first.
+func (c *reportCollector) list(host, kind string, n int) ([]ClientReport, int64) {
+	c.mu.Lock()
+	out := make([]ClientReport, 0, len(c.reports))
+	for _, e := range c.reports {
+		if (host == "" || strings.EqualFold(e.Host, host)) && (kind == "" || e.Kind == kind) {
+			out = append(out, *e)
+		}
+	}
+	dropped := c.dropped
+	c.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].key() < out[j].key()
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out, dropped
+}
+
+// clear forgets the reports for host, or all of them.
+func (c *reportCollector) clear(host string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k, e := range c.reports {
+		if host == "" || strings.EqualFold(e.Host, host) {
+			delete(c.reports, k)
+			n++
+		}
+	}
+	if host == "" {
+		c.dropped = 0
+	}
+	return n
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func sourceLine(file string, line int) string {
+	if file == "" || line <= 0 {
+		return file
+	}
+	return file + ":" + strconv.Itoa(line)
+}
+
+// cspReport is the body of a CSP violation, as the old report-uri sends it
+// under csp-report, with dashed names, or the Reporting API in camel case.
+type cspReport struct {
+	DocumentURI        string `json:"document-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	BlockedURI         string `json:"blocked-uri"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+
+	DocumentURL           string `json:"documentURL"`
+	EffectiveDirectiveAPI string `json:"effectiveDirective"`
+	BlockedURL            string `json:"blockedURL"`
+	SourceFileAPI         string `json:"sourceFile"`
+	LineNumberAPI         int    `json:"lineNumber"`
+}
+
+func (b *cspReport) report() *ClientReport {
+	directive := b.EffectiveDirective
+	if directive == "" {
+		directive = b.ViolatedDirective
+	}
+	if directive == "" {
+		directive = b.EffectiveDirectiveAPI
+	}
+	blocked := b.BlockedURI
+	if blocked == "" {
+		blocked = b.BlockedURL
+	}
+	source := sourceLine(b.SourceFile, b.LineNumber)
+	if source == "" {
+		source = sourceLine(b.SourceFileAPI, b.LineNumberAPI)
+	}
+	u := b.DocumentURI
+	if u == "" {
+		u = b.DocumentURL
+	}
+	return &ClientReport{Kind: "csp", Summary: strings.TrimSpace(directive + " blocked " + blocked), Source: source, URL: u}
+}
+
+// apiReport is one report from the Reporting API, sent by Report-To or
+// Reporting-Endpoints.
+type apiReport struct {
+	Type      string          `json:"type"`
+	URL       string          `json:"url"`
+	UserAgent string          `json:"user_agent"`
+	Body      json.RawMessage `json:"body"`
+}
+
+func (a *apiReport) report() (*ClientReport, error) {
+	switch a.Type {
+	case "csp-violation":
+		var b cspReport
+		if err := json.Unmarshal(a.Body, &b); err != nil {
+			return nil, err
+		}
+		rep := b.report()
+		rep.URL = a.URL
+		return rep, nil
+	case "network-error":
+		var b struct {
+			Type       string `json:"type"`
+			Phase      string `json:"phase"`
+			StatusCode int    `json:"status_code"`
+			ServerIP   string `json:"server_ip"`
+		}
+		if err := json.Unmarshal(a.Body, &b); err != nil {
+			return nil, err
+		}
+		summary := b.Type + " in " + b.Phase
+		if b.StatusCode != 0 {
+			summary += fmt.Sprintf(" (HTTP %d)", b.StatusCode)
+		}
+		return &ClientReport{Kind: "network-error", Summary: summary, Source: b.ServerIP, URL: a.URL}, nil
+	case "":
+		return nil, fmt.Errorf("report without a type")
+	}
+	// deprecation, intervention, crash and whatever comes next mostly share
+	// these.
+	var b struct {
+		ID         string `json:"id"`
+		Message    string `json:"message"`
+		Reason     string `json:"reason"`
+		SourceFile string `json:"sourceFile"`
+		LineNumber int    `json:"lineNumber"`
+	}
+	json.Unmarshal(a.Body, &b)
+	summary := b.Message
+	if summary == "" {
+		summary = b.ID + b.Reason
+	}
+	return &ClientReport{Kind: a.Type, Summary: summary, Source: sourceLine(b.SourceFile, b.LineNumber), URL: a.URL}, nil
+}
+
+// jsError is what /__report.js beacons.
+type jsError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Source  string `json:"source"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	URL     string `json:"url"`
+	Stack   string `json:"stack"`
+}
+
+// parseReports makes sense of a report request body, whichever of the formats
+// it's in.
+func parseReports(body []byte) ([]*ClientReport, error) {
+	body = []byte(strings.TrimSpace(string(body)))
+	if len(body) > 0 && body[0] == '[' {
+		var batch []apiReport
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, err
+		}
+		var out []*ClientReport
+		for i := range batch {
+			rep, err := batch[i].report()
+			if err != nil {
+				return nil, err
+			}
+			rep.UserAgent = batch[i].UserAgent
+			out = append(out, rep)
+		}
+		return out, nil
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, err
+	}
+	if raw, ok := obj["csp-report"]; ok {
+		var b cspReport
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return nil, err
+		}
+		return []*ClientReport{b.report()}, nil
+	}
+	var e jsError
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	if e.Type != "js-error" || e.Message == "" {
+		return nil, fmt.Errorf("not a CSP, Reporting API or JavaScript error report")
+	}
+	source := sourceLine(e.Source, e.Line)
+	if source != "" && e.Column > 0 {
+		source += ":" + strconv.Itoa(e.Column)
+	}
+	return []*ClientReport{{Kind: "js-error", Summary: e.Message, Source: source, URL: e.URL, Stack: e.Stack}}, nil
+}
+
+// withClientReports answers /__report and /__report.js ahead of h and, with
+// --nel_failure_fraction, asks browsers to report network errors there.
+func withClientReports(h http.Handler) http.Handler {
+	if !*clientReports {
+		return h
+	}
+	if *nelFailureFraction < 0 || *nelFailureFraction > 1 {
+		*nelFailureFraction = 0
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case reportPath:
+			reportHandler(w, r)
+			return
+		case reportScript:
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			io.WriteString(w, reportJS)
+			return
+		}
+		if *nelFailureFraction > 0 && isHTTPS(r) {
+			endpoint := "https://" + r.Host + reportPath
+			w.Header().Set("Report-To", fmt.Sprintf(`{"group":%q,"max_age":604800,"endpoints":[{"url":%q}]}`, reportGroup, endpoint))
+			w.Header().Set("Reporting-Endpoints", fmt.Sprintf(`%s=%q`, reportGroup, endpoint))
+			w.Header().Set("NEL", fmt.Sprintf(`{"report_to":%q,"max_age":604800,"failure_fraction":%g}`, reportGroup, *nelFailureFraction))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// reportHandler takes reports from browsers. Reporting API deliveries can be
+// cross-origin, so it answers CORS preflights too.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxReportBody))
+	if err != nil {
+		http.Error(w, "report too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	reps, err := parseReports(body)
+	if err != nil {
+		http.Error(w, "bad report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	for _, rep := range reps {
+		rep.Host = normalizeHost(r.Host)
+		if rep.UserAgent == "" {
+			rep.UserAgent = r.UserAgent()
+		}
+		rep.Summary = truncate(rep.Summary, maxReportField)
+		rep.Source = truncate(rep.Source, maxReportField)
+		rep.URL = truncate(rep.URL, maxReportField)
+		rep.UserAgent = truncate(rep.UserAgent, maxReportField)
+		rep.Stack = truncate(rep.Stack, 4*maxReportField)
+		reports.add(rep, now)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clientReportsHandler shows and clears the collected reports:
+//
+//	GET    /admin/reports?host=docs.example.com&kind=csp&n=100
+//	DELETE /admin/reports?host=docs.example.com
+func clientReportsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	host := q.Get("host")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodDelete:
+		writeJSON(w, struct {
+			Cleared int `json:"cleared"`
+		}{reports.clear(host)})
+		return
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := 100
+	if v := q.Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "bad n: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	list, dropped := reports.list(host, q.Get("kind"), n)
+	writeJSON(w, struct {
+		Reports []ClientReport `json:"reports"`
+		Dropped int64          `json:"dropped"`
+	}{list, dropped})
+}
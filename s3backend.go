@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	s3Endpoint        = flag.String("s3_endpoint", "", "S3 compatible endpoint --backend=s3 reads the buckets from, e.g. https://s3.eu-west-1.amazonaws.com, https://<account>.r2.cloudflarestorage.com or http://localhost:9000 for MinIO")
+	s3Region          = flag.String("s3_region", "us-east-1", "region requests to --s3_endpoint are signed for (auto for R2)")
+	s3AccessKeyID     = flag.String("s3_access_key_id", "", "access key ID --backend=s3 signs requests with (AWS_ACCESS_KEY_ID if empty)")
+	s3SecretAccessKey = secretVar("s3_secret_access_key", "secret access key for --s3_access_key_id (AWS_SECRET_ACCESS_KEY if empty)")
+	s3VirtualHosted   = flag.Bool("s3_virtual_hosted", false, "address buckets as <bucket>.<endpoint host> rather than as <endpoint>/<bucket>, for providers that don't take the latter")
+)
+
+// emptySHA256 is the hex SHA-256 of an empty payload, which all our requests
+// have.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Transport answers the reverse proxy's upstream requests from an S3
+// compatible object store with signed requests, the way storageTransport does
+// from the Cloud Storage API: directory indexes, the 404 page and the
+// /dir to /dir/ redirect are worked out here. S3 answers conditional and range
+// requests itself, and serves stored gzip as is, which decodeForClient takes
+// care of for clients that don't take it. The bucket is the request URL's
+// host, as the director sets it.
+type s3Transport struct {
+	endpoint *url.URL
+	rt       http.RoundTripper
+	now      func() time.Time
+}
+
+func newS3Transport() *s3Transport {
+	u, err := url.Parse(*s3Endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		log.Exitf("--backend=s3 needs --s3_endpoint to be an http:// or https:// URL, not %q", *s3Endpoint)
+	}
+	if id, _, _ := s3Credentials(); id == "" {
+		log.Exit("--backend=s3 needs --s3_access_key_id and --s3_secret_access_key, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return &s3Transport{endpoint: u, rt: http.DefaultTransport, now: time.Now}
+}
+
+// s3Credentials returns the key to sign with, and the session token that goes
+// with temporary credentials from the environment.
+func s3Credentials() (id, secret, token string) {
+	if *s3AccessKeyID != "" {
+		return *s3AccessKeyID, s3SecretAccessKey.Get(), ""
+	}
+	return os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+}
+
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := errorResponse(req, http.StatusMethodNotAllowed, "Method not allowed.")
+		resp.Header.Set("Allow", "GET, HEAD")
+		return resp, nil
+	}
+	bucket := req.URL.Host
+	indexes := indexFilesFor(req.Header.Get("X-Original-Host"))
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	var resp *http.Response
+	var err error
+	if name == "" || strings.HasSuffix(name, "/") {
+		for i, idx := range indexes {
+			if resp, err = t.fetch(req, req.Method, bucket, name+idx, true); err != nil || resp.StatusCode != http.StatusNotFound || i == len(indexes)-1 {
+				break
+			}
+			resp.Body.Close()
+		}
+	} else {
+		resp, err = t.fetch(req, req.Method, bucket, name, true)
+		if err == nil && resp.StatusCode == http.StatusNotFound {
+			// Send /dir to /dir/ if there's an index there, as GCS does.
+			for _, idx := range indexes {
+				r, err := t.fetch(req, http.MethodHead, bucket, name+"/"+idx, false)
+				if err != nil {
+					break
+				}
+				r.Body.Close()
+				if r.StatusCode == http.StatusOK {
+					resp.Body.Close()
+					resp = errorResponse(req, http.StatusMovedPermanently, "Moved permanently.")
+					resp.Header.Set("Location", req.URL.Path+"/")
+					return resp, nil
+				}
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && *storageNotFoundPage != "" {
+		resp.Body.Close()
+		if resp, err = t.fetch(req, req.Method, bucket, hostPrefix(req.Header.Get("X-Original-Host"))+*storageNotFoundPage, false); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			resp.StatusCode, resp.Status = http.StatusNotFound, "404 Not Found"
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return errorResponse(req, http.StatusNotFound, "Not found."), nil
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// fetch gets bucket's object name with a signed request, passing on req's
+// conditional and range headers if conditional. Only a missing object is a 404
+// response; S3 refusing or failing is an error.
+func (t *s3Transport) fetch(req *http.Request, method, bucket, name string, conditional bool) (*http.Response, error) {
+	object := "s3://" + bucket + "/" + name
+	sreq, err := t.newRequest(req.Context(), method, bucket, name)
+	if err != nil {
+		return nil, newUpstreamError(object, err)
+	}
+	// S3 sends objects as they're stored whatever this says. Without it the
+	// transport would ask for gzip and decompress what it got.
+	sreq.Header.Set("Accept-Encoding", "identity")
+	if conditional {
+		for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+			if v := req.Header.Get(h); v != "" {
+				sreq.Header.Set(h, v)
+			}
+		}
+	}
+	t.sign(sreq)
+	resp, err := t.rt.RoundTrip(sreq)
+	if err != nil {
+		return nil, newUpstreamError(object, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusPreconditionFailed, http.StatusRequestedRangeNotSatisfiable:
+	case http.StatusNotFound:
+		if method == http.MethodHead {
+			break
+		}
+		// Tell a missing object from a missing bucket.
+		serr := readS3Error(resp)
+		if serr.Code == "NoSuchBucket" {
+			return nil, newUpstreamError(object, serr)
+		}
+		resp.Body = ioutil.NopCloser(strings.NewReader(""))
+	default:
+		return nil, newUpstreamError(object, readS3Error(resp))
+	}
+	// A range of gzip that has to be decompressed for the client is no use, so
+	// get the whole object instead, as GCS would send it.
+	if resp.StatusCode == http.StatusPartialContent && contentEncoding(resp.Header.Get("Content-Encoding")) != "identity" &&
+		!acceptsEncoding(req, resp.Header.Get("Content-Encoding")) && transformAllowed(req, resp.Header) {
+		resp.Body.Close()
+		r := req.Clone(req.Context())
+		r.Header.Del("Range")
+		return t.fetch(r, method, bucket, name, conditional)
+	}
+	for k := range resp.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-") {
+			resp.Header.Del(k)
+		}
+	}
+	resp.Header.Del("Server")
+	resp.Header.Set("X-Goog-Stored-Content-Encoding", contentEncoding(resp.Header.Get("Content-Encoding")))
+	return resp, nil
+}
+
+// newRequest makes an unsigned request for bucket's object name.
+func (t *s3Transport) newRequest(ctx context.Context, method, bucket, name string) (*http.Request, error) {
+	u := *t.endpoint
+	p := strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + name
+	if *s3VirtualHosted {
+		u.Host = bucket + "." + u.Host
+		p = strings.TrimSuffix(u.Path, "/") + "/" + name
+	}
+	// S3 signs the path as it's sent, so send it escaped the way it's signed.
+	u.Path, u.RawPath, u.RawQuery = p, s3Escape(p), ""
+	return http.NewRequestWithContext(ctx, method, u.String(), nil)
+}
+
+// sign adds AWS Signature Version 4 headers to req, which has no body, covering
+// its host and every header it has.
+func (t *s3Transport) sign(req *http.Request) {
+	id, secret, token := s3Credentials()
+	now := t.now().UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	scope := date + "/" + *s3Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secret)
+	for _, s := range []string{date, *s3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		id, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// s3Escape escapes a path the way SigV4 canonicalizes it: everything but
+// unreserved characters and slashes is percent encoded.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Error is an error response from S3.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// readS3Error reads and closes the error response resp.
+func readS3Error(resp *http.Response) *s3Error {
+	defer resp.Body.Close()
+	e := &s3Error{StatusCode: resp.StatusCode}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(e)
+	return e
+}
+
+// checkS3Bucket verifies we can read objects from bucket. The index page not
+// existing is fine, it only has to answer. It asks for a byte of it with a GET,
+// since the answer to a HEAD can't tell a missing bucket from a missing page.
+func checkS3Bucket(t *s3Transport, bucket string) readinessCheck {
+	return func(ctx context.Context) error {
+		req, err := t.newRequest(ctx, http.MethodGet, bucket, indexFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", "bytes=0-0")
+		t.sign(req)
+		resp, err := t.rt.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+			resp.Body.Close()
+			return nil
+		}
+		serr := readS3Error(resp)
+		switch {
+		case serr.StatusCode == http.StatusNotFound && serr.Code != "NoSuchBucket":
+			return nil
+		case serr.StatusCode == http.StatusForbidden:
+			id, _, _ := s3Credentials()
+			return fmt.Errorf("s3://%s: %v: access key %s needs s3:GetObject on the bucket, and s3:ListBucket for missing pages to be 404s", bucket, serr, id)
+		}
+		return fmt.Errorf("s3://%s: %v", bucket, serr)
+	}
+}
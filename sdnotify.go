@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// sdNotify sends state to systemd over $NOTIFY_SOCKET (see sd_notify(3)). It's a
+// no-op when we weren't started by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ denotes a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdStatus sets the status systemctl status shows for us, on one line.
+func sdStatus(status string) {
+	if err := sdNotify("STATUS=" + strings.Replace(status, "\n", " ", -1)); err != nil {
+		log.Errorf("sdNotify(STATUS=): %v", err)
+	}
+}
+
+// sdWatchdog sends WATCHDOG=1 at half the interval systemd asked for with
+// WatchdogSec=, so a wedged process gets restarted. Each heartbeat waits on the
+// server at addr answering, and is skipped if it doesn't; the bucket being down
+// doesn't count, or an outage would restart every instance at once. It returns
+// immediately if the watchdog isn't enabled for us.
+func sdWatchdog(addr string) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Infof("Sending systemd watchdog heartbeats every %s", interval)
+	for range time.Tick(interval) {
+		// Draining closes the listener; TimeoutStopSec= covers that.
+		if atomic.LoadInt32(&stopping) == 0 {
+			if err := serverResponds(addr, interval); err != nil {
+				log.Warningf("Skipping the systemd watchdog heartbeat, the server on %s isn't answering: %v", addr, err)
+				continue
+			}
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Errorf("sdNotify(WATCHDOG=1): %v", err)
+		}
+	}
+}
+
+// serverResponds checks the server listening on addr answers within timeout. It
+// asks OPTIONS *, which net/http answers itself without running the handlers,
+// so the check stays out of the access log and the request metrics.
+func serverResponds(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.WriteString(conn, "OPTIONS * HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	log "github.com/golang/glog"
+	"google.golang.org/api/option"
+	smpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+var secretRefreshInterval = flag.Duration("secret_refresh_interval", 10*time.Minute, "how often to re-read Secret Manager backed flags so rotated secrets are picked up")
+
+// secretRefPrefix marks a secret flag value as a Secret Manager reference rather
+// than the secret itself.
+const secretRefPrefix = "sm://"
+
+// secretFlags are all the flags registered with secretVar, and the config file's
+// secrets.
+var secretFlags []*secretFlag
+
+// secretFlag is a flag.Value for credentials and tokens that shouldn't have to live
+// in flags or files. The flag can hold the secret itself, or a Secret Manager
+// reference, which resolveSecrets swaps for the secret's current value:
+//
+//	sm://<secret>                                  latest version in --gcp_project
+//	sm://projects/<project>/secrets/<secret>       latest version
+//	sm://projects/<project>/secrets/<secret>/versions/<version>
+type secretFlag struct {
+	name string // for messages, e.g. --admin_token
+	ref  string
+
+	mu  sync.RWMutex
+	val string
+}
+
+// secretVar defines a secret flag with the given name and usage.
+func secretVar(name, usage string) *secretFlag {
+	f := &secretFlag{name: "--" + name}
+	flag.Var(f, name, usage+" (the value itself, or an "+secretRefPrefix+"<secret> Secret Manager reference)")
+	secretFlags = append(secretFlags, f)
+	return f
+}
+
+// configSecret is a secret given in the config file rather than a flag, under
+// what; it's resolved and refreshed with the secret flags.
+func configSecret(what, v string) *secretFlag {
+	f := &secretFlag{name: what}
+	f.Set(v)
+	secretFlags = append(secretFlags, f)
+	return f
+}
+
+// String implements flag.Value. It never returns a literal secret.
+func (f *secretFlag) String() string {
+	switch {
+	case f == nil:
+		return ""
+	case f.ref != "" && !strings.HasPrefix(f.ref, secretRefPrefix):
+		return "<redacted>"
+	}
+	return f.ref
+}
+
+// Set implements flag.Value.
+func (f *secretFlag) Set(v string) error {
+	f.ref = v
+	if !strings.HasPrefix(v, secretRefPrefix) {
+		f.mu.Lock()
+		f.val = v
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// Get returns the current value of the secret.
+func (f *secretFlag) Get() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.val
+}
+
+// versionName turns the flag's reference into a full secret version resource name.
+func (f *secretFlag) versionName() string {
+	name := strings.TrimPrefix(f.ref, secretRefPrefix)
+	if !strings.HasPrefix(name, "projects/") {
+		name = fmt.Sprintf("projects/%s/secrets/%s", *project, name)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	return name
+}
+
+// refresh reads the secret from Secret Manager if the flag refers to one.
+func (f *secretFlag) refresh(ctx context.Context, c *secretmanager.Client) error {
+	if !strings.HasPrefix(f.ref, secretRefPrefix) {
+		return nil
+	}
+	name := f.versionName()
+	resp, err := c.AccessSecretVersion(ctx, &smpb.AccessSecretVersionRequest{Name: name})
+	if err != nil {
+		project := strings.SplitN(strings.TrimPrefix(name, "projects/"), "/", 2)[0]
+		return fmt.Errorf("%s: AccessSecretVersion(%s): %v", f.name, name, explainPermissionDenied(err, "Secret Manager", project))
+	}
+	v := strings.TrimSpace(string(resp.GetPayload().GetData()))
+
+	f.mu.Lock()
+	changed := f.val != v
+	f.val = v
+	f.mu.Unlock()
+	if changed {
+		log.Infof("Loaded %s from %s", f.name, resp.GetName())
+	}
+	return nil
+}
+
+// resolveSecrets fetches every secret flag that refers to Secret Manager, failing
+// if any can't be read, and then keeps them up to date in the background. Once
+// running, a failed refresh keeps the last good value.
+func resolveSecrets(ctx context.Context, opts ...option.ClientOption) error {
+	var refs []*secretFlag
+	for _, f := range secretFlags {
+		if strings.HasPrefix(f.ref, secretRefPrefix) {
+			refs = append(refs, f)
+		}
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	if *project == "" {
+		p, err := projectID(ctx)
+		if err != nil {
+			return fmt.Errorf("projectID: %v", err)
+		}
+		*project = p
+	}
+
+	c, err := secretmanager.NewClient(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("secretmanager.NewClient: %v", err)
+	}
+	for _, f := range refs {
+		if err := f.refresh(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		for range time.Tick(*secretRefreshInterval) {
+			for _, f := range refs {
+				if err := f.refresh(ctx, c); err != nil {
+					log.Errorf("Error refreshing secret: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
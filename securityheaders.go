@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	hstsMaxAge            = flag.Duration("hsts_max_age", 0, "max-age of the Strict-Transport-Security header sent over HTTPS, e.g. 8760h; 0 sends none. Browsers remember it, so start short")
+	hstsIncludeSubdomains = flag.Bool("hsts_include_subdomains", false, "add includeSubDomains to Strict-Transport-Security")
+	hstsPreload           = flag.Bool("hsts_preload", false, "add preload to Strict-Transport-Security, for submission to hstspreload.org; needs --hsts_include_subdomains and an --hsts_max_age of a year or more")
+	contentTypeOptions    = flag.String("x_content_type_options", "", "X-Content-Type-Options to send, e.g. nosniff")
+	frameOptions          = flag.String("x_frame_options", "", "X-Frame-Options to send, DENY or SAMEORIGIN")
+	referrerPolicy        = flag.String("referrer_policy", "", "Referrer-Policy to send, e.g. strict-origin-when-cross-origin")
+	contentSecurityPolicy = flag.String("content_security_policy", "", "Content-Security-Policy to send")
+	cspReportOnly         = flag.String("content_security_policy_report_only", "", "Content-Security-Policy-Report-Only to send, to try a policy out before enforcing it")
+)
+
+// hstsPreloadMinAge is the shortest max-age hstspreload.org accepts.
+const hstsPreloadMinAge = 365 * 24 * time.Hour
+
+// securityHeaders returns the headers the flags ask for, and
+// Strict-Transport-Security separately since it only goes out over HTTPS.
+func securityHeaders() (http.Header, string) {
+	h := http.Header{}
+	for name, v := range map[string]string{
+		"X-Content-Type-Options":              *contentTypeOptions,
+		"X-Frame-Options":                     *frameOptions,
+		"Referrer-Policy":                     *referrerPolicy,
+		"Content-Security-Policy":             *contentSecurityPolicy,
+		"Content-Security-Policy-Report-Only": *cspReportOnly,
+	} {
+		if v != "" {
+			h.Set(name, v)
+		}
+	}
+	if *hstsMaxAge <= 0 {
+		if *hstsPreload || *hstsIncludeSubdomains {
+			log.Exitf("--hsts_preload and --hsts_include_subdomains need --hsts_max_age")
+		}
+		return h, ""
+	}
+	hsts := fmt.Sprintf("max-age=%d", int64(hstsMaxAge.Seconds()))
+	if *hstsIncludeSubdomains {
+		hsts += "; includeSubDomains"
+	}
+	if *hstsPreload {
+		if !*hstsIncludeSubdomains || *hstsMaxAge < hstsPreloadMinAge {
+			log.Exitf("--hsts_preload needs --hsts_include_subdomains and an --hsts_max_age of at least %v", hstsPreloadMinAge)
+		}
+		hsts += "; preload"
+	}
+	return h, hsts
+}
+
+// securityHeaderWriter adds the security headers a response doesn't already
+// have just before it's written, so a headers rule in the config or a handler
+// can still set its own.
+type securityHeaderWriter struct {
+	http.ResponseWriter
+	headers http.Header
+	written bool
+}
+
+func (w *securityHeaderWriter) add() {
+	if w.written {
+		return
+	}
+	w.written = true
+	h := w.ResponseWriter.Header()
+	for name, v := range w.headers {
+		if _, ok := h[name]; !ok {
+			h[name] = v
+		}
+	}
+}
+
+func (w *securityHeaderWriter) WriteHeader(code int) {
+	w.add()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *securityHeaderWriter) Write(b []byte) (int, error) {
+	w.add()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets httputil.ReverseProxy flush through the writer.
+func (w *securityHeaderWriter) Flush() {
+	w.add()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *securityHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isHTTPS reports whether r reached us, or the proxy in front of us, over TLS.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https" || (*tlsTerminated && r.URL.Scheme == "")
+}
+
+// withSecurityHeaders sends the security header flags on every response,
+// redirects and errors included.
+func withSecurityHeaders(h http.Handler) http.Handler {
+	headers, hsts := securityHeaders()
+	if len(headers) == 0 && hsts == "" {
+		return h
+	}
+	secure := headers.Clone()
+	if hsts != "" {
+		secure.Set("Strict-Transport-Security", hsts)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sh := headers
+		if isHTTPS(r) {
+			sh = secure
+		}
+		h.ServeHTTP(&securityHeaderWriter{ResponseWriter: w, headers: sh}, r)
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	serverTimingAll   = flag.Bool("server_timing", false, "add Server-Timing headers (upstream fetch time, cache status and so on) to every response")
+	serverTimingCIDRs = flags.StringSlice("server_timing_cidrs", []string{}, "CSV of client networks (e.g. 10.0.0.0/8) that get Server-Timing headers without --server_timing")
+)
+
+type serverTimingKey struct{}
+
+// serverTiming collects the Server-Timing metrics for one request.
+type serverTiming struct {
+	start time.Time
+
+	mu      sync.Mutex
+	metrics []string
+}
+
+// addServerTiming records a metric for the request ctx belongs to, if it's one
+// that gets Server-Timing headers. d may be zero for metrics with no duration.
+func addServerTiming(ctx context.Context, name string, d time.Duration, desc string) {
+	st, ok := ctx.Value(serverTimingKey{}).(*serverTiming)
+	if !ok {
+		return
+	}
+	m := name
+	if d > 0 {
+		m += fmt.Sprintf(";dur=%.1f", float64(d)/float64(time.Millisecond))
+	}
+	if desc != "" {
+		m += fmt.Sprintf(";desc=%q", desc)
+	}
+	st.mu.Lock()
+	st.metrics = append(st.metrics, m)
+	st.mu.Unlock()
+}
+
+func (st *serverTiming) header() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return strings.Join(append(st.metrics, fmt.Sprintf("total;dur=%.1f", float64(time.Since(st.start))/float64(time.Millisecond))), ", ")
+}
+
+// timedBackend adds an upstream metric for each request rt makes of the
+// backend. It goes under the cache, so only what really went to the bucket is
+// timed as a fetch.
+func timedBackend(rt http.RoundTripper) http.RoundTripper {
+	return backendTiming{rt}
+}
+
+type backendTiming struct{ http.RoundTripper }
+
+func (t backendTiming) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	addServerTiming(req.Context(), "upstream", time.Since(start), *backend+" fetch")
+	return resp, err
+}
+
+// serverTimingWriter adds the Server-Timing header just before the response
+// headers go out.
+type serverTimingWriter struct {
+	http.ResponseWriter
+	st          *serverTiming
+	wroteHeader bool
+}
+
+func (w *serverTimingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing", w.st.header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *serverTimingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *serverTimingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withServerTiming enables Server-Timing for requests from clients that should
+// see it: everyone with --server_timing, otherwise those in --server_timing_cidrs.
+func withServerTiming(h http.Handler) http.Handler {
+	var nets []*net.IPNet
+	for _, c := range *serverTimingCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			log.Exitf("Bad --server_timing_cidrs entry %q: %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	if !*serverTimingAll && len(nets) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !*serverTimingAll && !ipInNets(clientIP(r), nets) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		st := &serverTiming{start: time.Now()}
+		r = r.WithContext(context.WithValue(r.Context(), serverTimingKey{}, st))
+		h.ServeHTTP(&serverTimingWriter{ResponseWriter: w, st: st}, r)
+	})
+}
+
+// clientIP returns the IP address of the client that made r. With
+// --trust_proxy_headers, RemoteAddr has already been replaced by the forwarded
+// address.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
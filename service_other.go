@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import log "github.com/golang/glog"
+
+// isWindowsService is always false off Windows.
+func isWindowsService() bool { return false }
+
+func runService(serve func()) { serve() }
+
+func serviceCommand(args []string) {
+	log.Exit("the service subcommand is only supported on Windows")
+}
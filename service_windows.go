@@ -0,0 +1,245 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+var serviceName = flag.String("windows_service_name", "hugoproxy", "name hugoproxy is registered under with the Windows service control manager")
+
+// elog receives service lifecycle events, and the errors glog copies to stderr,
+// when running under the service control manager. glog still writes its usual
+// files to --log_dir.
+var elog *eventlog.Log
+
+// isWindowsService reports whether we were started by the service control manager.
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	if err != nil {
+		log.Exitf("svc.IsWindowsService: %v", err)
+	}
+	return ok
+}
+
+// windowsService adapts serve to svc.Handler.
+type windowsService struct {
+	serve func()
+}
+
+// Execute implements svc.Handler. A stop request drains the listeners like
+// SIGTERM does, then returns, which lets svc.Run return and main exit.
+func (s *windowsService) Execute(args []string, req <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go s.serve()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	elog.Info(1, fmt.Sprintf("%s started", *serviceName))
+
+	for c := range req {
+		switch c.Cmd {
+		case svc.Interrogate:
+			status <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			elog.Info(1, fmt.Sprintf("%s stopping", *serviceName))
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32((*drainTimeout + shutdownHookTimeout) / time.Millisecond)}
+			shutdown(fmt.Sprintf("%s stopping", *serviceName))
+			return false, 0
+		default:
+			elog.Warning(1, fmt.Sprintf("unexpected service control request #%d", c.Cmd))
+		}
+	}
+	return false, 0
+}
+
+// runService hands control to the service control manager, calling serve once
+// the service has started.
+func runService(serve func()) {
+	var err error
+	if elog, err = eventlog.Open(*serviceName); err != nil {
+		log.Exitf("eventlog.Open(%q): %v", *serviceName, err)
+	}
+	defer elog.Close()
+	if err := stderrToEventLog(); err != nil {
+		elog.Warning(1, fmt.Sprintf("errors won't reach the event log: %v", err))
+	}
+
+	if err := svc.Run(*serviceName, &windowsService{serve}); err != nil {
+		elog.Error(1, fmt.Sprintf("%s failed: %v", *serviceName, err))
+		log.Exitf("svc.Run(%q): %v", *serviceName, err)
+	}
+	elog.Info(1, fmt.Sprintf("%s stopped", *serviceName))
+}
+
+// stderrToEventLog points os.Stderr, where glog copies messages at or above
+// --stderrthreshold (errors, by default), into the event log. Under the service
+// control manager it goes nowhere otherwise.
+func stderrToEventLog() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	os.Stderr = w
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line = strings.TrimSpace(line); line != "" {
+				// glog starts each line with its severity.
+				switch line[0] {
+				case 'I':
+					elog.Info(1, line)
+				case 'W':
+					elog.Warning(1, line)
+				default:
+					elog.Error(1, line)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// serviceCommand implements `hugoproxy [flags] service install|remove|start|stop`.
+// install registers the service to run with the flags given before "service".
+func serviceCommand(args []string) {
+	if len(args) != 1 {
+		log.Exit("usage: hugoproxy [flags] service install|remove|start|stop")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Exitf("mgr.Connect: %v", err)
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		err = installService(m)
+	case "remove":
+		err = removeService(m)
+	case "start":
+		err = startService(m)
+	case "stop":
+		err = controlService(m, svc.Stop, svc.Stopped)
+	default:
+		err = fmt.Errorf("unknown service command %q", args[0])
+	}
+	if err != nil {
+		log.Exitf("service %s: %v", args[0], err)
+	}
+}
+
+// serviceArgs returns the command line flags to register the service with: everything
+// up to the "service" subcommand.
+func serviceArgs() []string {
+	for i, a := range os.Args[1:] {
+		if a == "service" {
+			return os.Args[1 : i+1]
+		}
+	}
+	return nil
+}
+
+func installService(m *mgr.Mgr) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if s, err := m.OpenService(*serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", *serviceName)
+	}
+
+	s, err := m.CreateService(*serviceName, exe, mgr.Config{
+		DisplayName: "hugoproxy",
+		Description: "TLS terminating proxy for a Hugo site stored in GCS",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs()...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(*serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("eventlog.InstallAsEventCreate: %v", err)
+	}
+	log.Infof("Installed service %s running %s %q", *serviceName, exe, serviceArgs())
+	return nil
+}
+
+func removeService(m *mgr.Mgr) error {
+	s, err := m.OpenService(*serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %v", *serviceName, err)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	if err := eventlog.Remove(*serviceName); err != nil {
+		return fmt.Errorf("eventlog.Remove: %v", err)
+	}
+	log.Infof("Removed service %s", *serviceName)
+	return nil
+}
+
+func startService(m *mgr.Mgr) error {
+	s, err := m.OpenService(*serviceName)
+	if err != nil {
+		return fmt.Errorf("could not access service %s: %v", *serviceName, err)
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+// controlService sends c to the service and waits for it to reach state to: at
+// least 10 seconds, and for as long as the wait hint the service last reported,
+// which for a stop covers its --drain_timeout.
+func controlService(m *mgr.Mgr, c svc.Cmd, to svc.State) error {
+	s, err := m.OpenService(*serviceName)
+	if err != nil {
+		return fmt.Errorf("could not access service %s: %v", *serviceName, err)
+	}
+	defer s.Close()
+
+	status, err := s.Control(c)
+	if err != nil {
+		return fmt.Errorf("could not send control=%d: %v", c, err)
+	}
+	start := time.Now()
+	timeout := start.Add(10 * time.Second)
+	last := status
+	for status.State != to {
+		// The hint counts from when the service last reported progress.
+		if status.State != last.State || status.CheckPoint != last.CheckPoint {
+			start, last = time.Now(), status
+		}
+		if t := start.Add(time.Duration(status.WaitHint) * time.Millisecond); t.After(timeout) {
+			timeout = t
+		}
+		if time.Now().After(timeout) {
+			return fmt.Errorf("timeout waiting for service to go to state=%d", to)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return fmt.Errorf("could not retrieve service status: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var drainTimeout = flag.Duration("drain_timeout", 25*time.Second, "how long to let in-flight requests finish on SIGTERM or SIGINT before closing their connections; keep it under the platform's grace period, 30s for GCE preemption")
+
+// shutdownHookTimeout is how long the work done after draining, like saving the
+// cache index, gets on top of --drain_timeout.
+const shutdownHookTimeout = 10 * time.Second
+
+var (
+	shutdownMu    sync.Mutex
+	servers       []*http.Server
+	shutdownHooks []func(ctx context.Context)
+	shutdownOnce  sync.Once
+
+	// stopped is closed once shutdown has finished.
+	stopped = make(chan struct{})
+)
+
+// drained registers s to be shut down gracefully, and returns it.
+func drained(s *http.Server) *http.Server {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	servers = append(servers, s)
+	return s
+}
+
+// onShutdown runs f once the servers have drained, before the process exits.
+// Hooks run in the order they were added.
+func onShutdown(f func(ctx context.Context)) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+// shutdown stops accepting connections, waits up to --drain_timeout for the
+// requests in flight to finish, then runs the shutdown hooks. It's safe to call
+// more than once; later calls wait for the first to finish.
+func shutdown(reason string) {
+	shutdownOnce.Do(func() {
+		log.Infof("%s: draining connections for up to %v", reason, *drainTimeout)
+		setStopping()
+		if err := sdNotify("STOPPING=1"); err != nil {
+			log.Errorf("sdNotify(STOPPING=1): %v", err)
+		}
+
+		shutdownMu.Lock()
+		ss, hooks := servers, shutdownHooks
+		shutdownMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		var wg sync.WaitGroup
+		for _, s := range ss {
+			wg.Add(1)
+			go func(s *http.Server) {
+				defer wg.Done()
+				if err := s.Shutdown(ctx); err != nil {
+					log.Warningf("Gave up draining %s: %v", s.Addr, err)
+					s.Close()
+				}
+			}(s)
+		}
+		wg.Wait()
+		cancel()
+		log.Info("Listeners stopped")
+
+		ctx, cancel = context.WithTimeout(context.Background(), shutdownHookTimeout)
+		for _, f := range hooks {
+			f(ctx)
+		}
+		cancel()
+		log.Flush()
+		close(stopped)
+	})
+	<-stopped
+}
+
+// handleShutdownSignals shuts down gracefully on SIGTERM or SIGINT.
+func handleShutdownSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		shutdown("Got " + sig.String())
+	}()
+}
+
+// listenerStopped handles a server's Serve returning. After a shutdown that's
+// expected, and it waits for the shutdown to finish so serve can return;
+// anything else is fatal.
+func listenerStopped(what string, err error) {
+	if err == http.ErrServerClosed {
+		<-stopped
+		return
+	}
+	log.Exitf("%s: %v", what, err)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	snapshotDir      = flag.String("snapshot_dir", "", "directory to keep a last-known-good copy of --snapshot_paths in, served if the bucket can't be reached (disabled if empty)")
+	snapshotPaths    = flags.StringSlice("snapshot_paths", []string{"/", "/404.html"}, "CSV of the site's critical paths to snapshot")
+	snapshotInterval = flag.Duration("snapshot_interval", 10*time.Minute, "how often to refresh the snapshot")
+)
+
+var snapshotsServed = expvar.NewInt("snapshots_served")
+
+// snapshots is the last-known-good copy of the site, nil unless --snapshot_dir is set.
+var snapshots *snapshotter
+
+// snapshotter keeps copies of critical pages on local disk so the site stays
+// readable through a GCS outage.
+type snapshotter struct {
+	dir      string
+	upstream *url.URL
+	client   *http.Client
+}
+
+// snapshotMeta is stored next to each snapshotted body.
+type snapshotMeta struct {
+	Path        string    `json:"path"`
+	ContentType string    `json:"content_type"`
+	Fetched     time.Time `json:"fetched"`
+}
+
+func newSnapshotter(dir string, upstream *url.URL, backend http.RoundTripper) (*snapshotter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &snapshotter{dir: dir, upstream: upstream, client: &http.Client{Transport: backend, Timeout: time.Minute}}, nil
+}
+
+func (s *snapshotter) file(p, ext string) string {
+	sum := sha256.Sum256([]byte(p))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+ext)
+}
+
+// writeFileAtomic replaces name with data without readers ever seeing half of it.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// save fetches p from the bucket and stores it, if the bucket returns it OK.
+func (s *snapshotter) save(ctx context.Context, p string) error {
+	u := *s.upstream
+	u.Path = singleJoiningSlash(s.upstream.Path, p)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u.String(), resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(snapshotMeta{Path: p, ContentType: resp.Header.Get("Content-Type"), Fetched: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.file(p, ".body"), body); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file(p, ".json"), meta)
+}
+
+// refresh snapshots every --snapshot_paths entry every --snapshot_interval. A
+// failed fetch leaves the previous copy in place.
+func (s *snapshotter) refresh() {
+	for {
+		for _, p := range *snapshotPaths {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if err := s.save(ctx, p); err != nil {
+				log.Warningf("Error snapshotting %s: %v", p, err)
+			} else {
+				log.V(1).Infof("Snapshotted %s", p)
+			}
+			cancel()
+		}
+		time.Sleep(*snapshotInterval)
+	}
+}
+
+// serve writes the snapshot of r's path, reporting false if there isn't one.
+// status is the status to send it with.
+func (s *snapshotter) serve(w http.ResponseWriter, r *http.Request, status int) bool {
+	// Snapshots are of --gcs_bucket, not the --host_buckets sites.
+	if s == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) || hostBucketURL(r.Host) != nil {
+		return false
+	}
+	p := r.URL.Path
+	metaJSON, err := ioutil.ReadFile(s.file(p, ".json"))
+	if err != nil {
+		return false
+	}
+	meta := snapshotMeta{}
+	if err := json.Unmarshal(metaJSON, &meta); err != nil || meta.Path != p {
+		return false
+	}
+	f, err := os.Open(s.file(p, ".body"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	snapshotsServed.Add(1)
+	log.Warningf("Serving snapshot of %s from %s", p, meta.Fetched)
+	h := w.Header()
+	h.Set("Content-Type", meta.ContentType)
+	h.Set("Cache-Control", "no-store")
+	if status == http.StatusOK {
+		// The snapshot is the same object the bucket would send, so it caches the same.
+		applyCachePolicy(h, r.Host, p)
+	}
+	h.Set("Warning", `111 hugoproxy "Revalidation Failed"`)
+	h.Set("X-Hugoproxy-Snapshot", meta.Fetched.UTC().Format(http.TimeFormat))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+	return true
+}
+
+// has reports whether there's a snapshot of p.
+func (s *snapshotter) has(p string) bool {
+	if s == nil {
+		return false
+	}
+	_, err := os.Stat(s.file(p, ".json"))
+	return err == nil
+}
+
+// errUpstreamFailed makes the reverse proxy hand a bucket 5xx to
+// snapshotErrorHandler.
+type errUpstreamFailed struct{ status string }
+
+func (e errUpstreamFailed) Error() string { return "upstream returned " + e.status }
+
+// checkSnapshotFallback fails responses the bucket couldn't serve, when a
+// snapshot could be served instead.
+func checkSnapshotFallback(resp *http.Response) error {
+	if resp.StatusCode < 500 || snapshots == nil || resp.Request.URL.Host != snapshots.upstream.Host || !snapshots.has(resp.Request.URL.Path) {
+		return nil
+	}
+	resp.Body.Close()
+	e := &upstreamError{Class: classUnavailable, Object: resp.Request.URL.String(), Err: errUpstreamFailed{resp.Status}}
+	countUpstreamError(resp.Request.Context(), e)
+	return e
+}
+
+// startSnapshots enables the snapshot fallback if --snapshot_dir is set.
+func startSnapshots(upstream *url.URL, backend http.RoundTripper) {
+	if *snapshotDir == "" {
+		return
+	}
+	var err error
+	if snapshots, err = newSnapshotter(*snapshotDir, upstream, backend); err != nil {
+		log.Exitf("newSnapshotter(%s): %v", *snapshotDir, err)
+	}
+	go snapshots.refresh()
+}
+
+// snapshotErrorHandler is the reverse proxy's ErrorHandler: when the bucket can't
+// be reached at all, serve the snapshot if we have one. Otherwise the client
+// gets a status for the class of error.
+func snapshotErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	e := newUpstreamError(r.URL.Path, err)
+	if r.Context().Err() == context.Canceled {
+		// The client went away; there's no one to answer.
+		e.Class = classCanceled
+	}
+	logUpstreamError(e, r.URL.Path)
+	if e.Class == classCanceled || snapshots.serve(w, r, http.StatusOK) {
+		return
+	}
+	switch e.Class {
+	case classTimeout:
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case classUnavailable:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var stalenessInterval = flag.Duration("staleness_check_interval", 0, "how often to compare every --cache_size cache entry with its object in the bucket, for the report at /admin/staleness and the cache_stale_entries metric (0 to only check when the report asks for it)")
+
+// stalenessCheckTimeout bounds the HEAD request made for each cache entry.
+const stalenessCheckTimeout = 30 * time.Second
+
+var (
+	lastStalenessMu sync.Mutex
+	lastStaleness   *StalenessReport
+
+	// stalenessMu keeps to one check at a time.
+	stalenessMu sync.Mutex
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/staleness", stalenessHandler)
+	expvar.Publish("cache_stale_entries", expvar.Func(func() interface{} {
+		if r := latestStaleness(); r != nil {
+			return r.Stale
+		}
+		return 0
+	}))
+	expvar.Publish("cache_max_staleness_seconds", expvar.Func(func() interface{} {
+		if r := latestStaleness(); r != nil {
+			return r.MaxStaleSeconds
+		}
+		return 0
+	}))
+}
+
+// StalenessReport compares what the cache is serving with the bucket.
+type StalenessReport struct {
+	Checked time.Time `json:"checked"`
+	Entries int       `json:"entries"`
+	Stale   int       `json:"stale"`
+	// MaxStaleSeconds is the longest any entry has been out of date.
+	MaxStaleSeconds int64 `json:"max_stale_seconds"`
+	// Objects are the stale entries, most stale first, then the oldest of
+	// the rest.
+	Objects []StaleEntry `json:"objects"`
+}
+
+// StaleEntry is a cache entry and what the bucket has for it now.
+type StaleEntry struct {
+	Host       string     `json:"host,omitempty"`
+	URL        string     `json:"url"`
+	Status     int        `json:"status"`
+	Generation string     `json:"generation,omitempty"`
+	Modified   *time.Time `json:"modified,omitempty"`
+	Cached     time.Time  `json:"cached"`
+	Expires    time.Time  `json:"expires"`
+	AgeSeconds int64      `json:"age_seconds"`
+	Hits       int64      `json:"hits"`
+	Stale      bool       `json:"stale"`
+	// CurrentStatus and CurrentGeneration are what the bucket answers with
+	// now; CurrentStatus is zero if the check failed.
+	CurrentStatus     int    `json:"current_status,omitempty"`
+	CurrentGeneration string `json:"current_generation,omitempty"`
+	// StaleSeconds is how long the entry has been out of date: since the
+	// object changed, or since it was cached if that's later or unknown.
+	StaleSeconds int64  `json:"stale_seconds,omitempty"`
+	Error        string `json:"error,omitempty"`
+
+	// gzip is whether the entry was fetched for a client taking gzip.
+	gzip bool
+}
+
+func latestStaleness() *StalenessReport {
+	lastStalenessMu.Lock()
+	defer lastStalenessMu.Unlock()
+	return lastStaleness
+}
+
+// objectVersion identifies the version of the object behind h: its
+// generation, or its ETag for backends without one.
+func objectVersion(h http.Header) string {
+	if g := h.Get("X-Goog-Generation"); g != "" {
+		return g
+	}
+	return strings.TrimPrefix(h.Get("ETag"), "W/")
+}
+
+// snapshot copies out what's needed to check each entry still served.
+func (c *cache) snapshot(now time.Time) []StaleEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []StaleEntry
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		if now.After(e.staleUntil) {
+			continue
+		}
+		var modified *time.Time
+		if lm, err := http.ParseTime(e.header.Get("Last-Modified")); err == nil {
+			modified = &lm
+		}
+		entries = append(entries, StaleEntry{
+			Host:       e.host,
+			URL:        e.url,
+			Status:     e.status,
+			Generation: objectVersion(e.header),
+			Modified:   modified,
+			Cached:     e.stored,
+			Expires:    e.expires,
+			AgeSeconds: int64(now.Sub(e.stored) / time.Second),
+			Hits:       e.hits,
+			gzip:       e.gzip,
+		})
+	}
+	return entries
+}
+
+// checkEntry asks the backend, beneath the cache, for the object behind e.
+func (c *cache) checkEntry(e *StaleEntry, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), stalenessCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, e.URL, nil)
+	if err != nil {
+		e.Error = err.Error()
+		return
+	}
+	req.Host = req.URL.Host
+	req.Header.Set("X-Original-Host", e.Host)
+	req.Header.Set("Accept-Encoding", "identity")
+	if e.gzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	resp, err := c.RoundTripper.RoundTrip(req)
+	if err != nil {
+		e.Error = err.Error()
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	e.CurrentStatus = resp.StatusCode
+	e.CurrentGeneration = objectVersion(resp.Header)
+	if e.CurrentStatus == e.Status && e.CurrentGeneration == e.Generation {
+		return
+	}
+	e.Stale = true
+	since := e.Cached
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && lm.After(since) {
+		since = lm
+	}
+	e.StaleSeconds = int64(now.Sub(since) / time.Second)
+}
+
+// checkStaleness compares every unexpired entry in c with the bucket, with
+// --cache_warmers requests at a time, and saves the report.
+func (c *cache) checkStaleness() *StalenessReport {
+	stalenessMu.Lock()
+	defer stalenessMu.Unlock()
+	start := time.Now()
+	entries := c.snapshot(start)
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < *cacheWarmers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				c.checkEntry(&entries[i], start)
+			}
+		}()
+	}
+	for i := range entries {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	report := &StalenessReport{Checked: start, Entries: len(entries)}
+	for _, e := range entries {
+		if e.Stale {
+			report.Stale++
+			if e.StaleSeconds > report.MaxStaleSeconds {
+				report.MaxStaleSeconds = e.StaleSeconds
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Stale != b.Stale {
+			return a.Stale
+		}
+		if a.StaleSeconds != b.StaleSeconds {
+			return a.StaleSeconds > b.StaleSeconds
+		}
+		return a.Cached.Before(b.Cached)
+	})
+	report.Objects = entries
+	log.V(1).Infof("Checked %d cache entries against the bucket in %s: %d stale", len(entries), time.Since(start), report.Stale)
+	if report.Stale > 0 {
+		log.Warningf("%d cache entries are out of date, the oldest by %ds", report.Stale, report.MaxStaleSeconds)
+	}
+
+	lastStalenessMu.Lock()
+	lastStaleness = report
+	lastStalenessMu.Unlock()
+	return report
+}
+
+// startStaleness checks rt, if it's a cache, against the bucket every
+// --staleness_check_interval.
+func startStaleness(rt http.RoundTripper) {
+	c, ok := rt.(*cache)
+	if !ok || *stalenessInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(*stalenessInterval) {
+			c.checkStaleness()
+		}
+	}()
+}
+
+// stalenessHandler serves the latest staleness report, running a check first
+// with check=1 or if there hasn't been one:
+//
+//	GET /admin/staleness?check=1&limit=20
+func stalenessHandler(w http.ResponseWriter, r *http.Request) {
+	if contentCache == nil {
+		http.Error(w, "the cache is off (is --cache_size set?)", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	report := latestStaleness()
+	if check, _ := strconv.ParseBool(q.Get("check")); check || report == nil {
+		report = contentCache.checkStaleness()
+	}
+	out := *report
+	if len(out.Objects) > limit {
+		out.Objects = out.Objects[:limit]
+	}
+	writeJSON(w, &out)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"html/template"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	statusPath           = flag.String("status_path", "", "path, e.g. /status, to serve a status summary on every host, ahead of the site content: HTML for people, or JSON with Accept: application/json or ?format=json for dashboards (it's always on the admin API at /admin/status)")
+	statusErrorThreshold = flag.Float64("status_error_threshold", 0.05, "share of requests in the last 5 minutes answered with a server error above which the status page says degraded")
+	statusCertWarning    = flag.Duration("status_cert_warning", 7*24*time.Hour, "how close to expiry a certificate we serve has to be for the status page to say degraded")
+)
+
+// startTime is when this instance started, for its uptime.
+var startTime = time.Now()
+
+// statusMinutes is how many minutes of request counts the status page keeps.
+const statusMinutes = 60
+
+var requestRates = &requestRateTracker{}
+
+func init() {
+	adminMux.HandleFunc("/admin/status", statusHandler)
+	subscribe(func(e Event) {
+		if r, ok := e.(RequestCompleted); ok {
+			requestRates.record(r.Time, r.Status >= 500)
+		}
+	})
+}
+
+// requestRateTracker counts requests and server errors by minute.
+type requestRateTracker struct {
+	mu    sync.Mutex
+	slots [statusMinutes]struct {
+		minute           int64
+		requests, errors int64
+	}
+}
+
+func (t *requestRateTracker) record(now time.Time, failed bool) {
+	m := now.Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.slots[m%statusMinutes]
+	if s.minute != m {
+		s.minute, s.requests, s.errors = m, 0, 0
+	}
+	s.requests++
+	if failed {
+		s.errors++
+	}
+}
+
+// RequestRate is the requests and server errors over a window.
+type RequestRate struct {
+	Window    string  `json:"window"`
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// rate sums the last minutes minutes, this one included.
+func (t *requestRateTracker) rate(now time.Time, minutes int64) RequestRate {
+	m := now.Unix() / 60
+	r := RequestRate{Window: strconv.FormatInt(minutes, 10) + "m"}
+	t.mu.Lock()
+	for _, s := range t.slots {
+		if s.minute > m-minutes && s.minute <= m {
+			r.Requests += s.requests
+			r.Errors += s.errors
+		}
+	}
+	t.mu.Unlock()
+	if r.Requests > 0 {
+		r.ErrorRate = float64(r.Errors) / float64(r.Requests)
+	}
+	return r
+}
+
+// servedCerts remembers the certificates handshakes have been answered with, by
+// the names they cover.
+var servedCerts = &certTracker{certs: map[string]servedCert{}}
+
+type servedCert struct {
+	cert     *tls.Certificate
+	notAfter time.Time
+}
+
+type certTracker struct {
+	mu    sync.RWMutex
+	certs map[string]servedCert
+}
+
+// observeCertificates wraps a GetCertificate to note each certificate it
+// returns, for the status page.
+func observeCertificates(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := get(hello)
+		if err == nil && cert != nil {
+			servedCerts.note(cert)
+		}
+		return cert, err
+	}
+}
+
+func (t *certTracker) note(cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		// Only parsed the first time we see each certificate.
+		t.mu.RLock()
+		for _, s := range t.certs {
+			if s.cert == cert {
+				t.mu.RUnlock()
+				return
+			}
+		}
+		t.mu.RUnlock()
+		var err error
+		if len(cert.Certificate) == 0 {
+			return
+		}
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	names := strings.Join(leaf.DNSNames, ", ")
+	t.mu.RLock()
+	s, ok := t.certs[names]
+	t.mu.RUnlock()
+	if ok && s.cert == cert {
+		return
+	}
+	t.mu.Lock()
+	t.certs[names] = servedCert{cert: cert, notAfter: leaf.NotAfter}
+	t.mu.Unlock()
+}
+
+// CertStatus is one certificate we serve.
+type CertStatus struct {
+	Names    string    `json:"names"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int       `json:"days_left"`
+}
+
+func (t *certTracker) list(now time.Time) []CertStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var l []CertStatus
+	for names, s := range t.certs {
+		l = append(l, CertStatus{Names: names, NotAfter: s.notAfter, DaysLeft: int(s.notAfter.Sub(now).Hours() / 24)})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].NotAfter.Before(l[j].NotAfter) })
+	return l
+}
+
+// SiteRelease is the bucket, and prefix, a site is being served from.
+type SiteRelease struct {
+	Hosts   []string `json:"hosts"`
+	Release string   `json:"release"`
+}
+
+// siteReleases lists what each site serves: --gcs_bucket for --blog_hostnames
+// and anything else, and each --host_buckets entry.
+func siteReleases() []SiteRelease {
+	releaseOf := func(u *url.URL) string { return "gs://" + u.Host + "/" + strings.TrimPrefix(u.Path, "/") }
+	byRelease := map[string][]string{}
+	if u, err := bucketURL(*hugoBucket); err == nil {
+		r := releaseOf(u)
+		byRelease[r] = []string{}
+		for _, h := range *hostnames {
+			if hostBucketURL(h) == nil {
+				byRelease[r] = append(byRelease[r], h)
+			}
+		}
+	}
+	for _, h := range hostBucketHosts() {
+		r := releaseOf(hostBucketURL(h))
+		byRelease[r] = append(byRelease[r], h)
+	}
+	for _, h := range hostBucketWildcardHosts() {
+		r := releaseOf(hostBucketWildcards[h])
+		byRelease[r] = append(byRelease[r], h)
+	}
+	var l []SiteRelease
+	for r, hosts := range byRelease {
+		sort.Strings(hosts)
+		l = append(l, SiteRelease{Hosts: hosts, Release: r})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Release < l[j].Release })
+	return l
+}
+
+// StatusReport is what the status page says.
+type StatusReport struct {
+	Status        string        `json:"status"` // ok, degraded or unavailable
+	Problems      []string      `json:"problems,omitempty"`
+	Started       time.Time     `json:"started"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+	Ready         bool          `json:"ready"`
+	Build         string        `json:"build,omitempty"`
+	Requests      []RequestRate `json:"requests"`
+	Certificates  []CertStatus  `json:"certificates,omitempty"`
+	Sites         []SiteRelease `json:"sites"`
+}
+
+func statusReport(now time.Time) *StatusReport {
+	s := &StatusReport{
+		Status:        "ok",
+		Started:       startTime.UTC().Truncate(time.Second),
+		UptimeSeconds: int64(now.Sub(startTime) / time.Second),
+		Ready:         atomic.LoadInt32(&ready) != 0,
+		Requests:      []RequestRate{requestRates.rate(now, 5), requestRates.rate(now, statusMinutes)},
+		Certificates:  servedCerts.list(now),
+		Sites:         siteReleases(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		s.Build = bi.Main.Version
+	}
+	if r := s.Requests[0]; r.ErrorRate > *statusErrorThreshold {
+		s.Problems = append(s.Problems, "server errors are above "+formatPercent(*statusErrorThreshold)+" of requests")
+	}
+	for _, c := range s.Certificates {
+		if c.NotAfter.Sub(now) < *statusCertWarning {
+			s.Problems = append(s.Problems, "the certificate for "+c.Names+" expires "+c.NotAfter.Format(time.RFC3339))
+		}
+	}
+	switch {
+	case !s.Ready:
+		s.Status = "unavailable"
+	case len(s.Problems) > 0:
+		s.Status = "degraded"
+	}
+	return s
+}
+
+// formatPercent formats a share as a percentage, like 1.25%.
+func formatPercent(f float64) string {
+	return strings.TrimRight(strings.TrimRight(strconv.FormatFloat(f*100, 'f', 2, 64), "0"), ".") + "%"
+}
+
+// statusHandler serves the status report, as JSON if asked for and HTML
+// otherwise. Anyone may embed it.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	s := statusReport(time.Now())
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, s)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := statusPage.Execute(w, s); err != nil {
+		log.Errorf("Error writing the status page: %v", err)
+	}
+}
+
+// withStatusPage serves the status report at --status_path on every host.
+func withStatusPage(h http.Handler) http.Handler {
+	if *statusPath == "" {
+		return h
+	}
+	if !strings.HasPrefix(*statusPath, "/") {
+		log.Exitf("--status_path should start with /, not %q", *statusPath)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != *statusPath || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		statusHandler(w, r)
+	})
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": formatPercent,
+	"time":    func(t time.Time) string { return t.Format(time.RFC3339) },
+	"uptime":  func(s int64) string { return (time.Duration(s) * time.Second).String() },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Status: {{.Status}}</title>
+<style>
+body{font:15px/1.5 sans-serif;max-width:46em;margin:2em auto;padding:0 1em;color:#222}
+.ok{color:#080}.degraded{color:#b60}.unavailable{color:#c00}
+table{border-collapse:collapse;margin-bottom:1.5em}td,th{text-align:left;padding:.2em 1.2em .2em 0}
+</style>
+</head>
+<body>
+<h1 class="{{.Status}}">{{.Status}}</h1>
+{{range .Problems}}<p class="degraded">{{.}}</p>
+{{end}}<p>Up {{uptime .UptimeSeconds}}, since {{time .Started}}{{if .Build}}, build {{.Build}}{{end}}.</p>
+<h2>Requests</h2>
+<table>
+<tr><th>Last</th><th>Requests</th><th>Server errors</th><th>Error rate</th></tr>
+{{range .Requests}}<tr><td>{{.Window}}</td><td>{{.Requests}}</td><td>{{.Errors}}</td><td>{{percent .ErrorRate}}</td></tr>
+{{end}}</table>
+{{if .Certificates}}<h2>Certificates</h2>
+<table>
+<tr><th>Names</th><th>Expires</th><th>Days left</th></tr>
+{{range .Certificates}}<tr><td>{{.Names}}</td><td>{{time .NotAfter}}</td><td>{{.DaysLeft}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Releases</h2>
+<table>
+<tr><th>Hosts</th><th>Serving</th></tr>
+{{range .Sites}}<tr><td>{{range $i, $h := .Hosts}}{{if $i}}, {{end}}{{$h}}{{else}}everything else{{end}}</td><td>{{.Release}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
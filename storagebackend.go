@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	log "github.com/golang/glog"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	backend             = flag.String("backend", "storage", `how to read the bucket: "storage" reads objects with the Cloud Storage API using our credentials, "http" proxies GCS's public website endpoint over plain HTTP, "s3" reads objects from an S3 compatible store at --s3_endpoint with signed requests, "local" reads files from --local_dir, which sets it`)
+	storageNotFoundPage = flag.String("storage_not_found_page", "404.html", "object served with a 404 when a path doesn't exist, under the host's --host_buckets prefix if it has one (Hugo generates 404.html); with --backend=http a bucket's own website 404 page is used if it has one and there's no prefix")
+)
+
+// storageTransport answers the reverse proxy's upstream requests from the Cloud
+// Storage API instead of over the network, copying the way GCS's website
+// endpoint behaves so the rest of the transport can't tell the difference:
+// directory indexes, the 404 page, conditional and range requests, and
+// decompressive transcoding of gzip stored objects. The bucket is the request
+// URL's host, as the director sets it.
+type storageTransport struct {
+	client *storage.Client
+}
+
+func (t *storageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := errorResponse(req, http.StatusMethodNotAllowed, "Method not allowed.")
+		resp.Header.Set("Allow", "GET, HEAD")
+		return resp, nil
+	}
+	ctx := req.Context()
+	bucket := t.client.Bucket(req.URL.Host)
+
+	indexes := indexFilesFor(req.Header.Get("X-Original-Host"))
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	var attrs *storage.ObjectAttrs
+	var err error
+	if name == "" || strings.HasSuffix(name, "/") {
+		for _, idx := range indexes {
+			if attrs, err = bucket.Object(name + idx).Attrs(ctx); err != storage.ErrObjectNotExist {
+				break
+			}
+		}
+	} else {
+		attrs, err = bucket.Object(name).Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			// Like the website endpoint, send /dir to /dir/ if there's an index there.
+			for _, idx := range indexes {
+				if _, err := bucket.Object(name + "/" + idx).Attrs(ctx); err == nil {
+					resp := errorResponse(req, http.StatusMovedPermanently, "Moved permanently.")
+					resp.Header.Set("Location", req.URL.Path+"/")
+					return resp, nil
+				}
+			}
+		}
+	}
+	status := http.StatusOK
+	if err == storage.ErrObjectNotExist && *storageNotFoundPage != "" {
+		status = http.StatusNotFound
+		attrs, err = bucket.Object(hostPrefix(req.Header.Get("X-Original-Host")) + *storageNotFoundPage).Attrs(ctx)
+	}
+	if err == storage.ErrObjectNotExist {
+		return errorResponse(req, http.StatusNotFound, "Not found."), nil
+	}
+	if err != nil {
+		return nil, newUpstreamError("gs://"+req.URL.Host+"/"+name, err)
+	}
+	return serveObject(ctx, req, bucket, attrs, status)
+}
+
+func serveObject(ctx context.Context, req *http.Request, bucket *storage.BucketHandle, attrs *storage.ObjectAttrs, status int) (*http.Response, error) {
+	h := http.Header{}
+	etag := strconv.Quote(attrs.Etag)
+	if len(attrs.MD5) > 0 {
+		etag = strconv.Quote(hex.EncodeToString(attrs.MD5))
+	}
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", attrs.Updated.UTC().Format(http.TimeFormat))
+	h.Set("X-Goog-Generation", strconv.FormatInt(attrs.Generation, 10))
+	for k, v := range map[string]string{
+		"Cache-Control":       attrs.CacheControl,
+		"Content-Disposition": attrs.ContentDisposition,
+		"Content-Language":    attrs.ContentLanguage,
+		"Content-Type":        attrs.ContentType,
+	} {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, attrs.CRC32C)
+	hash := "crc32c=" + base64.StdEncoding.EncodeToString(crc)
+	if len(attrs.MD5) > 0 {
+		hash += ",md5=" + base64.StdEncoding.EncodeToString(attrs.MD5)
+	}
+	h.Set("X-Goog-Hash", hash)
+	h.Set("X-Goog-Stored-Content-Encoding", contentEncoding(attrs.ContentEncoding))
+
+	resp := &http.Response{
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+	if status == http.StatusOK && notModified(req, etag, attrs.Updated) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = "304 Not Modified"
+		return resp, nil
+	}
+
+	// Stored gzip goes out as is to clients that take it, or when it mustn't be
+	// transformed, and is transcoded for the rest, in which case the length
+	// isn't known and ranges don't apply.
+	obj := bucket.Object(attrs.Name).Generation(attrs.Generation)
+	length := attrs.Size
+	if contentEncoding(attrs.ContentEncoding) != "identity" {
+		if acceptsEncoding(req, attrs.ContentEncoding) || !transformAllowed(req, h) {
+			obj = obj.ReadCompressed(true)
+			h.Set("Content-Encoding", attrs.ContentEncoding)
+		} else {
+			length = -1
+		}
+	}
+	h.Set("Accept-Ranges", "bytes")
+	if length < 0 {
+		h.Del("Accept-Ranges")
+	}
+
+	offset, n := int64(0), length
+	if r := req.Header.Get("Range"); r != "" && status == http.StatusOK && length >= 0 && ifRangeMatches(req, etag, attrs.Updated) {
+		var code int
+		offset, n, code = parseRange(r, length)
+		switch code {
+		case http.StatusRequestedRangeNotSatisfiable:
+			resp = errorResponse(req, code, "Requested range not satisfiable.")
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+			return resp, nil
+		case http.StatusPartialContent:
+			resp.StatusCode = code
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, length))
+		}
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.ContentLength = n
+	if n >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(n, 10))
+	}
+	if req.Method == http.MethodHead {
+		return resp, nil
+	}
+
+	r, err := obj.NewRangeReader(ctx, offset, n)
+	if err != nil {
+		return nil, newUpstreamError("gs://"+attrs.Bucket+"/"+attrs.Name, err)
+	}
+	resp.Body = r
+	return resp, nil
+}
+
+// notModified evaluates req's If-None-Match, or failing that If-Modified-Since,
+// against an object. ETags are compared weakly, as If-None-Match calls for.
+func notModified(req *http.Request, etag string, updated time.Time) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+			if v == "*" || v == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		return !updated.Truncate(time.Second).After(ims)
+	}
+	return false
+}
+
+// ifRangeMatches reports whether a Range request should get a range, per its
+// If-Range: an ETag, compared strongly, or the object's Last-Modified.
+func ifRangeMatches(req *http.Request, etag string, updated time.Time) bool {
+	ir := strings.TrimSpace(req.Header.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return !strings.HasPrefix(ir, "W/") && !strings.HasPrefix(etag, "W/") && ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && updated.Truncate(time.Second).Equal(t)
+}
+
+// parseRange parses a single byte range against an object of size bytes. It
+// returns the offset and length to serve and the status to serve them with:
+// 206 for a range, 416 for one that starts past the end, or 200 to ignore a
+// header it doesn't understand, multiple ranges included.
+func parseRange(r string, size int64) (offset, n int64, status int) {
+	whole := func() (int64, int64, int) { return 0, size, http.StatusOK }
+	spec := strings.TrimPrefix(r, "bytes=")
+	i := strings.Index(spec, "-")
+	if spec == r || strings.Contains(spec, ",") || i < 0 {
+		return whole()
+	}
+	start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if start == "" {
+		suffix, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || suffix < 0 {
+			return whole()
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, http.StatusRequestedRangeNotSatisfiable
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, http.StatusPartialContent
+	}
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || offset < 0 {
+		return whole()
+	}
+	if offset >= size {
+		return 0, 0, http.StatusRequestedRangeNotSatisfiable
+	}
+	last := size - 1
+	if end != "" {
+		if last, err = strconv.ParseInt(end, 10, 64); err != nil || last < offset {
+			return whole()
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	return offset, last - offset + 1, http.StatusPartialContent
+}
+
+// checkBucket verifies we can read objects from bucket. The index page not
+// existing is fine, it only has to answer.
+func checkBucket(c *storage.Client, bucket string) readinessCheck {
+	return func(ctx context.Context) error {
+		_, err := c.Bucket(bucket).Object(indexFile).Attrs(ctx)
+		if err == nil || err == storage.ErrObjectNotExist {
+			return nil
+		}
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusForbidden {
+			who := "our credentials"
+			if *impersonateServiceAccount != "" {
+				who = *impersonateServiceAccount
+			}
+			return fmt.Errorf("gs://%s: %v: %s need roles/storage.objectViewer on the bucket", bucket, err, who)
+		}
+		return fmt.Errorf("gs://%s: %v", bucket, err)
+	}
+}
+
+// upstreamBackend returns what the reverse proxy reads the buckets at urls with,
+// and a readiness check covering all of them.
+func upstreamBackend(ctx context.Context, urls []*url.URL) (http.RoundTripper, readinessCheck) {
+	var rt http.RoundTripper
+	var checks []readinessCheck
+	if *localDir != "" {
+		*backend = "local"
+	}
+	switch *backend {
+	case "http":
+		rt = http.DefaultTransport
+		for _, u := range urls {
+			checks = append(checks, checkUpstream(u))
+		}
+	case "storage":
+		c := newStorageClient(ctx)
+		rt = &storageTransport{client: c}
+		for _, u := range urls {
+			log.Infof("Reading gs://%s with the Cloud Storage API", u.Host)
+			checks = append(checks, checkBucket(c, u.Host))
+		}
+	case "s3":
+		t := newS3Transport()
+		rt = t
+		for _, u := range urls {
+			log.Infof("Reading s3://%s from %s", u.Host, t.endpoint.Host)
+			checks = append(checks, checkS3Bucket(t, u.Host))
+		}
+	case "local":
+		if *localDir == "" {
+			log.Exit("--backend=local needs --local_dir")
+		}
+		rt = &localTransport{dir: *localDir}
+		log.Infof("Reading every bucket from %s", *localDir)
+		checks = append(checks, checkLocalDir(*localDir))
+	default:
+		log.Exitf("--backend must be storage, http, s3 or local, not %q", *backend)
+	}
+	return rt, func(ctx context.Context) error {
+		for _, check := range checks {
+			if err := check(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
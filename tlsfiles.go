@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	tlsCertFile       = flag.String("tls_cert_file", "", "PEM certificate chain to serve instead of fetching certificates from LetsEncrypt (reloaded when it changes)")
+	tlsKeyFile        = flag.String("tls_key_file", "", "PEM private key for --tls_cert_file")
+	tlsReloadInterval = flag.Duration("tls_reload_interval", time.Minute, "how often to check --tls_cert_file and --tls_key_file for rotation")
+)
+
+// certReloader serves a certificate and key pair read from disk, re-reading
+// them whenever either file changes. This suits cert-manager style setups where
+// a Kubernetes secret is mounted into the pod and rotated in place.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader loads certFile and keyFile, failing if they can't be used.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime returns the most recent modification time of the two files.
+// os.Stat follows symlinks, which is what we want for the ..data symlink swap
+// Kubernetes does when a mounted secret changes.
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload re-reads the certificate pair if it changed on disk since the last
+// load. It reports whether a new certificate was loaded.
+func (c *certReloader) reload() (bool, error) {
+	mt, err := c.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && mt.Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("tls.LoadX509KeyPair(%q, %q): %v", c.certFile, c.keyFile, err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = mt
+	c.mu.Unlock()
+	return true, nil
+}
+
+// watch polls for changes every interval until the process exits. A bad
+// rotation (say, the cert written before the key) keeps the old certificate in
+// service and is retried on the next tick.
+func (c *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		changed, err := c.reload()
+		if err != nil {
+			log.Errorf("Error reloading TLS certificate from %s: %v", c.certFile, err)
+			continue
+		}
+		if changed {
+			log.Infof("Reloaded TLS certificate from %s", c.certFile)
+		}
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
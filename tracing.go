@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+	log "github.com/golang/glog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+)
+
+var (
+	traceExporter    = flag.String("trace_exporter", "", "where to send OpenTelemetry traces of requests, upstream fetches and TLS handshakes: cloudtrace for Cloud Trace in --gcp_project, or otlp for --otlp_endpoint (disabled if empty)")
+	traceSampleRatio = flag.Float64("trace_sample_ratio", 0.1, "fraction of requests to trace; requests carrying a sampled traceparent header are always traced")
+	otlpEndpoint     = flag.String("otlp_endpoint", "http://localhost:4318", "OTLP/HTTP collector to send traces to with --trace_exporter=otlp; http:// sends them unencrypted")
+)
+
+// tracer is nil unless --trace_exporter is set.
+var tracer trace.Tracer
+
+// startTracing sets up the --trace_exporter, flushing it at shutdown.
+func startTracing(ctx context.Context, opts []option.ClientOption) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch *traceExporter {
+	case "":
+		return
+	case "cloudtrace":
+		p := *project
+		if p == "" {
+			if p, err = projectID(ctx); err != nil {
+				log.Exitf("projectID: %v", err)
+			}
+		}
+		exp, err = texporter.New(texporter.WithProjectID(p), texporter.WithTraceClientOptions(opts))
+	case "otlp":
+		exp, err = newOTLPExporter(ctx)
+	default:
+		log.Exitf("Unknown --trace_exporter %q, want cloudtrace or otlp", *traceExporter)
+	}
+	if err != nil {
+		log.Exitf("Error starting the %s trace exporter: %v", *traceExporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("hugoproxy")))
+	if err != nil {
+		log.Exitf("resource.Merge: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*traceSampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = tp.Tracer("hugoproxy")
+	onShutdown(func(ctx context.Context) {
+		if err := tp.Shutdown(ctx); err != nil {
+			log.Errorf("Error flushing traces: %v", err)
+		}
+	})
+	log.Infof("Tracing %g of requests to %s", *traceSampleRatio, *traceExporter)
+}
+
+func newOTLPExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(*otlpEndpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("bad --otlp_endpoint %q", *otlpEndpoint)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	return otlptracehttp.New(ctx, opts...)
+}
+
+// withTracing starts a span for every request h serves, continuing the
+// caller's trace if it sent a traceparent header. The span gets children for
+// the TLS handshake of a new connection and for writing the response.
+func withTracing(h http.Handler) http.Handler {
+	if tracer == nil {
+		return h
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tlsHandshakes.span(r)
+		tw := &traceWriter{ResponseWriter: w, ctx: r.Context()}
+		h.ServeHTTP(tw, r)
+		if tw.span != nil {
+			tw.span.End()
+		}
+	})
+	return otelhttp.NewHandler(inner, "hugoproxy", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + r.Host
+	}))
+}
+
+// traceWriter times writing the response, from the status line on.
+type traceWriter struct {
+	http.ResponseWriter
+	ctx  context.Context
+	span trace.Span
+}
+
+func (w *traceWriter) start() {
+	if w.span == nil {
+		_, w.span = tracer.Start(w.ctx, "write response")
+	}
+}
+
+func (w *traceWriter) WriteHeader(code int) {
+	w.start()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	w.start()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets httputil.ReverseProxy flush through the writer.
+func (w *traceWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *traceWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// tracedTransport traces upstream fetches, with DNS, connect and TLS spans
+// when a new connection is needed. The spans of storage client calls made while
+// serving a request carry the same detail, since they share its context.
+func tracedTransport(rt http.RoundTripper) http.RoundTripper {
+	if tracer == nil {
+		return rt
+	}
+	return otelhttp.NewTransport(clientTraceTransport{rt}, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return "upstream " + r.Method + " " + r.URL.Path
+	}))
+}
+
+type clientTraceTransport struct{ http.RoundTripper }
+
+func (t clientTraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	return t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, otelhttptrace.NewClientTrace(ctx))))
+}
+
+// handshakeTimes records when each connection's TLS handshake started and
+// finished, keyed by remote address, until its first request turns them into a
+// span. The handshake is over before there's a request to hang it off.
+type handshakeTimes struct {
+	mu    sync.Mutex
+	conns map[string]*handshake
+}
+
+type handshake struct {
+	start, end time.Time
+	version    uint16
+	serverName string
+}
+
+var tlsHandshakes = &handshakeTimes{conns: map[string]*handshake{}}
+
+// traceTLSConfig returns c timing its handshakes, or c itself when tracing is off.
+func traceTLSConfig(c *tls.Config) *tls.Config {
+	if tracer == nil {
+		return c
+	}
+	t := tlsHandshakes
+	c = c.Clone()
+	get := c.GetConfigForClient
+	c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		addr := hello.Conn.RemoteAddr().String()
+		hs := &handshake{start: time.Now(), serverName: hello.ServerName}
+		t.mu.Lock()
+		t.conns[addr] = hs
+		t.mu.Unlock()
+
+		cc := c
+		if get != nil {
+			got, err := get(hello)
+			if err != nil {
+				return nil, err
+			}
+			if got != nil {
+				cc = got
+			}
+		}
+		cc = cc.Clone()
+		verify := cc.VerifyConnection
+		cc.VerifyConnection = func(cs tls.ConnectionState) error {
+			t.mu.Lock()
+			hs.end, hs.version = time.Now(), cs.Version
+			t.mu.Unlock()
+			if verify != nil {
+				return verify(cs)
+			}
+			return nil
+		}
+		return cc, nil
+	}
+	return c
+}
+
+// span turns the handshake of r's connection into a span, on its first request.
+func (t *handshakeTimes) span(r *http.Request) {
+	if r.TLS == nil {
+		return
+	}
+	t.mu.Lock()
+	hs, ok := t.conns[r.RemoteAddr]
+	delete(t.conns, r.RemoteAddr)
+	t.mu.Unlock()
+	if !ok || hs.end.IsZero() {
+		return
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	_, s := tracer.Start(r.Context(), "tls handshake", trace.WithTimestamp(hs.start), trace.WithAttributes(
+		semconv.NetPeerIPKey.String(ip),
+		semconv.HTTPServerNameKey.String(hs.serverName),
+		attribute.Int("tls.version", int(hs.version)),
+	))
+	s.End(trace.WithTimestamp(hs.end))
+}
+
+// connState forgets the handshakes of connections that close without a request.
+func (t *handshakeTimes) connState(c net.Conn, s http.ConnState) {
+	if s == http.StateClosed || s == http.StateHijacked {
+		t.mu.Lock()
+		delete(t.conns, c.RemoteAddr().String())
+		t.mu.Unlock()
+	}
+}
+
+// traceConnState chains handshake cleanup onto a server's ConnState hook.
+func traceConnState(f func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	if tracer == nil {
+		return f
+	}
+	return func(c net.Conn, s http.ConnState) {
+		tlsHandshakes.connState(c, s)
+		f(c, s)
+	}
+}
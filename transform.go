@@ -0,0 +1,78 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// transformsSkipped counts responses sent as stored because transformAllowed
+// said no.
+var transformsSkipped = expvar.NewInt("transforms_skipped")
+
+// NoTransformRule keeps hugoproxy from changing the bodies of the responses it
+// matches, like already optimized assets or files whose signatures have to
+// check out byte for byte: they're served exactly as stored, gzip included.
+// Match and ContentType are as in CacheControlRule, Host is optional, and a
+// rule needs Match or ContentType.
+type NoTransformRule struct {
+	Host        string `yaml:"host" toml:"host"`
+	Match       string `yaml:"match" toml:"match"`
+	ContentType string `yaml:"content_type" toml:"content_type"`
+
+	re *regexp.Regexp
+}
+
+// compileNoTransformRules checks and compiles the config's no_transform rules.
+func (c *Config) compileNoTransformRules() error {
+	for i := range c.NoTransform {
+		r := &c.NoTransform[i]
+		if r.Match == "" && r.ContentType == "" {
+			return fmt.Errorf("no_transform rule %d needs a match or content_type", i+1)
+		}
+		if r.Match == "" {
+			continue
+		}
+		re, err := compileGlob(r.Match)
+		if err != nil {
+			return fmt.Errorf("no_transform rule %q: %v", r.Match, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+func (r *NoTransformRule) matches(host, p, mediaType string) bool {
+	return hostMatches(r.Host, host) && (r.re == nil || r.re.MatchString(p)) && mediaTypeMatches(r.ContentType, mediaType)
+}
+
+// transformAllowed reports whether we may change the body of a response to req
+// with headers h: decompress it for a client that didn't ask for gzip, inject a
+// banner, or anything else that makes it differ from what's stored. Not if a
+// no_transform rule matches, or if the request or the Cache-Control the client
+// would get says no-transform, which is also what GCS goes by.
+func transformAllowed(req *http.Request, h http.Header) bool {
+	host := req.Header.Get("X-Original-Host")
+	p, _ := clientPath(host, req.URL.Path)
+	if strings.HasSuffix(p, "/") {
+		p = path.Join(p, indexFilesFor(host)[0])
+	}
+	if hasDirective(req.Header, "Cache-Control", "no-transform") {
+		return false
+	}
+	final := http.Header{"Cache-Control": h.Values("Cache-Control"), "Content-Type": h.Values("Content-Type")}
+	applyCachePolicy(final, host, p)
+	if hasDirective(final, "Cache-Control", "no-transform") {
+		return false
+	}
+	mediaType := responseMediaType(h, p)
+	for i := range config.NoTransform {
+		if config.NoTransform[i].matches(host, p, mediaType) {
+			return false
+		}
+	}
+	return true
+}
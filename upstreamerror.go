@@ -0,0 +1,207 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	log "github.com/golang/glog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/googleapi"
+)
+
+// upstreamClass is the kind of failure an upstream fetch ran into. It decides
+// whether the fetch is retried, what the client is told, and how loudly it's
+// logged, and it's the key of the upstream_errors metric.
+type upstreamClass string
+
+const (
+	// classNotFound is the bucket, or an object we'd already found, not being
+	// there. Objects that simply don't exist are 404 responses, not errors.
+	classNotFound upstreamClass = "not_found"
+	// classTimeout is GCS not answering within --upstream_timeout or
+	// --upstream_body_timeout.
+	classTimeout upstreamClass = "timeout"
+	// classPermission is our credentials being refused.
+	classPermission upstreamClass = "permission"
+	// classCorrupt is an object that doesn't decompress or match its checksum.
+	classCorrupt upstreamClass = "corrupt"
+	// classUnavailable is GCS failing or being unreachable, which is worth
+	// another try.
+	classUnavailable upstreamClass = "unavailable"
+	// classCanceled is the client going away before we were done.
+	classCanceled upstreamClass = "canceled"
+	classOther    upstreamClass = "other"
+)
+
+var upstreamErrors = expvar.NewMap("upstream_errors")
+
+// upstreamError is a failed upstream fetch of Object, a gs:// or bucket URL.
+type upstreamError struct {
+	Class  upstreamClass
+	Object string
+	Err    error
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Object, e.Class, e.Err)
+}
+
+func (e *upstreamError) Unwrap() error { return e.Err }
+
+// newUpstreamError classifies err from fetching object.
+func newUpstreamError(object string, err error) *upstreamError {
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		return ue
+	}
+	return &upstreamError{Class: classifyUpstreamError(err), Object: object, Err: err}
+}
+
+// classifyUpstreamError works out the class of an error from the storage
+// client, http.Transport or decompression.
+func classifyUpstreamError(err error) upstreamClass {
+	var ue *upstreamError
+	var gerr *googleapi.Error
+	var serr *s3Error
+	var corrupt flate.CorruptInputError
+	var nerr net.Error
+	switch {
+	case errors.As(err, &ue):
+		return ue.Class
+	case errors.Is(err, context.Canceled):
+		return classCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return classTimeout
+	case errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist):
+		return classNotFound
+	case errors.Is(err, os.ErrPermission):
+		return classPermission
+	case errors.As(err, &gerr):
+		return classifyStatus(gerr.Code)
+	case errors.As(err, &serr):
+		return classifyStatus(serr.StatusCode)
+	case errors.Is(err, gzip.ErrChecksum), errors.Is(err, gzip.ErrHeader), errors.As(err, &corrupt), errors.Is(err, io.ErrUnexpectedEOF):
+		return classCorrupt
+	case errors.As(err, &nerr):
+		if nerr.Timeout() {
+			return classTimeout
+		}
+		return classUnavailable
+	case strings.Contains(err.Error(), "bad CRC"):
+		// The storage client's checksum mismatch has no error value of its own.
+		return classCorrupt
+	}
+	return classOther
+}
+
+// classifyStatus works out the class of an error response from the bucket.
+func classifyStatus(code int) upstreamClass {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return classPermission
+	case code == http.StatusNotFound:
+		return classNotFound
+	case code == http.StatusRequestTimeout:
+		return classTimeout
+	case code == http.StatusTooManyRequests || code >= 500:
+		return classUnavailable
+	}
+	return classOther
+}
+
+// retryable reports whether a fetch that failed this way is worth trying again.
+func (c upstreamClass) retryable() bool {
+	return c == classUnavailable
+}
+
+// logUpstreamError logs e for what was being served, at a severity by class:
+// errors need someone to fix credentials or a bad object, warnings are GCS
+// having a bad moment.
+func logUpstreamError(e *upstreamError, what string) {
+	switch e.Class {
+	case classCanceled:
+		log.V(1).Infof("Client gave up on %s: %v", what, e)
+	case classTimeout, classUnavailable:
+		log.Warningf("Error proxying %s: %v", what, e)
+	default:
+		log.Errorf("Error proxying %s: %v", what, e)
+	}
+}
+
+// upstreamErrorKey is the context key for a request's upstreamErrorNote.
+type upstreamErrorKey struct{}
+
+// upstreamErrorNote is the class of the first upstream error serving a request
+// hit, for its access log record.
+type upstreamErrorNote struct {
+	mu    sync.Mutex
+	class upstreamClass
+}
+
+// withUpstreamErrorNote returns a context that collects the upstream error
+// class of the request ctx belongs to.
+func withUpstreamErrorNote(ctx context.Context) (context.Context, *upstreamErrorNote) {
+	n := &upstreamErrorNote{}
+	return context.WithValue(ctx, upstreamErrorKey{}, n), n
+}
+
+func (n *upstreamErrorNote) get() upstreamClass {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.class
+}
+
+// countUpstreamError records e against the request ctx belongs to: in the
+// upstream_errors metric, its trace span and its access log record.
+func countUpstreamError(ctx context.Context, e *upstreamError) {
+	if e.Class == classCanceled {
+		return
+	}
+	upstreamErrors.Add(string(e.Class), 1)
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("hugoproxy.upstream_error", string(e.Class)))
+	span.SetStatus(codes.Error, e.Error())
+	if n, ok := ctx.Value(upstreamErrorKey{}).(*upstreamErrorNote); ok {
+		n.mu.Lock()
+		if n.class == "" {
+			n.class = e.Class
+		}
+		n.mu.Unlock()
+	}
+}
+
+// upstreamBody classifies and counts errors reading an upstream body, which
+// happen after the response has started and so never reach the error handler.
+type upstreamBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	object string
+	failed bool
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	e := newUpstreamError(b.object, err)
+	if !b.failed {
+		b.failed = true
+		countUpstreamError(b.ctx, e)
+		logUpstreamError(e, b.object+" body")
+	}
+	return n, e
+}
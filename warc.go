@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+)
+
+var (
+	warcHostnames      = flags.StringSlice("warc_hostnames", []string{}, "CSV of hostnames whose responses are archived to --warc_bucket")
+	warcBucket         = flag.String("warc_bucket", "", "bucket to write WARC files of served responses to")
+	warcPrefix         = flag.String("warc_prefix", "warc/", "object name prefix for WARC files")
+	warcRotateInterval = flag.Duration("warc_rotate_interval", time.Hour, "how often to close the current WARC file and upload it")
+	warcRotateSize     = flag.Int64("warc_rotate_size", 100<<20, "compressed size at which the current WARC file is closed and uploaded early")
+	warcMaxRecord      = flag.Int64("warc_max_record", maxTransformSize, "largest response body archived in full; longer ones are truncated and marked so")
+)
+
+var (
+	warcRecords = expvar.NewInt("warc_records")
+	warcDropped = expvar.NewInt("warc_dropped")
+)
+
+// warcExchange is one request/response pair waiting to be archived.
+type warcExchange struct {
+	time      time.Time
+	uri       string
+	request   []byte
+	status    string
+	header    http.Header
+	body      []byte
+	truncated bool
+}
+
+// warcRecorder captures the response written through it, up to --warc_max_record
+// bytes of body.
+type warcRecorder struct {
+	statusRecorder
+	header    http.Header
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (r *warcRecorder) WriteHeader(code int) {
+	if r.header == nil {
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	r.statusRecorder.WriteHeader(code)
+}
+
+func (r *warcRecorder) Write(b []byte) (int, error) {
+	if r.header == nil {
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	if room := *warcMaxRecord - int64(r.body.Len()); int64(len(b)) > room {
+		r.body.Write(b[:room])
+		r.truncated = true
+	} else {
+		r.body.Write(b)
+	}
+	return r.statusRecorder.Write(b)
+}
+
+// warcArchiver writes exchanges to a local WARC file, uploading it to the bucket
+// each time it's rotated.
+type warcArchiver struct {
+	bucket    *storage.BucketHandle
+	exchanges chan *warcExchange
+	flushes   chan chan error
+	hostname  string
+	serial    int
+
+	file    *os.File
+	size    int64
+	started time.Time
+}
+
+func newWARCArchiver(c *storage.Client) *warcArchiver {
+	hostname, _ := os.Hostname()
+	return &warcArchiver{
+		bucket:    c.Bucket(*warcBucket),
+		exchanges: make(chan *warcExchange, 256),
+		flushes:   make(chan chan error),
+		hostname:  hostname,
+	}
+}
+
+// withWARCArchive archives GET responses for --warc_hostnames.
+func (a *warcArchiver) withWARCArchive(h http.Handler) http.Handler {
+	hosts := map[string]bool{}
+	for _, host := range *warcHostnames {
+		hosts[strings.ToLower(host)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !hosts[strings.ToLower(r.Host)] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &warcRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+		h.ServeHTTP(rec, r)
+		if rec.header == nil {
+			rec.header = w.Header().Clone()
+		}
+
+		req := &bytes.Buffer{}
+		fmt.Fprintf(req, "%s %s %s\r\n", r.Method, r.URL.RequestURI(), r.Proto)
+		fmt.Fprintf(req, "Host: %s\r\n", r.Host)
+		r.Header.Write(req)
+		req.WriteString("\r\n")
+
+		x := &warcExchange{
+			time:      start,
+			uri:       "https://" + r.Host + r.URL.RequestURI(),
+			request:   req.Bytes(),
+			status:    fmt.Sprintf("%d %s", rec.Status(), http.StatusText(rec.Status())),
+			header:    rec.header,
+			body:      rec.body.Bytes(),
+			truncated: rec.truncated,
+		}
+		select {
+		case a.exchanges <- x:
+		default:
+			warcDropped.Add(1)
+		}
+	})
+}
+
+func warcRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func warcDigest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeRecord appends one WARC record to the current file as its own gzip
+// member, so the file can be read or verified a record at a time.
+func (a *warcArchiver) writeRecord(fields [][2]string, block, payload []byte) error {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	fmt.Fprintf(zw, "WARC/1.1\r\n")
+	for _, f := range fields {
+		fmt.Fprintf(zw, "%s: %s\r\n", f[0], f[1])
+	}
+	fmt.Fprintf(zw, "WARC-Block-Digest: %s\r\n", warcDigest(block))
+	if payload != nil {
+		fmt.Fprintf(zw, "WARC-Payload-Digest: %s\r\n", warcDigest(payload))
+	}
+	fmt.Fprintf(zw, "Content-Length: %d\r\n\r\n", len(block))
+	zw.Write(block)
+	zw.Write([]byte("\r\n\r\n"))
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	n, err := a.file.Write(buf.Bytes())
+	a.size += int64(n)
+	return err
+}
+
+func (a *warcArchiver) write(x *warcExchange) error {
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	date := x.time.UTC().Format(time.RFC3339)
+	responseID := warcRecordID()
+
+	resp := &bytes.Buffer{}
+	fmt.Fprintf(resp, "HTTP/1.1 %s\r\n", x.status)
+	x.header.Write(resp)
+	resp.WriteString("\r\n")
+	resp.Write(x.body)
+
+	fields := [][2]string{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", responseID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", x.uri},
+		{"Content-Type", "application/http;msgtype=response"},
+	}
+	if x.truncated {
+		fields = append(fields, [2]string{"WARC-Truncated", "length"})
+	}
+	if err := a.writeRecord(fields, resp.Bytes(), x.body); err != nil {
+		return err
+	}
+	return a.writeRecord([][2]string{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", warcRecordID()},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", x.uri},
+		{"WARC-Concurrent-To", responseID},
+		{"Content-Type", "application/http;msgtype=request"},
+	}, x.request, nil)
+}
+
+// open starts a new WARC file with its warcinfo record.
+func (a *warcArchiver) open() error {
+	f, err := ioutil.TempFile("", "hugoproxy-*.warc.gz")
+	if err != nil {
+		return err
+	}
+	a.file, a.size, a.started = f, 0, time.Now()
+	info := fmt.Sprintf("software: hugoproxy\r\nhostname: %s\r\nformat: WARC File Format 1.1\r\n", a.hostname)
+	return a.writeRecord([][2]string{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", warcRecordID()},
+		{"WARC-Date", a.started.UTC().Format(time.RFC3339)},
+		{"Content-Type", "application/warc-fields"},
+	}, []byte(info), nil)
+}
+
+// rotate uploads the current WARC file, if there is one.
+func (a *warcArchiver) rotate(ctx context.Context) error {
+	if a.file == nil {
+		return nil
+	}
+	f := a.file
+	a.file = nil
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	a.serial++
+	name := fmt.Sprintf("%shugoproxy-%s-%05d-%s.warc.gz", *warcPrefix, a.started.UTC().Format(backupTimeFormat), a.serial, a.hostname)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w := a.bucket.Object(name).NewWriter(ctx)
+	w.ContentType = "application/warc"
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return fmt.Errorf("upload %s: %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("upload %s: %v", name, err)
+	}
+	log.Infof("Uploaded gs://%s/%s (%d bytes)", *warcBucket, name, a.size)
+	return nil
+}
+
+// record writes x to the current WARC file.
+func (a *warcArchiver) record(x *warcExchange) {
+	if err := a.write(x); err != nil {
+		log.Errorf("Error writing WARC record for %s: %v", x.uri, err)
+		return
+	}
+	warcRecords.Add(1)
+}
+
+// run archives exchanges until the process exits.
+func (a *warcArchiver) run() {
+	ctx := context.Background()
+	tick := time.NewTicker(*warcRotateInterval)
+	for {
+		select {
+		case x := <-a.exchanges:
+			a.record(x)
+			if a.size < *warcRotateSize {
+				continue
+			}
+		case <-tick.C:
+		case done := <-a.flushes:
+			// Take in whatever's queued, then upload it all.
+			for queued := true; queued; {
+				select {
+				case x := <-a.exchanges:
+					a.record(x)
+				default:
+					queued = false
+				}
+			}
+			done <- a.rotate(ctx)
+			continue
+		}
+		if err := a.rotate(ctx); err != nil {
+			log.Errorf("Error rotating WARC file: %v", err)
+		}
+	}
+}
+
+// flush uploads everything archived so far, for shutdown.
+func (a *warcArchiver) flush(ctx context.Context) {
+	done := make(chan error, 1)
+	select {
+	case a.flushes <- done:
+	case <-ctx.Done():
+		log.Errorf("Error flushing WARC file: %v", ctx.Err())
+		return
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Errorf("Error flushing WARC file: %v", err)
+		}
+	case <-ctx.Done():
+		log.Errorf("Error flushing WARC file: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/mikewiacek/flags"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	dns "google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+var (
+	wildcardDomains = flags.StringSlice("wildcard_domains", []string{}, "CSV of wildcard names, e.g. *.preview.example.com, to get certificates for with DNS-01 challenges in Cloud DNS, so any host under them can be served; needs autocert, not --tls_cert_file")
+	cloudDNSProject = flag.String("cloud_dns_project", "", "GCP project of the Cloud DNS zones for --wildcard_domains, if not --gcp_project")
+	cloudDNSZone    = flag.String("cloud_dns_zone", "", "Cloud DNS managed zone to put --wildcard_domains challenge records in; defaults to the public zone in --cloud_dns_project closest to each domain")
+)
+
+var wildcardFailures = expvar.NewInt("wildcard_certificate_failures")
+
+const (
+	// wildcardRenewBefore is how long before expiry a wildcard certificate is
+	// renewed, as autocert does by default.
+	wildcardRenewBefore = 30 * 24 * time.Hour
+	// wildcardCheckInterval is how often the certificates are checked for
+	// renewal, and wildcardRetryInterval how soon after a failure.
+	wildcardCheckInterval = 12 * time.Hour
+	wildcardRetryInterval = time.Hour
+	// challengeTTL is the TTL of the challenge TXT records.
+	challengeTTL = 60
+)
+
+// wildcardCerts gets and renews --wildcard_domains certificates with DNS-01
+// challenges, which HTTP-01 can't do, and keeps them in autocert's cache under
+// the wildcard name.
+type wildcardCerts struct {
+	cache   autocert.Cache
+	dns     *dns.Service
+	project string
+	domains []string
+
+	client *acme.Client // set up by the first order
+
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate // by cache name, the wildcard name with +rsa for RSA
+}
+
+// newWildcardCerts returns the manager for --wildcard_domains and the wildcard
+// hosts in --host_buckets, or nil if there are none.
+func newWildcardCerts(ctx context.Context, cache autocert.Cache, opts []option.ClientOption) *wildcardCerts {
+	var domains []string
+	seen := map[string]bool{}
+	for _, d := range append(append([]string{}, *wildcardDomains...), hostBucketWildcardHosts()...) {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if !strings.HasPrefix(d, "*.") || strings.Count(d, ".") < 2 || strings.Contains(d[2:], "*") {
+			log.Exitf("--wildcard_domains need to look like *.example.com, not %q", d)
+		}
+		if !seen[d] {
+			seen[d] = true
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	p := firstNonEmpty(*cloudDNSProject, *project)
+	if p == "" {
+		var err error
+		if p, err = projectID(ctx); err != nil {
+			log.Exitf("projectID: %v", err)
+		}
+	}
+	s, err := dns.NewService(ctx, opts...)
+	if err != nil {
+		log.Exitf("dns.NewService: %v", err)
+	}
+	log.Infof("Getting wildcard certificates for %s with Cloud DNS in %q", strings.Join(domains, ", "), p)
+	return &wildcardCerts{cache: cache, dns: s, project: p, domains: domains, certs: map[string]*tls.Certificate{}}
+}
+
+// covering returns the wildcard name covering host, or "". A wildcard covers
+// one label: *.example.com covers a.example.com but not example.com or
+// a.b.example.com.
+func (w *wildcardCerts) covering(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	i := strings.Index(host, ".")
+	if i <= 0 {
+		return ""
+	}
+	for _, d := range w.domains {
+		if host[i:] == d[1:] {
+			return d
+		}
+	}
+	return ""
+}
+
+// getCertificate serves the wildcard certificates for the hosts they cover, and
+// leaves everything else to next, autocert.
+func (w *wildcardCerts) getCertificate(next func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		d := w.covering(hello.ServerName)
+		if d == "" {
+			return next(hello)
+		}
+		rsaKey, err := useRSA(hello)
+		if err != nil {
+			return nil, err
+		}
+		name := certCacheName(d, rsaKey)
+		w.mu.RLock()
+		cert := w.certs[name]
+		w.mu.RUnlock()
+		if cert == nil {
+			return nil, fmt.Errorf("no certificate for %s yet", name)
+		}
+		return cert, nil
+	}
+}
+
+// certCacheName is the name autocert's cache keeps d's certificate under.
+func certCacheName(d string, rsaKey bool) string {
+	if rsaKey {
+		return d + "+rsa"
+	}
+	return d
+}
+
+// run loads the certificates from the cache and keeps them renewed.
+func (w *wildcardCerts) run() {
+	for {
+		next := wildcardCheckInterval
+		withECDSA, withRSA := certKeyTypes()
+		for _, d := range w.domains {
+			for _, rsaKey := range []bool{false, true} {
+				if (rsaKey && !withRSA) || (!rsaKey && !withECDSA) {
+					continue
+				}
+				if err := w.refresh(d, rsaKey); err != nil {
+					wildcardFailures.Add(1)
+					log.Errorf("Wildcard certificate for %s: %v", certCacheName(d, rsaKey), err)
+					next = wildcardRetryInterval
+				}
+			}
+		}
+		time.Sleep(next)
+	}
+}
+
+// refresh makes sure we have a certificate for d, with an RSA key or not, that
+// isn't due for renewal, from the cache if another instance already got one, or
+// else from the CA.
+func (w *wildcardCerts) refresh(d string, rsaKey bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	name := certCacheName(d, rsaKey)
+	w.mu.RLock()
+	cert := w.certs[name]
+	w.mu.RUnlock()
+	if cert == nil || renewalDue(cert) {
+		c, err := w.cached(ctx, d, name)
+		switch {
+		case err == autocert.ErrCacheMiss:
+		case err != nil:
+			log.Warningf("Ignoring cached certificate for %s: %v", name, err)
+		default:
+			cert = c
+		}
+	}
+	if cert != nil && !renewalDue(cert) {
+		w.store(name, cert)
+		return nil
+	}
+	if cert != nil && time.Now().Before(cert.Leaf.NotAfter) {
+		// Keep serving the old one while we renew.
+		w.store(name, cert)
+	}
+	log.Infof("Requesting a certificate for %s", name)
+	cert, err := w.order(ctx, d, rsaKey)
+	if err != nil {
+		return err
+	}
+	if err := w.put(ctx, name, cert); err != nil {
+		return err
+	}
+	w.store(name, cert)
+	log.Infof("Got a certificate for %s, valid until %s", name, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func renewalDue(cert *tls.Certificate) bool {
+	return time.Until(cert.Leaf.NotAfter) < wildcardRenewBefore
+}
+
+func (w *wildcardCerts) store(name string, cert *tls.Certificate) {
+	w.mu.Lock()
+	w.certs[name] = cert
+	w.mu.Unlock()
+}
+
+// cached reads the certificate for d the cache has under name, in autocert's
+// format: the PEM private key, then the chain.
+func (w *wildcardCerts) cached(ctx context.Context, d, name string) (*tls.Certificate, error) {
+	data, err := w.cache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var keyPEM, certPEM bytes.Buffer
+	for {
+		var b *pem.Block
+		b, data = pem.Decode(data)
+		if b == nil {
+			break
+		}
+		if strings.HasSuffix(b.Type, "PRIVATE KEY") {
+			pem.Encode(&keyPEM, b)
+		} else {
+			pem.Encode(&certPEM, b)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM.Bytes(), keyPEM.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if err := cert.Leaf.VerifyHostname("x" + d[1:]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// put writes a certificate to the cache under name in autocert's format.
+func (w *wildcardCerts) put(ctx context.Context, name string, cert *tls.Certificate) error {
+	var buf bytes.Buffer
+	switch key := cert.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+	case *rsa.PrivateKey:
+		pem.Encode(&buf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	default:
+		return fmt.Errorf("can't store a %T", key)
+	}
+	for _, der := range cert.Certificate {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return w.cache.Put(ctx, name, buf.Bytes())
+}
+
+// acmeClient returns an ACME client for autocert's account, creating and
+// registering the account if autocert hasn't yet.
+func (w *wildcardCerts) acmeClient(ctx context.Context) (*acme.Client, error) {
+	if w.client != nil {
+		return w.client, nil
+	}
+	key, err := loadACMEAccountKey(ctx, w.cache)
+	if err != nil {
+		return nil, err
+	}
+	c := newACMEClient(key)
+	if err := registerACMEAccount(ctx, c); err != nil {
+		return nil, err
+	}
+	w.client = c
+	return c, nil
+}
+
+// order gets a new certificate for d from the CA, with an RSA key or not.
+func (w *wildcardCerts) order(ctx context.Context, d string, rsaKey bool) (*tls.Certificate, error) {
+	c, err := w.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o, err := c.AuthorizeOrder(ctx, acme.DomainIDs(d))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range o.AuthzURLs {
+		if err := w.authorize(ctx, c, u); err != nil {
+			return nil, err
+		}
+	}
+	if o, err = c.WaitOrder(ctx, o.URI); err != nil {
+		return nil, err
+	}
+	key, err := newCertKey(rsaKey)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{d}}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := c.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// authorize answers the DNS-01 challenge of one of an order's authorizations
+// with a TXT record, and takes the record away again once the CA has looked.
+func (w *wildcardCerts) authorize(ctx context.Context, c *acme.Client, u string) error {
+	z, err := c.GetAuthorization(ctx, u)
+	if err != nil {
+		return err
+	}
+	if z.Status != acme.StatusPending {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, ch := range z.Challenges {
+		if ch.Type == "dns-01" {
+			chal = ch
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("the CA offered no dns-01 challenge for %s", z.Identifier.Value)
+	}
+	value, err := c.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	name := "_acme-challenge." + z.Identifier.Value + "."
+	zone, err := w.zoneFor(ctx, name)
+	if err != nil {
+		return err
+	}
+	rrs := &dns.ResourceRecordSet{Name: name, Type: "TXT", Ttl: challengeTTL, Rrdatas: []string{`"` + value + `"`}}
+	if err := w.change(ctx, zone, &dns.Change{Additions: []*dns.ResourceRecordSet{rrs}}); err != nil {
+		return fmt.Errorf("adding %s TXT to Cloud DNS zone %s: %v", name, zone, err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := w.change(ctx, zone, &dns.Change{Deletions: []*dns.ResourceRecordSet{rrs}}); err != nil {
+			log.Warningf("Removing %s TXT from Cloud DNS zone %s: %v", name, zone, err)
+		}
+	}()
+	if _, err := c.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = c.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// change makes a Cloud DNS change and waits for it to reach the zone's name
+// servers. A challenge record left behind by a failed attempt is replaced.
+func (w *wildcardCerts) change(ctx context.Context, zone string, ch *dns.Change) error {
+	for _, add := range ch.Additions {
+		old, err := w.dns.ResourceRecordSets.Get(w.project, zone, add.Name, add.Type).Context(ctx).Do()
+		var gerr *googleapi.Error
+		switch {
+		case errors.As(err, &gerr) && gerr.Code == http.StatusNotFound:
+		case err != nil:
+			return err
+		default:
+			ch.Deletions = append(ch.Deletions, old)
+		}
+	}
+	ch, err := w.dns.Changes.Create(w.project, zone, ch).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	for ch.Status != "done" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		if ch, err = w.dns.Changes.Get(w.project, zone, ch.Id).Context(ctx).Do(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zoneFor returns --cloud_dns_zone, or the public managed zone closest to the
+// fully qualified name.
+func (w *wildcardCerts) zoneFor(ctx context.Context, name string) (string, error) {
+	if *cloudDNSZone != "" {
+		return *cloudDNSZone, nil
+	}
+	var zone, zoneDNS string
+	err := w.dns.ManagedZones.List(w.project).Pages(ctx, func(l *dns.ManagedZonesListResponse) error {
+		for _, z := range l.ManagedZones {
+			if z.Visibility == "private" || len(z.DnsName) <= len(zoneDNS) {
+				continue
+			}
+			if name == z.DnsName || strings.HasSuffix(name, "."+z.DnsName) {
+				zone, zoneDNS = z.Name, z.DnsName
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("listing Cloud DNS zones in %q: %v", w.project, err)
+	}
+	if zone == "" {
+		return "", fmt.Errorf("no public Cloud DNS zone in %q holds %s; set --cloud_dns_project or --cloud_dns_zone", w.project, name)
+	}
+	return zone, nil
+}